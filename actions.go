@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Action is something that can be done to a generated message with one of the buttons under it.
+type Action string
+
+const (
+	// actionRegenerate generates the message again with the same options, but a new seed.
+	actionRegenerate Action = "regenerate"
+	// actionContinue generates more text that picks up where the message left off.
+	actionContinue Action = "continue"
+	// actionDelete deletes the message. Only the user who asked for it may do that.
+	actionDelete Action = "delete"
+)
+
+// generatedActions are the buttons that go under every message that a persona generates.
+var generatedActions = []Action{actionRegenerate, actionContinue, actionDelete}
+
+// maxGeneratedMessages is how many of the bot's generated messages are remembered. The buttons
+// under older messages stop working.
+const maxGeneratedMessages = 1000
+
+// generatedMsg is what the bot remembers about a message that it generated. It's saved in
+// snapshots as JSON.
+type generatedMsg struct {
+	Persona string `json:"persona"`
+	// What the persona was asked to generate. See GenerateOptions.
+	Start string   `json:"start,omitempty"`
+	Words int      `json:"words,omitempty"`
+	After []string `json:"after,omitempty"`
+	// The seed that the message was generated with, and its Generation.Path.
+	Seed int64    `json:"seed"`
+	Path []string `json:"path"`
+	// Platform ID of the user who asked for the message.
+	Invoker string    `json:"invoker"`
+	Time    time.Time `json:"time"`
+}
+
+// opts returns the options to generate the message again with, which get a new seed.
+func (g generatedMsg) opts() GenerateOptions {
+	return GenerateOptions{Start: g.Start, Words: g.Words, After: g.After}
+}
+
+// continued returns the options to generate as many words again with, picking up where the
+// message left off.
+func (g generatedMsg) continued() GenerateOptions {
+	return GenerateOptions{Words: g.Words, After: g.Path}
+}
+
+// GeneratedMessages remembers the options of the most recent messages that the bot generated, so
+// that the buttons under them work. It's safe for concurrent use.
+type GeneratedMessages struct {
+	mu   sync.Mutex
+	byID map[string]generatedMsg
+	// IDs of the messages in byID, oldest first.
+	order []string
+}
+
+// NewGeneratedMessages returns a pointer to a new, empty GeneratedMessages.
+func NewGeneratedMessages() *GeneratedMessages {
+	return &GeneratedMessages{byID: make(map[string]generatedMsg)}
+}
+
+// Add remembers a message under the provided ID, which should be prefixed with the name of the
+// chat service that it came from. If there are too many messages already, the oldest one is
+// forgotten.
+func (g *GeneratedMessages) Add(messageID string, msg generatedMsg) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.byID[messageID]; !ok {
+		if len(g.order) == maxGeneratedMessages {
+			delete(g.byID, g.order[0])
+			g.order = g.order[1:]
+		}
+		g.order = append(g.order, messageID)
+	}
+	g.byID[messageID] = msg
+}
+
+// Get returns the message with the provided ID, and whether it's remembered.
+func (g *GeneratedMessages) Get(messageID string) (generatedMsg, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	msg, ok := g.byID[messageID]
+	return msg, ok
+}
+
+// Remove forgets the message with the provided ID.
+func (g *GeneratedMessages) Remove(messageID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.byID[messageID]; !ok {
+		return
+	}
+	delete(g.byID, messageID)
+	for i, id := range g.order {
+		if id == messageID {
+			g.order = append(g.order[:i], g.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// HandlePress is called by a Platform every time someone presses one of the buttons under a
+// message that the bot generated. m stands in for the press: it says who pressed the button, and
+// in which channel, but it doesn't have any content. messageID is the ID of the message that the
+// button is under.
+//
+// It returns a notice that only the user who pressed the button should see, like why nothing
+// happened, or "" if there isn't one.
+func (b *Bot) HandlePress(p Platform, m *Message, messageID string, action Action) string {
+	var notice string
+	b.handle(p, m, func(p Platform, m *Message) (string, string, string) {
+		settings := b.settingsFor(p, m).inChannel(m.ChannelID)
+		if ok, denial := b.authorize(p, m, settings, string(action)); !ok {
+			notice = denial
+			return string(action), "", outcomeDenied
+		}
+		var persona, outcome string
+		persona, outcome, notice = b.press(p, m, messageID, action)
+		return string(action), persona, outcome
+	})
+	return notice
+}
+
+// press does what the pressed button says to. It returns the name of the persona that generated a
+// response, if one did, the outcome, and a notice for the user who pressed the button.
+func (b *Bot) press(p Platform, m *Message, messageID string,
+	action Action) (string, string, string) {
+	id := platformID(p, messageID)
+	generated, ok := b.generated.Get(id)
+	if !ok {
+		return "", outcomeInvalid, "I don't remember that message anymore. Invoke me again instead"
+	}
+
+	switch action {
+	case actionDelete:
+		if platformID(p, m.Author.ID) != generated.Invoker {
+			return "", outcomeDenied, "Only the person who asked for that message can delete it"
+		}
+		deleter, ok := p.(MessageDeleter)
+		if !ok {
+			return "", outcomeInvalid, "I can't delete messages here"
+		}
+		if err := deleter.DeleteMessage(m.ChannelID, messageID); err != nil {
+			loggerFrom(m.Context()).Error("Failed to delete a generated message", "error", err)
+			return "", outcomeFailed, "Something went wrong while deleting that message"
+		}
+		b.generated.Remove(id)
+		return "", outcomeOK, ""
+
+	case actionRegenerate, actionContinue:
+		persona, ok := b.personas.Get(generated.Persona)
+		if !ok {
+			return "", outcomeInvalid,
+				fmt.Sprintf("There's no persona named %q anymore", generated.Persona)
+		}
+		opts := generated.opts()
+		if action == actionContinue {
+			opts = generated.continued()
+		}
+		if !b.allow(p, m, invocationCost(opts.Words)) {
+			return persona.Name, outcomeRateLimited, ""
+		}
+		b.respond(p, m, persona, opts)
+		return persona.Name, outcomeOK, ""
+	}
+	return "", outcomeInvalid, fmt.Sprintf("I don't know how to %s", action)
+}
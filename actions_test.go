@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestGeneratedMessages makes sure that only the most recent generated messages are remembered,
+// and that removed ones are forgotten.
+func TestGeneratedMessages(t *testing.T) {
+	g := NewGeneratedMessages()
+	for i := 0; i <= maxGeneratedMessages; i++ {
+		g.Add(strconv.Itoa(i), generatedMsg{Persona: "persona"})
+	}
+	if _, ok := g.Get("0"); ok {
+		t.Errorf("Expected the oldest message to be forgotten\n")
+	}
+	if _, ok := g.Get("1"); !ok {
+		t.Errorf("Expected the second oldest message to be remembered\n")
+	}
+
+	g.Remove("1")
+	if _, ok := g.Get("1"); ok {
+		t.Errorf("Expected a removed message to be forgotten\n")
+	}
+	// Removing a message makes room for another one without forgetting anything else.
+	g.Add("new", generatedMsg{Persona: "persona"})
+	if _, ok := g.Get("2"); !ok {
+		t.Errorf("Expected a message to be forgotten before it had to be\n")
+	}
+}
+
+// TestHandlePress makes sure that the buttons under generated messages regenerate, continue, and
+// delete them, and that only the user who asked for a message can delete it.
+func TestHandlePress(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("press", "!", hmm)
+	p := newTrackingPlatform("botID")
+	alice := &Message{ChannelID: "channel", Author: User{ID: "alice"}}
+	bob := &Message{ChannelID: "channel", Author: User{ID: "bob"}}
+	defer func() {
+		wasMessagePosted = false
+		postedMsg = ""
+	}()
+
+	if notice := bot.HandlePress(p, alice, "posted", actionRegenerate); notice == "" {
+		t.Errorf("Expected a notice about a message that the bot doesn't remember\n")
+	}
+
+	bot.HandleMessage(p, &Message{ChannelID: "channel", Author: User{ID: "alice"},
+		Content: "!press quick 3"})
+	if postedMsg != "quick brown fox" {
+		t.Fatalf("Unexpected message. got: %q, want: %q\n", postedMsg, "quick brown fox")
+	}
+	if !reflect.DeepEqual(p.actions, generatedActions) {
+		t.Errorf("Unexpected buttons. got: %v, want: %v\n", p.actions, generatedActions)
+	}
+
+	// Anyone can regenerate a message, which gets the same options.
+	postedMsg = ""
+	if notice := bot.HandlePress(p, bob, "posted", actionRegenerate); notice != "" {
+		t.Errorf("Unexpected notice: %q\n", notice)
+	}
+	if postedMsg != "quick brown fox" {
+		t.Errorf("Unexpected regenerated message. got: %q, want: %q\n", postedMsg,
+			"quick brown fox")
+	}
+
+	// Continuing picks up where the message left off, with as many words.
+	bot.HandlePress(p, bob, "posted", actionContinue)
+	if postedMsg != "jumps over the" {
+		t.Errorf("Unexpected continued message. got: %q, want: %q\n", postedMsg,
+			"jumps over the")
+	}
+
+	// Bob pressed the button that generated the message that's remembered as "posted" now.
+	if notice := bot.HandlePress(p, alice, "posted", actionDelete); !strings.Contains(notice,
+		"Only") {
+		t.Errorf("Expected only bob to be allowed to delete the message. got: %q\n", notice)
+	}
+	if notice := bot.HandlePress(p, bob, "posted", actionDelete); notice != "" {
+		t.Errorf("Unexpected notice: %q\n", notice)
+	}
+	if !reflect.DeepEqual(p.deleted, []string{"posted"}) {
+		t.Errorf("Unexpected deleted messages. got: %q, want: %q\n", p.deleted,
+			[]string{"posted"})
+	}
+	if _, ok := bot.generated.Get("fake/posted"); ok {
+		t.Errorf("Expected the deleted message to be forgotten\n")
+	}
+
+	// Presses are counted like invocations.
+	regenerates := metrics.invocations.WithLabelValues(string(actionRegenerate), "", outcomeInvalid)
+	deletes := metrics.invocations.WithLabelValues(string(actionDelete), "", outcomeDenied)
+	if testutil.ToFloat64(regenerates) == 0 || testutil.ToFloat64(deletes) == 0 {
+		t.Errorf("Expected presses to be counted\n")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// apiCommand is what generate requests are counted as in metrics.
+	apiCommand = "api"
+	// maxAPIRequestBytes is the largest request body that the API accepts.
+	maxAPIRequestBytes = 1 << 16
+	// maxAPIChars is the most characters that the API generates in one request.
+	maxAPIChars = 20000
+	// maxTemperature is the highest sampling temperature that the API accepts. Past this point,
+	// every word that could come next is about as likely as any other.
+	maxTemperature = 10
+)
+
+// ErrAPINoKeys is returned when an API is created without any API keys.
+var ErrAPINoKeys = errors.New("the HTTP API needs at least one API key")
+
+// DefaultAPIRateLimit lets each API key generate a burst of 60 short pieces of text, and then 1
+// every second.
+var DefaultAPIRateLimit = BucketConfig{Capacity: 60, Period: time.Minute}
+
+// APIConfig describes how to serve the HTTP API.
+type APIConfig struct {
+	// Address to listen on, like ":8080".
+	Addr string
+	// Keys that callers must present, either in an "Authorization: Bearer <key>" header or in an
+	// "X-API-Key" header.
+	Keys []string
+	// Budget that each key gets. Requests cost tokens just like bot invocations do. A Capacity of
+	// 0 turns rate limiting off.
+	RateLimit BucketConfig
+	// How words are picked when a request leaves the temperature or top_k out.
+	Sampling Sampling
+}
+
+// API serves an HTTP API for generating text with the same Personas that the bot uses, so that
+// scripts and websites don't need to go through a chat service. Every response is JSON.
+//
+// API serves these paths:
+//   - POST /v1/generate generates text
+//   - GET /v1/personas lists the personas
+//   - GET /v1/personas/{name}/stats describes the size of a persona's model
+type API struct {
+	config   APIConfig
+	personas *Personas
+	limiter  *Limiter
+	mux      *http.ServeMux
+}
+
+// NewAPI returns a pointer to a new API initialized with the provided config and the Personas to
+// generate text with.
+func NewAPI(config APIConfig, personas *Personas) (*API, error) {
+	if len(config.Keys) == 0 {
+		return nil, ErrAPINoKeys
+	}
+
+	a := &API{
+		config:   config,
+		personas: personas,
+		limiter:  NewLimiter(LimiterConfig{User: config.RateLimit}),
+		mux:      http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/v1/generate", a.handleGenerate)
+	a.mux.HandleFunc("/v1/personas", a.handlePersonas)
+	a.mux.HandleFunc("/v1/personas/", a.handlePersonaStats)
+	a.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+	})
+	return a, nil
+}
+
+// Name returns "api".
+func (a *API) Name() string {
+	return "api"
+}
+
+// Run serves the HTTP API until ctx is done, and then lets the requests that are being served
+// finish up.
+func (a *API) Run(ctx context.Context, ready func()) error {
+	slog.Info("Serving the HTTP API", "addr", a.config.Addr)
+	return serveHTTP(ctx, a.config.Addr, a, ready)
+}
+
+// ServeHTTP makes sure that a request has a valid API key, and then routes it to the right
+// handler.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "missing or invalid API key")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIRequestBytes)
+	a.mux.ServeHTTP(w, r)
+}
+
+// apiKey returns the API key that a request was made with.
+func apiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authorized reports whether a request has one of the API's keys.
+func (a *API) authorized(r *http.Request) bool {
+	key := apiKey(r)
+	if key == "" {
+		return false
+	}
+	for _, k := range a.config.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// allow takes the provided number of tokens out of the requesting key's budget. If the budget
+// can't afford it, a 429 is written and false is returned.
+func (a *API) allow(w http.ResponseWriter, r *http.Request, cost float64) bool {
+	ok, wait, _ := a.limiter.Allow("api/"+apiKey(r), "", "", cost)
+	if !ok {
+		metrics.rateLimited.WithLabelValues("api").Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeAPIError(w, http.StatusTooManyRequests, slowDownMsg(wait))
+	}
+	return ok
+}
+
+// generateRequest is the body of a POST /v1/generate request. See GenerateOptions for what each
+// field means.
+type generateRequest struct {
+	Persona     string  `json:"persona"`
+	Start       string  `json:"start"`
+	Words       int     `json:"words"`
+	Chars       int     `json:"chars"`
+	Seed        int64   `json:"seed"`
+	Temperature float64 `json:"temperature"`
+	TopK        int     `json:"top_k"`
+}
+
+// generateResponse is the body of a response to a POST /v1/generate request.
+type generateResponse struct {
+	Persona string `json:"persona"`
+	Text    string `json:"text"`
+	Seed    int64  `json:"seed"`
+	Tokens  int    `json:"tokens"`
+}
+
+// handleGenerate generates text with a persona. If the request doesn't name a persona, the default
+// one is used.
+func (a *API) handleGenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var req generateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "malformed request body: "+err.Error())
+		return
+	}
+	if msg := req.validate(); msg != "" {
+		metrics.invocations.WithLabelValues(apiCommand, "", outcomeInvalid).Inc()
+		writeAPIError(w, http.StatusBadRequest, msg)
+		return
+	}
+	persona, ok := a.personas.Get(req.Persona)
+	if !ok {
+		// Don't label metrics with whatever persona was asked for, since there's no end to those.
+		metrics.invocations.WithLabelValues(apiCommand, "", outcomeInvalid).Inc()
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no persona named %q", req.Persona))
+		return
+	}
+	if !a.allow(w, r, invocationCost(req.Words)) {
+		metrics.invocations.WithLabelValues(apiCommand, persona.Name, outcomeRateLimited).Inc()
+		return
+	}
+
+	opts := GenerateOptions{
+		Start:       req.Start,
+		Words:       req.Words,
+		Chars:       req.Chars,
+		Seed:        req.Seed,
+		Temperature: req.Temperature,
+		TopK:        req.TopK,
+	}
+	if opts.Temperature == 0 {
+		opts.Temperature = a.config.Sampling.Temperature
+	}
+	if opts.TopK == 0 {
+		opts.TopK = a.config.Sampling.TopK
+	}
+	start := time.Now()
+	gen := persona.HMM.Generate(opts)
+	metrics.observeGeneration(persona.Name, start, gen.Text)
+	metrics.invocations.WithLabelValues(apiCommand, persona.Name, outcomeOK).Inc()
+	writeAPIResponse(w, http.StatusOK, generateResponse{
+		Persona: persona.Name,
+		Text:    gen.Text,
+		Seed:    gen.Seed,
+		Tokens:  gen.Tokens,
+	})
+}
+
+// validate returns a message that explains what's wrong with a generate request, or an empty
+// string if nothing is.
+func (req generateRequest) validate() string {
+	switch {
+	case len(strings.Fields(req.Start)) > 1:
+		return "start must be a single word"
+	case req.Words < 0 || req.Words > maxNumWords:
+		return fmt.Sprintf("words must be between 0 and %d", maxNumWords)
+	case req.Chars < 0 || req.Chars > maxAPIChars:
+		return fmt.Sprintf("chars must be between 0 and %d", maxAPIChars)
+	case req.Temperature < 0 || req.Temperature > maxTemperature:
+		return fmt.Sprintf("temperature must be between 0 and %d", maxTemperature)
+	case req.TopK < 0:
+		return "top_k can't be negative"
+	}
+	return ""
+}
+
+// personaResponse describes a persona in a GET /v1/personas response.
+type personaResponse struct {
+	Name   string `json:"name"`
+	Corpus string `json:"corpus"`
+}
+
+// handlePersonas lists the personas.
+func (a *API) handlePersonas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	if !a.allow(w, r, 1) {
+		return
+	}
+
+	resp := struct {
+		Personas []personaResponse `json:"personas"`
+	}{Personas: []personaResponse{}}
+	for _, persona := range a.personas.List() {
+		resp.Personas = append(resp.Personas, personaResponse{persona.Name, persona.Corpus})
+	}
+	writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// statsResponse is the body of a response to a GET /v1/personas/{name}/stats request.
+type statsResponse struct {
+	Name           string `json:"name"`
+	Corpus         string `json:"corpus"`
+	Words          int    `json:"words"`
+	Transitions    int    `json:"transitions"`
+	SentenceStarts int    `json:"sentence_starts"`
+}
+
+// handlePersonaStats describes the size of a persona's model.
+func (a *API) handlePersonaStats(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/personas/"), "/")
+	// An empty name would get the default persona.
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "stats" {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	persona, ok := a.personas.Get(parts[0])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no persona named %q", parts[0]))
+		return
+	}
+	if !a.allow(w, r, 1) {
+		return
+	}
+
+	stats := persona.HMM.Stats()
+	writeAPIResponse(w, http.StatusOK, statsResponse{
+		Name:           persona.Name,
+		Corpus:         persona.Corpus,
+		Words:          stats.Words,
+		Transitions:    stats.Transitions,
+		SentenceStarts: stats.SentenceStarts,
+	})
+}
+
+// writeAPIResponse writes a JSON response with the provided status code.
+func writeAPIResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Warn("Failed to write HTTP API response", "error", err)
+	}
+}
+
+// writeAPIError writes a JSON error response like {"error": "..."} with the provided status code.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeAPIResponse(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "k3y"
+
+// newTestAPI returns an API with two personas, "foo" and "bar", where "foo" is the default one.
+func newTestAPI(t *testing.T, rateLimit BucketConfig) *API {
+	foo, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bar, _ := NewHMM("roll up and roll out\n", 5)
+	personas := NewPersonas(
+		&Persona{Name: "foo", Corpus: "foo.txt", HMM: foo},
+		&Persona{Name: "bar", Corpus: "bar.txt", HMM: bar},
+	)
+	api, err := NewAPI(APIConfig{Keys: []string{"other", testAPIKey}, RateLimit: rateLimit},
+		personas)
+	if err != nil {
+		t.Fatalf("Failed to create new API: %v\n", err)
+	}
+	return api
+}
+
+// apiRequest sends a request to the provided API with the test API key, and decodes the JSON
+// response into out if it isn't nil.
+func apiRequest(t *testing.T, api *API, method, path, body string,
+	out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAPIKey)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Unexpected Content-Type. got: %q, want: %q\n", got, "application/json")
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("Failed to decode response %q: %v\n", w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+// TestAPIAuth makes sure that requests without a valid API key are turned away.
+func TestAPIAuth(t *testing.T) {
+	api := newTestAPI(t, BucketConfig{})
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{"bearer", "Authorization", "Bearer " + testAPIKey, http.StatusOK},
+		{"header", "X-API-Key", testAPIKey, http.StatusOK},
+		{"missing", "", "", http.StatusUnauthorized},
+		{"wrong", "Authorization", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "Authorization", "Basic " + testAPIKey, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/personas", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if w.Code != tc.wantStatus {
+				t.Errorf("Unexpected status. got: %d, want: %d\n", w.Code, tc.wantStatus)
+			}
+		})
+	}
+
+	if _, err := NewAPI(APIConfig{}, NewPersonas()); err != ErrAPINoKeys {
+		t.Errorf("Unexpected error. got: %v, want: %v\n", err, ErrAPINoKeys)
+	}
+}
+
+// TestAPIGenerate makes sure that text is generated with the requested persona and options, and
+// that bad requests are turned away with a helpful message.
+func TestAPIGenerate(t *testing.T) {
+	api := newTestAPI(t, BucketConfig{})
+
+	var got generateResponse
+	w := apiRequest(t, api, http.MethodPost, "/v1/generate",
+		`{"persona": "bar", "start": "roll", "words": 12, "seed": 7, "top_k": 2}`, &got)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status. got: %d, want: %d\n", w.Code, http.StatusOK)
+	}
+	words := strings.Fields(got.Text)
+	if got.Persona != "bar" || got.Seed != 7 || got.Tokens != 12 || len(words) != 12 ||
+		words[0] != "roll" {
+		t.Errorf("Unexpected response: %+v\n", got)
+	}
+	for _, word := range words {
+		if !strings.Contains("roll up and roll out", word) {
+			t.Errorf("Generated text contains a word that isn't in bar's corpus: %q\n", word)
+		}
+	}
+
+	// The default persona is used when the request doesn't name one.
+	apiRequest(t, api, http.MethodPost, "/v1/generate", `{"chars": 20}`, &got)
+	if got.Persona != "foo" || len(got.Text) > 20 || got.Seed == 0 {
+		t.Errorf("Unexpected response: %+v\n", got)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantErr    string
+	}{
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed, "use POST"},
+		{"malformed", http.MethodPost, "{", http.StatusBadRequest, "malformed request body"},
+		{"unknown field", http.MethodPost, `{"wordz": 3}`, http.StatusBadRequest,
+			"malformed request body"},
+		{"too many words", http.MethodPost, `{"words": 1001}`, http.StatusBadRequest,
+			"words must be between 0 and 1000"},
+		{"negative chars", http.MethodPost, `{"chars": -1}`, http.StatusBadRequest,
+			"chars must be between 0 and 20000"},
+		{"hot", http.MethodPost, `{"temperature": 11}`, http.StatusBadRequest,
+			"temperature must be between 0 and 10"},
+		{"negative top k", http.MethodPost, `{"top_k": -1}`, http.StatusBadRequest,
+			"top_k can't be negative"},
+		{"two start words", http.MethodPost, `{"start": "the quick"}`, http.StatusBadRequest,
+			"start must be a single word"},
+		{"unknown persona", http.MethodPost, `{"persona": "baz"}`, http.StatusNotFound,
+			`no persona named "baz"`},
+		{"too big", http.MethodPost, `{"start": "` + strings.Repeat("a", maxAPIRequestBytes) + `"}`,
+			http.StatusBadRequest, "malformed request body"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var resp struct {
+				Error string `json:"error"`
+			}
+			w := apiRequest(t, api, tc.method, "/v1/generate", tc.body, &resp)
+			if w.Code != tc.wantStatus {
+				t.Errorf("Unexpected status. got: %d, want: %d\n", w.Code, tc.wantStatus)
+			}
+			if !strings.HasPrefix(resp.Error, tc.wantErr) {
+				t.Errorf("Unexpected error. got: %q, want: %q\n", resp.Error, tc.wantErr)
+			}
+		})
+	}
+}
+
+// TestAPIPersonas makes sure that personas are listed, and that their stats are reported.
+func TestAPIPersonas(t *testing.T) {
+	api := newTestAPI(t, BucketConfig{})
+
+	var list struct {
+		Personas []personaResponse `json:"personas"`
+	}
+	apiRequest(t, api, http.MethodGet, "/v1/personas", "", &list)
+	wantList := []personaResponse{{"bar", "bar.txt"}, {"foo", "foo.txt"}}
+	if !reflect.DeepEqual(list.Personas, wantList) {
+		t.Errorf("Unexpected personas. got: %+v, want: %+v\n", list.Personas, wantList)
+	}
+
+	var stats statsResponse
+	w := apiRequest(t, api, http.MethodGet, "/v1/personas/bar/stats", "", &stats)
+	wantStats := statsResponse{
+		Name: "bar", Corpus: "bar.txt", Words: 4, Transitions: 5, SentenceStarts: 1,
+	}
+	if w.Code != http.StatusOK || stats != wantStats {
+		t.Errorf("Unexpected stats. got: %d %+v, want: %+v\n", w.Code, stats, wantStats)
+	}
+
+	for _, path := range []string{"/v1/personas/baz/stats", "/v1/personas/bar",
+		"/v1/personas/bar/stats/more", "/v2/generate"} {
+		if w := apiRequest(t, api, http.MethodGet, path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("Unexpected status for %s. got: %d, want: %d\n", path, w.Code,
+				http.StatusNotFound)
+		}
+	}
+}
+
+// TestAPIRateLimit makes sure that each API key gets its own budget, and that requests which
+// can't be afforded are turned away with a Retry-After header.
+func TestAPIRateLimit(t *testing.T) {
+	api := newTestAPI(t, BucketConfig{Capacity: 3, Period: time.Minute})
+	now := time.Unix(1600000000, 0)
+	api.limiter.now = func() time.Time { return now }
+
+	// 1 token.
+	if w := apiRequest(t, api, http.MethodGet, "/v1/personas", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status. got: %d, want: %d\n", w.Code, http.StatusOK)
+	}
+	// 1 + 100/100 = 2 tokens.
+	w := apiRequest(t, api, http.MethodPost, "/v1/generate", `{"words": 100}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status. got: %d, want: %d\n", w.Code, http.StatusOK)
+	}
+	w = apiRequest(t, api, http.MethodGet, "/v1/personas", "", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Unexpected status. got: %d, want: %d\n", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "20" {
+		t.Errorf("Unexpected Retry-After. got: %q, want: %q\n", got, "20")
+	}
+
+	// Other keys have budgets of their own.
+	r := httptest.NewRequest(http.MethodGet, "/v1/personas", nil)
+	r.Header.Set("X-API-Key", "other")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status for another key. got: %d, want: %d\n", w.Code, http.StatusOK)
+	}
+
+	now = now.Add(20 * time.Second)
+	if w := apiRequest(t, api, http.MethodGet, "/v1/personas", "", nil); w.Code != http.StatusOK {
+		t.Errorf("Unexpected status after waiting. got: %d, want: %d\n", w.Code, http.StatusOK)
+	}
+}
@@ -1,123 +1,236 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"os"
-	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
-	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-// msgTooLongErr is a common error that may occur when attempting to post a Discord message. This
-// error is checked for in postDiscordMessage().
-const msgTooLongErr = "HTTP 400 Bad Request, {\"content\": [\"Must be 2000 or fewer in length.\"]}"
+// maxNumWords is the most words that may be asked for in a bot invocation. Discord won't post
+// messages that are longer than 2000 characters anyway, so this just keeps the bot from doing a
+// bunch of work for nothing.
+const maxNumWords = 1000
 
-// Starter describes objects which perform necessary procedures before spinning up a Discord bot,
-// and then spin up a Discord bot.
-//
-// I need to come up with a better name for this interface lol
-type Starter interface {
-	Start()
-}
+// plainInvocation is what plain invocations, like "!botname 40", are counted as in metrics.
+const plainInvocation = "generate"
 
-// Bot establishes a new Discord session and is invoked by commands in Discord messages.
+// Bot is invoked by commands in chat messages, and responds to them with generated content. A Bot
+// doesn't know about any particular chat service; Platform adapters hand it messages, and it talks
+// back through them.
 type Bot struct {
-	dg            *discordgo.Session
-	postFN        MsgPoster
 	name          string
-	prefix        string
-	hmm           *HMM
 	contentRegexp *regexp.Regexp
+	// Each guild's prefix, default persona, and word limit.
+	settings *Settings
+	// The default persona's HMM is what generates content. Reloads may swap it out at any time.
+	personas *Personas
+
+	// Used to build throwaway HMMs from recent messages in a channel.
+	models    *ModelCache
+	optOuts   *OptOuts
+	allowNSFW bool
+	// How words are picked when generating text.
+	sampling Sampling
+	// Reactions on generated messages reweight the transitions that personas pick.
+	feedback *Feedback
+	// Generated messages that the buttons under them work on.
+	generated *GeneratedMessages
+	// The last few messages that were generated in each channel.
+	channels *ChannelHistory
+
+	limiter *Limiter
+	// If reloader isn't nil, admins may reload the config and retrain personas' models.
+	reloader *Reloader
 }
 
-// NewBot returns a pointer to a new Bot initialized with the providen token, bot prefix, and hidden
+// NewBot returns a pointer to a new Bot initialized with the provided name, bot prefix, and hidden
 // Markov model to generate content.
-func NewBot(name, prefix, token string, hmm *HMM) (*Bot, error) {
-	dg, err := discordgo.New("Bot " + token)
-	if err != nil {
-		return nil, err
-	}
-
-	// This step is kinda expensive. Instead of doing this in messageCreateHandler() every time we
-	// handle a bot invocation, we do this once when the bot is created.
+func NewBot(name, prefix string, hmm *HMM) (*Bot, error) {
+	// This step is kinda expensive. Instead of doing this in HandleMessage() every time we handle a
+	// bot invocation, we do this once when the bot is created.
 	reg, err := regexp.Compile("[^a-zA-Z0-9 ]+") // Filtering for alphanumeric values only
 	if err != nil {
 		return nil, err
 	}
 
 	return &Bot{
-		dg:            dg,
-		postFN:        postDiscordMessage,
 		name:          name,
-		prefix:        prefix,
-		hmm:           hmm,
 		contentRegexp: reg,
+		settings:      NewSettings(NewMemoryStore(), defaultSettings(prefix)),
+		personas:      NewPersonas(&Persona{Name: name, HMM: hmm}),
+		models:        NewModelCache(modelCacheSize, modelCacheTTL),
+		optOuts:       NewOptOuts(NewMemoryStore()),
+		feedback:      NewFeedback(),
+		generated:     NewGeneratedMessages(),
+		channels:      NewChannelHistory(),
+		limiter:       NewLimiter(LimiterConfig{}),
 	}, nil
 }
 
-// Start opens a websocket connection with Discord and starts listening for events.
-func (b *Bot) Start() error {
-	b.addHandlers()
-
-	err := b.dg.Open()
-	if err != nil {
-		return err
-	}
-	log.Println("Bot is up & running. Press Ctrl+C to shut it down.")
-
-	// Block until Ctrl+C is pressed, or the process is interrupted or terminated.
-	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
-	<-sc
-
-	log.Println("Spinning down....")
-	b.dg.Close()
-	return nil
-}
-
-// MessageCreateHandler is called every time a new message is posted in a a channel that the bot has
-// access to.
-func (b *Bot) MessageCreateHandler(s *discordgo.Session, m *discordgo.MessageCreate) {
+// HandleMessage is called by a Platform every time a new message is posted in a channel that the
+// bot has access to.
+func (b *Bot) HandleMessage(p Platform, m *Message) {
 	// Ignore all messages posted by the bot.
 	// Just to save CPU cycles, even though they're cheap ;)
-	if m.Author.ID == s.State.User.ID {
+	if m.Author.ID == p.SelfID() {
 		return
 	}
-	// Look for bot prefix at the beginning of the message.
-	prefixAndName := b.prefix + b.name
-	if !strings.HasPrefix(m.Content, prefixAndName) {
+	// Look for bot prefix at the beginning of the message. Each guild may pick its own.
+	settings := b.settingsFor(p, m).inChannel(m.ChannelID)
+	if !strings.HasPrefix(m.Content, settings.Prefix+b.name) {
 		return
 	}
-	// If anyone was mentioned in the message, don't mess with it.
-	if len(m.Mentions) > 0 {
-		b.postFN(s, m.ChannelID, "@'ing people isn't supported yet :(")
+	// Channels that the bot doesn't answer in are ignored without a word. Settings can still be
+	// changed from them, so that nobody locks themselves out.
+	fields := strings.Fields(strings.TrimPrefix(m.Content, settings.Prefix+b.name))
+	isConfig := len(fields) > 0 && strings.ToLower(fields[0]) == configCmd
+	if !settings.Answers(m.ChannelID) && !isConfig {
 		return
 	}
+	b.handle(p, m, func(p Platform, m *Message) (string, string, string) {
+		return b.invoke(p, m, settings)
+	})
+}
+
+// handle traces, counts, and logs an invocation, which invoke responds to. invoke returns which
+// command was invoked, the name of the persona that generated the response, if one did, and the
+// invocation's outcome.
+func (b *Bot) handle(p Platform, m *Message,
+	invoke func(p Platform, m *Message) (string, string, string)) {
+	// Chat services that don't start a request for each message get one here.
+	if m.ctx == nil {
+		m = m.WithContext(newRequestContext(p.Name(), m))
+	}
+	ctx, span := startSpan(m.Context(), "invocation", attribute.String("platform", p.Name()),
+		attribute.String("request_id", requestID(m.Context())))
+	m = m.WithContext(ctx)
+	if span.SpanContext().HasTraceID() {
+		annotate(ctx, "trace_id", span.SpanContext().TraceID().String())
+	}
+	start := time.Now()
+	command, persona, outcome := invoke(p, m)
+	span.SetAttributes(attribute.String("command", command), attribute.String("persona", persona),
+		attribute.String("outcome", outcome))
+	if outcome == outcomeFailed {
+		span.SetStatus(codes.Error, "invocation failed")
+	}
+	span.End()
+	metrics.invocations.WithLabelValues(command, persona, outcome).Inc()
+	args := []interface{}{
+		"command", command,
+		"persona", persona,
+		"outcome", outcome,
+		"latency", time.Since(start),
+		contentKey, m.Content,
+	}
+	loggerFrom(m.Context()).Info("Handled invocation", append(args, annotations(m.Context())...)...)
+}
+
+// invoke responds to a bot invocation, going by the settings of the guild that it was posted in.
+// It returns which command was invoked, the name of the persona that generated the response, if
+// one did, and the invocation's outcome.
+func (b *Bot) invoke(p Platform, m *Message, settings GuildSettings) (string, string, string) {
+	_, parse := startSpan(m.Context(), "parse_invocation")
+	// Look for commands that are spelled out as the first argument. Anything else is a plain
+	// invocation.
+	command := plainInvocation
+	invocation := settings.Prefix + b.name
+	fields := strings.Fields(strings.TrimPrefix(m.Content, invocation))
+	if len(fields) > 0 {
+		switch first := strings.ToLower(fields[0]); first {
+		case imitateCmd, channelCmd, optOutCmd, optInCmd, reloadCmd, feedbackCmd, againCmd,
+			continueCmd, seedCmd, configCmd:
+			command = first
+		}
+	}
+	var arguments []string
+	if command == plainInvocation {
+		arguments = b.arguments(invocation, m.Content)
+	}
+	parse.SetAttributes(attribute.String("command", command))
+	parse.End()
+
+	if ok, denial := b.authorize(p, m, settings, command); !ok {
+		b.replyPrivately(p, m, denial)
+		return command, "", outcomeDenied
+	}
+
+	// Mentions are allowed in some of these commands, so they're handled before mentions get
+	// rejected in generateFor().
+	switch command {
+	case imitateCmd:
+		return command, "", b.imitate(p, m, fields[1:])
+	case channelCmd:
+		return command, "", b.mimicChannel(p, m, fields[1:])
+	case optOutCmd:
+		return command, "", b.optOut(p, m)
+	case optInCmd:
+		return command, "", b.optIn(p, m)
+	case reloadCmd:
+		return command, "", b.reload(p, m)
+	case feedbackCmd:
+		return command, "", b.feedbackCommand(p, m, fields[1:])
+	case configCmd:
+		return command, "", b.configCommand(p, m, fields[1:])
+	case againCmd, continueCmd, seedCmd:
+		persona, outcome := b.recall(p, m, command)
+		return command, persona, outcome
+	}
 
+	_, lookup := startSpan(m.Context(), "lookup_model")
+	persona, ok := b.personas.Get(settings.Persona)
+	if !ok {
+		// The guild's persona was taken out of the config since it picked it.
+		persona, _ = b.personas.Get("")
+	}
+	lookup.SetAttributes(attribute.String("persona", persona.Name))
+	lookup.End()
+	return plainInvocation, persona.Name, b.generateFor(p, m, persona, settings, arguments)
+}
+
+// arguments returns the sanitized arguments of a plain bot invocation, like ["hello", "40"] for
+// "!botname Hello 40". invocation is what invocations start with, like "!botname".
+func (b *Bot) arguments(invocation, content string) []string {
 	// Clean up and sanitize input.
-	content := strings.TrimPrefix(m.Content, prefixAndName)
+	content = strings.TrimPrefix(content, invocation)
 	content = strings.TrimSpace(content)
 	content = strings.ToLower(content)
 	content = b.contentRegexp.ReplaceAllString(content, "")
 
 	arguments := strings.Split(content, " ")
-	numArgs := len(arguments)
 	// If content is an empty string, then arguments will look like: [""]. Nuke that empty string.
-	if numArgs == 1 && arguments[0] == "" {
-		arguments = nil
-		numArgs = 0
+	if len(arguments) == 1 && arguments[0] == "" {
+		return nil
 	}
+	return arguments
+}
 
+// generateFor responds to a plain bot invocation, like "!botname 40", with text that the provided
+// persona generates, and returns the invocation's outcome. settings are those of the guild that it
+// was posted in, and arguments are the invocation's sanitized arguments.
+func (b *Bot) generateFor(p Platform, m *Message, persona *Persona, settings GuildSettings,
+	arguments []string) string {
+	prefixAndName := settings.Prefix + b.name
+	// If anyone was mentioned in the message, don't mess with it.
+	if len(m.Mentions) > 0 {
+		p.Reply(m.Context(), m.ChannelID, "@'ing people isn't supported yet :(")
+		return outcomeInvalid
+	}
+
+	numArgs := len(arguments)
 	// Handle response based on how many arguments were provided in the bot invocation.
 	if numArgs == 0 {
-		msg := b.hmm.GenerateSpeech()
-		b.postFN(s, m.ChannelID, msg)
-		return
+		if !b.allow(p, m, invocationCost(0)) {
+			return outcomeRateLimited
+		}
+		b.respond(p, m, persona, GenerateOptions{})
+		return outcomeOK
 	}
 	if numArgs == 1 {
 		arg := arguments[0]
@@ -126,20 +239,29 @@ func (b *Bot) MessageCreateHandler(s *discordgo.Session, m *discordgo.MessageCre
 		if err != nil {
 			// Something went wrong trying to convert the first argument to an int. That means the
 			// first argument is a word that the generated text should start with.
-			msg := b.hmm.GenerateSpeechBeginningWithWord(arg)
-			b.postFN(s, m.ChannelID, msg)
-			return
+			if !b.allow(p, m, invocationCost(0)) {
+				return outcomeRateLimited
+			}
+			b.respond(p, m, persona, GenerateOptions{Start: arg})
+			return outcomeOK
 		}
 		// The string to int conversion was successful. Assume that the number passed in is the
 		// number of words that the generated text should have.
 		if numWords == 0 {
 			msg := "Can't post an empty message"
-			b.postFN(s, m.ChannelID, msg)
-			return
+			p.Reply(m.Context(), m.ChannelID, msg)
+			return outcomeInvalid
 		}
-		msg := b.hmm.GenerateSpeechWithNumWords(numWords)
-		b.postFN(s, m.ChannelID, msg)
-		return
+		if numWords > settings.MaxWords {
+			p.Reply(m.Context(), m.ChannelID,
+				fmt.Sprintf("Can't post more than %d words", settings.MaxWords))
+			return outcomeInvalid
+		}
+		if !b.allow(p, m, invocationCost(numWords)) {
+			return outcomeRateLimited
+		}
+		b.respond(p, m, persona, GenerateOptions{Words: numWords})
+		return outcomeOK
 	}
 	// len(arguments) is at least 2. If there were more than 2 arguments provided, ignore all of
 	// them except for the first two.
@@ -149,44 +271,100 @@ func (b *Bot) MessageCreateHandler(s *discordgo.Session, m *discordgo.MessageCre
 		// Second argument was not a number. Respond with usage instructions.
 		msg := fmt.Sprintf("%q is not a number. Example usage: `%s"+
 			" <firstWord> <numWords>`", arguments[1], prefixAndName)
-		b.postFN(s, m.ChannelID, msg)
-		return
+		p.Reply(m.Context(), m.ChannelID, msg)
+		return outcomeInvalid
 	}
 	if numWords == 0 {
 		msg := "Can't post an empty message"
-		b.postFN(s, m.ChannelID, msg)
+		p.Reply(m.Context(), m.ChannelID, msg)
+		return outcomeInvalid
+	}
+	if numWords > settings.MaxWords {
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("Can't post more than %d words", settings.MaxWords))
+		return outcomeInvalid
+	}
+	if !b.allow(p, m, invocationCost(numWords)) {
+		return outcomeRateLimited
+	}
+	b.respond(p, m, persona, GenerateOptions{Start: firstWord, Words: numWords})
+	return outcomeOK
+}
+
+// model returns the default persona's HMM. Since reloads may swap it out at any time, callers
+// should hang on to the returned HMM for the rest of an invocation instead of calling this again.
+func (b *Bot) model() *HMM {
+	persona, _ := b.personas.Get("")
+	return persona.HMM
+}
+
+// generate returns a piece of text that the provided persona generated, as described by opts.
+// The bot's sampling settings and the feedback that the persona got are taken into account.
+func (b *Bot) generate(ctx context.Context, persona *Persona, opts GenerateOptions) Generation {
+	_, span := startSpan(ctx, "generate", attribute.String("persona", persona.Name),
+		attribute.Int("words", opts.Words))
+	start := time.Now()
+	opts.Temperature = b.sampling.Temperature
+	opts.TopK = b.sampling.TopK
+	opts.Weight = b.feedback.Weight(persona.Name)
+	gen := persona.HMM.Generate(opts)
+	span.SetAttributes(attribute.Int64("seed", gen.Seed))
+	span.End()
+	metrics.observeGeneration(persona.Name, start, gen.Text)
+	annotate(ctx, "seed", gen.Seed, "generation_latency", time.Since(start))
+	return gen
+}
+
+// respond replies to m with text that the provided persona generated, as described by opts, and
+// remembers it as the last message in m's channel. If the Platform can tell which message the
+// reply became, the reply gets buttons to regenerate, continue, or delete it, and reactions on it
+// count as feedback on the persona.
+func (b *Bot) respond(p Platform, m *Message, persona *Persona, opts GenerateOptions) {
+	gen := b.generate(m.Context(), persona, opts)
+	generated := generatedMsg{
+		Persona: persona.Name,
+		Start:   opts.Start,
+		Words:   opts.Words,
+		After:   opts.After,
+		Seed:    gen.Seed,
+		Path:    gen.Path,
+		Invoker: platformID(p, m.Author.ID),
+		Time:    time.Now(),
+	}
+	b.channels.Record(platformID(p, m.ChannelID), generated)
+	tracked, ok := p.(TrackedReplier)
+	if !ok {
+		p.Reply(m.Context(), m.ChannelID, gen.Text)
 		return
 	}
-	msg := b.hmm.GenerateSpeechBeginningWithWordAndWithNumWords(firstWord, numWords)
-	b.postFN(s, m.ChannelID, msg)
+	tracked.ReplyTracked(m.Context(), m.ChannelID, gen.Text, generatedActions,
+		func(messageID string) {
+			b.feedback.Track(platformID(p, messageID), persona.Name, gen.Path)
+			b.generated.Add(platformID(p, messageID), generated)
+		})
 }
 
-// MsgPoster describes functions that send messages to specified Discord channels. This type exists
-// mainly so that postDiscordMessage() can be mocked in tests.
-type MsgPoster func(*discordgo.Session, string, string)
-
-// postDiscordMessage posts a message in the provided Discord channel as the bot. If anything goes
-// wrong, this function is responsible for handling that problem, most likely by just posting a
-// message in Discord about what happened.
-//
-// postDiscordMessage is of the custom type: MsgPoster
-func postDiscordMessage(session *discordgo.Session, channelID, msg string) {
-	_, err := session.ChannelMessageSend(channelID, msg)
-	if err != nil {
-		// See if the error is a common one that we recognize.
-		if err.Error() == msgTooLongErr {
-			errMsg := "The generated message was too long. Discord doesn't let messages that are" +
-				" longer than 2000 characters go through."
-			session.ChannelMessageSend(channelID, errMsg)
-			return
-		}
-		// We didn't recognize the error at this point. Post a general response.
-		errMsg := fmt.Sprintf("Something went wrong: %v", err)
-		session.ChannelMessageSend(channelID, errMsg)
+// allow charges the invoking user, channel, and guild for an invocation that costs the provided
+// number of tokens, and reports whether the invocation may go through. The first time that a user
+// is turned away, they're told how long they need to wait. After that, they're ignored until they
+// can afford to invoke the bot again.
+func (b *Bot) allow(p Platform, m *Message, cost float64) bool {
+	ok, wait, firstWarning := b.limiter.Allow(platformID(p, m.Author.ID),
+		platformID(p, m.ChannelID), platformID(p, m.GuildID), cost)
+	if !ok {
+		metrics.rateLimited.WithLabelValues(p.Name()).Inc()
+	}
+	if !ok && firstWarning {
+		p.Reply(m.Context(), m.ChannelID, slowDownMsg(wait))
 	}
+	return ok
 }
 
-// addHandlers registers all of this bot's handler functions with the bot's Discord session.
-func (b *Bot) addHandlers() {
-	b.dg.AddHandler(b.MessageCreateHandler)
+// platformID prefixes an ID with the name of the chat service that it came from, so that IDs from
+// different chat services never collide. Empty IDs stay empty.
+func platformID(p Platform, id string) string {
+	if id == "" {
+		return ""
+	}
+	return p.Name() + "/" + id
 }
@@ -5,55 +5,41 @@ import (
 	"strconv"
 	"strings"
 	"testing"
-
-	"github.com/bwmarrin/discordgo"
 )
 
-// Globals set by postDiscordMessageMock()
+// Globals set by fakePlatform.Reply()
 var (
 	wasMessagePosted bool
 	postedMsg        string
 )
 
-// TestMessageCreateHandler makes sure that the bot responds appropriately, either with the right
+// TestHandleMessage makes sure that the bot responds appropriately, either with the right
 // warning message or with a generated speech that has the properties that were asked for.
 //
 // This test is long; it might be difficult for someone else other than the original author to read
 // and figure out what's going on. I need to think about how to break it up into separate test
 // functions without them all being really repetitive.
-func TestMessageCreateHandler(t *testing.T) {
+func TestHandleMessage(t *testing.T) {
 	corpus := "the quick brown fox jumps over the lazy dog\n"
 	maxRetries := 5
 	hmm, _ := NewHMM(corpus, maxRetries)
 
 	botName := "foo"
 	botPrefix := "!"
-	botToken := "bar"
-	bot, _ := NewBot(botName, botPrefix, botToken, hmm)
-	bot.postFN = postDiscordMessageMock
+	bot, _ := NewBot(botName, botPrefix, hmm)
 
 	// Setting up test case for message posted by bot.
 	botID := "botID"
-	s := &discordgo.Session{
-		State: &discordgo.State{
-			Ready: discordgo.Ready{
-				User: &discordgo.User{
-					ID: botID,
-				},
-			},
-		},
-	}
-	m := &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: botID,
-			},
+	p := newFakePlatform(botID)
+	m := &Message{
+		Author: User{
+			ID: botID,
 		},
 	}
 	// Make sure that nothing happens, since messages posted by the bot should be ignored.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if wasMessagePosted {
-		t.Error("A message was posted in response to the bot. MessageCreateHandler should return" +
+		t.Error("A message was posted in response to the bot. HandleMessage should return" +
 			" once it realizes that the bot posted the most recent message.")
 	}
 	wasMessagePosted = false
@@ -61,16 +47,14 @@ func TestMessageCreateHandler(t *testing.T) {
 
 	// Setting up test case for message that doesn't invoke the bot.
 	normalUserID := "normalUserID"
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content: "foo",
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content: "foo",
 	}
 	// Make sure nothing happens, since messages that don't invoke the bot should be ignored.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if wasMessagePosted {
 		t.Error("A message was posted in response to a message that didn't invoke the bot." +
 			" Messages that don't invoke the bot should be ignored.")
@@ -79,19 +63,17 @@ func TestMessageCreateHandler(t *testing.T) {
 	postedMsg = ""
 
 	// Setting up test case for message that mentions (@s) another user.
-	botInvocationString := bot.prefix + bot.name
-	mentionedUser := &discordgo.User{}
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + "foo",
-			Mentions: []*discordgo.User{mentionedUser},
+	botInvocationString := bot.settings.Get("").Prefix + bot.name
+	mentionedUser := User{}
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + "foo",
+		Mentions: []User{mentionedUser},
 	}
 	// Make sure nothing happens, since messages that mention other users should be ignored.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	want := "@'ing people isn't supported yet :("
 	if !wasMessagePosted {
 		t.Error("A message was posted in response to a message that mentioned (@d) another user." +
@@ -106,17 +88,15 @@ func TestMessageCreateHandler(t *testing.T) {
 
 	// Setting up test case where we ask for a message with a specific word count.
 	numWordsWant := 42
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + strconv.Itoa(numWordsWant),
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + strconv.Itoa(numWordsWant),
+		Mentions: []User{},
 	}
 	// Make sure that the response contains numWordsWant words.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if !wasMessagePosted {
 		t.Errorf("No message was posted after asking for a speech with %d words.", numWordsWant)
 	} else {
@@ -130,17 +110,15 @@ func TestMessageCreateHandler(t *testing.T) {
 
 	// Setting up test case where we ask for a message with 0 words.
 	numWordsWant = 0
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + strconv.Itoa(numWordsWant),
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + strconv.Itoa(numWordsWant),
+		Mentions: []User{},
 	}
 	// Make sure that the response contains numWordsWant words.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	want = "Can't post an empty message"
 	if !wasMessagePosted {
 		t.Error("No warning message was posted after asking for a speech with 0 words.")
@@ -153,17 +131,15 @@ func TestMessageCreateHandler(t *testing.T) {
 
 	// Setting up test case where we ask for a message that begins with a word.
 	firstWordWant := "foo"
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + firstWordWant,
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + firstWordWant,
+		Mentions: []User{},
 	}
 	// Make sure that the response starts with firstWordWant.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if !wasMessagePosted {
 		t.Errorf("No message was posted after asking for a speech that begins with %q.",
 			firstWordWant)
@@ -181,17 +157,15 @@ func TestMessageCreateHandler(t *testing.T) {
 	// certain amount of words.
 	firstWordWant = "foo"
 	numWordsWant = 42
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant),
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant),
+		Mentions: []User{},
 	}
 	// Make sure that the response meets the requested criteria.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if !wasMessagePosted {
 		t.Errorf("No message was posted after asking for a speech that begins with %q and has %d"+
 			" words.", firstWordWant, numWordsWant)
@@ -210,17 +184,15 @@ func TestMessageCreateHandler(t *testing.T) {
 	// Setting up test case where we ask for a message that begins with a word and contains 0 words.
 	firstWordWant = "foo"
 	numWordsWant = 0
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant),
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant),
+		Mentions: []User{},
 	}
 	// Make sure that the response meets the requested criteria.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	want = "Can't post an empty message"
 	if !wasMessagePosted {
 		t.Error("No warning message was posted after asking for a speech that begins with a word" +
@@ -235,18 +207,16 @@ func TestMessageCreateHandler(t *testing.T) {
 	// Setting up test case where we make a request with too many arguments.
 	firstWordWant = "foo"
 	numWordsWant = 42
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content: botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant) + " " +
-				"bar baz",
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content: botInvocationString + firstWordWant + " " + strconv.Itoa(numWordsWant) + " " +
+			"bar baz",
+		Mentions: []User{},
 	}
 	// Make sure that the response meets the requested criteria, ignoring the additional arguments.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	if !wasMessagePosted {
 		t.Errorf("No message was posted after asking for a speech that begins with %q and has %d"+
 			" words (but with too many arguments).", firstWordWant, numWordsWant)
@@ -264,17 +234,15 @@ func TestMessageCreateHandler(t *testing.T) {
 
 	// Setting up test case where we make an invalid request with two arguments (firstWord and
 	// numWords are flipped).
-	m = &discordgo.MessageCreate{
-		Message: &discordgo.Message{
-			Author: &discordgo.User{
-				ID: normalUserID,
-			},
-			Content:  botInvocationString + strconv.Itoa(numWordsWant) + " " + firstWordWant,
-			Mentions: []*discordgo.User{},
+	m = &Message{
+		Author: User{
+			ID: normalUserID,
 		},
+		Content:  botInvocationString + strconv.Itoa(numWordsWant) + " " + firstWordWant,
+		Mentions: []User{},
 	}
 	// Make sure that the response contains the appropriate warning.
-	bot.MessageCreateHandler(s, m)
+	bot.HandleMessage(p, m)
 	want = fmt.Sprintf("%q is not a number. Example usage: `%s <firstWord> <numWords>`",
 		firstWordWant, botInvocationString)
 	if !wasMessagePosted {
@@ -287,11 +255,3 @@ func TestMessageCreateHandler(t *testing.T) {
 	wasMessagePosted = false
 	postedMsg = ""
 }
-
-// postDiscordMessageMock is a function of the custom type: MsgPoster. It sets the global:
-// "wasMessagePosted" and "msg" vars. A test is then responsible for checking the values of those
-// global vars and resetting them.
-func postDiscordMessageMock(session *discordgo.Session, channelID, msg string) {
-	wasMessagePosted = true
-	postedMsg = msg
-}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ModelCache is a size-bounded collection of HMMs that were built on the fly. Once it's full, the
+// least recently used HMM is thrown out to make room for new ones. HMMs are also thrown out once
+// they're older than the cache's TTL, so that they don't keep going by messages that are long gone.
+//
+// Discord event handlers run in their own goroutines, so a ModelCache is safe for concurrent use.
+type ModelCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // Front is the most recently used entry.
+	entries  map[string]*list.Element
+	// Returns the current time. Tests swap it out.
+	now func() time.Time
+}
+
+// cacheEntry is what's stored in each element of a ModelCache's order list.
+type cacheEntry struct {
+	key   string
+	hmm   *HMM
+	added time.Time
+}
+
+// NewModelCache returns a pointer to a new, empty ModelCache that holds at most capacity HMMs, each
+// for at most ttl.
+func NewModelCache(capacity int, ttl time.Duration) *ModelCache {
+	return &ModelCache{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// Get returns the HMM stored under the provided key, if there is one that isn't too old, and marks
+// it as the most recently used entry.
+func (c *ModelCache) Get(key string) (*HMM, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if c.now().Sub(elem.Value.(*cacheEntry).added) >= c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).hmm, true
+}
+
+// Add stores the provided HMM under the provided key, evicting the least recently used entry if the
+// cache is full.
+func (c *ModelCache) Add(key string, hmm *HMM) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.hmm, entry.added = hmm, c.now()
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, hmm: hmm, added: c.now()})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Clear throws out every HMM in the cache.
+func (c *ModelCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Len returns the number of HMMs currently in the cache.
+func (c *ModelCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
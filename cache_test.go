@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestModelCache makes sure that a ModelCache hands back what was put in it, and that it throws out
+// the least recently used HMM once it's full.
+func TestModelCache(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	cache := NewModelCache(2, time.Minute)
+
+	cache.Add("a", hmm)
+	cache.Add("b", hmm)
+	// Touch "a" so that "b" becomes the least recently used entry.
+	if got, ok := cache.Get("a"); !ok || got != hmm {
+		t.Errorf("Unexpected cache lookup for \"a\". got: %v, %t, want: %v, true\n", got, ok, hmm)
+	}
+	cache.Add("c", hmm)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("\"b\" was still in the cache. It should have been evicted as the least recently" +
+			" used entry.")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%q was evicted from the cache, but it shouldn't have been.", key)
+		}
+	}
+	if got := cache.Len(); got != 2 {
+		t.Errorf("Unexpected cache length. got: %d, want: %d\n", got, 2)
+	}
+
+	// Adding an existing key shouldn't grow the cache.
+	cache.Add("a", hmm)
+	if got := cache.Len(); got != 2 {
+		t.Errorf("Unexpected cache length after re-adding a key. got: %d, want: %d\n", got, 2)
+	}
+}
+
+// TestModelCacheTTL makes sure that a ModelCache throws out HMMs once they're older than its TTL.
+func TestModelCacheTTL(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	now := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	cache := NewModelCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	cache.Add("a", hmm)
+	now = now.Add(59 * time.Second)
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("\"a\" was thrown out before its TTL was up\n")
+	}
+	now = now.Add(time.Second)
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("\"a\" was still in the cache after its TTL was up\n")
+	}
+	if got := cache.Len(); got != 0 {
+		t.Errorf("Unexpected cache length. got: %d, want: %d\n", got, 0)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// cliUsage explains how to run the bot from the command line.
+const cliUsage = `Usage: hmm-discord-bot [command] [flags]
+
+Commands:
+  serve      connect to the configured chat services. This is the default
+  generate   generate text with a corpus or model file
+  train      train a model on a corpus, and write it to a model file
+  stats      describe how big a corpus's or model file's model is
+  backup     write a copy of what the bot remembers to a backup file
+  restore    replace what the bot remembers with a backup file
+
+Run "hmm-discord-bot <command> -h" to learn more about a command.
+`
+
+var (
+	// ErrNoModel is returned when a subcommand isn't told which corpus or model file to use.
+	ErrNoModel = errors.New("pass either --corpus or --model")
+	// errUsage is returned when a subcommand's flags can't be parsed. The FlagSet has already
+	// explained what went wrong by then.
+	errUsage = errors.New("bad flags")
+)
+
+// runCLI runs one of the subcommands that work offline, without connecting to any chat services.
+// args[0] is the name of the subcommand, and the rest are its flags. Whatever the subcommand has
+// to say is written to stdout, and anything else is written to stderr.
+func runCLI(args []string, stdout, stderr io.Writer) error {
+	switch args[0] {
+	case "generate":
+		return generateCmd(args[1:], stdout, stderr)
+	case "train":
+		return trainCmd(args[1:], stdout, stderr)
+	case "stats":
+		return statsCmd(args[1:], stdout, stderr)
+	case "backup":
+		return backupCmd(args[1:], stdout, stderr)
+	case "restore":
+		return restoreCmd(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return nil
+	}
+	fmt.Fprint(stderr, cliUsage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// modelFlags are the flags that subcommands use to pick which HMM to work with.
+type modelFlags struct {
+	corpus     string
+	model      string
+	maxRetries int
+	order      int
+}
+
+// register adds the flags to the provided FlagSet.
+func (f *modelFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.corpus, "corpus", "", "path to a corpus file to train a model on")
+	fs.StringVar(&f.model, "model", "", "path to a model file that was written by train")
+	fs.IntVar(&f.maxRetries, "max-retries", defaultMaxRetries,
+		"how many sentences' worth of retries to allow when generating sentences")
+	fs.IntVar(&f.order, "order", 1,
+		fmt.Sprintf("how many previous words to take into account, up to %d", maxOrder))
+}
+
+// load trains an HMM on the corpus file, or reads it from the model file.
+func (f *modelFlags) load() (*HMM, error) {
+	if (f.corpus == "") == (f.model == "") {
+		return nil, ErrNoModel
+	}
+	if f.model != "" {
+		file, err := os.Open(f.model)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return LoadHMM(file)
+	}
+
+	content, err := ioutil.ReadFile(f.corpus)
+	if err != nil {
+		return nil, err
+	}
+	return NewHMMOfOrder(string(content), f.maxRetries, f.order)
+}
+
+// newFlagSet returns a FlagSet for the subcommand with the provided name, which writes its usage
+// and errors to stderr.
+func newFlagSet(name, usage string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: hmm-discord-bot %s [flags]\n\n%s\n\nFlags:\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a subcommand's flags. Asking for help returns flag.ErrHelp, and anything else
+// that goes wrong returns errUsage.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err != nil && err != flag.ErrHelp {
+		return errUsage
+	}
+	if err == nil && fs.NArg() > 0 {
+		fmt.Fprintf(fs.Output(), "unexpected argument: %q\n", fs.Arg(0))
+		fs.Usage()
+		return errUsage
+	}
+	return err
+}
+
+// generateCmd generates text, like:
+//
+//	hmm-discord-bot generate --corpus corpora/corpus.txt --words 40 --seed 7
+//
+// If no seed is provided, the one that was picked at random is written to stderr, so that the same
+// text can be generated again.
+func generateCmd(args []string, stdout, stderr io.Writer) error {
+	var mf modelFlags
+	var opts GenerateOptions
+	fs := newFlagSet("generate", "Generates text with a corpus or model file.", stderr)
+	mf.register(fs)
+	fs.StringVar(&opts.Start, "start", "", "the word to start with")
+	fs.IntVar(&opts.Words, "words", 0,
+		"exactly how many words to generate. If it's 0, a few sentences are generated")
+	fs.IntVar(&opts.Chars, "chars", 0, "the most characters to generate. 0 means no limit")
+	fs.Int64Var(&opts.Seed, "seed", 0,
+		"the same seed always generates the same text. 0 picks a seed at random")
+	fs.Float64Var(&opts.Temperature, "temperature", 1,
+		"below 1, likely words become even more likely. Above 1, the odds even out")
+	fs.IntVar(&opts.TopK, "top-k", 0,
+		"only pick from this many of the most likely words. 0 means no limit")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if opts.Words < 0 || opts.Chars < 0 || opts.Temperature <= 0 || opts.TopK < 0 {
+		return errors.New("words, chars, and top-k can't be negative, and temperature must be" +
+			" greater than 0")
+	}
+
+	hmm, err := mf.load()
+	if err != nil {
+		return err
+	}
+	gen := hmm.Generate(opts)
+	if opts.Seed == 0 {
+		fmt.Fprintf(stderr, "seed: %d\n", gen.Seed)
+	}
+	_, err = fmt.Fprintln(stdout, gen.Text)
+	return err
+}
+
+// trainCmd trains an HMM on a corpus, and writes it to a model file, like:
+//
+//	hmm-discord-bot train --corpus corpora/corpus.txt --out model.json
+func trainCmd(args []string, stdout, stderr io.Writer) error {
+	var mf modelFlags
+	var out string
+	fs := newFlagSet("train", "Trains a model on a corpus, and writes it to a model file.", stderr)
+	mf.register(fs)
+	fs.StringVar(&out, "out", "", "path to write the model file to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if mf.model != "" {
+		return errors.New("train needs a --corpus, not a --model")
+	}
+	if out == "" {
+		return errors.New("pass --out to say where the model file should go")
+	}
+
+	hmm, err := mf.load()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := hmm.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	stats := hmm.Stats()
+	_, err = fmt.Fprintf(stdout, "Trained a model with %d words and %d transitions, and wrote it"+
+		" to %s\n", stats.Words, stats.Transitions, out)
+	return err
+}
+
+// statsCmd describes how big an HMM is, like:
+//
+//	hmm-discord-bot stats --model model.json
+func statsCmd(args []string, stdout, stderr io.Writer) error {
+	var mf modelFlags
+	fs := newFlagSet("stats", "Describes how big a corpus's or model file's model is.", stderr)
+	mf.register(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	hmm, err := mf.load()
+	if err != nil {
+		return err
+	}
+	stats := hmm.Stats()
+	_, err = fmt.Fprintf(stdout, "words: %d\ntransitions: %d\nsentence starts: %d\n", stats.Words,
+		stats.Transitions, stats.SentenceStarts)
+	return err
+}
+
+// backupCmd writes a copy of the store in a persistence directory to a backup file, like:
+//
+//	hmm-discord-bot backup --dir data --out backup.db
+//
+// The bot should be stopped first.
+func backupCmd(args []string, stdout, stderr io.Writer) error {
+	var dir, out string
+	fs := newFlagSet("backup", "Writes a copy of what the bot remembers to a backup file. Stop the"+
+		" bot first.", stderr)
+	fs.StringVar(&dir, "dir", "", "the bot's persistence directory")
+	fs.StringVar(&out, "out", "", "path to write the backup file to")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if dir == "" || out == "" {
+		return errors.New("pass --dir and --out to say what to back up, and where to")
+	}
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	n, err := backupStore(dir, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "Backed up %d keys to %s\n", n, out)
+	return err
+}
+
+// restoreCmd replaces the store in a persistence directory with a backup file, like:
+//
+//	hmm-discord-bot restore --dir data --in backup.db
+//
+// The bot should be stopped first.
+func restoreCmd(args []string, stdout, stderr io.Writer) error {
+	var dir, in string
+	fs := newFlagSet("restore", "Replaces what the bot remembers with a backup file. Stop the bot"+
+		" first.", stderr)
+	fs.StringVar(&dir, "dir", "", "the bot's persistence directory")
+	fs.StringVar(&in, "in", "", "path to a backup file that was written by backup")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if dir == "" || in == "" {
+		return errors.New("pass --dir and --in to say what to restore, and from where")
+	}
+
+	file, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := restoreStore(dir, file)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "Restored %d keys to %s\n", n, dir)
+	return err
+}
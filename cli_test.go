@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCorpus writes a corpus file to a temporary directory that's removed when the test
+// finishes, and returns the directory and the corpus file's path.
+func writeTestCorpus(t *testing.T, corpus string) (string, string) {
+	dir, err := ioutil.TempDir("", "hmm-cli")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v\n", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "corpus.txt")
+	if err := ioutil.WriteFile(path, []byte(corpus), 0644); err != nil {
+		t.Fatalf("Failed to write corpus file: %v\n", err)
+	}
+	return dir, path
+}
+
+// runTestCLI runs a subcommand, and returns what it wrote to stdout and stderr.
+func runTestCLI(args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	err := runCLI(args, &stdout, &stderr)
+	return stdout.String(), stderr.String(), err
+}
+
+// TestCLIGenerate makes sure that text is generated with the provided options, and that the same
+// seed generates the same text whether the model was trained on the spot or read from a model
+// file.
+func TestCLIGenerate(t *testing.T) {
+	corpus := "the cat sat on the mat\nthe dog sat on the log\n"
+	dir, corpusPath := writeTestCorpus(t, corpus)
+
+	out, errOut, err := runTestCLI("generate", "--corpus", corpusPath, "--words", "40", "--seed",
+		"7")
+	if err != nil {
+		t.Fatalf("generate failed: %v\n", err)
+	}
+	if got := len(strings.Fields(out)); got != 40 {
+		t.Errorf("Unexpected number of words. got: %d, want: %d\n", got, 40)
+	}
+	if errOut != "" {
+		t.Errorf("Unexpected output on stderr: %q\n", errOut)
+	}
+
+	modelPath := filepath.Join(dir, "model.json")
+	trainOut, _, err := runTestCLI("train", "--corpus", corpusPath, "--out", modelPath)
+	if err != nil {
+		t.Fatalf("train failed: %v\n", err)
+	}
+	want := "Trained a model with 7 words and 11 transitions, and wrote it to " + modelPath + "\n"
+	if trainOut != want {
+		t.Errorf("Unexpected train output.\ngot: %q\nwant: %q\n", trainOut, want)
+	}
+
+	fromModel, _, err := runTestCLI("generate", "--model", modelPath, "--words", "40", "--seed",
+		"7")
+	if err != nil {
+		t.Fatalf("generate with a model file failed: %v\n", err)
+	}
+	if fromModel != out {
+		t.Errorf("Same seed generated different text from a model file.\ncorpus: %q\nmodel: %q\n",
+			out, fromModel)
+	}
+
+	// Without a seed, the one that was picked is reported.
+	_, errOut, err = runTestCLI("generate", "--model", modelPath, "--start", "dog", "--top-k", "1",
+		"--chars", "20")
+	if err != nil {
+		t.Fatalf("generate failed: %v\n", err)
+	}
+	if !strings.HasPrefix(errOut, "seed: ") {
+		t.Errorf("Expected the seed on stderr. got: %q\n", errOut)
+	}
+}
+
+// TestCLIGenerateTopK makes sure that greedy generation on the shipped corpus, which has runs of
+// blank lines, finishes with as many words as were asked for.
+func TestCLIGenerateTopK(t *testing.T) {
+	type result struct {
+		out string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, _, err := runTestCLI("generate", "--corpus", filepath.Join("corpora", "corpus.txt"),
+			"--words", "40", "--top-k", "1", "--seed", "1")
+		done <- result{out, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("generate failed: %v\n", res.err)
+		}
+		if got := len(strings.Fields(res.out)); got != 40 {
+			t.Errorf("Unexpected number of words. got: %d, want: %d\n", got, 40)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("generate --words 40 --top-k 1 never finished\n")
+	}
+}
+
+// TestCLIStats makes sure that stats are reported for corpora and model files alike.
+func TestCLIStats(t *testing.T) {
+	dir, corpusPath := writeTestCorpus(t, "roll up and roll out\nroll on\n")
+	modelPath := filepath.Join(dir, "model.json")
+	if _, _, err := runTestCLI("train", "--corpus", corpusPath, "--out", modelPath); err != nil {
+		t.Fatalf("train failed: %v\n", err)
+	}
+
+	want := "words: 5\ntransitions: 8\nsentence starts: 1\n"
+	for _, args := range [][]string{{"--corpus", corpusPath}, {"--model", modelPath}} {
+		out, _, err := runTestCLI(append([]string{"stats"}, args...)...)
+		if err != nil {
+			t.Fatalf("stats %v failed: %v\n", args, err)
+		}
+		if out != want {
+			t.Errorf("Unexpected stats for %v.\ngot: %q\nwant: %q\n", args, out, want)
+		}
+	}
+}
+
+// TestCLIBackupRestore makes sure that a store can be backed up and restored from the command
+// line.
+func TestCLIBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := OpenBoltStore(dir)
+	s.Put(optOutsBucket, "fake/alice", nil)
+	s.Close()
+
+	backupPath := filepath.Join(t.TempDir(), "backup.db")
+	out, _, err := runTestCLI("backup", "--dir", dir, "--out", backupPath)
+	if want := "Backed up 2 keys to " + backupPath + "\n"; err != nil || out != want {
+		t.Errorf("Unexpected backup output. got: %q, %v, want: %q\n", out, err, want)
+	}
+	restoreDir := filepath.Join(t.TempDir(), "data")
+	out, _, err = runTestCLI("restore", "--dir", restoreDir, "--in", backupPath)
+	if want := "Restored 2 keys to " + restoreDir + "\n"; err != nil || out != want {
+		t.Errorf("Unexpected restore output. got: %q, %v, want: %q\n", out, err, want)
+	}
+}
+
+// TestCLIErrors makes sure that subcommands complain about bad input.
+func TestCLIErrors(t *testing.T) {
+	dir, corpusPath := writeTestCorpus(t, "roll up and roll out\n")
+	notAModel := filepath.Join(dir, "not-a-model.json")
+	ioutil.WriteFile(notAModel, []byte(`{"version": 99}`), 0644)
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"unknown command", []string{"frobnicate"}, `unknown command "frobnicate"`},
+		{"no model", []string{"generate"}, ErrNoModel.Error()},
+		{"both", []string{"stats", "--corpus", corpusPath, "--model", corpusPath},
+			ErrNoModel.Error()},
+		{"bad flag", []string{"generate", "--wordz", "3"}, errUsage.Error()},
+		{"extra arg", []string{"stats", "--corpus", corpusPath, "extra"}, errUsage.Error()},
+		{"help", []string{"train", "-h"}, flag.ErrHelp.Error()},
+		{"negative words", []string{"generate", "--corpus", corpusPath, "--words", "-1"},
+			"words, chars, and top-k can't be negative"},
+		{"missing corpus", []string{"stats", "--corpus", filepath.Join(dir, "nope.txt")},
+			"no such file or directory"},
+		{"bad model file", []string{"generate", "--model", notAModel}, ErrBadModelFile.Error()},
+		{"train without out", []string{"train", "--corpus", corpusPath},
+			"pass --out to say where the model file should go"},
+		{"train from model", []string{"train", "--model", notAModel, "--out", "x"},
+			"train needs a --corpus, not a --model"},
+		{"backup without dir", []string{"backup", "--out", "x"},
+			"pass --dir and --out to say what to back up, and where to"},
+		{"backup without store", []string{"backup", "--dir", dir, "--out",
+			filepath.Join(dir, "backup.db")}, "no such file or directory"},
+		{"restore without in", []string{"restore", "--dir", dir},
+			"pass --dir and --in to say what to restore, and from where"},
+		{"restore corrupted", []string{"restore", "--dir", dir, "--in", corpusPath},
+			"the backup is corrupted"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := runTestCLI(tc.args...)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Unexpected error. got: %v, want: %q\n", err, tc.wantErr)
+			}
+		})
+	}
+}
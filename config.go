@@ -0,0 +1,592 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config describes everything about how the bot runs: who it is, which personas it generates text
+// with, and which chat services it connects to. It's read from a TOML config file, and env vars and
+// flags override what's in the file. See config.sample.toml for what goes in it.
+type Config struct {
+	Bot BotSection `toml:"bot"`
+	// The first persona is the default one, which chat messages are answered with.
+	Personas []PersonaSection `toml:"personas"`
+	Sampling Sampling         `toml:"sampling"`
+	Limits   LimitsSection    `toml:"limits"`
+
+	Discord  DiscordSection  `toml:"discord"`
+	IRC      IRCSection      `toml:"irc"`
+	Slack    SlackSection    `toml:"slack"`
+	Telegram TelegramSection `toml:"telegram"`
+	Matrix   MatrixSection   `toml:"matrix"`
+	API      APISection      `toml:"api"`
+	Metrics  MetricsSection  `toml:"metrics"`
+	Health   HealthSection   `toml:"health"`
+	Tracing  TracingSection  `toml:"tracing"`
+	Log      LogSection      `toml:"log"`
+
+	Persistence PersistenceSection `toml:"persistence"`
+
+	// Path of the config file that the Config was read from, if any.
+	path string
+}
+
+// BotSection describes the bot itself.
+type BotSection struct {
+	Name      string   `toml:"name"`
+	Prefix    string   `toml:"prefix"`
+	AllowNSFW bool     `toml:"allow_nsfw"`
+	Admins    []string `toml:"admins"`
+	// Directory that corpus files are read from.
+	CorporaDir string `toml:"corpora_dir"`
+	// How often to check whether the config file or corpus files changed, like "5s". "0s" turns
+	// checking off.
+	ReloadInterval string `toml:"reload_interval"`
+	// How long the bot gets to finish up what it's doing when it shuts down, like "30s".
+	ShutdownTimeout string `toml:"shutdown_timeout"`
+}
+
+// PersonaSection describes a persona, and how to train its model.
+type PersonaSection struct {
+	Name string `toml:"name"`
+	// Name of a corpus file in the corpora directory.
+	Corpus     string `toml:"corpus"`
+	Order      int    `toml:"order"`
+	MaxRetries int    `toml:"max_retries"`
+}
+
+// Sampling describes how words are picked when generating text, unless an invocation or request
+// says otherwise. See GenerateOptions for what each field means.
+type Sampling struct {
+	Temperature float64 `toml:"temperature"`
+	TopK        int     `toml:"top_k"`
+}
+
+// LimitsSection describes rate limits like "10/1m". See ParseBucketConfig(). Empty limits fall back
+// to the ones in DefaultLimiterConfig.
+type LimitsSection struct {
+	User    string `toml:"user"`
+	Channel string `toml:"channel"`
+	Guild   string `toml:"guild"`
+}
+
+// DiscordSection describes how to connect to Discord.
+type DiscordSection struct {
+	Token string `toml:"token"`
+}
+
+// IRCSection describes how to connect to an IRC server. See IRCConfig.
+type IRCSection struct {
+	Server           string   `toml:"server"`
+	TLS              bool     `toml:"tls"`
+	Nick             string   `toml:"nick"`
+	Password         string   `toml:"password"`
+	SASLUser         string   `toml:"sasl_user"`
+	SASLPassword     string   `toml:"sasl_password"`
+	NickServPassword string   `toml:"nickserv_password"`
+	Channels         []string `toml:"channels"`
+	FloodControl     string   `toml:"flood_control"`
+}
+
+// SlackSection describes how to connect to a Slack workspace. See SlackConfig.
+type SlackSection struct {
+	BotToken      string `toml:"bot_token"`
+	SigningSecret string `toml:"signing_secret"`
+	ListenAddr    string `toml:"listen_addr"`
+}
+
+// TelegramSection describes how to connect to Telegram.
+type TelegramSection struct {
+	Token string `toml:"token"`
+}
+
+// MatrixSection describes how to connect to a Matrix homeserver.
+type MatrixSection struct {
+	Homeserver  string `toml:"homeserver"`
+	AccessToken string `toml:"access_token"`
+}
+
+// APISection describes how to serve the HTTP API. See APIConfig.
+type APISection struct {
+	Addr      string   `toml:"addr"`
+	Keys      []string `toml:"keys"`
+	RateLimit string   `toml:"rate_limit"`
+}
+
+// MetricsSection describes where to serve metrics for Prometheus to scrape.
+type MetricsSection struct {
+	// Address to serve /metrics on, like ":9090". If it's empty, metrics aren't served.
+	Addr string `toml:"addr"`
+}
+
+// HealthSection describes where to serve health checks for container platforms to probe.
+type HealthSection struct {
+	// Address to serve /healthz and /readyz on, like ":8081". If it's empty, they aren't served.
+	Addr string `toml:"addr"`
+	// How long the Discord gateway can go without acknowledging a heartbeat before /healthz
+	// fails, like "2m". Defaults to defaultStallTimeout.
+	StallTimeout string `toml:"stall_timeout"`
+}
+
+// TracingSection describes where to export traces to.
+type TracingSection struct {
+	// Base URL of an OpenTelemetry collector that takes OTLP over HTTP, like
+	// "http://localhost:4318". If it's empty, tracing is off.
+	Endpoint string `toml:"endpoint"`
+}
+
+// LogSection describes what gets logged, and how.
+type LogSection struct {
+	// "debug", "info", "warn", or "error". Defaults to "info".
+	Level string `toml:"level"`
+	// "text" or "json". Defaults to "text".
+	Format string `toml:"format"`
+	// If ShowContent is true, what people said in chat is logged as it is, instead of being
+	// redacted.
+	ShowContent bool `toml:"show_content"`
+}
+
+// PersistenceSection describes where what the bot remembers is saved, so that it survives
+// restarts.
+type PersistenceSection struct {
+	// Directory to save things in, like "data". It's created if it doesn't exist. If it's empty,
+	// nothing is saved.
+	Dir string `toml:"dir"`
+}
+
+// ConfigError lists everything that's wrong with a Config, so that it can all be fixed in one go.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// DefaultConfig returns the Config that's used for anything that isn't configured.
+func DefaultConfig() Config {
+	return Config{
+		Bot:      BotSection{CorporaDir: corporaDirName},
+		Sampling: Sampling{Temperature: 1},
+		Slack:    SlackSection{ListenAddr: defaultSlackListenAddr},
+	}
+}
+
+// loadConfig builds the Config that "hmm-discord-bot serve" runs with. A config file is read if
+// one is named with the --config flag or the CONFIG_FILE env var. Env vars override what's in the
+// file, and flags override env vars.
+func loadConfig(args []string, getenv func(string) string, stderr io.Writer) (Config, error) {
+	var (
+		path, name, prefix, corpus string
+		order, retries, topK       int
+		temperature                float64
+	)
+	fs := newFlagSet("serve", "Connects the bot to every chat service that's configured.", stderr)
+	fs.StringVar(&path, "config", getenv("CONFIG_FILE"), "path to a TOML config file")
+	fs.StringVar(&name, "name", "", "the bot's name")
+	fs.StringVar(&prefix, "prefix", "", "what goes in front of the bot's name to invoke it")
+	fs.StringVar(&corpus, "corpus", "", "corpus file of the default persona")
+	fs.IntVar(&order, "order", 0,
+		"how many previous words the default persona takes into account")
+	fs.IntVar(&retries, "max-retries", 0,
+		"how many sentences' worth of retries the default persona gets")
+	fs.Float64Var(&temperature, "temperature", 0, "default sampling temperature")
+	fs.IntVar(&topK, "top-k", 0, "default number of most likely words to pick from")
+	if err := parseFlags(fs, args); err != nil {
+		return Config{}, err
+	}
+
+	config := DefaultConfig()
+	if path != "" {
+		if err := ReadConfigFile(path, &config); err != nil {
+			return Config{}, err
+		}
+		config.path = path
+	}
+	if err := config.applyEnv(getenv); err != nil {
+		return Config{}, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			config.Bot.Name = name
+		case "prefix":
+			config.Bot.Prefix = prefix
+		case "corpus":
+			config.defaultPersona().Corpus = corpus
+		case "order":
+			config.defaultPersona().Order = order
+		case "max-retries":
+			config.defaultPersona().MaxRetries = retries
+		case "temperature":
+			config.Sampling.Temperature = temperature
+		case "top-k":
+			config.Sampling.TopK = topK
+		}
+	})
+	config.setDefaults()
+	return config, config.Validate()
+}
+
+// ReadConfigFile reads a TOML config file into config. Anything that the file leaves out is left
+// alone. Keys that the config doesn't have are an error, so that typos don't go unnoticed.
+func ReadConfigFile(path string, config *Config) error {
+	meta, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("%s: unknown key %q", path, undecoded[0].String())
+	}
+	return nil
+}
+
+// applyEnv overrides the config with the env vars that are set. These are the same env vars that
+// the bot was configured with before it had config files, so .env files keep working.
+func (c *Config) applyEnv(getenv func(string) string) error {
+	for name, dst := range map[string]*string{
+		"BOT_NAME":              &c.Bot.Name,
+		"BOT_PREFIX":            &c.Bot.Prefix,
+		"BOT_TOKEN":             &c.Discord.Token,
+		"RELOAD_INTERVAL":       &c.Bot.ReloadInterval,
+		"SHUTDOWN_TIMEOUT":      &c.Bot.ShutdownTimeout,
+		"RATE_LIMIT_USER":       &c.Limits.User,
+		"RATE_LIMIT_CHANNEL":    &c.Limits.Channel,
+		"RATE_LIMIT_GUILD":      &c.Limits.Guild,
+		"IRC_SERVER":            &c.IRC.Server,
+		"IRC_NICK":              &c.IRC.Nick,
+		"IRC_PASSWORD":          &c.IRC.Password,
+		"IRC_SASL_USER":         &c.IRC.SASLUser,
+		"IRC_SASL_PASSWORD":     &c.IRC.SASLPassword,
+		"IRC_NICKSERV_PASSWORD": &c.IRC.NickServPassword,
+		"IRC_FLOOD_CONTROL":     &c.IRC.FloodControl,
+		"SLACK_BOT_TOKEN":       &c.Slack.BotToken,
+		"SLACK_SIGNING_SECRET":  &c.Slack.SigningSecret,
+		"SLACK_LISTEN_ADDR":     &c.Slack.ListenAddr,
+		"TELEGRAM_BOT_TOKEN":    &c.Telegram.Token,
+		"MATRIX_HOMESERVER":     &c.Matrix.Homeserver,
+		"MATRIX_ACCESS_TOKEN":   &c.Matrix.AccessToken,
+		"API_ADDR":              &c.API.Addr,
+		"API_RATE_LIMIT":        &c.API.RateLimit,
+		"METRICS_ADDR":          &c.Metrics.Addr,
+		"HEALTH_ADDR":           &c.Health.Addr,
+		"HEALTH_STALL_TIMEOUT":  &c.Health.StallTimeout,
+		"TRACING_ENDPOINT":      &c.Tracing.Endpoint,
+		"LOG_LEVEL":             &c.Log.Level,
+		"LOG_FORMAT":            &c.Log.Format,
+		"PERSISTENCE_DIR":       &c.Persistence.Dir,
+	} {
+		if val := getenv(name); val != "" {
+			*dst = val
+		}
+	}
+	for name, dst := range map[string]*[]string{
+		"ADMIN_IDS":    &c.Bot.Admins,
+		"IRC_CHANNELS": &c.IRC.Channels,
+		"API_KEYS":     &c.API.Keys,
+	} {
+		if val := getenv(name); val != "" {
+			*dst = strings.Split(val, ",")
+		}
+	}
+	for name, dst := range map[string]*bool{
+		"ALLOW_NSFW":  &c.Bot.AllowNSFW,
+		"IRC_TLS":     &c.IRC.TLS,
+		"LOG_CONTENT": &c.Log.ShowContent,
+	} {
+		if val := getenv(name); val != "" {
+			*dst = val == "true"
+		}
+	}
+
+	if val := getenv("FILENAME"); val != "" {
+		c.defaultPersona().Corpus = val
+	}
+	for name, dst := range map[string]func() *int{
+		"MODEL_ORDER": func() *int { return &c.defaultPersona().Order },
+		"MAX_RETRIES": func() *int { return &c.defaultPersona().MaxRetries },
+	} {
+		if val := getenv(name); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s should be a whole number, not %q", name, val)
+			}
+			*dst() = n
+		}
+	}
+	return nil
+}
+
+// defaultPersona returns the default persona, adding one if there aren't any yet.
+func (c *Config) defaultPersona() *PersonaSection {
+	if len(c.Personas) == 0 {
+		c.Personas = append(c.Personas, PersonaSection{})
+	}
+	return &c.Personas[0]
+}
+
+// setDefaults fills in whatever was left out that has a sensible default.
+func (c *Config) setDefaults() {
+	for i := range c.Personas {
+		persona := &c.Personas[i]
+		if persona.Name == "" && i == 0 {
+			persona.Name = c.Bot.Name
+		}
+		if persona.Order == 0 {
+			persona.Order = 1
+		}
+		if persona.MaxRetries == 0 {
+			persona.MaxRetries = defaultMaxRetries
+		}
+	}
+	if c.IRC.Nick == "" {
+		c.IRC.Nick = c.Bot.Name
+	}
+}
+
+// Validate returns a *ConfigError that lists everything that's wrong with the config, or nil if
+// nothing is.
+func (c *Config) Validate() error {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	checkBucket := func(key, val string) {
+		if val == "" {
+			return
+		}
+		if _, err := ParseBucketConfig(val); err != nil {
+			problemf("%s should look like \"10/1m\", not %q", key, val)
+		}
+	}
+
+	if c.Bot.Name == "" {
+		problemf("bot.name (BOT_NAME) is required")
+	}
+	if c.Bot.ReloadInterval != "" {
+		if d, err := time.ParseDuration(c.Bot.ReloadInterval); err != nil || d < 0 {
+			problemf("bot.reload_interval should look like \"5s\", not %q", c.Bot.ReloadInterval)
+		}
+	}
+	if c.Bot.ShutdownTimeout != "" {
+		if d, err := time.ParseDuration(c.Bot.ShutdownTimeout); err != nil || d <= 0 {
+			problemf("bot.shutdown_timeout should look like \"30s\", not %q",
+				c.Bot.ShutdownTimeout)
+		}
+	}
+
+	if len(c.Personas) == 0 {
+		problemf("at least one persona is required. Add a [[personas]] table, or set FILENAME")
+	}
+	names := make(map[string]bool)
+	for i, persona := range c.Personas {
+		key := fmt.Sprintf("personas[%d]", i)
+		switch {
+		case persona.Name == "":
+			problemf("%s.name is required", key)
+		case names[persona.Name]:
+			problemf("%s.name %q is already taken by another persona", key, persona.Name)
+		}
+		names[persona.Name] = true
+		if persona.Corpus == "" {
+			problemf("%s.corpus is required", key)
+		} else if _, err := os.Stat(filepath.Join(c.Bot.CorporaDir, persona.Corpus)); err != nil {
+			problemf("%s.corpus: %v", key, err)
+		}
+		if persona.Order < 1 || persona.Order > maxOrder {
+			problemf("%s.order should be between 1 and %d", key, maxOrder)
+		}
+		if persona.MaxRetries < 1 {
+			problemf("%s.max_retries should be greater than 0", key)
+		}
+	}
+
+	if c.Sampling.Temperature <= 0 || c.Sampling.Temperature > maxTemperature {
+		problemf("sampling.temperature should be greater than 0, and at most %d", maxTemperature)
+	}
+	if c.Sampling.TopK < 0 {
+		problemf("sampling.top_k can't be negative")
+	}
+
+	checkBucket("limits.user", c.Limits.User)
+	checkBucket("limits.channel", c.Limits.Channel)
+	checkBucket("limits.guild", c.Limits.Guild)
+
+	if c.Discord.Token == "" && c.IRC.Server == "" && c.Slack.BotToken == "" &&
+		c.Telegram.Token == "" && c.Matrix.Homeserver == "" && c.API.Addr == "" {
+		problemf("nothing to connect to. Set discord.token (BOT_TOKEN), or configure irc, slack," +
+			" telegram, matrix, or api")
+	}
+
+	if c.IRC.Server != "" {
+		if _, _, err := net.SplitHostPort(c.IRC.Server); err != nil {
+			problemf("irc.server should look like \"irc.libera.chat:6697\", not %q", c.IRC.Server)
+		}
+		for i, channel := range c.IRC.Channels {
+			if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+				problemf("irc.channels[%d] should start with \"#\" or \"&\", not %q", i, channel)
+			}
+		}
+		checkBucket("irc.flood_control", c.IRC.FloodControl)
+	}
+
+	if c.Slack.BotToken != "" {
+		if c.Slack.SigningSecret == "" {
+			problemf("slack.signing_secret (SLACK_SIGNING_SECRET) is required to use Slack")
+		}
+		if c.Slack.ListenAddr == "" {
+			problemf("slack.listen_addr (SLACK_LISTEN_ADDR) is required to use Slack")
+		}
+	}
+
+	if c.Matrix.Homeserver != "" {
+		if u, err := url.Parse(c.Matrix.Homeserver); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problemf("matrix.homeserver should look like \"https://matrix.org\", not %q",
+				c.Matrix.Homeserver)
+		}
+		if c.Matrix.AccessToken == "" {
+			problemf("matrix.access_token (MATRIX_ACCESS_TOKEN) is required to use Matrix")
+		}
+	}
+
+	if c.API.Addr != "" {
+		if len(c.API.Keys) == 0 {
+			problemf("api.keys (API_KEYS) needs at least one key to serve the HTTP API")
+		}
+		checkBucket("api.rate_limit", c.API.RateLimit)
+	}
+	if c.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+			problemf("metrics.addr should look like \":9090\", not %q", c.Metrics.Addr)
+		}
+	}
+	if c.Health.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Health.Addr); err != nil {
+			problemf("health.addr should look like \":8081\", not %q", c.Health.Addr)
+		}
+	}
+	if c.Health.StallTimeout != "" {
+		if d, err := time.ParseDuration(c.Health.StallTimeout); err != nil || d <= 0 {
+			problemf("health.stall_timeout should look like \"2m\", not %q",
+				c.Health.StallTimeout)
+		}
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problemf("tracing.endpoint should look like \"http://localhost:4318\", not %q",
+				c.Tracing.Endpoint)
+		}
+	}
+	if c.Persistence.Dir != "" {
+		if info, err := os.Stat(c.Persistence.Dir); err == nil && !info.IsDir() {
+			problemf("persistence.dir should be a directory, but %q is a file",
+				c.Persistence.Dir)
+		}
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problemf("log.level should be debug, info, warn, or error, not %q", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		problemf("log.format should be text or json, not %q", c.Log.Format)
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// bucketConfig parses a rate limit that Validate() already checked, falling back to def if it's
+// empty.
+func bucketConfig(val string, def BucketConfig) BucketConfig {
+	parsed, err := ParseBucketConfig(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+// limiterConfig returns the rate limits for bot invocations.
+func (c *Config) limiterConfig() LimiterConfig {
+	return LimiterConfig{
+		User:    bucketConfig(c.Limits.User, DefaultLimiterConfig.User),
+		Channel: bucketConfig(c.Limits.Channel, DefaultLimiterConfig.Channel),
+		Guild:   bucketConfig(c.Limits.Guild, DefaultLimiterConfig.Guild),
+		Admins:  c.Bot.Admins,
+	}
+}
+
+// ircConfig returns how to connect to the IRC server.
+func (c *Config) ircConfig() IRCConfig {
+	config := IRCConfig{
+		Server:           c.IRC.Server,
+		Nick:             c.IRC.Nick,
+		Password:         c.IRC.Password,
+		SASLUser:         c.IRC.SASLUser,
+		SASLPassword:     c.IRC.SASLPassword,
+		NickServPassword: c.IRC.NickServPassword,
+		Channels:         c.IRC.Channels,
+		FloodControl:     bucketConfig(c.IRC.FloodControl, DefaultIRCFloodControl),
+	}
+	if c.IRC.TLS {
+		host, _, _ := net.SplitHostPort(c.IRC.Server)
+		config.TLS = &tls.Config{ServerName: host}
+	}
+	return config
+}
+
+// reloadInterval returns how often to check whether the config file or corpus files changed. 0
+// means never.
+func (c *Config) reloadInterval() time.Duration {
+	if c.Bot.ReloadInterval == "" {
+		return defaultReloadInterval
+	}
+	d, _ := time.ParseDuration(c.Bot.ReloadInterval)
+	return d
+}
+
+// shutdownTimeout returns how long the bot gets to finish up what it's doing when it shuts down.
+func (c *Config) shutdownTimeout() time.Duration {
+	if c.Bot.ShutdownTimeout == "" {
+		return defaultShutdownTimeout
+	}
+	d, _ := time.ParseDuration(c.Bot.ShutdownTimeout)
+	return d
+}
+
+// stallTimeout returns how long the Discord gateway can go quiet before the bot counts as stuck.
+func (c *Config) stallTimeout() time.Duration {
+	if c.Health.StallTimeout == "" {
+		return defaultStallTimeout
+	}
+	d, _ := time.ParseDuration(c.Health.StallTimeout)
+	return d
+}
+
+// apiConfig returns how to serve the HTTP API.
+func (c *Config) apiConfig() APIConfig {
+	return APIConfig{
+		Addr:      c.API.Addr,
+		Keys:      c.API.Keys,
+		RateLimit: bucketConfig(c.API.RateLimit, DefaultAPIRateLimit),
+		Sampling:  c.Sampling,
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes a config file and the provided corpus files to a temporary directory
+// that's removed when the test finishes, and returns the config file's path. The config file's
+// bot.corpora_dir is the directory that the corpus files are in.
+func writeTestConfig(t *testing.T, config string, corpora map[string]string) string {
+	dir, err := ioutil.TempDir("", "hmm-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v\n", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, corpus := range corpora {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(corpus), 0644); err != nil {
+			t.Fatalf("Failed to write corpus file: %v\n", err)
+		}
+	}
+	config = strings.ReplaceAll(config, "$CORPORA", filepath.ToSlash(dir))
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v\n", err)
+	}
+	return path
+}
+
+// testEnv returns a getenv func that looks env vars up in the provided map.
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+// TestLoadConfig makes sure that env vars override the config file, and that flags override both.
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `
+[bot]
+name = "hmm"
+prefix = "?"
+admins = ["123"]
+corpora_dir = "$CORPORA"
+
+[[personas]]
+name = "foo"
+corpus = "foo.txt"
+order = 2
+
+[[personas]]
+name = "bar"
+corpus = "bar.txt"
+max_retries = 7
+
+[sampling]
+temperature = 0.8
+
+[limits]
+user = "5/30s"
+
+[irc]
+server = "irc.libera.chat:6697"
+tls = true
+channels = ["#general"]
+
+[api]
+addr = ":8080"
+keys = ["k3y"]
+`, map[string]string{"foo.txt": "roll up and roll out\n", "bar.txt": "the cat sat\n"})
+
+	env := map[string]string{
+		"CONFIG_FILE":  path,
+		"BOT_PREFIX":   "!",
+		"IRC_CHANNELS": "#bots,#random",
+		"ALLOW_NSFW":   "true",
+	}
+	config, err := loadConfig([]string{"--name", "mmh", "--top-k", "3"}, testEnv(env),
+		ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v\n", err)
+	}
+
+	if config.Bot.Name != "mmh" || config.Bot.Prefix != "!" || !config.Bot.AllowNSFW {
+		t.Errorf("Unexpected bot section: %+v\n", config.Bot)
+	}
+	wantPersonas := []PersonaSection{
+		{Name: "foo", Corpus: "foo.txt", Order: 2, MaxRetries: defaultMaxRetries},
+		{Name: "bar", Corpus: "bar.txt", Order: 1, MaxRetries: 7},
+	}
+	if !reflect.DeepEqual(config.Personas, wantPersonas) {
+		t.Errorf("Unexpected personas.\ngot: %+v\nwant: %+v\n", config.Personas, wantPersonas)
+	}
+	if want := (Sampling{Temperature: 0.8, TopK: 3}); config.Sampling != want {
+		t.Errorf("Unexpected sampling. got: %+v, want: %+v\n", config.Sampling, want)
+	}
+
+	limits := config.limiterConfig()
+	wantLimits := DefaultLimiterConfig
+	wantLimits.User = BucketConfig{Capacity: 5, Period: 30 * time.Second}
+	wantLimits.Admins = []string{"123"}
+	if !reflect.DeepEqual(limits, wantLimits) {
+		t.Errorf("Unexpected limits. got: %+v, want: %+v\n", limits, wantLimits)
+	}
+
+	irc := config.ircConfig()
+	if irc.Nick != "mmh" || irc.TLS == nil || irc.TLS.ServerName != "irc.libera.chat" ||
+		!reflect.DeepEqual(irc.Channels, []string{"#bots", "#random"}) ||
+		irc.FloodControl != DefaultIRCFloodControl {
+		t.Errorf("Unexpected IRC config: %+v\n", irc)
+	}
+	if api := config.apiConfig(); api.RateLimit != DefaultAPIRateLimit ||
+		api.Sampling != config.Sampling {
+		t.Errorf("Unexpected API config: %+v\n", api)
+	}
+
+	personas := NewPersonas()
+	if _, err := NewReloader(personas, nil).Apply(config); err != nil {
+		t.Fatalf("Failed to load personas: %v\n", err)
+	}
+	foo, _ := personas.Get("")
+	if foo.Name != "foo" || foo.HMM.order != 2 {
+		t.Errorf("Unexpected default persona: %+v\n", foo)
+	}
+}
+
+// TestLoadConfigEnv makes sure that the bot can still be configured with env vars alone.
+func TestLoadConfigEnv(t *testing.T) {
+	env := map[string]string{
+		"BOT_NAME":    "hmm",
+		"BOT_PREFIX":  "!",
+		"BOT_TOKEN":   "t0k3n",
+		"FILENAME":    "corpus.txt",
+		"MAX_RETRIES": "5",
+	}
+	config, err := loadConfig(nil, testEnv(env), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v\n", err)
+	}
+	want := []PersonaSection{{Name: "hmm", Corpus: "corpus.txt", Order: 1, MaxRetries: 5}}
+	if !reflect.DeepEqual(config.Personas, want) {
+		t.Errorf("Unexpected personas.\ngot: %+v\nwant: %+v\n", config.Personas, want)
+	}
+	if config.Discord.Token != "t0k3n" || config.Bot.CorporaDir != corporaDirName ||
+		config.Sampling.Temperature != 1 || config.Slack.ListenAddr != defaultSlackListenAddr {
+		t.Errorf("Unexpected config: %+v\n", config)
+	}
+}
+
+// TestLoadConfigErrors makes sure that every problem with a config is pointed out.
+func TestLoadConfigErrors(t *testing.T) {
+	corpora := map[string]string{"foo.txt": "roll up and roll out\n"}
+	tests := []struct {
+		name     string
+		config   string
+		env      map[string]string
+		args     []string
+		wantErrs []string
+	}{
+		{
+			name:     "syntax",
+			config:   "[bot]\nname = hmm\n",
+			wantErrs: []string{`config.toml: toml: line 2`, `found "hmm"`},
+		},
+		{
+			name:     "unknown key",
+			config:   "[bot]\nnmae = \"hmm\"\n",
+			wantErrs: []string{`config.toml: unknown key "bot.nmae"`},
+		},
+		{
+			name:     "wrong type",
+			config:   "[[personas]]\nname = \"foo\"\norder = \"two\"\n",
+			wantErrs: []string{"config.toml: toml: line 3", "incompatible types"},
+		},
+		{
+			name:     "bad env var",
+			env:      map[string]string{"MODEL_ORDER": "two"},
+			wantErrs: []string{`MODEL_ORDER should be a whole number, not "two"`},
+		},
+		{
+			name:     "bad flag",
+			args:     []string{"--nmae", "hmm"},
+			wantErrs: []string{errUsage.Error()},
+		},
+		{
+			name: "invalid",
+			config: `
+[bot]
+corpora_dir = "$CORPORA"
+
+[[personas]]
+corpus = "foo.txt"
+order = 9
+
+[[personas]]
+corpus = "nope.txt"
+max_retries = -1
+
+[sampling]
+temperature = 11
+top_k = -1
+
+[limits]
+guild = "lots"
+
+[irc]
+server = "irc.libera.chat"
+channels = ["general"]
+
+[slack]
+bot_token = "xoxb"
+
+[matrix]
+homeserver = "matrix.org"
+
+[api]
+addr = ":8080"
+
+[health]
+addr = "8081"
+stall_timeout = "forever"
+
+[tracing]
+endpoint = "localhost:4318"
+
+[persistence]
+dir = "go.mod"
+`,
+			wantErrs: []string{
+				"invalid config:",
+				"bot.name (BOT_NAME) is required",
+				"personas[0].name is required",
+				"personas[0].order should be between 1 and 5",
+				"personas[1].name is required",
+				"personas[1].corpus: stat",
+				"personas[1].max_retries should be greater than 0",
+				"sampling.temperature should be greater than 0, and at most 10",
+				"sampling.top_k can't be negative",
+				`limits.guild should look like "10/1m", not "lots"`,
+				`irc.server should look like "irc.libera.chat:6697", not "irc.libera.chat"`,
+				`irc.channels[0] should start with "#" or "&", not "general"`,
+				"slack.signing_secret (SLACK_SIGNING_SECRET) is required to use Slack",
+				`matrix.homeserver should look like "https://matrix.org", not "matrix.org"`,
+				"matrix.access_token (MATRIX_ACCESS_TOKEN) is required to use Matrix",
+				"api.keys (API_KEYS) needs at least one key to serve the HTTP API",
+				`health.addr should look like ":8081", not "8081"`,
+				`health.stall_timeout should look like "2m", not "forever"`,
+				`tracing.endpoint should look like "http://localhost:4318", not "localhost:4318"`,
+				`persistence.dir should be a directory, but "go.mod" is a file`,
+			},
+		},
+		{
+			name:   "nothing configured",
+			config: "[bot]\nname = \"hmm\"\n",
+			wantErrs: []string{
+				"at least one persona is required",
+				"nothing to connect to",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := tc.env
+			if env == nil {
+				env = make(map[string]string)
+			}
+			if tc.config != "" {
+				env["CONFIG_FILE"] = writeTestConfig(t, tc.config, corpora)
+			}
+			_, err := loadConfig(tc.args, testEnv(env), ioutil.Discard)
+			if err == nil {
+				t.Fatalf("Expected an error\n")
+			}
+			for _, want := range tc.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Error doesn't mention %q:\n%v\n", want, err)
+				}
+			}
+		})
+	}
+}
+
+// TestSampleConfig makes sure that config.sample.toml is a config that the bot accepts.
+func TestSampleConfig(t *testing.T) {
+	env := map[string]string{"CONFIG_FILE": "config.sample.toml", "BOT_TOKEN": "t0k3n"}
+	config, err := loadConfig(nil, testEnv(env), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config.sample.toml: %v\n", err)
+	}
+	if config.Bot.Name != "botname" || len(config.Personas) != 1 {
+		t.Errorf("Unexpected config: %+v\n", config)
+	}
+}
+
+// TestConfiguredSampling makes sure that the bot generates text with the sampling settings from
+// its config, and that greedy sampling on the shipped corpus, which has runs of blank lines, still
+// finishes with as many words as were asked for.
+func TestConfiguredSampling(t *testing.T) {
+	corpus, err := ioutil.ReadFile(filepath.Join("corpora", "corpus.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read the shipped corpus: %v\n", err)
+	}
+	path := writeTestConfig(t, `
+[bot]
+name = "hmm"
+corpora_dir = "$CORPORA"
+
+[[personas]]
+name = "obama"
+corpus = "corpus.txt"
+
+[sampling]
+top_k = 1
+`, map[string]string{"corpus.txt": string(corpus)})
+	env := map[string]string{"CONFIG_FILE": path, "BOT_TOKEN": "t0k3n"}
+	config, err := loadConfig(nil, testEnv(env), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v\n", err)
+	}
+	personas := NewPersonas()
+	if _, err := NewReloader(personas, nil).Apply(config); err != nil {
+		t.Fatalf("Failed to load personas: %v\n", err)
+	}
+	persona, _ := personas.Get("")
+	bot, _ := NewBot(config.Bot.Name, config.Bot.Prefix, persona.HMM)
+	bot.sampling = config.Sampling
+
+	for seed := int64(1); seed <= 10; seed++ {
+		done := make(chan Generation, 1)
+		go func() {
+			done <- bot.generate(context.Background(), persona, GenerateOptions{Words: 40,
+				Seed: seed})
+		}()
+		select {
+		case gen := <-done:
+			if gen.Tokens != 40 {
+				t.Errorf("Unexpected number of words with seed %d. got: %d, want: %d\n", seed,
+					gen.Tokens, 40)
+			}
+			again := persona.HMM.Generate(GenerateOptions{Words: 40, Seed: seed, TopK: 1})
+			if again.Text != gen.Text {
+				t.Errorf("Generation didn't use the configured top k.\ngot: %q\nwant: %q\n",
+					gen.Text, again.Text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Generating 40 words with seed %d never finished\n", seed)
+		}
+	}
+}
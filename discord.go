@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordSessionState is how a Discord's gateway session is doing, going by discordgo's connect,
+// disconnect, and resumed events.
+type discordSessionState string
+
+const (
+	// The session hasn't connected yet.
+	sessionConnecting discordSessionState = "connecting"
+	sessionConnected  discordSessionState = "connected"
+	// The session reconnected, and Discord replayed the events that it missed.
+	sessionResumed discordSessionState = "resumed"
+	// The session lost its connection. discordgo reconnects on its own.
+	sessionDisconnected discordSessionState = "disconnected"
+)
+
+// Discord connects a Bot to Discord. It establishes a new Discord session, hands the messages that
+// are posted in the channels it can see to its Bot, and is the Platform that the Bot talks back
+// through.
+type Discord struct {
+	dg     *discordgo.Session
+	outbox *Outbox
+	bot    *Bot
+	// Messages that are being handled.
+	handlers inFlight
+	*discordHistoryFetcher
+
+	mu    sync.Mutex
+	state discordSessionState
+}
+
+// NewDiscord returns a pointer to a new Discord initialized with the provided token and the Bot to
+// hand messages to.
+func NewDiscord(token string, bot *Bot) (*Discord, error) {
+	dg, err := discordgo.New("Bot " + token)
+	if err != nil {
+		return nil, err
+	}
+	// The bot reads what people post to find its commands, and Discord only hands the content of
+	// messages over to bots that ask for it.
+	dg.Identify.Intents = discordgo.IntentsAllWithoutPrivileged | discordgo.IntentMessageContent
+
+	return &Discord{
+		dg:                    dg,
+		outbox:                NewOutbox(),
+		bot:                   bot,
+		discordHistoryFetcher: &discordHistoryFetcher{session: dg},
+		state:                 sessionConnecting,
+	}, nil
+}
+
+// Run opens a websocket connection with Discord, and hands messages to the Bot until ctx is done.
+// Then it stops handing messages over, lets the ones that are being handled and the replies that
+// are still on their way out finish up, and closes the session.
+func (d *Discord) Run(ctx context.Context, ready func()) error {
+	d.addHandlers()
+
+	err := d.dg.Open()
+	if err != nil {
+		return err
+	}
+	ready()
+
+	<-ctx.Done()
+	d.handlers.Close()
+	d.outbox.Wait()
+	return d.dg.Close()
+}
+
+// MessageCreateHandler is called every time a new message is posted in a a channel that the bot has
+// access to. Once the bot starts shutting down, messages are ignored.
+func (d *Discord) MessageCreateHandler(s *discordgo.Session, m *discordgo.MessageCreate) {
+	d.handlers.Do(func() {
+		message := newDiscordMessage(m.Message)
+		d.bot.HandleMessage(d, message.WithContext(newRequestContext(d.Name(), message)))
+	})
+}
+
+// MessageReactionAddHandler is called every time someone reacts to a message in a channel that the
+// bot has access to. Once the bot starts shutting down, reactions are ignored.
+func (d *Discord) MessageReactionAddHandler(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	d.handlers.Do(func() {
+		d.bot.HandleReaction(d, newDiscordReaction(r.MessageReaction))
+	})
+}
+
+// ConnectHandler is called whenever the session connects to Discord's gateway.
+func (d *Discord) ConnectHandler(s *discordgo.Session, c *discordgo.Connect) {
+	d.setSessionState(sessionConnected)
+}
+
+// DisconnectHandler is called whenever the session loses its connection to Discord's gateway.
+func (d *Discord) DisconnectHandler(s *discordgo.Session, c *discordgo.Disconnect) {
+	d.setSessionState(sessionDisconnected)
+}
+
+// ResumedHandler is called whenever the session picks up where it left off after reconnecting.
+func (d *Discord) ResumedHandler(s *discordgo.Session, r *discordgo.Resumed) {
+	d.setSessionState(sessionResumed)
+}
+
+func (d *Discord) setSessionState(state discordSessionState) {
+	d.mu.Lock()
+	d.state = state
+	d.mu.Unlock()
+	if state == sessionDisconnected {
+		slog.Warn("Disconnected from Discord")
+	} else {
+		slog.Info("Discord session state changed", "state", state)
+	}
+}
+
+// SessionState returns how the gateway session is doing.
+func (d *Discord) SessionState() discordSessionState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// checkSession returns an error unless the gateway session is connected. It's a readiness check.
+func (d *Discord) checkSession() error {
+	switch state := d.SessionState(); state {
+	case sessionConnected, sessionResumed:
+		return nil
+	default:
+		return fmt.Errorf("session is %s", state)
+	}
+}
+
+// checkHeartbeat returns an error if the gateway hasn't acknowledged a heartbeat within
+// stallTimeout since the session first connected. That means that the loop which reads from the
+// gateway is stuck, or that reconnecting keeps failing. It's a liveness check.
+func (d *Discord) checkHeartbeat(stallTimeout time.Duration) error {
+	if d.SessionState() == sessionConnecting {
+		return nil
+	}
+	d.dg.RLock()
+	lastAck := d.dg.LastHeartbeatAck
+	d.dg.RUnlock()
+	if since := time.Since(lastAck); since > stallTimeout {
+		return fmt.Errorf("the gateway hasn't acknowledged a heartbeat in %v",
+			since.Round(time.Second))
+	}
+	return nil
+}
+
+// Name returns "discord".
+func (d *Discord) Name() string {
+	return "discord"
+}
+
+// SelfID returns the bot's user ID, which Discord hands over once the session is ready.
+func (d *Discord) SelfID() string {
+	if d.dg.State == nil || d.dg.State.User == nil {
+		return ""
+	}
+	return d.dg.State.User.ID
+}
+
+// Reply queues a message up in the outbox for delivery to the provided channel.
+func (d *Discord) Reply(ctx context.Context, channelID, msg string) {
+	d.outbox.Post(ctx, d.dg, channelID, msg)
+}
+
+// ReplyTracked is like Reply, but the message gets a button for each of the provided actions, and
+// sent is called with the message's ID once it's delivered.
+func (d *Discord) ReplyTracked(ctx context.Context, channelID, msg string, actions []Action,
+	sent func(messageID string)) {
+	d.outbox.PostTracked(ctx, d.dg, channelID, msg, actions, sent)
+}
+
+// DeleteMessage deletes a message from the provided channel.
+func (d *Discord) DeleteMessage(channelID, messageID string) error {
+	return d.dg.ChannelMessageDelete(channelID, messageID)
+}
+
+// discordPermissions maps the names in permissionNames to Discord's permission bits.
+var discordPermissions = map[string]int64{
+	administratorPermission: discordgo.PermissionAdministrator,
+	"ban_members":           discordgo.PermissionBanMembers,
+	"kick_members":          discordgo.PermissionKickMembers,
+	"manage_channels":       discordgo.PermissionManageChannels,
+	"manage_messages":       discordgo.PermissionManageMessages,
+	"manage_roles":          discordgo.PermissionManageRoles,
+	manageServerPermission:  discordgo.PermissionManageServer,
+	"mention_everyone":      discordgo.PermissionMentionEveryone,
+}
+
+// LookupMember returns the roles of the author of m, and their permissions in the channel that it
+// was posted in, preferring the session's state cache over a REST API call. Guild owners and
+// administrators have every permission.
+func (d *Discord) LookupMember(m *Message) (Member, error) {
+	if d.dg.State == nil {
+		return Member{}, discordgo.ErrNilState
+	}
+	member, err := d.dg.State.Member(m.GuildID, m.Author.ID)
+	if err == discordgo.ErrStateNotFound {
+		// Guilds' channels and roles are always cached, but their members might not be.
+		member, err = d.dg.GuildMember(m.GuildID, m.Author.ID)
+		if err != nil {
+			return Member{}, err
+		}
+		member.GuildID = m.GuildID
+		err = d.dg.State.MemberAdd(member)
+	}
+	if err != nil {
+		return Member{}, err
+	}
+	bits, err := d.dg.State.UserChannelPermissions(m.Author.ID, m.ChannelID)
+	if err != nil {
+		return Member{}, err
+	}
+	var permissions []string
+	for _, name := range permissionNames {
+		if bit := discordPermissions[name]; bits&bit == bit {
+			permissions = append(permissions, name)
+		}
+	}
+	return Member{Roles: member.Roles, Permissions: permissions}, nil
+}
+
+// ReplyPrivately sends msg to the author of m in a direct message, since Discord only lets
+// interactions be answered so that nobody else sees it.
+func (d *Discord) ReplyPrivately(ctx context.Context, m *Message, msg string) {
+	channel, err := d.dg.UserChannelCreate(m.Author.ID)
+	if err != nil {
+		loggerFrom(ctx).Warn("Failed to open a direct message, so replying in the channel instead",
+			"error", err)
+		d.Reply(ctx, m.ChannelID, msg)
+		return
+	}
+	d.outbox.Post(ctx, d.dg, channel.ID, msg)
+}
+
+// SendFile uploads a file to the provided channel.
+func (d *Discord) SendFile(channelID, name string, r io.Reader) error {
+	_, err := d.dg.ChannelFileSend(channelID, name, r)
+	return err
+}
+
+// IsNSFW reports whether the provided channel is marked as NSFW, preferring the session's state
+// cache over a REST API call.
+func (d *Discord) IsNSFW(channelID string) (bool, error) {
+	if d.dg.State != nil {
+		if channel, err := d.dg.State.Channel(channelID); err == nil {
+			return channel.NSFW, nil
+		}
+	}
+	channel, err := d.dg.Channel(channelID)
+	if err != nil {
+		return false, err
+	}
+	return channel.NSFW, nil
+}
+
+// addHandlers registers all of this adapter's handler functions with its Discord session.
+func (d *Discord) addHandlers() {
+	d.dg.AddHandler(d.MessageCreateHandler)
+	d.dg.AddHandler(d.MessageReactionAddHandler)
+	d.dg.AddHandler(d.InteractionCreateHandler)
+	d.dg.AddHandler(d.ConnectHandler)
+	d.dg.AddHandler(d.DisconnectHandler)
+	d.dg.AddHandler(d.ResumedHandler)
+}
+
+// newDiscordMessage converts a Discord message into a platform-neutral Message.
+func newDiscordMessage(m *discordgo.Message) *Message {
+	msg := &Message{
+		ID:        m.ID,
+		ChannelID: m.ChannelID,
+		GuildID:   m.GuildID,
+		Content:   m.Content,
+	}
+	if m.Author != nil {
+		msg.Author = newDiscordUser(m.Author)
+	}
+	for _, mention := range m.Mentions {
+		msg.Mentions = append(msg.Mentions, newDiscordUser(mention))
+	}
+	return msg
+}
+
+// newDiscordUser converts a Discord user into a platform-neutral User.
+func newDiscordUser(u *discordgo.User) User {
+	return User{ID: u.ID, Name: u.Username, Bot: u.Bot}
+}
+
+// newDiscordReaction converts a Discord reaction into a platform-neutral Reaction.
+func newDiscordReaction(r *discordgo.MessageReaction) Reaction {
+	return Reaction{
+		MessageID: r.MessageID,
+		ChannelID: r.ChannelID,
+		UserID:    r.UserID,
+		Emoji:     r.Emoji.Name,
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// TestNewDiscordMessage makes sure that Discord messages are converted into Messages without losing
+// anything that the bot cares about.
+func TestNewDiscordMessage(t *testing.T) {
+	m := &discordgo.Message{
+		ID:        "message",
+		ChannelID: "channel",
+		GuildID:   "guild",
+		Content:   "!foo imitate <@bob>",
+		Author:    &discordgo.User{ID: "alice", Username: "alice"},
+		Mentions:  []*discordgo.User{{ID: "bob", Username: "bob", Bot: true}},
+	}
+	want := &Message{
+		ID:        "message",
+		ChannelID: "channel",
+		GuildID:   "guild",
+		Content:   "!foo imitate <@bob>",
+		Author:    User{ID: "alice", Name: "alice"},
+		Mentions:  []User{{ID: "bob", Name: "bob", Bot: true}},
+	}
+	if got := newDiscordMessage(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected Message.\ngot: %+v\nwant: %+v\n", got, want)
+	}
+}
+
+// TestDiscordPlatform makes sure that the Discord adapter talks to Discord's REST API correctly when
+// the bot replies, publicly or privately, reads history, and looks up channels.
+func TestDiscordPlatform(t *testing.T) {
+	fake := newFakeDiscord(t)
+	fake.nsfw["nsfw"] = true
+	fake.addMessages("channel", "alice", "hello there friend")
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	discord, _ := NewDiscord("token", bot)
+
+	discord.Reply(context.Background(), "channel", "hello")
+	discord.outbox.Wait()
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, []string{"hello"}) {
+		t.Errorf("Unexpected messages sent. got: %q, want: %q\n", got, []string{"hello"})
+	}
+
+	m := &Message{ChannelID: "channel", GuildID: "guild", Author: User{ID: "alice"}}
+	discord.ReplyPrivately(context.Background(), m, "psst")
+	discord.outbox.Wait()
+	if got := fake.sent["dm-alice"]; !reflect.DeepEqual(got, []string{"psst"}) {
+		t.Errorf("Unexpected direct messages sent. got: %q, want: %q\n", got, []string{"psst"})
+	}
+
+	all := func(string) bool { return true }
+	msgs, err := discord.FetchMessages("channel", 10, all)
+	if err != nil || !reflect.DeepEqual(msgs, []string{"hello there friend"}) {
+		t.Errorf("Unexpected history. got: %q and %v, want: %q and no error\n", msgs, err,
+			[]string{"hello there friend"})
+	}
+
+	for channelID, want := range map[string]bool{"nsfw": true, "channel": false} {
+		got, err := discord.IsNSFW(channelID)
+		if err != nil || got != want {
+			t.Errorf("Unexpected NSFW lookup for %q. got: %t and %v, want: %t and no error\n",
+				channelID, got, err, want)
+		}
+	}
+}
+
+// TestDiscordSessionState makes sure that the session's state follows discordgo's events, and that
+// the health checks go by it.
+func TestDiscordSessionState(t *testing.T) {
+	d, err := NewDiscord("t0k3n", nil)
+	if err != nil {
+		t.Fatalf("Failed to create a Discord: %v\n", err)
+	}
+	if err := d.checkSession(); err == nil || err.Error() != "session is connecting" {
+		t.Errorf("Unexpected readiness before connecting: %v\n", err)
+	}
+	d.dg.LastHeartbeatAck = time.Now().Add(-time.Hour)
+	if err := d.checkHeartbeat(time.Minute); err != nil {
+		t.Errorf("Liveness failed before connecting: %v\n", err)
+	}
+
+	for _, tc := range []struct {
+		event   func()
+		want    discordSessionState
+		wantErr string
+	}{
+		{func() { d.ConnectHandler(d.dg, &discordgo.Connect{}) }, sessionConnected, ""},
+		{func() { d.DisconnectHandler(d.dg, &discordgo.Disconnect{}) }, sessionDisconnected,
+			"session is disconnected"},
+		{func() { d.ResumedHandler(d.dg, &discordgo.Resumed{}) }, sessionResumed, ""},
+	} {
+		tc.event()
+		if got := d.SessionState(); got != tc.want {
+			t.Errorf("Unexpected state. got: %s, want: %s\n", got, tc.want)
+		}
+		err := d.checkSession()
+		if (err == nil && tc.wantErr != "") || (err != nil && err.Error() != tc.wantErr) {
+			t.Errorf("Unexpected readiness in state %s. got: %v, want: %q\n", tc.want, err,
+				tc.wantErr)
+		}
+	}
+
+	if err := d.checkHeartbeat(time.Minute); err == nil {
+		t.Errorf("Liveness passed even though the last heartbeat ACK was an hour ago\n")
+	}
+	d.dg.LastHeartbeatAck = time.Now()
+	if err := d.checkHeartbeat(time.Minute); err != nil {
+		t.Errorf("Liveness failed right after a heartbeat ACK: %v\n", err)
+	}
+}
+
+// TestDiscordLookupMember makes sure that members' permissions go by their roles, and that
+// members who aren't in the state cache are looked up.
+func TestDiscordLookupMember(t *testing.T) {
+	fake := newFakeDiscord(t)
+	fake.members["guild"] = map[string]*discordgo.Member{
+		"owner": {User: &discordgo.User{ID: "owner"}},
+		"carol": {User: &discordgo.User{ID: "carol"}, Roles: []string{"mods"}},
+	}
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	discord, _ := NewDiscord("token", bot)
+	discord.dg.State.GuildAdd(&discordgo.Guild{
+		ID:      "guild",
+		OwnerID: "owner",
+		Roles: []*discordgo.Role{
+			{ID: "guild", Permissions: discordgo.PermissionSendMessages},
+			{ID: "mods", Permissions: discordgo.PermissionManageServer |
+				discordgo.PermissionManageMessages},
+		},
+		Channels: []*discordgo.Channel{{ID: "channel", GuildID: "guild"}},
+		Members: []*discordgo.Member{
+			{GuildID: "guild", User: &discordgo.User{ID: "alice"}},
+			{GuildID: "guild", User: &discordgo.User{ID: "bob"}, Roles: []string{"mods"}},
+		},
+	})
+
+	mod := Member{Roles: []string{"mods"}, Permissions: []string{"manage_messages",
+		manageServerPermission}}
+	for userID, want := range map[string]Member{
+		// Guild owners have every permission.
+		"owner": {Permissions: permissionNames},
+		"alice": {},
+		"bob":   mod,
+		"carol": mod,
+	} {
+		m := &Message{ChannelID: "channel", GuildID: "guild", Author: User{ID: userID}}
+		got, err := discord.LookupMember(m)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected member %s. got: %+v and %v, want: %+v and no error\n", userID,
+				got, err, want)
+		}
+	}
+	m := &Message{ChannelID: "channel", GuildID: "guild", Author: User{ID: "dave"}}
+	if _, err := discord.LookupMember(m); err == nil {
+		t.Errorf("Expected an error for someone who isn't in the guild\n")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeDiscord is a local stand-in for the parts of Discord's REST API that the bot talks to. Each
+// channel's messages are kept newest first, which is the order that Discord hands them back in.
+type fakeDiscord struct {
+	*httptest.Server
+	messages map[string][]*discordgo.Message
+	// IDs of channels that are marked as NSFW.
+	nsfw map[string]bool
+	// Guilds' members, keyed by guild ID and then user ID.
+	members map[string]map[string]*discordgo.Member
+
+	// Guards everything below, since messages are sent from an Outbox's goroutines.
+	mu sync.Mutex
+	// Contents of the messages that were posted in each channel, in the order they arrived.
+	sent map[string][]string
+	// Custom IDs of the buttons under each message that was posted, keyed by message ID.
+	buttons map[string][]string
+	// IDs of the messages that were deleted.
+	deleted []string
+	// Responses to interactions, in the order they arrived.
+	responses []discordgo.InteractionResponse
+	// Responses to hand back to upcoming attempts to post a message, in order, instead of posting
+	// it.
+	sendFailures []fakeFailure
+}
+
+// fakeFailure is an error response that a fakeDiscord hands back.
+type fakeFailure struct {
+	status int
+	body   string
+}
+
+// newFakeDiscord spins up a fakeDiscord and points discordgo's endpoints at it for the duration of
+// the test.
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{
+		messages: make(map[string][]*discordgo.Message),
+		nsfw:     make(map[string]bool),
+		members:  make(map[string]map[string]*discordgo.Member),
+		sent:     make(map[string][]string),
+		buttons:  make(map[string][]string),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+
+	oldEndpoint, oldGuilds, oldUsers, oldInteractions := discordgo.EndpointChannels,
+		discordgo.EndpointGuilds, discordgo.EndpointUsers, discordgo.EndpointInteractionResponse
+	discordgo.EndpointChannels = f.URL + "/channels/"
+	discordgo.EndpointGuilds = f.URL + "/guilds/"
+	discordgo.EndpointUsers = f.URL + "/users/"
+	discordgo.EndpointInteractionResponse = func(iID, iToken string) string {
+		return f.URL + "/interactions/" + iID + "/" + iToken + "/callback"
+	}
+	t.Cleanup(func() {
+		discordgo.EndpointChannels, discordgo.EndpointGuilds = oldEndpoint, oldGuilds
+		discordgo.EndpointUsers, discordgo.EndpointInteractionResponse = oldUsers, oldInteractions
+		f.Close()
+	})
+	return f
+}
+
+// addMessages appends messages to the beginning of a channel's history, as if they had just been
+// posted by the user with the provided ID. The last provided message is the newest one.
+func (f *fakeDiscord) addMessages(channelID, userID string, contents ...string) {
+	for _, content := range contents {
+		msg := &discordgo.Message{
+			ID:        strconv.Itoa(len(f.messages[channelID]) + 1),
+			ChannelID: channelID,
+			Content:   content,
+			Author:    &discordgo.User{ID: userID},
+		}
+		f.messages[channelID] = append([]*discordgo.Message{msg}, f.messages[channelID]...)
+	}
+}
+
+// serveHTTP implements GET /channels/{channelID}, POST /channels/{channelID}/messages,
+// DELETE /channels/{channelID}/messages/{messageID}, POST /interactions/{id}/{token}/callback,
+// GET /guilds/{guildID}/members/{userID}, POST /users/@me/channels, and
+// GET /channels/{channelID}/messages while honoring the limit and before query params. Direct
+// message channels' IDs are "dm-" followed by the ID of the user on the other end.
+func (f *fakeDiscord) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/users/@me/channels" && r.Method == http.MethodPost {
+		var body struct {
+			RecipientID string `json:"recipient_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(&discordgo.Channel{ID: "dm-" + body.RecipientID})
+		return
+	}
+	if guild := strings.Split(strings.TrimPrefix(r.URL.Path, "/guilds/"), "/"); len(guild) == 3 &&
+		guild[1] == "members" && r.Method == http.MethodGet {
+		member, ok := f.members[guild[0]][guild[2]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(member)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/interactions/") && r.Method == http.MethodPost {
+		var response discordgo.InteractionResponse
+		json.NewDecoder(r.Body).Decode(&response)
+		f.mu.Lock()
+		f.responses = append(f.responses, response)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/channels/"), "/")
+	if r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "messages" {
+		f.mu.Lock()
+		f.deleted = append(f.deleted, parts[2])
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		json.NewEncoder(w).Encode(&discordgo.Channel{ID: parts[0], NSFW: f.nsfw[parts[0]]})
+		return
+	}
+	if r.Method == http.MethodPost && len(parts) == 2 && parts[1] == "messages" {
+		f.serveSend(w, r, parts[0])
+		return
+	}
+	if r.Method != http.MethodGet || len(parts) != 2 || parts[1] != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+
+	msgs := f.messages[parts[0]]
+	if before := r.URL.Query().Get("before"); before != "" {
+		for i, msg := range msgs {
+			if msg.ID == before {
+				msgs = msgs[i+1:]
+				break
+			}
+		}
+	}
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		limit = l
+	}
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	json.NewEncoder(w).Encode(msgs)
+}
+
+// serveSend records a message posted in the provided channel, unless a failure was queued up.
+func (f *fakeDiscord) serveSend(w http.ResponseWriter, r *http.Request, channelID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.sendFailures) > 0 {
+		failure := f.sendFailures[0]
+		f.sendFailures = f.sendFailures[1:]
+		w.WriteHeader(failure.status)
+		w.Write([]byte(failure.body))
+		return
+	}
+
+	// discordgo can't decode components on their own, so only the parts of them that are checked
+	// are.
+	var msg struct {
+		Content    string `json:"content"`
+		Components []struct {
+			Components []struct {
+				CustomID string `json:"custom_id"`
+			} `json:"components"`
+		} `json:"components"`
+	}
+	json.NewDecoder(r.Body).Decode(&msg)
+	f.sent[channelID] = append(f.sent[channelID], msg.Content)
+	id := strconv.Itoa(len(f.sent[channelID]))
+	for _, row := range msg.Components {
+		for _, button := range row.Components {
+			f.buttons[id] = append(f.buttons[id], button.CustomID)
+		}
+	}
+	json.NewEncoder(w).Encode(&discordgo.Message{
+		ID:        id,
+		ChannelID: channelID,
+		Content:   msg.Content,
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// feedbackCmd is the argument for managing the feedback that personas got from reactions. Only
+	// admins may use it.
+	feedbackCmd = "feedback"
+
+	// upvoteEmoji and downvoteEmoji are the reactions that count as feedback on the bot's messages.
+	upvoteEmoji   = "👍"
+	downvoteEmoji = "👎"
+
+	// feedbackStep is how much one reaction multiplies, or divides, the weights of the transitions
+	// in the message that it was left on.
+	feedbackStep = 1.1
+	// maxFeedbackWeight bounds transitions' weights to between 1/maxFeedbackWeight and
+	// maxFeedbackWeight, so that no amount of feedback makes a persona say the same thing forever,
+	// or never say something at all.
+	maxFeedbackWeight = 4.0
+	// feedbackHalfLife is how long it takes for a weight to get halfway back to 1 on its own, so
+	// that what people liked a while ago matters less than what they like now.
+	feedbackHalfLife = 7 * 24 * time.Hour
+	// maxTrackedMessages is how many of the bot's messages' token paths are remembered. Reactions
+	// on older messages are ignored.
+	maxTrackedMessages = 1000
+)
+
+// transition is one word following another in generated text.
+type transition struct {
+	from, to string
+}
+
+// feedbackWeight is the log of how much a transition's odds are multiplied by, as of updated.
+// Keeping the log makes upvotes and downvotes cancel out, and makes decay a multiplication.
+type feedbackWeight struct {
+	log     float64
+	updated time.Time
+}
+
+// trackedMessage is a message that the bot posted, and what it needs to know to take feedback on
+// it.
+type trackedMessage struct {
+	persona string
+	path    []string
+	// IDs of the users who already left feedback on the message.
+	voters map[string]bool
+}
+
+// Feedback keeps track of the reactions that people leave on the bot's generated messages, and
+// turns them into weights for each persona's transitions. Upvotes make the transitions in a
+// message more likely, and downvotes make them less likely. Weights are bounded, and decay back
+// to 1 over time. It's safe for concurrent use.
+type Feedback struct {
+	mu sync.Mutex
+	// Each persona's transitions' weights, by persona name.
+	weights map[string]map[transition]feedbackWeight
+	// Messages that feedback may be left on, by message ID, and their IDs, oldest first.
+	tracked map[string]*trackedMessage
+	order   []string
+
+	// Used in tests instead of time.Now.
+	now func() time.Time
+}
+
+// NewFeedback returns a pointer to a new Feedback without any feedback in it.
+func NewFeedback() *Feedback {
+	return &Feedback{
+		weights: make(map[string]map[transition]feedbackWeight),
+		tracked: make(map[string]*trackedMessage),
+		now:     time.Now,
+	}
+}
+
+// Track remembers that the message with the provided ID was generated by the provided persona
+// through the provided path, so that reactions on it count as feedback. messageID should be
+// prefixed with the name of the chat service that it came from.
+func (f *Feedback) Track(messageID, persona string, path []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.tracked[messageID]; ok {
+		return
+	}
+	if len(f.order) == maxTrackedMessages {
+		delete(f.tracked, f.order[0])
+		f.order = f.order[1:]
+	}
+	f.tracked[messageID] = &trackedMessage{persona: persona, path: path,
+		voters: make(map[string]bool)}
+	f.order = append(f.order, messageID)
+}
+
+// Vote counts a user's reaction on a message as feedback on the transitions in it. Each user's
+// first vote on a message is the only one that counts. It returns the name of the persona that
+// generated the message, and whether the vote counted.
+func (f *Feedback) Vote(messageID, userID string, up bool) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	msg, ok := f.tracked[messageID]
+	if !ok || msg.voters[userID] {
+		return "", false
+	}
+	msg.voters[userID] = true
+
+	weights, ok := f.weights[msg.persona]
+	if !ok {
+		weights = make(map[transition]feedbackWeight)
+		f.weights[msg.persona] = weights
+	}
+	step, bound := math.Log(feedbackStep), math.Log(maxFeedbackWeight)
+	if !up {
+		step = -step
+	}
+	now := f.now()
+	for i := 0; i+1 < len(msg.path); i++ {
+		t := transition{from: msg.path[i], to: msg.path[i+1]}
+		w := decay(weights[t], now)
+		weights[t] = feedbackWeight{log: math.Max(-bound, math.Min(bound, w+step)), updated: now}
+	}
+	return msg.persona, true
+}
+
+// decay returns the log of a weight as of now.
+func decay(w feedbackWeight, now time.Time) float64 {
+	if w.log == 0 {
+		return 0
+	}
+	halfLives := float64(now.Sub(w.updated)) / float64(feedbackHalfLife)
+	return w.log * math.Pow(0.5, halfLives)
+}
+
+// Weight returns how much the odds of to following from are multiplied by when the provided
+// persona generates text, which is 1 for transitions that nobody left feedback on. It's meant for
+// GenerateOptions.Weight.
+func (f *Feedback) Weight(persona string) func(from, to string) float64 {
+	return func(from, to string) float64 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		w, ok := f.weights[persona][transition{from: from, to: to}]
+		if !ok {
+			return 1
+		}
+		return math.Exp(decay(w, f.now()))
+	}
+}
+
+// Reset forgets all of the feedback that the provided persona got, and returns how many
+// transitions had weights.
+func (f *Feedback) Reset(persona string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.weights[persona])
+	delete(f.weights, persona)
+	return n
+}
+
+// savedWeight is a transition's weight in a snapshot of a Feedback.
+type savedWeight struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Log     float64   `json:"log"`
+	Updated time.Time `json:"updated"`
+}
+
+// snapshot returns each persona's weights, by persona name. Weights are in order, so that the
+// same weights always make the same snapshot.
+func (f *Feedback) snapshot() map[string][]savedWeight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	snapshot := make(map[string][]savedWeight, len(f.weights))
+	for persona, weights := range f.weights {
+		saved := make([]savedWeight, 0, len(weights))
+		for t, w := range weights {
+			saved = append(saved, savedWeight{From: t.from, To: t.to, Log: w.log,
+				Updated: w.updated})
+		}
+		sort.Slice(saved, func(i, j int) bool {
+			if saved[i].From != saved[j].From {
+				return saved[i].From < saved[j].From
+			}
+			return saved[i].To < saved[j].To
+		})
+		snapshot[persona] = saved
+	}
+	return snapshot
+}
+
+// restore replaces the provided persona's weights with ones that snapshot returned.
+func (f *Feedback) restore(persona string, saved []savedWeight) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	weights := make(map[transition]feedbackWeight, len(saved))
+	for _, w := range saved {
+		weights[transition{from: w.From, to: w.To}] = feedbackWeight{log: w.Log,
+			updated: w.Updated}
+	}
+	f.weights[persona] = weights
+}
+
+// Reaction is an emoji reaction that a user left on a message.
+type Reaction struct {
+	MessageID string
+	ChannelID string
+	UserID    string
+	Emoji     string
+}
+
+// HandleReaction is called by a Platform every time someone reacts to a message in a channel that
+// the bot has access to. Upvotes and downvotes on the bot's generated messages are taken as
+// feedback.
+func (b *Bot) HandleReaction(p Platform, r Reaction) {
+	if r.UserID == p.SelfID() || (r.Emoji != upvoteEmoji && r.Emoji != downvoteEmoji) {
+		return
+	}
+	up := r.Emoji == upvoteEmoji
+	persona, ok := b.feedback.Vote(platformID(p, r.MessageID), platformID(p, r.UserID), up)
+	if !ok {
+		return
+	}
+	vote := "down"
+	if up {
+		vote = "up"
+	}
+	metrics.feedback.WithLabelValues(persona, vote).Inc()
+}
+
+// feedbackCommand responds to a bot invocation like "!botname feedback reset shakespeare", which
+// forgets the feedback that a persona got. If no persona is named, the default one's is
+// forgotten. By default, only admins may use it.
+func (b *Bot) feedbackCommand(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s reset [persona]`", b.invocation(p, m), feedbackCmd)
+	if len(arguments) == 0 || arguments[0] != "reset" {
+		p.Reply(m.Context(), m.ChannelID, usage)
+		return outcomeInvalid
+	}
+	name := ""
+	if len(arguments) > 1 {
+		name = arguments[1]
+	}
+	persona, ok := b.personas.Get(name)
+	if !ok {
+		p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("There's no persona named %q", name))
+		return outcomeInvalid
+	}
+	n := b.feedback.Reset(persona.Name)
+	p.Reply(m.Context(), m.ChannelID,
+		fmt.Sprintf("Forgot the feedback on %d transitions for %s", n, persona.Name))
+	return outcomeOK
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestFeedbackVotes makes sure that votes reweight the transitions in the message that they were
+// left on, that each user only gets one vote per message, and that weights stay bounded.
+func TestFeedbackVotes(t *testing.T) {
+	f := NewFeedback()
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	f.Track("up", "persona", []string{"the", "cat", "\n", "the"})
+	f.Track("down", "persona", []string{"the", "dog"})
+	weight := f.Weight("persona")
+
+	if persona, ok := f.Vote("up", "alice", true); !ok || persona != "persona" {
+		t.Fatalf("Expected alice's vote to count for persona. got: %q, %t\n", persona, ok)
+	}
+	if _, ok := f.Vote("up", "alice", false); ok {
+		t.Errorf("Expected alice's second vote on the same message not to count\n")
+	}
+	if _, ok := f.Vote("untracked", "alice", true); ok {
+		t.Errorf("Expected a vote on an untracked message not to count\n")
+	}
+	f.Vote("down", "alice", false)
+
+	for _, tc := range []struct {
+		from, to string
+		want     float64
+	}{
+		{"the", "cat", feedbackStep},
+		{"cat", "\n", feedbackStep},
+		{"\n", "the", feedbackStep},
+		{"the", "dog", 1 / feedbackStep},
+		{"the", "mat", 1},
+	} {
+		if got := weight(tc.from, tc.to); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("Unexpected weight for %q -> %q. got: %v, want: %v\n", tc.from, tc.to, got,
+				tc.want)
+		}
+	}
+	if got := f.Weight("other")("the", "cat"); got != 1 {
+		t.Errorf("Expected feedback to stick to its persona. got: %v, want: 1\n", got)
+	}
+
+	// No matter how many people vote, weights don't go past their bounds.
+	for i := 0; i < 100; i++ {
+		f.Vote("up", strconv.Itoa(i), true)
+		f.Vote("down", strconv.Itoa(i), false)
+	}
+	if got := weight("the", "cat"); math.Abs(got-maxFeedbackWeight) > 1e-9 {
+		t.Errorf("Unexpected upper bound. got: %v, want: %v\n", got, maxFeedbackWeight)
+	}
+	if got := weight("the", "dog"); math.Abs(got-1/maxFeedbackWeight) > 1e-9 {
+		t.Errorf("Unexpected lower bound. got: %v, want: %v\n", got, 1/maxFeedbackWeight)
+	}
+}
+
+// TestFeedbackDecay makes sure that weights make their way back to 1 over time.
+func TestFeedbackDecay(t *testing.T) {
+	f := NewFeedback()
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	f.Track("message", "persona", []string{"the", "cat"})
+	for i := 0; i < 100; i++ {
+		f.Vote("message", strconv.Itoa(i), true)
+	}
+	weight := f.Weight("persona")
+
+	now = now.Add(feedbackHalfLife)
+	got, want := weight("the", "cat"), math.Sqrt(maxFeedbackWeight)
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("Unexpected weight after one half-life. got: %v, want: %v\n", got, want)
+	}
+	now = now.Add(100 * feedbackHalfLife)
+	if got := weight("the", "cat"); math.Abs(got-1) > 1e-9 {
+		t.Errorf("Unexpected weight after a long time. got: %v, want: 1\n", got)
+	}
+}
+
+// TestFeedbackTracking makes sure that only the most recent messages are remembered.
+func TestFeedbackTracking(t *testing.T) {
+	f := NewFeedback()
+	for i := 0; i <= maxTrackedMessages; i++ {
+		f.Track(strconv.Itoa(i), "persona", []string{"the", "cat"})
+	}
+	if _, ok := f.Vote("0", "alice", true); ok {
+		t.Errorf("Expected the oldest message to be forgotten\n")
+	}
+	if _, ok := f.Vote(strconv.Itoa(maxTrackedMessages), "alice", true); !ok {
+		t.Errorf("Expected the newest message to be remembered\n")
+	}
+}
+
+// TestHandleReaction makes sure that reactions on generated messages count as feedback, and that
+// admins can reset it.
+func TestHandleReaction(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("feedback", "!", hmm)
+	bot.limiter = NewLimiter(LimiterConfig{Admins: []string{"fake/admin"}})
+	p := newTrackingPlatform("botID")
+	upvotes := metrics.feedback.WithLabelValues("feedback", "up")
+	before := testutil.ToFloat64(upvotes)
+
+	bot.HandleMessage(p, &Message{Author: User{ID: "someone"}, Content: "!feedback quick 3"})
+	if postedMsg != "quick brown fox" {
+		t.Fatalf("Unexpected message. got: %q, want: %q\n", postedMsg, "quick brown fox")
+	}
+	// The bot's own reactions, and reactions that aren't votes, don't count.
+	bot.HandleReaction(p, Reaction{MessageID: "posted", UserID: "botID", Emoji: upvoteEmoji})
+	bot.HandleReaction(p, Reaction{MessageID: "posted", UserID: "someone", Emoji: "🦊"})
+	bot.HandleReaction(p, Reaction{MessageID: "posted", UserID: "someone", Emoji: upvoteEmoji})
+	if got := testutil.ToFloat64(upvotes) - before; got != 1 {
+		t.Errorf("Unexpected number of upvotes. got: %v, want: 1\n", got)
+	}
+	// Weights start decaying right away, so allow for a little bit of that.
+	got := bot.feedback.Weight("feedback")("quick", "brown")
+	if math.Abs(got-feedbackStep) > 1e-6 {
+		t.Errorf("Unexpected weight. got: %v, want: %v\n", got, feedbackStep)
+	}
+
+	tests := []struct {
+		name    string
+		userID  string
+		content string
+		want    string
+	}{
+		{"no subcommand", "admin", "!feedback feedback", "Example usage: `!feedback feedback reset" +
+			" [persona]`"},
+		{"not an admin", "someone", "!feedback feedback reset", "Sorry, only my owners can use feedback here"},
+		{"unknown persona", "admin", "!feedback feedback reset nobody",
+			`There's no persona named "nobody"`},
+		{"reset", "admin", "!feedback feedback reset",
+			"Forgot the feedback on 2 transitions for feedback"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bot.HandleMessage(p, &Message{Author: User{ID: tc.userID}, Content: tc.content})
+			if postedMsg != tc.want {
+				t.Errorf("Unexpected reply. got: %q, want: %q\n", postedMsg, tc.want)
+			}
+		})
+	}
+	if got := bot.feedback.Weight("feedback")("quick", "brown"); got != 1 {
+		t.Errorf("Expected the feedback to be forgotten. got: %v, want: 1\n", got)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+}
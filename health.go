@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultStallTimeout is how long the Discord gateway can go without acknowledging a heartbeat
+// before the bot counts as stuck, unless the config says otherwise. Discord asks for a heartbeat
+// about every 41 seconds, so this leaves room for a couple of slow ones.
+const defaultStallTimeout = 2 * time.Minute
+
+// Health keeps track of checks that tell whether the bot is alive, and whether it's ready to answer
+// messages, so that container platforms can probe them. If a liveness check fails, the bot is
+// stuck and should be restarted. If a readiness check fails, the bot can't do its job right now,
+// but might be able to soon, like while it's reconnecting. It's safe for concurrent use.
+type Health struct {
+	mu        sync.Mutex
+	liveness  []healthCheck
+	readiness []healthCheck
+}
+
+// healthCheck is a named check. check returns an error that explains what's wrong, if anything is.
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// NewHealth returns a pointer to a new Health without any checks.
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddLiveness adds a check that /healthz runs.
+func (h *Health) AddLiveness(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.liveness = append(h.liveness, healthCheck{name: name, check: check})
+}
+
+// AddReadiness adds a check that /readyz runs.
+func (h *Health) AddReadiness(name string, check func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readiness = append(h.readiness, healthCheck{name: name, check: check})
+}
+
+// Handler returns an http.Handler which serves the liveness checks on /healthz, and the readiness
+// checks on /readyz.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		checks := h.liveness
+		h.mu.Unlock()
+		serveChecks(w, checks)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		checks := h.readiness
+		h.mu.Unlock()
+		serveChecks(w, checks)
+	})
+	return mux
+}
+
+// serveChecks runs the provided checks, and writes how each one went on its own line, like
+// "[+]discord ok" or "[-]discord failed: session is disconnected". The response's status is 503
+// if any of them failed, and 200 otherwise.
+func serveChecks(w http.ResponseWriter, checks []healthCheck) {
+	status := http.StatusOK
+	var body string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			body += fmt.Sprintf("[-]%s failed: %v\n", c.name, err)
+		} else {
+			body += fmt.Sprintf("[+]%s ok\n", c.name)
+		}
+	}
+	if status == http.StatusOK {
+		body += "ok\n"
+	} else {
+		body += "failed\n"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	fmt.Fprint(w, body)
+}
+
+// healthService serves a Health's checks on /healthz and /readyz.
+type healthService struct {
+	addr   string
+	health *Health
+}
+
+// Name returns "health".
+func (s *healthService) Name() string {
+	return "health"
+}
+
+// Run serves health checks until ctx is done.
+func (s *healthService) Run(ctx context.Context, ready func()) error {
+	slog.Info("Serving health checks", "addr", s.addr, "paths", "/healthz, /readyz")
+	return serveHTTP(ctx, s.addr, s.health.Handler(), ready)
+}
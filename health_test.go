@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHealth makes sure that /healthz and /readyz run their own checks, and fail if any of them
+// does.
+func TestHealth(t *testing.T) {
+	health := NewHealth()
+	var disconnected bool
+	health.AddLiveness("loop", func() error { return nil })
+	health.AddReadiness("models", func() error { return nil })
+	health.AddReadiness("discord", func() error {
+		if disconnected {
+			return errors.New("session is disconnected")
+		}
+		return nil
+	})
+
+	for _, tc := range []struct {
+		path         string
+		disconnected bool
+		wantStatus   int
+		wantBody     string
+	}{
+		{"/healthz", false, http.StatusOK, "[+]loop ok\nok\n"},
+		{"/readyz", false, http.StatusOK, "[+]models ok\n[+]discord ok\nok\n"},
+		{"/healthz", true, http.StatusOK, "[+]loop ok\nok\n"},
+		{"/readyz", true, http.StatusServiceUnavailable,
+			"[+]models ok\n[-]discord failed: session is disconnected\nfailed\n"},
+	} {
+		disconnected = tc.disconnected
+		rec := httptest.NewRecorder()
+		health.Handler().ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if rec.Code != tc.wantStatus {
+			t.Errorf("Unexpected status from %s. got: %d, want: %d\n", tc.path, rec.Code,
+				tc.wantStatus)
+		}
+		if got := rec.Body.String(); got != tc.wantBody {
+			t.Errorf("Unexpected body from %s.\ngot:\n%s\nwant:\n%s\n", tc.path, got, tc.wantBody)
+		}
+	}
+}
+
+// TestCheckModels makes sure that personas only count as ready once there's at least one, and
+// every one of them has a model.
+func TestCheckModels(t *testing.T) {
+	personas := NewPersonas()
+	if err := personas.checkModels(); err == nil {
+		t.Errorf("Expected an error without any personas\n")
+	}
+	hmm, _ := NewHMM("roll up and roll out\n", 5)
+	personas.Replace(&Persona{Name: "foo", HMM: hmm}, &Persona{Name: "bar"})
+	err := personas.checkModels()
+	if err == nil || err.Error() != `persona "bar" doesn't have a model` {
+		t.Errorf("Unexpected error with a persona that's missing a model: %v\n", err)
+	}
+	personas.Replace(&Persona{Name: "foo", HMM: hmm})
+	if err = personas.checkModels(); err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
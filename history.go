@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxMessagesPerPage is the largest number of messages that Discord's REST API hands back from a
+// single message history request.
+const maxMessagesPerPage = 100
+
+// maxHistoryPages caps how many pages of channel history are walked through while looking for
+// messages. Without it, asking for the messages of someone who rarely talks could crawl through a
+// channel's entire history.
+const maxHistoryPages = 20
+
+// HistoryFetcher describes objects which retrieve the contents of recent messages posted in a
+// channel. This type exists mainly so that the Discord REST API can be swapped out in tests.
+type HistoryFetcher interface {
+	// FetchMessages returns the contents of up to limit of the most recent messages in the
+	// provided channel, newest first. Only messages whose author's ID is accepted by include are
+	// returned.
+	FetchMessages(channelID string, limit int, include func(authorID string) bool) ([]string, error)
+}
+
+// discordHistoryFetcher is a HistoryFetcher which pages through a channel's message history with
+// Discord's REST API.
+type discordHistoryFetcher struct {
+	session *discordgo.Session
+}
+
+// FetchMessages walks backwards through the provided channel's history one page at a time until it
+// has found enough messages, it runs out of history, or it hits maxHistoryPages.
+func (f *discordHistoryFetcher) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	var contents []string
+	beforeID := ""
+
+	for page := 0; page < maxHistoryPages && len(contents) < limit; page++ {
+		msgs, err := f.session.ChannelMessages(channelID, maxMessagesPerPage, beforeID, "", "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range msgs {
+			if len(contents) == limit {
+				break
+			}
+			if msg.Author == nil || !include(msg.Author.ID) {
+				continue
+			}
+			if content := strings.TrimSpace(msg.Content); content != "" {
+				contents = append(contents, content)
+			}
+		}
+
+		// A short page means that we've reached the beginning of the channel.
+		if len(msgs) < maxMessagesPerPage {
+			break
+		}
+		beforeID = msgs[len(msgs)-1].ID
+	}
+
+	return contents, nil
+}
+
+// buildCorpus stitches a collection of messages together into something that NewHMM() can train
+// on. Each message is treated like its own line in a corpus file.
+//
+// Messages that invoke the bot are skipped so that the bot doesn't end up imitating its own
+// commands.
+func buildCorpus(msgs []string, invocation string) string {
+	var lines []string
+	for _, msg := range msgs {
+		if strings.HasPrefix(msg, invocation) {
+			continue
+		}
+		lines = append(lines, msg)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+
+	// Ending the corpus with a newline char guarantees that the HMM can always reach the end of a
+	// sentence, which GenerateSpeech() relies on to stop.
+	return strings.Join(lines, "\n") + "\n"
+}
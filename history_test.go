@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// TestFetchMessages makes sure that discordHistoryFetcher pages through a channel's history, only
+// keeps messages from the requested user, and stops once it has enough of them.
+func TestFetchMessages(t *testing.T) {
+	fake := newFakeDiscord(t)
+	channelID := "channel"
+	// Interleave two users' messages across multiple pages of history.
+	for i := 0; i < 150; i++ {
+		fake.addMessages(channelID, "alice", fmt.Sprintf("alice %d", i))
+		fake.addMessages(channelID, "bob", fmt.Sprintf("bob %d", i))
+	}
+	dg, _ := discordgo.New("Bot token")
+	fetcher := &discordHistoryFetcher{session: dg}
+
+	tests := []struct {
+		userID      string
+		limit       int
+		numMsgsWant int
+		newestWant  string
+	}{
+		{"alice", 10, 10, "alice 149"},
+		{"bob", 120, 120, "bob 149"},
+		{"alice", 500, 150, "alice 149"},
+		{"", 5, 5, "bob 149"},
+		{"carol", 10, 0, ""},
+	}
+	for _, c := range tests {
+		include := func(authorID string) bool { return c.userID == "" || authorID == c.userID }
+		got, err := fetcher.FetchMessages(channelID, c.limit, include)
+		if err != nil {
+			t.Fatalf("Unexpected error while fetching messages: %v\n", err)
+		}
+		if len(got) != c.numMsgsWant {
+			t.Errorf("Unexpected number of messages for user %q. got: %d, want: %d\n",
+				c.userID, len(got), c.numMsgsWant)
+			continue
+		}
+		if len(got) > 0 && got[0] != c.newestWant {
+			t.Errorf("Unexpected newest message. got: %q, want: %q\n", got[0], c.newestWant)
+		}
+		for _, msg := range got {
+			if c.userID != "" && !strings.HasPrefix(msg, c.userID) {
+				t.Errorf("Fetched a message that wasn't posted by %q: %q\n", c.userID, msg)
+			}
+		}
+	}
+}
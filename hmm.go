@@ -1,18 +1,36 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // Custom errors
 var (
 	ErrEmtpyCorpus   = errors.New("corpus cannot be an empty string")
+	ErrNoWords       = errors.New("corpus doesn't have any words in it")
+	ErrNoTransitions = errors.New("corpus needs at least one word that's followed by another")
 	ErrNegMaxRetries = errors.New("maxRetries must be greater than 0")
+	ErrBadModelFile  = errors.New("not a model file that this version of the bot can read")
+	ErrBadOrder      = fmt.Errorf("order must be between 1 and %d", maxOrder)
 )
 
+// modelFileVersion is bumped every time the model file format changes in a way that older
+// versions of the bot can't read.
+const modelFileVersion = 1
+
+// maxOrder is the most previous words that an HMM can take into account when picking the next
+// one. Past this point, models mostly just recite their corpus.
+const maxOrder = 5
+
 // HMM generates pieces of text with the same vocabulary and sentence structure as a corpus file. A
 // hidden Markov model is used to generate content.
 type HMM struct {
@@ -28,6 +46,22 @@ type HMM struct {
 	// List of words that appear at the beginning of new lines in the corpus.
 	firstWords []string
 
+	// The same information as probMap, but with each word's successors sorted from most to least
+	// likely, and ties broken alphabetically. Unlike ranging over a map, this order doesn't change
+	// from run to run, which is what makes seeded generation repeatable.
+	successors map[string][]successor
+	// Every key in probMap, sorted.
+	vocab []string
+
+	// How many of the previous words are taken into account when picking the next one. An HMM of
+	// order 1 only looks at the current word.
+	order int
+	// The words that follow each run of 2 to order words in the corpus, and the odds that they do.
+	// Runs are keyed by their words joined with spaces. Only used by Generate().
+	contextProbs map[string]map[string]float64
+	// The same information as contextProbs, sorted like successors.
+	contexts map[string][]successor
+
 	// The max number of times that speech generation is allowed to restart.See GenerateSpeech() for
 	// more details.
 	maxRetries int
@@ -35,24 +69,47 @@ type HMM struct {
 
 // NewHMM returns a new HMM with fields populated based on the provided corpus file.
 func NewHMM(corpus string, maxRetries int) (*HMM, error) {
+	return NewHMMOfOrder(corpus, maxRetries, 1)
+}
+
+// NewHMMOfOrder returns a new HMM like NewHMM() does, but one that takes up to order previous words
+// into account when Generate() picks the next word.
+func NewHMMOfOrder(corpus string, maxRetries, order int) (*HMM, error) {
 	if len(corpus) < 1 {
 		return nil, ErrEmtpyCorpus
 	}
 	if maxRetries < 1 {
 		return nil, ErrNegMaxRetries
 	}
+	if order < 1 || order > maxOrder {
+		return nil, ErrBadOrder
+	}
 
 	words := getWords(corpus)
+	if len(words) == 0 {
+		return nil, ErrNoWords
+	}
 	probMap, firstWords := buildHMMFields(words)
+	if err := checkModel(probMap, firstWords); err != nil {
+		return nil, err
+	}
+	successors, vocab := sortSuccessors(probMap)
+	contextProbs := buildContexts(words, order)
+	contexts, _ := sortSuccessors(contextProbs)
 
 	// Seed the pseudo-random number generator once on this HMM object's initialization before
 	// generating any numbers.
 	rand.Seed(time.Now().UnixNano())
 
 	return &HMM{
-		probMap:    probMap,
-		firstWords: firstWords,
-		maxRetries: maxRetries,
+		probMap:      probMap,
+		firstWords:   firstWords,
+		successors:   successors,
+		vocab:        vocab,
+		order:        order,
+		contextProbs: contextProbs,
+		contexts:     contexts,
+		maxRetries:   maxRetries,
 	}, nil
 }
 
@@ -152,6 +209,256 @@ func (h *HMM) GenerateSpeechBeginningWithWordAndWithNumWords(firstWord string, n
 	return strings.TrimSpace(output)
 }
 
+// modelFile is how an HMM is stored in a model file.
+type modelFile struct {
+	Version    int                           `json:"version"`
+	MaxRetries int                           `json:"max_retries"`
+	FirstWords []string                      `json:"first_words"`
+	ProbMap    map[string]map[string]float64 `json:"transitions"`
+	// Model files that were written before HMMs had orders leave these out, and are of order 1.
+	Order    int                           `json:"order,omitempty"`
+	Contexts map[string]map[string]float64 `json:"contexts,omitempty"`
+}
+
+// Save writes the HMM to w as a model file, which LoadHMM() can read back in. Training an HMM on a
+// big corpus takes a while, and loading a model file doesn't.
+func (h *HMM) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(modelFile{
+		Version:    modelFileVersion,
+		MaxRetries: h.maxRetries,
+		FirstWords: h.firstWords,
+		ProbMap:    h.probMap,
+		Order:      h.order,
+		Contexts:   h.contextProbs,
+	})
+}
+
+// LoadHMM reads an HMM from a model file that HMM.Save() wrote.
+func LoadHMM(r io.Reader) (*HMM, error) {
+	var file modelFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version != modelFileVersion {
+		return nil, ErrBadModelFile
+	}
+	if err := checkModel(file.ProbMap, file.FirstWords); err != nil {
+		return nil, err
+	}
+	if file.MaxRetries < 1 {
+		return nil, ErrNegMaxRetries
+	}
+	if file.Order == 0 {
+		file.Order = 1
+	}
+	if file.Order > maxOrder {
+		return nil, ErrBadOrder
+	}
+
+	successors, vocab := sortSuccessors(file.ProbMap)
+	contexts, _ := sortSuccessors(file.Contexts)
+	return &HMM{
+		probMap:      file.ProbMap,
+		firstWords:   file.FirstWords,
+		successors:   successors,
+		vocab:        vocab,
+		order:        file.Order,
+		contextProbs: file.Contexts,
+		contexts:     contexts,
+		maxRetries:   file.MaxRetries,
+	}, nil
+}
+
+// checkModel makes sure that a model has something to generate: a word that a sentence begins with
+// other than a line break, and a word that's followed by another one. Without them, generation
+// would have nowhere to start or nowhere to go.
+func checkModel(probMap map[string]map[string]float64, firstWords []string) error {
+	words := false
+	for _, word := range firstWords {
+		words = words || word != "\n"
+	}
+	if !words {
+		return ErrNoWords
+	}
+	if len(probMap) == 0 {
+		return ErrNoTransitions
+	}
+	return nil
+}
+
+// GenerateOptions describe a piece of text for HMM.Generate() to generate. The zero value asks for
+// the same kind of text that GenerateSpeech() returns.
+type GenerateOptions struct {
+	// The word to kick off generation with. If it's empty, a word from the collection of words at
+	// the beginning of sentences in the corpus is randomly chosen.
+	Start string
+	// If After isn't empty, generation picks up where text that ended with those words left off,
+	// like they're the path of an earlier Generation. They're taken into account, but they aren't
+	// part of the text, and Start is ignored.
+	After []string
+	// If Words is greater than 0, exactly that many words are generated. Otherwise, sentences are
+	// generated until the HMM runs out of retries, like GenerateSpeech() does.
+	Words int
+	// If Chars is greater than 0, generation stops before the text gets longer than that many
+	// characters.
+	Chars int
+	// Seed for the pseudo-random number generator. The same options and the same corpus always
+	// generate the same text. If Seed is 0, a seed is picked at random.
+	Seed int64
+	// Temperature reshapes the odds of which word comes next. Below 1, likely words become even
+	// more likely. Above 1, the odds even out. 0 is the same as 1.
+	Temperature float64
+	// If TopK is greater than 0, only the TopK most likely words are considered for what comes
+	// next.
+	TopK int
+	// If Weight isn't nil, the odds that a word comes next are multiplied by what it returns for
+	// the word before it and that word. It's how feedback nudges generation.
+	Weight func(from, to string) float64
+}
+
+// Generation is a piece of text that HMM.Generate() generated.
+type Generation struct {
+	Text string
+	// The seed that the text was generated with, which is handy when one was picked at random.
+	Seed int64
+	// Number of words in the text.
+	Tokens int
+	// Every word that was picked, in order, including the line breaks between sentences. Each
+	// word and the one after it make up a transition that generation went through.
+	Path []string
+}
+
+// Generate returns a piece of generated text, as described by the provided options.
+func (h *HMM) Generate(opts GenerateOptions) Generation {
+	seed := opts.Seed
+	for seed == 0 {
+		seed = rand.Int63()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	temperature := opts.Temperature
+	if temperature <= 0 {
+		temperature = 1
+	}
+
+	// The last few words that were picked, which HMMs of higher orders take into account.
+	history := make([]string, 0, h.order)
+	var curWord string
+	if len(opts.After) > 0 {
+		after := opts.After
+		if len(after) > h.order {
+			after = after[len(after)-h.order:]
+		}
+		history = append(history, after...)
+		curWord = h.sampleNextWord(rng, history, temperature, opts.TopK, opts.Weight)
+	} else {
+		curWord = strings.ToLower(opts.Start)
+		if curWord == "" {
+			curWord = h.firstWords[rng.Intn(len(h.firstWords))]
+		}
+	}
+	var speech, path []string
+	tokens, chars, retries := 0, 0, 0
+	for {
+		// Account for the space that goes in front of every word but the first. Line breaks are
+		// joined to the text with a space too.
+		length := utf8.RuneCountInString(curWord)
+		if chars > 0 {
+			length++
+		}
+		if curWord != "\n" {
+			if opts.Chars > 0 && chars+length > opts.Chars {
+				break
+			}
+			speech = append(speech, curWord)
+			path = append(path, curWord)
+			tokens++
+			chars += length
+			if opts.Words > 0 && tokens == opts.Words {
+				break
+			}
+			// A corpus without any line breaks would otherwise never run out of retries.
+			if tokens == maxNumWords {
+				break
+			}
+		} else if opts.Words <= 0 {
+			if opts.Chars > 0 && chars+length > opts.Chars {
+				break
+			}
+			speech = append(speech, curWord)
+			path = append(path, curWord)
+			chars += length
+			retries += rng.Intn(2) + 1 // Generate int in range: [1, 3]
+			if retries >= h.maxRetries {
+				break
+			}
+		} else {
+			// Line breaks are left out of the text when a number of words was asked for, but
+			// generation still goes through them.
+			path = append(path, curWord)
+		}
+		if len(history) == h.order {
+			history = history[1:]
+		}
+		history = append(history, curWord)
+		next := h.sampleNextWord(rng, history, temperature, opts.TopK, opts.Weight)
+		// Line breaks don't count toward Words, so a run of blank lines that sampling keeps
+		// picking would never end. The next sentence is started from scratch instead.
+		if opts.Words > 0 && curWord == "\n" && next == "\n" {
+			next = h.sentenceStart(rng)
+		}
+		curWord = next
+	}
+
+	output := strings.Join(speech, " ")
+	return Generation{Text: strings.TrimSpace(output), Seed: seed, Tokens: tokens, Path: path}
+}
+
+// sentenceStart picks one of the words that sentences in the corpus begin with at random, skipping
+// the line breaks that blank lines begin with.
+func (h *HMM) sentenceStart(rng *rand.Rand) string {
+	var starts []string
+	for _, word := range h.firstWords {
+		if word != "\n" {
+			starts = append(starts, word)
+		}
+	}
+	if len(starts) == 0 {
+		return h.vocab[rng.Intn(len(h.vocab))]
+	}
+	return starts[rng.Intn(len(starts))]
+}
+
+// HMMStats describe the size of an HMM.
+type HMMStats struct {
+	// Number of unique words in the corpus.
+	Words int
+	// Number of unique pairs of words where one follows the other.
+	Transitions int
+	// Number of unique words that sentences begin with.
+	SentenceStarts int
+}
+
+// Stats returns stats about the HMM.
+func (h *HMM) Stats() HMMStats {
+	words := make(map[string]bool)
+	transitions := 0
+	for cur, successors := range h.probMap {
+		words[cur] = true
+		for successor := range successors {
+			words[successor] = true
+			transitions++
+		}
+	}
+	delete(words, "\n")
+
+	starts := make(map[string]bool)
+	for _, word := range h.firstWords {
+		starts[word] = true
+	}
+
+	return HMMStats{Words: len(words), Transitions: transitions, SentenceStarts: len(starts)}
+}
+
 // getWords performs input sanitization on the provided string, and splits it up into a slice of
 // words.
 //
@@ -210,6 +517,34 @@ func buildHMMFields(words []string) (map[string]map[string]float64, []string) {
 	return probMap, firstWords
 }
 
+// buildContexts builds an HMM's contextProbs field from a provided slice of words. Runs of words
+// are only counted up to the provided order, so an HMM of order 1 doesn't get any.
+func buildContexts(words []string, order int) map[string]map[string]float64 {
+	freqMap := make(map[string]map[string]int)
+	for n := 2; n <= order; n++ {
+		for i := 0; i+n < len(words); i++ {
+			context := strings.Join(words[i:i+n], " ")
+			if _, ok := freqMap[context]; !ok {
+				freqMap[context] = make(map[string]int)
+			}
+			freqMap[context][words[i+n]]++
+		}
+	}
+
+	contextProbs := make(map[string]map[string]float64, len(freqMap))
+	for context, successors := range freqMap {
+		total := 0
+		for _, freq := range successors {
+			total += freq
+		}
+		contextProbs[context] = make(map[string]float64, len(successors))
+		for successor, freq := range successors {
+			contextProbs[context][successor] = float64(freq) / float64(total)
+		}
+	}
+	return contextProbs
+}
+
 // getNextWord consults the provided probMap to pick the next word that should follow the provided
 // curWord like a hidden Markov model would.
 func getNextWord(curWord string, probMap map[string]map[string]float64) string {
@@ -234,3 +569,72 @@ func getNextWord(curWord string, probMap map[string]map[string]float64) string {
 	}
 	return probMapKeps[rand.Intn(n)]
 }
+
+// successor is a word that follows some other word, and the odds that it does.
+type successor struct {
+	word string
+	prob float64
+}
+
+// sortSuccessors builds an HMM's successors and vocab fields from its probMap.
+func sortSuccessors(probMap map[string]map[string]float64) (map[string][]successor, []string) {
+	successors := make(map[string][]successor, len(probMap))
+	vocab := make([]string, 0, len(probMap))
+	for cur, probs := range probMap {
+		vocab = append(vocab, cur)
+		sorted := make([]successor, 0, len(probs))
+		for word, prob := range probs {
+			sorted = append(sorted, successor{word, prob})
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].prob != sorted[j].prob {
+				return sorted[i].prob > sorted[j].prob
+			}
+			return sorted[i].word < sorted[j].word
+		})
+		successors[cur] = sorted
+	}
+	sort.Strings(vocab)
+	return successors, vocab
+}
+
+// sampleNextWord picks the next word that should follow the last word in history, like
+// getNextWord() does, but with the provided pseudo-random number generator and sampling params. The
+// longest run of words at the end of history that appears in the corpus decides what can come
+// next.
+func (h *HMM) sampleNextWord(rng *rand.Rand, history []string, temperature float64, topK int,
+	weight func(from, to string) float64) string {
+	candidates, ok := h.successors[history[len(history)-1]]
+	for n := len(history); n > 1; n-- {
+		if context, found := h.contexts[strings.Join(history[len(history)-n:], " ")]; found {
+			candidates, ok = context, true
+			break
+		}
+	}
+	if !ok {
+		// If the provided curWord isn't in the HMM, then pick a starting word at random.
+		return h.vocab[rng.Intn(len(h.vocab))]
+	}
+	if topK > 0 && topK < len(candidates) {
+		candidates = candidates[:topK]
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	prev := history[len(history)-1]
+	for i, candidate := range candidates {
+		weights[i] = math.Pow(candidate.prob, 1/temperature)
+		if weight != nil {
+			weights[i] *= weight(prev, candidate.word)
+		}
+		total += weights[i]
+	}
+	r := rng.Float64() * total
+	for i, weight := range weights {
+		r -= weight
+		if r < 0 {
+			return candidates[i].word
+		}
+	}
+	return candidates[len(candidates)-1].word
+}
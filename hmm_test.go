@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // TestHMMCreation makes sure that NewHMM() is returning HMM structs with expected fields. In other
@@ -58,6 +61,9 @@ func TestHMMCreation(t *testing.T) {
 			[]string{},
 			ErrEmtpyCorpus,
 		},
+		{"   ", 10, nil, nil, ErrNoWords},
+		{" \n \n\n", 10, nil, nil, ErrNoWords},
+		{"foo", 10, nil, nil, ErrNoTransitions},
 		{
 			"foo",
 			-1,
@@ -258,3 +264,189 @@ func TestGenerateSpeechBeginningWithWordAndWithNumWords(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerate(t *testing.T) {
+	corpus := "the cat sat on the mat\nthe dog sat on the log\nthe cat ran off\n"
+	hmm, _ := NewHMM(corpus, 20)
+
+	tests := []struct {
+		name         string
+		opts         GenerateOptions
+		numWordsWant int
+		maxChars     int
+		startWant    string
+	}{
+		{"words", GenerateOptions{Words: 42, Seed: 1}, 42, 0, ""},
+		{"start", GenerateOptions{Start: "Dog", Words: 5, Seed: 2}, 5, 0, "dog"},
+		{"chars", GenerateOptions{Words: 100, Chars: 30, Seed: 3}, -1, 30, ""},
+		{"top k", GenerateOptions{Words: 10, TopK: 1, Seed: 4}, 10, 0, ""},
+		{"temperature", GenerateOptions{Words: 10, Temperature: 2.5, Seed: 5}, 10, 0, ""},
+		{"sentences", GenerateOptions{Seed: 6}, -1, 0, ""},
+	}
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			gen := hmm.Generate(c.opts)
+			words := strings.Fields(gen.Text)
+			if gen.Seed != c.opts.Seed {
+				t.Errorf("Unexpected seed. got: %d, want: %d\n", gen.Seed, c.opts.Seed)
+			}
+			if gen.Tokens != len(words) {
+				t.Errorf("Unexpected token count. got: %d, want: %d\n", gen.Tokens, len(words))
+			}
+			if c.numWordsWant >= 0 && len(words) != c.numWordsWant {
+				t.Errorf("Unexpected speech length. got: %d, want: %d\n", len(words),
+					c.numWordsWant)
+			}
+			if c.maxChars > 0 && (len(gen.Text) > c.maxChars || len(gen.Text) < c.maxChars-4) {
+				t.Errorf("Speech isn't as close to %d chars as it could be: %q\n", c.maxChars,
+					gen.Text)
+			}
+			if c.startWant != "" && words[0] != c.startWant {
+				t.Errorf("Unexpected first word. got: %q, want: %q\n", words[0], c.startWant)
+			}
+			for _, word := range words {
+				if !strings.Contains(corpus, word) {
+					t.Errorf("Speech contains a word that isn't in the corpus: %q\n", word)
+				}
+			}
+
+			// The same seed always generates the same text.
+			if again := hmm.Generate(c.opts); !reflect.DeepEqual(again, gen) {
+				t.Errorf("Same seed generated different speech.\nfirst: %+v\nsecond: %+v\n", gen,
+					again)
+			}
+		})
+	}
+
+	// With only the most likely word to pick from, "the" is always followed by "cat".
+	gen := hmm.Generate(GenerateOptions{Start: "the", Words: 2, TopK: 1})
+	if gen.Text != "the cat" {
+		t.Errorf("Unexpected speech with top k of 1. got: %q, want: %q\n", gen.Text, "the cat")
+	}
+	if gen.Seed == 0 {
+		t.Errorf("Expected a random seed to be picked\n")
+	}
+}
+
+// TestGenerateCharsWithLineBreaks makes sure that the line breaks between sentences count toward
+// the chars limit.
+func TestGenerateCharsWithLineBreaks(t *testing.T) {
+	hmm, _ := NewHMM("the lazy dog\nthe dog\n", 20)
+	for seed := int64(1); seed <= 200; seed++ {
+		gen := hmm.Generate(GenerateOptions{Chars: 20, Seed: seed})
+		if chars := utf8.RuneCountInString(gen.Text); chars > 20 {
+			t.Fatalf("Speech generated with seed %d is %d chars long: %q\n", seed, chars,
+				gen.Text)
+		}
+	}
+}
+
+// TestGenerateBlankLines makes sure that generation with a number of words in mind doesn't get
+// stuck going from one line break to the next when the corpus has runs of blank lines, and greedy
+// sampling always picks another line break.
+func TestGenerateBlankLines(t *testing.T) {
+	hmm, _ := NewHMM("the cat sat\n\n\n\n\nthe dog ran\n\n\n\n\n", 20)
+	for _, opts := range []GenerateOptions{
+		{Words: 40, TopK: 1, Seed: 1},
+		{Words: 40, TopK: 2, Temperature: 0.1, Seed: 2},
+		{Start: "ran", Words: 40, TopK: 1, Seed: 3},
+	} {
+		done := make(chan Generation, 1)
+		go func() { done <- hmm.Generate(opts) }()
+		select {
+		case gen := <-done:
+			if gen.Tokens != 40 {
+				t.Errorf("Unexpected number of words with %+v. got: %d, want: %d\n", opts,
+					gen.Tokens, 40)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Generating with %+v never finished\n", opts)
+		}
+	}
+}
+
+// TestGenerateWeight makes sure that Weight reweights transitions, and that the path that
+// generation took lines up with the text.
+func TestGenerateWeight(t *testing.T) {
+	hmm, _ := NewHMM("the cat sat on the mat\nthe dog sat on the log\nthe cat ran off\n", 20)
+	// Without feedback, "the" is followed by "cat" most of the time. Make it never happen.
+	noCats := func(from, to string) float64 {
+		if from == "the" && to == "cat" {
+			return 0
+		}
+		return 1
+	}
+	for seed := int64(1); seed <= 50; seed++ {
+		gen := hmm.Generate(GenerateOptions{Start: "the", Words: 20, Seed: seed, Weight: noCats})
+		if strings.Contains(gen.Text, "the cat") {
+			t.Fatalf("Speech generated with seed %d has a transition weighted to 0: %q\n", seed,
+				gen.Text)
+		}
+
+		var words []string
+		for _, word := range gen.Path {
+			if word != "\n" {
+				words = append(words, word)
+			}
+		}
+		if got := strings.Join(words, " "); got != gen.Text {
+			t.Fatalf("Path doesn't line up with the text.\npath: %q\ntext: %q\n", gen.Path, gen.Text)
+		}
+	}
+}
+
+// TestGenerateAfter makes sure that generation can pick up where earlier text left off.
+func TestGenerateAfter(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 20)
+	gen := hmm.Generate(GenerateOptions{Start: "ignored", After: []string{"quick", "brown"},
+		Words: 3})
+	if gen.Text != "fox jumps over" {
+		t.Errorf("Unexpected text. got: %q, want: %q\n", gen.Text, "fox jumps over")
+	}
+}
+
+func TestHMMStats(t *testing.T) {
+	hmm, _ := NewHMM("roll up and roll out\nroll on\n", 20)
+	got := hmm.Stats()
+	want := HMMStats{Words: 5, Transitions: 8, SentenceStarts: 1}
+	if got != want {
+		t.Errorf("Unexpected stats. got: %+v, want: %+v\n", got, want)
+	}
+}
+
+func TestHMMOrder(t *testing.T) {
+	corpus := "a x b\nc x d\n"
+	first, _ := NewHMMOfOrder(corpus, 20, 1)
+	second, _ := NewHMMOfOrder(corpus, 20, 2)
+	var buf bytes.Buffer
+	if err := second.Save(&buf); err != nil {
+		t.Fatalf("Failed to save model: %v\n", err)
+	}
+	loaded, err := LoadHMM(&buf)
+	if err != nil {
+		t.Fatalf("Failed to load model: %v\n", err)
+	}
+
+	// An HMM of order 1 only knows that "x" is followed by "b" or "d", while one of order 2 knows
+	// that "a x" is always followed by "b".
+	sawD := false
+	for seed := int64(1); seed <= 50; seed++ {
+		opts := GenerateOptions{Start: "a", Words: 3, Seed: seed}
+		sawD = sawD || first.Generate(opts).Text == "a x d"
+		for _, hmm := range []*HMM{second, loaded} {
+			if got := hmm.Generate(opts).Text; got != "a x b" {
+				t.Fatalf("Unexpected speech from an HMM of order 2. got: %q, want: %q\n", got,
+					"a x b")
+			}
+		}
+	}
+	if !sawD {
+		t.Errorf("An HMM of order 1 never generated %q\n", "a x d")
+	}
+
+	for _, order := range []int{0, maxOrder + 1} {
+		if _, err := NewHMMOfOrder(corpus, 20, order); err != ErrBadOrder {
+			t.Errorf("Unexpected error for order %d. got: %v, want: %v\n", order, err, ErrBadOrder)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Labels of the buttons for each action.
+var discordButtonLabels = map[Action]string{
+	actionRegenerate: "🔁 Regenerate",
+	actionContinue:   "➕ Continue",
+	actionDelete:     "🗑 Delete",
+}
+
+// newDiscordButtons returns a row with a button for each of the provided actions.
+func newDiscordButtons(actions []Action) []discordgo.MessageComponent {
+	var row discordgo.ActionsRow
+	for _, action := range actions {
+		style := discordgo.SecondaryButton
+		if action == actionDelete {
+			style = discordgo.DangerButton
+		}
+		row.Components = append(row.Components, discordgo.Button{
+			Label:    discordButtonLabels[action],
+			Style:    style,
+			CustomID: string(action),
+		})
+	}
+	return []discordgo.MessageComponent{row}
+}
+
+// sendWithButtons posts a message with a button for each of the provided actions in the provided
+// channel, and returns the message's ID. options are passed along with the request.
+func sendWithButtons(s *discordgo.Session, channelID, msg string, actions []Action,
+	options ...discordgo.RequestOption) (string, error) {
+	m, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:    msg,
+		Components: newDiscordButtons(actions),
+	}, options...)
+	if err != nil {
+		return "", err
+	}
+	return m.ID, nil
+}
+
+// InteractionCreateHandler is called every time someone interacts with the bot. It handles presses
+// of the buttons under generated messages, and ignores everything else. Once the bot starts
+// shutting down, presses are ignored.
+func (d *Discord) InteractionCreateHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent || i.Message == nil {
+		return
+	}
+	d.handlers.Do(func() {
+		press := &Message{ChannelID: i.ChannelID, GuildID: i.GuildID}
+		// Member is who set off the interaction in a guild, and User is who did in a DM.
+		if i.Member != nil && i.Member.User != nil {
+			press.Author = newDiscordUser(i.Member.User)
+		} else if i.User != nil {
+			press.Author = newDiscordUser(i.User)
+		}
+		ctx := newRequestContext(d.Name(), press)
+		notice := d.bot.HandlePress(d, press.WithContext(ctx), i.Message.ID,
+			Action(i.MessageComponentData().CustomID))
+
+		// Discord shows an error under the button unless every press gets a response.
+		response := &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredMessageUpdate,
+		}
+		if notice != "" {
+			response = &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				// Only the user who pressed the button sees the notice.
+				Data: &discordgo.InteractionResponseData{
+					Content: notice,
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			}
+		}
+		if err := s.InteractionRespond(i.Interaction, response); err != nil {
+			loggerFrom(ctx).Error("Failed to respond to a button press", "error", err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// TestDiscordButtons makes sure that generated messages get buttons on Discord, and that pressing
+// them gets a response, which only the user who pressed the button sees if it's a notice.
+func TestDiscordButtons(t *testing.T) {
+	fake := newFakeDiscord(t)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	discord, _ := NewDiscord("token", bot)
+
+	discord.MessageCreateHandler(discord.dg, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ChannelID: "channel",
+		Content:   "!foo quick 3",
+		Author:    &discordgo.User{ID: "alice"},
+	}})
+	discord.outbox.Wait()
+	sent := []string{"quick brown fox"}
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, sent) {
+		t.Fatalf("Unexpected messages sent. got: %q, want: %q\n", got, sent)
+	}
+	want := []string{"regenerate", "continue", "delete"}
+	if got := fake.buttons["1"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected buttons. got: %q, want: %q\n", got, want)
+	}
+
+	press := func(userID, customID string) {
+		discord.InteractionCreateHandler(discord.dg, &discordgo.InteractionCreate{
+			Interaction: &discordgo.Interaction{
+				ID:        "interaction",
+				Type:      discordgo.InteractionMessageComponent,
+				Token:     "token",
+				ChannelID: "channel",
+				GuildID:   "guild",
+				Data:      discordgo.MessageComponentInteractionData{CustomID: customID},
+				Message:   &discordgo.Message{ID: "1", ChannelID: "channel"},
+				Member:    &discordgo.Member{User: &discordgo.User{ID: userID}},
+			},
+		})
+		discord.outbox.Wait()
+	}
+
+	// Other interactions are ignored.
+	discord.InteractionCreateHandler(discord.dg, &discordgo.InteractionCreate{
+		Interaction: &discordgo.Interaction{Type: discordgo.InteractionApplicationCommand},
+	})
+	press("bob", string(actionContinue))
+	press("bob", string(actionDelete))
+	press("alice", string(actionDelete))
+
+	sent = append(sent, "jumps over the")
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, sent) {
+		t.Errorf("Unexpected messages sent. got: %q, want: %q\n", got, sent)
+	}
+	if len(fake.responses) != 3 {
+		t.Fatalf("Unexpected number of responses. got: %d, want: 3\n", len(fake.responses))
+	}
+	for i, wantType := range []discordgo.InteractionResponseType{
+		discordgo.InteractionResponseDeferredMessageUpdate,
+		discordgo.InteractionResponseChannelMessageWithSource,
+		discordgo.InteractionResponseDeferredMessageUpdate,
+	} {
+		if fake.responses[i].Type != wantType {
+			t.Errorf("Unexpected type of response %d. got: %d, want: %d\n", i,
+				fake.responses[i].Type, wantType)
+		}
+	}
+	data := fake.responses[1].Data
+	if data == nil || data.Flags != discordgo.MessageFlagsEphemeral {
+		t.Errorf("Expected the notice to be ephemeral. got: %+v\n", data)
+	}
+	if !reflect.DeepEqual(fake.deleted, []string{"1"}) {
+		t.Errorf("Unexpected deleted messages. got: %q, want: %q\n", fake.deleted, []string{"1"})
+	}
+}
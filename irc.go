@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIRCTextLength is how many bytes of text are put in each PRIVMSG. IRC lines can't be longer
+	// than 512 bytes, so this leaves plenty of room for the command, the target, and the prefix
+	// that the server tacks on when it relays the message.
+	maxIRCTextLength = 400
+	// ircDialTimeout is how long connecting to an IRC server may take.
+	ircDialTimeout = 30 * time.Second
+	// ircQuitTimeout is how long to wait for an IRC server to hang up after saying goodbye to it.
+	ircQuitTimeout = 10 * time.Second
+	// ircReconnectDelay is how long to wait before reconnecting to an IRC server after losing the
+	// connection.
+	ircReconnectDelay = 30 * time.Second
+	// ircKeepalive is how long the IRC server may go quiet before the bot PINGs it. If the server
+	// doesn't answer within that long either, the connection is considered lost.
+	ircKeepalive = 2 * time.Minute
+	// ircAccountTagCap is the IRCv3 capability that tags messages with their sender's services
+	// account.
+	ircAccountTagCap = "account-tag"
+)
+
+// Errors that an IRC connection may end with.
+var (
+	ErrIRCNoServer            = errors.New("no IRC server was configured")
+	ErrIRCSASLFailed          = errors.New("SASL authentication failed")
+	ErrIRCTimeout             = errors.New("the IRC server stopped responding")
+	ErrAttachmentsUnsupported = errors.New("this platform doesn't support attachments")
+)
+
+// DefaultIRCFloodControl lets the bot send a burst of 5 lines, and then 1 line every 2 seconds.
+// Most IRC servers disconnect clients that send faster than that.
+var DefaultIRCFloodControl = BucketConfig{Capacity: 5, Period: 10 * time.Second}
+
+// IRCConfig describes how to connect to an IRC server.
+type IRCConfig struct {
+	// Address of the server, like "irc.libera.chat:6697".
+	Server string
+	// If TLS isn't nil, the connection to the server is made over TLS with this config.
+	TLS *tls.Config
+
+	Nick     string
+	User     string
+	RealName string
+	// Password sent with the PASS command, for servers that require one.
+	Password string
+
+	// If SASLUser isn't empty, the bot authenticates with SASL PLAIN before registering.
+	SASLUser     string
+	SASLPassword string
+	// If NickServPassword isn't empty, the bot identifies with NickServ once it has registered.
+	NickServPassword string
+
+	// Channels to join once the bot has registered, like "#general".
+	Channels []string
+
+	// How fast lines may be sent to the server. A Capacity of 0 turns flood control off.
+	FloodControl BucketConfig
+}
+
+// IRC connects a Bot to an IRC server. It hands the messages that are posted in the channels it
+// joined, or that are sent to it directly, to its Bot, and is the Platform that the Bot talks back
+// through.
+//
+// IRC servers don't keep any history, so an IRC remembers the most recent messages in each
+// channel itself.
+//
+// An IRC can only connect once. To reconnect, create a new one.
+type IRC struct {
+	config IRCConfig
+	bot    *Bot
+
+	conn    net.Conn
+	writeMu sync.Mutex
+	// Lines waiting to be sent to the server, subject to flood control.
+	out chan string
+	// Closed once the bot has registered with the server.
+	registered chan struct{}
+	// Closed once the connection is gone.
+	done chan struct{}
+	// Messages that are being handled.
+	handlers inFlight
+	// How long the server may go quiet before it's PINGed. Defaults to ircKeepalive.
+	keepalive time.Duration
+
+	mu sync.Mutex
+	// Set once Close is called, so that a connection that's still being made is closed right away.
+	closed bool
+	nick   string
+	// The bot's own services account, and the user@host that the server knows it by. The bot is
+	// told apart from everyone else the same way that they're told apart from each other. See
+	// ircMessage.userID.
+	account  string
+	userHost string
+	history  map[string][]Message // Newest first.
+	// The ID of the user who last went by each nick, by lowercased nick. Mentions are resolved
+	// with it.
+	ids map[string]string
+}
+
+// NewIRC returns a pointer to a new IRC initialized with the provided config and the Bot to hand
+// messages to.
+func NewIRC(config IRCConfig, bot *Bot) (*IRC, error) {
+	if config.Server == "" {
+		return nil, ErrIRCNoServer
+	}
+	if config.User == "" {
+		config.User = config.Nick
+	}
+	if config.RealName == "" {
+		config.RealName = config.Nick
+	}
+
+	return &IRC{
+		config:     config,
+		bot:        bot,
+		out:        make(chan string, 64),
+		registered: make(chan struct{}),
+		done:       make(chan struct{}),
+		keepalive:  ircKeepalive,
+		nick:       config.Nick,
+		history:    make(map[string][]Message),
+		ids:        make(map[string]string),
+	}, nil
+}
+
+// Start connects to the IRC server, registers, and then handles incoming lines until the
+// connection is closed.
+func (c *IRC) Start() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		conn.Close()
+		close(c.done)
+		return nil
+	}
+	defer func() {
+		close(c.done)
+		conn.Close()
+	}()
+	go c.writeLoop()
+
+	// account-tag tags messages with the services account of whoever sent them, which is what
+	// users are told apart by. See ircMessage.userID.
+	c.sendNow("CAP REQ :" + ircAccountTagCap)
+	if c.config.SASLUser != "" {
+		c.sendNow("CAP REQ :sasl")
+	}
+	if c.config.Password != "" {
+		c.sendNow("PASS " + c.config.Password)
+	}
+	c.sendNow("NICK " + c.config.Nick)
+	c.sendNow(fmt.Sprintf("USER %s 0 * :%s", c.config.User, c.config.RealName))
+
+	// A connection that went away without being closed, like when the network drops, would
+	// otherwise never be noticed. So the server is PINGed when it's quiet for too long, and the
+	// connection is given up on if it stays quiet.
+	reader := bufio.NewReader(conn)
+	partial := ""
+	pinged := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.keepalive))
+		line, err := reader.ReadString('\n')
+		partial += line
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			if pinged {
+				return ErrIRCTimeout
+			}
+			pinged = true
+			c.sendNow("PING :keepalive")
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line, partial, pinged = partial, "", false
+		if err := c.handleLine(parseIRCLine(line)); err != nil {
+			return err
+		}
+	}
+}
+
+// Close says goodbye to the IRC server and closes the connection. If the connection is still being
+// made, it's closed as soon as it's made.
+func (c *IRC) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.closed = true
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	c.sendNow("QUIT :Spinning down")
+	return conn.Close()
+}
+
+// Quit lets the messages that are being handled finish up, sends the lines that are still queued
+// up, and then says goodbye to the IRC server. The connection is closed once the server hangs up,
+// or after ircQuitTimeout.
+func (c *IRC) Quit() error {
+	c.handlers.Close()
+	// Queue the QUIT up behind everything else, rather than skipping flood control with it.
+	c.send("QUIT :Spinning down")
+	select {
+	case <-c.done:
+	case <-time.After(ircQuitTimeout):
+	}
+	return c.Close()
+}
+
+// ircService keeps a Bot connected to an IRC server, reconnecting whenever the connection is lost.
+type ircService struct {
+	config IRCConfig
+	bot    *Bot
+	// How long to wait before reconnecting. Defaults to ircReconnectDelay.
+	reconnectDelay time.Duration
+}
+
+// newIRCService returns a pointer to a new ircService initialized with the provided config and the
+// Bot to hand messages to.
+func newIRCService(config IRCConfig, bot *Bot) *ircService {
+	return &ircService{config: config, bot: bot, reconnectDelay: ircReconnectDelay}
+}
+
+// Name returns "irc".
+func (s *ircService) Name() string {
+	return "irc"
+}
+
+// Run connects to the IRC server, and is ready once the bot has registered. It reconnects whenever
+// the connection is lost, until ctx is done. Then it lets the messages that are being handled
+// finish up, and says goodbye to the server. If the first connection fails before the bot
+// registers, the error is returned instead.
+func (s *ircService) Run(ctx context.Context, ready func()) error {
+	registered := false
+	for {
+		irc, err := NewIRC(s.config, s.bot)
+		if err != nil {
+			return err
+		}
+		errs := make(chan error, 1)
+		go func() { errs <- irc.Start() }()
+
+		select {
+		case <-irc.registered:
+			if !registered {
+				registered = true
+				ready()
+			}
+			select {
+			case err = <-errs:
+			case <-ctx.Done():
+				irc.Quit()
+				<-errs
+				return nil
+			}
+		case err = <-errs:
+			if !registered {
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				return fmt.Errorf("failed to connect to IRC server %s: %v", s.config.Server, err)
+			}
+		case <-ctx.Done():
+			irc.Close()
+			<-errs
+			return nil
+		}
+
+		slog.Warn("Lost connection to IRC server, reconnecting", "server", s.config.Server,
+			"error", err, "delay", s.reconnectDelay)
+		select {
+		case <-time.After(s.reconnectDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dial opens a connection to the IRC server, over TLS if it's configured.
+func (c *IRC) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	if c.config.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", c.config.Server, c.config.TLS)
+	}
+	return dialer.Dial("tcp", c.config.Server)
+}
+
+// handleLine responds to one line from the IRC server. If the line means that the connection
+// can't go on, an error is returned.
+func (c *IRC) handleLine(msg ircMessage) error {
+	switch msg.command {
+	case "PING":
+		c.sendNow("PONG :" + msg.param(0))
+	case "CAP":
+		// Looks like: CAP * ACK :sasl
+		caps := strings.Fields(msg.param(2))
+		switch {
+		case contains(caps, "sasl") && msg.param(1) == "ACK":
+			c.sendNow("AUTHENTICATE PLAIN")
+		case contains(caps, "sasl") && msg.param(1) == "NAK":
+			return ErrIRCSASLFailed
+		case contains(caps, ircAccountTagCap) && c.config.SASLUser == "":
+			// Without account-tag, nobody is told apart by their account, but the bot still works.
+			// With SASL, negotiation ends once the bot has logged in instead.
+			c.sendNow("CAP END")
+		}
+	case "AUTHENTICATE":
+		if msg.param(0) == "+" {
+			creds := "\x00" + c.config.SASLUser + "\x00" + c.config.SASLPassword
+			c.sendNow("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte(creds)))
+		}
+	case "903": // RPL_SASLSUCCESS
+		c.sendNow("CAP END")
+	case "904", "905": // ERR_SASLFAIL, ERR_SASLTOOLONG
+		return ErrIRCSASLFailed
+	case "433": // ERR_NICKNAMEINUSE
+		c.mu.Lock()
+		c.nick += "_"
+		nick := c.nick
+		c.mu.Unlock()
+		c.sendNow("NICK " + nick)
+	case "001": // RPL_WELCOME
+		c.mu.Lock()
+		c.nick = msg.param(0)
+		c.mu.Unlock()
+		// The server says what it knows the bot as in a 302 reply.
+		c.send("USERHOST " + msg.param(0))
+		if c.config.NickServPassword != "" {
+			c.send("PRIVMSG NickServ :IDENTIFY " + c.config.NickServPassword)
+		}
+		for _, channel := range c.config.Channels {
+			c.send("JOIN " + channel)
+		}
+		close(c.registered)
+		slog.Info("Connected to IRC server", "server", c.config.Server, "nick", msg.param(0))
+	case "302": // RPL_USERHOST. Looks like: 302 foo :foo=+user@host
+		for _, reply := range strings.Fields(msg.param(1)) {
+			nick, userHost, _ := strings.Cut(reply, "=")
+			if strings.TrimSuffix(nick, "*") == c.SelfNick() {
+				c.mu.Lock()
+				c.userHost = strings.TrimLeft(userHost, "+-")
+				c.mu.Unlock()
+			}
+		}
+	case "900": // RPL_LOGGEDIN. Looks like: 900 foo foo!user@host account :You are now logged in
+		c.mu.Lock()
+		c.account = msg.param(2)
+		c.mu.Unlock()
+	case "901": // RPL_LOGGEDOUT
+		c.mu.Lock()
+		c.account = ""
+		c.mu.Unlock()
+	case "JOIN":
+		// Servers tell the bot about its own JOINs with the prefix that everyone else sees, which
+		// picks up changes like a cloak that was set after registering.
+		if msg.nick() == c.SelfNick() {
+			c.mu.Lock()
+			if i := strings.Index(msg.prefix, "!"); i != -1 {
+				c.userHost = msg.prefix[i+1:]
+			}
+			if account := msg.tags["account"]; account != "" && account != "*" {
+				c.account = account
+			}
+			c.mu.Unlock()
+		}
+	case "PRIVMSG":
+		c.handlePrivmsg(msg)
+	}
+	return nil
+}
+
+// handlePrivmsg records a message in its channel's history, and then hands it to the Bot. Messages
+// sent straight to the bot are answered in private.
+func (c *IRC) handlePrivmsg(msg ircMessage) {
+	target := msg.param(0)
+	text := msg.param(1)
+	m := Message{
+		ChannelID: target,
+		Author:    User{ID: msg.userID(), Name: msg.nick()},
+		Content:   text,
+	}
+	if !strings.HasPrefix(target, "#") && !strings.HasPrefix(target, "&") {
+		m.ChannelID = msg.nick()
+	}
+
+	c.mu.Lock()
+	c.ids[strings.ToLower(msg.nick())] = m.Author.ID
+	// IRC doesn't have real mentions, so treat words like "@nick" as mentions.
+	for _, word := range strings.Fields(text) {
+		if len(word) > 1 && strings.HasPrefix(word, "@") {
+			nick := strings.TrimPrefix(word, "@")
+			id, ok := c.ids[strings.ToLower(nick)]
+			if !ok {
+				id = nick
+			}
+			m.Mentions = append(m.Mentions, User{ID: id, Name: nick})
+		}
+	}
+	history := append([]Message{m}, c.history[m.ChannelID]...)
+	if len(history) > maxMimicMsgs {
+		history = history[:maxMimicMsgs]
+	}
+	c.history[m.ChannelID] = history
+	c.mu.Unlock()
+
+	// Generating speech can take a while, so don't hold up the connection while it happens.
+	c.handlers.Go(func() { c.bot.HandleMessage(c, &m) })
+}
+
+// sendNow writes a line to the IRC server right away, skipping flood control. It's meant for
+// registration and for answering PINGs, which can't wait.
+func (c *IRC) sendNow(line string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := io.WriteString(c.conn, line+"\r\n"); err != nil {
+		slog.Warn("Failed to write to IRC server", "error", err)
+	}
+}
+
+// send queues a line up to be written to the IRC server once flood control allows it. Lines sent
+// after the connection is gone are dropped.
+func (c *IRC) send(line string) {
+	select {
+	case c.out <- line:
+	case <-c.done:
+	}
+}
+
+// writeLoop writes queued lines to the IRC server, no faster than flood control allows.
+func (c *IRC) writeLoop() {
+	flood := c.config.FloodControl
+	tokens := flood.Capacity
+	last := time.Now()
+	for {
+		var line string
+		select {
+		case line = <-c.out:
+		case <-c.done:
+			return
+		}
+
+		if flood.Capacity > 0 {
+			now := time.Now()
+			tokens += now.Sub(last).Seconds() * flood.rate()
+			if tokens > flood.Capacity {
+				tokens = flood.Capacity
+			}
+			last = now
+			if tokens < 1 {
+				wait := time.Duration((1 - tokens) / flood.rate() * float64(time.Second))
+				time.Sleep(wait)
+				tokens = 1
+				last = time.Now()
+			}
+			tokens--
+		}
+		c.sendNow(line)
+	}
+}
+
+// Name returns "irc".
+func (c *IRC) Name() string {
+	return "irc"
+}
+
+// SelfID returns the bot's own ID, which is its services account if it's logged in to one, and the
+// user@host that the server knows it by otherwise. It's empty until the server says either.
+func (c *IRC) SelfID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.account != "" {
+		return c.account
+	}
+	return c.userHost
+}
+
+// SelfNick returns the nick that the bot is currently using.
+func (c *IRC) SelfNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Reply sends a message to the provided channel or nick. IRC lines can't have line breaks in them,
+// so the message's lines are joined with spaces. Messages that are too long for one IRC line are
+// split up into multiple PRIVMSGs.
+func (c *IRC) Reply(ctx context.Context, channelID, msg string) {
+	text := strings.Join(strings.Fields(msg), " ")
+	for _, chunk := range splitIRCText(text, maxIRCTextLength) {
+		c.send(fmt.Sprintf("PRIVMSG %s :%s", channelID, chunk))
+	}
+}
+
+// SendFile always fails, since IRC doesn't have attachments.
+func (c *IRC) SendFile(channelID, name string, r io.Reader) error {
+	return ErrAttachmentsUnsupported
+}
+
+// FetchMessages returns the contents of messages that the bot has seen in the provided channel
+// since it connected, newest first.
+func (c *IRC) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var contents []string
+	for _, msg := range c.history[channelID] {
+		if len(contents) == limit {
+			break
+		}
+		if include(msg.Author.ID) {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents, nil
+}
+
+// IsNSFW always reports false, since IRC channels can't be marked as NSFW.
+func (c *IRC) IsNSFW(channelID string) (bool, error) {
+	return false, nil
+}
+
+// ircMessage is one parsed line from an IRC server.
+type ircMessage struct {
+	prefix  string
+	command string
+	params  []string
+	// IRCv3 message tags, like "account". Nil if the line didn't have any.
+	tags map[string]string
+}
+
+// parseIRCLine parses a raw IRC line like ":nick!user@host PRIVMSG #channel :hello there".
+func parseIRCLine(line string) ircMessage {
+	line = strings.TrimRight(line, "\r\n")
+	var msg ircMessage
+
+	if strings.HasPrefix(line, "@") {
+		tags := line[1:]
+		if i := strings.Index(line, " "); i != -1 {
+			tags, line = line[1:i], line[i+1:]
+		} else {
+			line = ""
+		}
+		msg.tags = parseIRCTags(tags)
+	}
+	if strings.HasPrefix(line, ":") {
+		if i := strings.Index(line, " "); i != -1 {
+			msg.prefix, line = line[1:i], line[i+1:]
+		} else {
+			msg.prefix, line = line[1:], ""
+		}
+	}
+
+	// Everything after " :" is one param, even if it has spaces in it.
+	var trailing *string
+	if i := strings.Index(line, " :"); i != -1 {
+		t := line[i+2:]
+		trailing = &t
+		line = line[:i]
+	} else if strings.HasPrefix(line, ":") {
+		t := line[1:]
+		trailing = &t
+		line = ""
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.command = strings.ToUpper(fields[0])
+		msg.params = fields[1:]
+	}
+	if trailing != nil {
+		msg.params = append(msg.params, *trailing)
+	}
+	return msg
+}
+
+// param returns the message's i-th param, or an empty string if there isn't one.
+func (m ircMessage) param(i int) string {
+	if i < len(m.params) {
+		return m.params[i]
+	}
+	return ""
+}
+
+// parseIRCTags parses IRCv3 message tags like "account=alice;time=2020-01-01T00:00:00Z", undoing
+// the escaping in their values.
+func parseIRCTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		key, value := tag, ""
+		if i := strings.Index(tag, "="); i != -1 {
+			key, value = tag[:i], ircTagUnescaper.Replace(tag[i+1:])
+		}
+		if key != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// ircTagUnescaper undoes the escaping in IRCv3 message tag values.
+var ircTagUnescaper = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// userID returns the ID of whoever sent the message. It's their services account, if the server
+// says that they're logged in to one. Otherwise it's the user@host part of the message's prefix,
+// which can't be mistaken for an account, and doesn't change when they change their nick. Nicks
+// aren't used, since anybody can take one that isn't in use.
+func (m ircMessage) userID() string {
+	if account := m.tags["account"]; account != "" && account != "*" {
+		return account
+	}
+	if i := strings.Index(m.prefix, "!"); i != -1 {
+		return m.prefix[i+1:]
+	}
+	return m.prefix
+}
+
+// nick returns the nick part of the message's prefix.
+func (m ircMessage) nick() string {
+	if i := strings.Index(m.prefix, "!"); i != -1 {
+		return m.prefix[:i]
+	}
+	return m.prefix
+}
+
+// splitIRCText breaks text up into chunks of at most maxLen bytes, preferring to break between
+// words.
+func splitIRCText(text string, maxLen int) []string {
+	var chunks []string
+	for len(text) > maxLen {
+		// Look one byte past the limit, in case the chunk ends right before a space.
+		cut := strings.LastIndex(text[:maxLen+1], " ")
+		if cut <= 0 {
+			cut = maxLen
+			// Don't cut a multi-byte character in half.
+			for cut > 0 && text[cut]&0xC0 == 0x80 {
+				cut--
+			}
+		}
+		chunks = append(chunks, text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
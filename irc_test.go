@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIRCServer is a local, in-process IRC server that accepts one client. Tests drive the
+// conversation themselves by checking what the client sent and sending lines back.
+type fakeIRCServer struct {
+	t      *testing.T
+	ln     net.Listener
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newFakeIRCServer starts listening on a random local port, over TLS if tlsConfig isn't nil.
+func newFakeIRCServer(t *testing.T, tlsConfig *tls.Config) *fakeIRCServer {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("Failed to start fake IRC server: %v\n", err)
+	}
+	s := &fakeIRCServer{t: t, ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+	return s
+}
+
+// accept waits for the client to connect.
+func (s *fakeIRCServer) accept() {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		s.t.Fatalf("Fake IRC server failed to accept a connection: %v\n", err)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+}
+
+// expect fails the test unless the next line that the client sends is want.
+func (s *fakeIRCServer) expect(want string) {
+	s.t.Helper()
+	if got := s.readLine(); got != want {
+		s.t.Fatalf("Unexpected line from IRC client.\ngot: %q\nwant:%q\n", got, want)
+	}
+}
+
+// readLine returns the next line that the client sends, without its trailing CRLF.
+func (s *fakeIRCServer) readLine() string {
+	s.t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		s.t.Fatalf("Failed to read from IRC client: %v\n", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// send writes a line to the client.
+func (s *fakeIRCServer) send(line string) {
+	if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+		s.t.Fatalf("Failed to write to IRC client: %v\n", err)
+	}
+}
+
+// newTestTLSConfigs returns a server config with a freshly made self-signed certificate for
+// 127.0.0.1, and a client config that trusts it.
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v\n", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return server, client
+}
+
+// TestIRC walks an IRC client through connecting over TLS, authenticating with SASL and NickServ,
+// joining channels, answering PINGs, and responding to a bot invocation.
+func TestIRC(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	server := newFakeIRCServer(t, serverTLS)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	irc, _ := NewIRC(IRCConfig{
+		Server:           server.ln.Addr().String(),
+		TLS:              clientTLS,
+		Nick:             "foo",
+		SASLUser:         "foo",
+		SASLPassword:     "hunter2",
+		NickServPassword: "swordfish",
+		Channels:         []string{"#general", "#random"},
+	}, bot)
+	errs := make(chan error, 1)
+	go func() { errs <- irc.Start() }()
+	server.accept()
+
+	server.expect("CAP REQ :account-tag")
+	server.expect("CAP REQ :sasl")
+	server.expect("NICK foo")
+	server.expect("USER foo 0 * :foo")
+	server.send(":server CAP * ACK :sasl")
+	server.expect("AUTHENTICATE PLAIN")
+	server.send("AUTHENTICATE +")
+	server.expect("AUTHENTICATE " + base64.StdEncoding.EncodeToString([]byte("\x00foo\x00hunter2")))
+	server.send(":server 903 foo :SASL authentication successful")
+	server.expect("CAP END")
+	server.send(":server 001 foo :Welcome to the fake IRC network")
+	server.expect("USERHOST foo")
+	server.expect("PRIVMSG NickServ :IDENTIFY swordfish")
+	server.expect("JOIN #general")
+	server.expect("JOIN #random")
+
+	server.send("PING :12345")
+	server.expect("PONG :12345")
+
+	server.send(":alice!alice@host PRIVMSG #general :hello there friend")
+	server.send(":bob!bob@host PRIVMSG #general :!foo imitate @alice")
+	reply := server.readLine()
+	if !strings.HasPrefix(reply, "PRIVMSG #general :") {
+		t.Fatalf("Unexpected reply to a bot invocation: %q\n", reply)
+	}
+	vocab := map[string]bool{"hello": true, "there": true, "friend": true}
+	for _, word := range strings.Fields(strings.TrimPrefix(reply, "PRIVMSG #general :")) {
+		if !vocab[word] {
+			t.Errorf("Imitation contained a word that alice never said: %q\n", word)
+		}
+	}
+
+	// Direct messages are answered in private.
+	server.send(":bob!bob@host PRIVMSG foo :!foo 3")
+	if reply := server.readLine(); !strings.HasPrefix(reply, "PRIVMSG bob :") {
+		t.Errorf("Unexpected reply to a direct message: %q\n", reply)
+	}
+
+	irc.Close()
+	<-errs
+}
+
+// TestIRCSASLFailure makes sure that a failed SASL login ends the connection with an error.
+func TestIRCSASLFailure(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	irc, _ := NewIRC(IRCConfig{
+		Server:       server.ln.Addr().String(),
+		Nick:         "foo",
+		SASLUser:     "foo",
+		SASLPassword: "wrong",
+	}, bot)
+	errs := make(chan error, 1)
+	go func() { errs <- irc.Start() }()
+	server.accept()
+
+	server.expect("CAP REQ :account-tag")
+	server.expect("CAP REQ :sasl")
+	server.expect("NICK foo")
+	server.expect("USER foo 0 * :foo")
+	server.send(":server CAP * ACK :sasl")
+	server.expect("AUTHENTICATE PLAIN")
+	server.send("AUTHENTICATE +")
+	server.readLine()
+	server.send(":server 904 foo :SASL authentication failed")
+	if err := <-errs; err != ErrIRCSASLFailed {
+		t.Errorf("Unexpected error. got: %v, want: %v\n", err, ErrIRCSASLFailed)
+	}
+}
+
+// TestIRCIdentity makes sure that IRC users are told apart by their services account, or by their
+// user@host when they aren't logged in, and never by their nick alone.
+func TestIRCIdentity(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	bot.limiter = NewLimiter(LimiterConfig{Admins: []string{"irc/alice"}})
+	irc, _ := NewIRC(IRCConfig{Server: server.ln.Addr().String(), Nick: "foo"}, bot)
+	errs := make(chan error, 1)
+	go func() { errs <- irc.Start() }()
+	server.accept()
+
+	server.expect("CAP REQ :account-tag")
+	server.expect("NICK foo")
+	server.expect("USER foo 0 * :foo")
+	server.send(":server CAP * ACK :account-tag")
+	server.expect("CAP END")
+	server.send(":server 001 foo :Welcome to the fake IRC network")
+	server.expect("USERHOST foo")
+
+	// The bot learns its own ID the same way, and ignores its own messages.
+	selfID := func(want string) {
+		t.Helper()
+		// The bot handles lines in order, so once this is answered, so are the ones before it.
+		server.send("PING :sync")
+		server.expect("PONG :sync")
+		if got := irc.SelfID(); got != want {
+			t.Errorf("Unexpected self ID. got: %q, want: %q\n", got, want)
+		}
+	}
+	server.send(":server 302 foo :foo=+foo@bot.host")
+	selfID("foo@bot.host")
+	server.send(":foo!foo@cloak/bot JOIN #general")
+	selfID("foo@cloak/bot")
+	server.send(":server 900 foo foo!foo@cloak/bot foobot :You are now logged in as foobot")
+	selfID("foobot")
+	server.send("@account=foobot :foo!foo@cloak/bot PRIVMSG #general :!foo reload")
+
+	server.send("@account=alice :alice!alice@host PRIVMSG #general :!foo reload")
+	want := "PRIVMSG #general :Reloading isn't turned on"
+	if reply := server.readLine(); reply != want {
+		t.Errorf("Unexpected reply to an admin.\ngot: %q\nwant: %q\n", reply, want)
+	}
+	// Anybody can take alice's nick once they're gone, but that doesn't make them alice.
+	server.send(":alice!mallory@elsewhere PRIVMSG #general :!foo reload")
+	want = "PRIVMSG #general :Sorry, only my owners can use reload here"
+	if reply := server.readLine(); reply != want {
+		t.Errorf("Unexpected reply to somebody using an admin's nick.\ngot: %q\nwant: %q\n", reply,
+			want)
+	}
+	server.send("@account=* :alice!mallory@elsewhere PRIVMSG #general :!foo reload")
+	if reply := server.readLine(); reply != want {
+		t.Errorf("Unexpected reply to somebody who isn't logged in.\ngot: %q\nwant: %q\n", reply,
+			want)
+	}
+
+	// Mentions are resolved to whoever last went by the nick.
+	server.send(":bob!bob@host PRIVMSG #general :!foo imitate @alice")
+	server.readLine()
+	for id, want := range map[string]int{"alice": 1, "mallory@elsewhere": 2} {
+		contents, _ := irc.FetchMessages("#general", 10, func(authorID string) bool {
+			return authorID == id
+		})
+		if len(contents) != want {
+			t.Errorf("Unexpected number of messages from %q. got: %d, want: %d\n", id,
+				len(contents), want)
+		}
+	}
+	irc.mu.Lock()
+	mention := irc.history["#general"][0].Mentions[0]
+	irc.mu.Unlock()
+	if mention.ID != "mallory@elsewhere" || mention.Name != "alice" {
+		t.Errorf("Unexpected mention: %+v\n", mention)
+	}
+
+	irc.Close()
+	<-errs
+}
+
+// TestIRCKeepalive makes sure that a quiet IRC server is PINGed, and that the connection is given
+// up on if the server stays quiet.
+func TestIRCKeepalive(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	irc, _ := NewIRC(IRCConfig{Server: server.ln.Addr().String(), Nick: "foo"}, bot)
+	irc.keepalive = 50 * time.Millisecond
+	errs := make(chan error, 1)
+	go func() { errs <- irc.Start() }()
+	server.accept()
+
+	server.expect("CAP REQ :account-tag")
+	server.expect("NICK foo")
+	server.expect("USER foo 0 * :foo")
+	server.send(":server 001 foo :Welcome to the fake IRC network")
+	server.expect("USERHOST foo")
+
+	// Answering the PING keeps the connection going.
+	server.expect("PING :keepalive")
+	server.send(":server PONG server :keepalive")
+	server.expect("PING :keepalive")
+	select {
+	case err := <-errs:
+		if err != ErrIRCTimeout {
+			t.Errorf("Unexpected error. got: %v, want: %v\n", err, ErrIRCTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The connection wasn't given up on after the server went quiet\n")
+	}
+}
+
+// TestIRCFloodControl makes sure that an IRC client doesn't send lines faster than its flood
+// control allows, and that it picks a new nick when its nick is taken.
+func TestIRCFloodControl(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	irc, _ := NewIRC(IRCConfig{
+		Server: server.ln.Addr().String(),
+		Nick:   "foo",
+		// A burst of 2 lines, and then 1 line every 100ms.
+		FloodControl: BucketConfig{Capacity: 2, Period: 200 * time.Millisecond},
+	}, bot)
+	errs := make(chan error, 1)
+	go func() { errs <- irc.Start() }()
+	server.accept()
+
+	server.expect("CAP REQ :account-tag")
+	server.expect("NICK foo")
+	server.expect("USER foo 0 * :foo")
+	server.send(":server 433 * foo :Nickname is already in use")
+	server.expect("NICK foo_")
+	server.send(":server 001 foo_ :Welcome to the fake IRC network")
+	server.expect("USERHOST foo_")
+	<-irc.registered
+	if got := irc.SelfNick(); got != "foo_" {
+		t.Errorf("Unexpected nick. got: %q, want: %q\n", got, "foo_")
+	}
+
+	start := time.Now()
+	for _, word := range []string{"one", "two", "three", "four"} {
+		irc.Reply(context.Background(), "#general", word)
+	}
+	for _, word := range []string{"one", "two", "three", "four"} {
+		server.expect("PRIVMSG #general :" + word)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("4 lines were sent in %v, faster than flood control should allow.\n", elapsed)
+	}
+
+	irc.Close()
+	<-errs
+}
+
+// TestIRCService makes sure that an ircService is ready once the bot registers, reconnects after
+// losing the connection, and answers the invocations that it's handling before it says goodbye.
+func TestIRCService(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	service := newIRCService(IRCConfig{Server: server.ln.Addr().String(), Nick: "foo"}, bot)
+	service.reconnectDelay = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() { errs <- service.Run(ctx, func() { close(ready) }) }()
+
+	register := func() {
+		server.accept()
+		server.expect("CAP REQ :account-tag")
+		server.expect("NICK foo")
+		server.expect("USER foo 0 * :foo")
+		server.send(":server 001 foo :Welcome to the fake IRC network")
+	}
+	register()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the service to be ready\n")
+	}
+
+	server.conn.Close()
+	register()
+
+	server.send(":bob!bob@host PRIVMSG #general :!foo 3")
+	// PINGs are answered once the lines before them were handled.
+	server.send("PING :12345")
+	answered := false
+	for {
+		line := server.readLine()
+		if line == "PONG :12345" {
+			cancel()
+		}
+		if line == "QUIT :Spinning down" {
+			break
+		}
+		answered = answered || strings.HasPrefix(line, "PRIVMSG #general :")
+	}
+	if !answered {
+		t.Errorf("The invocation wasn't answered before the bot said goodbye\n")
+	}
+	server.conn.Close()
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+}
+
+// TestIRCServiceFailure makes sure that an ircService that can't register the first time it
+// connects fails instead of trying again.
+func TestIRCServiceFailure(t *testing.T) {
+	server := newFakeIRCServer(t, nil)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	service := newIRCService(IRCConfig{Server: server.ln.Addr().String(), Nick: "foo"}, bot)
+	errs := make(chan error, 1)
+	go func() { errs <- service.Run(context.Background(), func() {}) }()
+	server.accept()
+	server.conn.Close()
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Errorf("Unexpected error. got: %v\n", err)
+	}
+}
+
+func TestParseIRCLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want ircMessage
+	}{
+		{
+			":alice!alice@host PRIVMSG #general :hello there\r\n",
+			ircMessage{"alice!alice@host", "PRIVMSG", []string{"#general", "hello there"}, nil},
+		},
+		{"PING :12345\r\n", ircMessage{"", "PING", []string{"12345"}, nil}},
+		{
+			"@time=2020-01-01T00:00:00Z :server 001 foo :Welcome\r\n",
+			ircMessage{"server", "001", []string{"foo", "Welcome"},
+				map[string]string{"time": "2020-01-01T00:00:00Z"}},
+		},
+		{
+			`@account=al\sice\:1;+draft/flag;empty= :alice!a@host PRIVMSG #general :hi`,
+			ircMessage{"alice!a@host", "PRIVMSG", []string{"#general", "hi"},
+				map[string]string{"account": "al ice;1", "+draft/flag": "", "empty": ""}},
+		},
+		{":server CAP * ACK :sasl", ircMessage{"server", "CAP", []string{"*", "ACK", "sasl"},
+			nil}},
+		{"AUTHENTICATE +", ircMessage{"", "AUTHENTICATE", []string{"+"}, nil}},
+	}
+	for _, c := range tests {
+		if got := parseIRCLine(c.line); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected parse of %q.\ngot: %+v\nwant: %+v\n", c.line, got, c.want)
+		}
+	}
+}
+
+func TestSplitIRCText(t *testing.T) {
+	tests := []struct {
+		text   string
+		maxLen int
+		want   []string
+	}{
+		{"hello there friend", 400, []string{"hello there friend"}},
+		{"hello there friend", 11, []string{"hello there", "friend"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"héllo", 2, []string{"h", "é", "ll", "o"}},
+		{"", 4, nil},
+	}
+	for _, c := range tests {
+		if got := splitIRCText(c.text, c.maxLen); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected split of %q. got: %q, want: %q\n", c.text, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultStartTimeout is how long each service gets to become ready.
+	defaultStartTimeout = 30 * time.Second
+
+	// defaultShutdownTimeout is how long every service gets, altogether, to finish up the work that
+	// it has underway when the bot shuts down, unless the config says otherwise.
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// Service is something that runs for as long as the bot does, like a connection to a chat service,
+// or the HTTP API.
+type Service interface {
+	// Name identifies the service in logs.
+	Name() string
+	// Run starts the service, and calls ready once it's ready to do its job. It keeps running until
+	// ctx is done, and then stops taking on new work, finishes the work that's underway, and
+	// returns. An error means that the service couldn't start, or stopped unexpectedly.
+	Run(ctx context.Context, ready func()) error
+}
+
+// Supervisor runs services under one context. It starts them one at a time, in order, and stops
+// them in the reverse order, so that services can rely on the ones that started before them.
+type Supervisor struct {
+	services []Service
+	// How long each service gets to become ready.
+	startTimeout time.Duration
+	// How long every service gets, altogether, to finish up when the supervisor stops them.
+	shutdownTimeout time.Duration
+
+	mu    sync.Mutex
+	ready map[string]bool
+}
+
+// NewSupervisor returns a pointer to a new Supervisor which runs the provided services, in order.
+func NewSupervisor(startTimeout, shutdownTimeout time.Duration, services ...Service) *Supervisor {
+	return &Supervisor{
+		services:        services,
+		startTimeout:    startTimeout,
+		shutdownTimeout: shutdownTimeout,
+		ready:           make(map[string]bool),
+	}
+}
+
+// supervised is a service that a Supervisor started.
+type supervised struct {
+	service Service
+	cancel  context.CancelFunc
+	// Closed once the service's Run returns. err is what it returned.
+	done chan struct{}
+	err  error
+}
+
+// Run starts every service, waiting for each one to be ready before starting the next. Then it
+// waits until ctx is done or a service stops on its own, and stops every service that it started,
+// in reverse order. Services get until the shutdown timeout to finish up.
+//
+// It returns an error if a service couldn't start, stopped unexpectedly, or didn't finish up in
+// time.
+func (s *Supervisor) Run(ctx context.Context) error {
+	var started []*supervised
+	// Services report here when their Run returns, for whatever reason.
+	stopped := make(chan *supervised, len(s.services))
+	var err error
+	for _, service := range s.services {
+		serviceCtx, cancel := context.WithCancel(context.Background())
+		sv := &supervised{service: service, cancel: cancel, done: make(chan struct{})}
+		ready := make(chan struct{})
+		var once sync.Once
+		go func() {
+			sv.err = sv.service.Run(serviceCtx, func() { once.Do(func() { close(ready) }) })
+			close(sv.done)
+			stopped <- sv
+		}()
+		started = append(started, sv)
+
+		timer := time.NewTimer(s.startTimeout)
+		select {
+		case <-ready:
+			s.setReady(service.Name(), true)
+			slog.Info("Started service", "service", service.Name())
+		case <-sv.done:
+			err = fmt.Errorf("%s failed to start: %v", service.Name(), sv.err)
+			if sv.err == nil {
+				err = fmt.Errorf("%s stopped before it was ready", service.Name())
+			}
+		case <-timer.C:
+			err = fmt.Errorf("%s wasn't ready within %v", service.Name(), s.startTimeout)
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		if err != nil || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if err == nil && ctx.Err() == nil {
+		slog.Info("Bot is up & running. Press Ctrl+C to shut it down.")
+		select {
+		case <-ctx.Done():
+		case sv := <-stopped:
+			err = fmt.Errorf("%s stopped unexpectedly: %v", sv.service.Name(), sv.err)
+			if sv.err == nil {
+				err = fmt.Errorf("%s stopped unexpectedly", sv.service.Name())
+			}
+		}
+	}
+
+	slog.Info("Spinning down....")
+	if shutdownErr := s.stop(started); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// stop stops the provided services in reverse order, and waits for each one to finish up. If the
+// shutdown timeout passes first, the services that are left are told to stop without waiting for
+// them.
+func (s *Supervisor) stop(started []*supervised) error {
+	timer := time.NewTimer(s.shutdownTimeout)
+	defer timer.Stop()
+	for i := len(started) - 1; i >= 0; i-- {
+		sv := started[i]
+		s.setReady(sv.service.Name(), false)
+		sv.cancel()
+		select {
+		case <-sv.done:
+			if sv.err != nil {
+				slog.Error("Service stopped with an error", "service", sv.service.Name(),
+					"error", sv.err)
+			}
+		case <-timer.C:
+			for _, left := range started[:i] {
+				s.setReady(left.service.Name(), false)
+				left.cancel()
+			}
+			return fmt.Errorf("%s didn't finish up within %v", sv.service.Name(),
+				s.shutdownTimeout)
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) setReady(name string, ready bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready[name] = ready
+}
+
+// Ready reports whether every service is running and ready to do its job.
+func (s *Supervisor) Ready() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, service := range s.services {
+		if !s.ready[service.Name()] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkReady returns an error naming the services that aren't ready, if any. It's a readiness
+// check.
+func (s *Supervisor) checkReady() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var waiting []string
+	for _, service := range s.services {
+		if !s.ready[service.Name()] {
+			waiting = append(waiting, service.Name())
+		}
+	}
+	if len(waiting) > 0 {
+		return fmt.Errorf("waiting on %s", strings.Join(waiting, ", "))
+	}
+	return nil
+}
+
+// inFlight keeps track of the work that a service has underway, so that it can finish that work
+// before it stops. It's safe for concurrent use.
+type inFlight struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// add counts a piece of work as underway, unless Close was called.
+func (f *inFlight) add() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.wg.Add(1)
+	return true
+}
+
+// Do runs work, unless Close was called, in which case work is dropped and false is returned.
+func (f *inFlight) Do(work func()) bool {
+	if !f.add() {
+		return false
+	}
+	defer f.wg.Done()
+	work()
+	return true
+}
+
+// Go is like Do, but runs work in a new goroutine.
+func (f *inFlight) Go(work func()) bool {
+	if !f.add() {
+		return false
+	}
+	go func() {
+		defer f.wg.Done()
+		work()
+	}()
+	return true
+}
+
+// Close stops new work from starting, and waits for the work that's underway to finish.
+func (f *inFlight) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// serveHTTP serves HTTP requests on the provided address until ctx is done, and then waits for the
+// requests that are being served to finish. It calls ready once it's listening.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, ready func()) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: handler}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+	ready()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	// The Supervisor decides how long to wait, so don't give up on requests here.
+	return server.Shutdown(context.Background())
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeService is a Service that records when it starts and stops in a shared log.
+type fakeService struct {
+	name string
+	// If startErr isn't nil, Run returns it instead of becoming ready.
+	startErr error
+	// If it isn't nil, Run returns once this is closed, even if ctx isn't done.
+	crash chan struct{}
+	// How long Run takes to finish up once ctx is done.
+	drain time.Duration
+
+	mu  *sync.Mutex
+	log *[]string
+}
+
+func (s *fakeService) Name() string {
+	return s.name
+}
+
+func (s *fakeService) record(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*s.log = append(*s.log, event+" "+s.name)
+}
+
+func (s *fakeService) Run(ctx context.Context, ready func()) error {
+	if s.startErr != nil {
+		return s.startErr
+	}
+	s.record("start")
+	ready()
+	select {
+	case <-ctx.Done():
+	case <-s.crash:
+		return errors.New("crashed")
+	}
+	time.Sleep(s.drain)
+	s.record("stop")
+	return nil
+}
+
+// newFakeServices returns fake services with the provided names, which share a log.
+func newFakeServices(names ...string) ([]*fakeService, *[]string, *sync.Mutex) {
+	mu := &sync.Mutex{}
+	log := &[]string{}
+	var services []*fakeService
+	for _, name := range names {
+		services = append(services, &fakeService{name: name, mu: mu, log: log})
+	}
+	return services, log, mu
+}
+
+func newTestSupervisor(shutdownTimeout time.Duration, services []*fakeService) *Supervisor {
+	var list []Service
+	for _, service := range services {
+		list = append(list, service)
+	}
+	return NewSupervisor(time.Second, shutdownTimeout, list...)
+}
+
+// TestSupervisor makes sure that services are started in order, that the supervisor is ready once
+// they all are, and that they're stopped in the reverse order once the context is done.
+func TestSupervisor(t *testing.T) {
+	services, log, mu := newFakeServices("a", "b", "c")
+	supervisor := newTestSupervisor(time.Second, services)
+	if supervisor.Ready() {
+		t.Errorf("The supervisor was ready before it started anything\n")
+	}
+
+	if err := supervisor.checkReady(); err == nil || err.Error() != "waiting on a, b, c" {
+		t.Errorf("Unexpected readiness before starting. got: %v\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- supervisor.Run(ctx) }()
+	for deadline := time.Now().Add(5 * time.Second); !supervisor.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the supervisor to be ready\n")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := supervisor.checkReady(); err != nil {
+		t.Errorf("Unexpected readiness once every service started: %v\n", err)
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if supervisor.Ready() {
+		t.Errorf("The supervisor was still ready after it stopped\n")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"start a", "start b", "start c", "stop c", "stop b", "stop a"}
+	if !reflect.DeepEqual(*log, want) {
+		t.Errorf("Unexpected order.\ngot: %v\nwant: %v\n", *log, want)
+	}
+}
+
+// TestSupervisorErrors makes sure that a service that can't start keeps the ones after it from
+// starting, that a service that stops unexpectedly stops the rest, and that services that take too
+// long to finish up aren't waited for.
+func TestSupervisorErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(services []*fakeService)
+		cancel  bool
+		wantErr string
+		wantLog []string
+	}{
+		{
+			name:    "failed to start",
+			setup:   func(services []*fakeService) { services[1].startErr = errors.New("nope") },
+			wantErr: "b failed to start: nope",
+			wantLog: []string{"start a", "stop a"},
+		},
+		{
+			name: "crashed",
+			setup: func(services []*fakeService) {
+				services[1].crash = make(chan struct{})
+				close(services[1].crash)
+			},
+			wantErr: "b stopped unexpectedly: crashed",
+			wantLog: []string{"start a", "start b", "start c", "stop c", "stop a"},
+		},
+		{
+			name:    "too slow to finish up",
+			setup:   func(services []*fakeService) { services[2].drain = time.Second },
+			cancel:  true,
+			wantErr: "c didn't finish up within 50ms",
+			wantLog: []string{"start a", "start b", "start c"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			services, log, mu := newFakeServices("a", "b", "c")
+			tc.setup(services)
+			supervisor := newTestSupervisor(50*time.Millisecond, services)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				go func() {
+					for !supervisor.Ready() {
+						time.Sleep(time.Millisecond)
+					}
+					cancel()
+				}()
+			}
+
+			err := supervisor.Run(ctx)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("Unexpected error. got: %v, want: %q\n", err, tc.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(*log, tc.wantLog) {
+				t.Errorf("Unexpected order.\ngot: %v\nwant: %v\n", *log, tc.wantLog)
+			}
+		})
+	}
+}
+
+// TestInFlight makes sure that Close waits for work that's underway, and that work that's handed
+// over afterwards is dropped.
+func TestInFlight(t *testing.T) {
+	var handlers inFlight
+	release := make(chan struct{})
+	var finished bool
+	if !handlers.Go(func() {
+		<-release
+		finished = true
+	}) {
+		t.Fatalf("Work was dropped before Close was called\n")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		handlers.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Close returned while work was still underway\n")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	if !finished {
+		t.Errorf("Close returned before the work finished\n")
+	}
+
+	if handlers.Do(func() { t.Errorf("Work ran after Close was called\n") }) {
+		t.Errorf("Do reported that work ran after Close was called\n")
+	}
+}
+
+// TestServeHTTP makes sure that requests that are being served when the context is done get to
+// finish.
+func TestServeHTTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v\n", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, "finished")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() { errs <- serveHTTP(ctx, addr, handler, func() { close(ready) }) }()
+	<-ready
+
+	bodies := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		bodies <- string(body)
+	}()
+	<-started
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+	if body := <-bodies; !strings.Contains(body, "finished") {
+		t.Errorf("The request that was being served didn't finish. got: %q\n", body)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxBuckets is how many buckets a Limiter keeps track of before it throws out the ones that
+	// have refilled completely. A full bucket is no different from a bucket that was never created.
+	maxBuckets = 10000
+	// pruneInterval is how often a Limiter that has more than maxBuckets buckets looks for ones to
+	// throw out. Looking goes through every bucket, so during a flood of invocations from different
+	// users, it can't happen on every one of them.
+	pruneInterval = time.Minute
+)
+
+// ErrBadBucketConfig is returned when a bucket config string can't be parsed.
+var ErrBadBucketConfig = errors.New("bucket config must look like: <tokens>/<duration>, ex: 10/1m")
+
+// BucketConfig describes one kind of token bucket. A bucket holds at most Capacity tokens, and
+// refills at a rate of Capacity tokens per Period.
+//
+// A BucketConfig with a Capacity of 0 disables that kind of bucket.
+type BucketConfig struct {
+	Capacity float64
+	Period   time.Duration
+}
+
+// ParseBucketConfig parses a string like "10/1m" into a BucketConfig with a Capacity of 10 tokens
+// that refills over one minute.
+func ParseBucketConfig(s string) (BucketConfig, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return BucketConfig{}, ErrBadBucketConfig
+	}
+	capacity, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || capacity < 0 {
+		return BucketConfig{}, ErrBadBucketConfig
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return BucketConfig{}, ErrBadBucketConfig
+	}
+	return BucketConfig{Capacity: capacity, Period: period}, nil
+}
+
+// rate returns how many tokens are added to this kind of bucket every second.
+func (c BucketConfig) rate() float64 {
+	return c.Capacity / c.Period.Seconds()
+}
+
+// LimiterConfig describes the budgets that a Limiter hands out to each user, channel, and guild.
+type LimiterConfig struct {
+	User    BucketConfig
+	Channel BucketConfig
+	Guild   BucketConfig
+
+	// IDs of users who are never rate limited.
+	Admins []string
+}
+
+// DefaultLimiterConfig is what the bot uses when it isn't configured with any rate limits of its
+// own.
+var DefaultLimiterConfig = LimiterConfig{
+	User:    BucketConfig{Capacity: 10, Period: time.Minute},
+	Channel: BucketConfig{Capacity: 30, Period: time.Minute},
+	Guild:   BucketConfig{Capacity: 60, Period: time.Minute},
+}
+
+// Limiter keeps bot invocations from hogging the bot with a token bucket for each user, channel,
+// and guild. An invocation only goes through if all of those buckets can afford it. It's safe for
+// concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	config  LimiterConfig
+	admins  map[string]bool
+	buckets map[string]*bucket
+
+	// IDs of users who have already been told to slow down since the last time they were allowed
+	// through.
+	warned map[string]bool
+	// When buckets were last pruned.
+	pruned time.Time
+
+	// Exists so that the passage of time can be faked in tests.
+	now func() time.Time
+}
+
+// bucket is one token bucket in a Limiter.
+type bucket struct {
+	config BucketConfig
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a pointer to a new Limiter which hands out the budgets in the provided config.
+func NewLimiter(config LimiterConfig) *Limiter {
+	admins := make(map[string]bool)
+	for _, id := range config.Admins {
+		admins[id] = true
+	}
+	return &Limiter{
+		config:  config,
+		admins:  admins,
+		buckets: make(map[string]*bucket),
+		warned:  make(map[string]bool),
+		now:     time.Now,
+	}
+}
+
+// IsAdmin reports whether the provided user is an admin.
+func (l *Limiter) IsAdmin(userID string) bool {
+	return l.admins[userID]
+}
+
+// Allow reports whether an invocation that costs the provided number of tokens may go through. If
+// it may, its cost is taken out of the user's, channel's, and guild's buckets. An empty guildID
+// means that the invocation came from a direct message, and skips the guild's bucket.
+//
+// If the invocation may not go through, Allow also returns how long the caller needs to wait until
+// it would be allowed, and whether this is the first time that the user has been turned away since
+// they were last allowed through.
+func (l *Limiter) Allow(userID, channelID, guildID string, cost float64) (bool, time.Duration, bool) {
+	if l.admins[userID] {
+		return true, 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.buckets) > maxBuckets && now.Sub(l.pruned) >= pruneInterval {
+		l.prune(now)
+	}
+	buckets := []*bucket{
+		l.bucket("user/"+userID, l.config.User, now),
+		l.bucket("channel/"+channelID, l.config.Channel, now),
+	}
+	if guildID != "" {
+		buckets = append(buckets, l.bucket("guild/"+guildID, l.config.Guild, now))
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		// An invocation that costs more than a bucket could ever hold just drains that bucket.
+		need := math.Min(cost, b.config.Capacity)
+		if b.tokens < need {
+			secs := (need - b.tokens) / b.config.rate()
+			if w := time.Duration(secs * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		firstWarning := !l.warned[userID]
+		l.warned[userID] = true
+		return false, wait, firstWarning
+	}
+
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.tokens -= math.Min(cost, b.config.Capacity)
+	}
+	delete(l.warned, userID)
+	return true, 0, false
+}
+
+// bucket returns the refilled bucket stored under the provided key, creating a full one if it
+// doesn't exist yet. If the provided config disables this kind of bucket, nil is returned.
+func (l *Limiter) bucket(key string, config BucketConfig, now time.Time) *bucket {
+	if config.Capacity <= 0 {
+		return nil
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{config: config, tokens: config.Capacity, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(config.Capacity, b.tokens+now.Sub(b.last).Seconds()*config.rate())
+	b.last = now
+	return b
+}
+
+// prune throws out every bucket that would have refilled completely by now. Which users have been
+// warned is forgotten too, which at worst means that someone gets told to slow down twice.
+func (l *Limiter) prune(now time.Time) {
+	l.pruned = now
+	l.warned = make(map[string]bool)
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.config.rate() >= b.config.Capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// invocationCost returns how many tokens it costs to generate speech with the provided number of
+// words. Speech of unknown length costs as much as the shortest speech.
+func invocationCost(numWords int) float64 {
+	if numWords <= 0 {
+		return 1
+	}
+	return 1 + float64(numWords)/100
+}
+
+// slowDownMsg returns the message that's posted the first time a user gets rate limited.
+func slowDownMsg(wait time.Duration) string {
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return fmt.Sprintf("Slow down! You can use me again in %v", wait)
+}
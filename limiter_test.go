@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseBucketConfig(t *testing.T) {
+	tests := []struct {
+		s           string
+		want        BucketConfig
+		expectedErr error
+	}{
+		{"10/1m", BucketConfig{Capacity: 10, Period: time.Minute}, nil},
+		{"2.5/30s", BucketConfig{Capacity: 2.5, Period: 30 * time.Second}, nil},
+		{"0/1h", BucketConfig{Capacity: 0, Period: time.Hour}, nil},
+		{"10", BucketConfig{}, ErrBadBucketConfig},
+		{"ten/1m", BucketConfig{}, ErrBadBucketConfig},
+		{"-1/1m", BucketConfig{}, ErrBadBucketConfig},
+		{"10/forever", BucketConfig{}, ErrBadBucketConfig},
+		{"10/0s", BucketConfig{}, ErrBadBucketConfig},
+	}
+	for _, c := range tests {
+		got, err := ParseBucketConfig(c.s)
+		if err != c.expectedErr {
+			t.Errorf("Unexpected error for %q. got: %v, want: %v\n", c.s, err, c.expectedErr)
+		}
+		if got != c.want {
+			t.Errorf("Unexpected BucketConfig for %q. got: %+v, want: %+v\n", c.s, got, c.want)
+		}
+	}
+}
+
+// TestLimiterAllow makes sure that a Limiter turns away invocations that a user, channel, or guild
+// can't afford, warns users once, refills over time, and lets admins through no matter what.
+func TestLimiterAllow(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(LimiterConfig{
+		User:    BucketConfig{Capacity: 2, Period: time.Minute},
+		Channel: BucketConfig{Capacity: 3, Period: time.Minute},
+		Guild:   BucketConfig{Capacity: 0},
+		Admins:  []string{"admin"},
+	})
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := limiter.Allow("alice", "general", "guild", 1); !ok {
+			t.Fatalf("Invocation #%d was turned away, but alice's bucket should afford it.", i+1)
+		}
+	}
+	ok, wait, firstWarning := limiter.Allow("alice", "general", "guild", 1)
+	if ok || !firstWarning {
+		t.Errorf("Unexpected result after alice ran out of tokens. got: %t and %t, want: false and"+
+			" true\n", ok, firstWarning)
+	}
+	if wait != 30*time.Second {
+		t.Errorf("Unexpected wait time. got: %v, want: %v\n", wait, 30*time.Second)
+	}
+	if _, _, firstWarning = limiter.Allow("alice", "general", "guild", 1); firstWarning {
+		t.Error("Alice was warned twice in a row. Users should only be told to slow down once.")
+	}
+
+	// Bob has a bucket of their own, but shares the channel's bucket with alice.
+	if ok, _, _ := limiter.Allow("bob", "general", "guild", 1); !ok {
+		t.Error("Bob was turned away, but both their bucket and the channel's should afford it.")
+	}
+	if ok, _, _ := limiter.Allow("bob", "general", "guild", 1); ok {
+		t.Error("Bob was let through, but the channel's bucket should be empty.")
+	}
+	if ok, _, _ := limiter.Allow("bob", "random", "guild", 1); !ok {
+		t.Error("Bob was turned away in a different channel, but their bucket should afford it.")
+	}
+
+	// Expensive invocations drain a bucket instead of being turned away forever.
+	now = now.Add(time.Minute)
+	if ok, _, _ := limiter.Allow("alice", "general", "guild", 100); !ok {
+		t.Error("An expensive invocation was turned away even though alice's bucket was full.")
+	}
+	if ok, _, _ := limiter.Allow("alice", "general", "guild", 1); ok {
+		t.Error("Alice was let through, but alice's bucket should have been drained.")
+	}
+
+	for i := 0; i < 10; i++ {
+		if ok, _, _ := limiter.Allow("admin", "general", "guild", 100); !ok {
+			t.Fatal("An admin was turned away. Admins should never be rate limited.")
+		}
+	}
+}
+
+// TestLimiterPrune makes sure that a Limiter with more than maxBuckets buckets throws out the ones
+// that refilled, but doesn't look for them more than once every pruneInterval.
+func TestLimiterPrune(t *testing.T) {
+	now := time.Now()
+	limiter := NewLimiter(LimiterConfig{User: BucketConfig{Capacity: 1, Period: time.Hour}})
+	limiter.now = func() time.Time { return now }
+	// Buckets are pruned when there are more than maxBuckets of them before a new one is added.
+	for i := 0; i < maxBuckets+2; i++ {
+		limiter.Allow(strconv.Itoa(i), "general", "", 1)
+	}
+	// None of the buckets refilled, so there was nothing to throw out.
+	pruned := limiter.pruned
+	if len(limiter.buckets) != maxBuckets+2 || pruned != now {
+		t.Errorf("Unexpected buckets after a prune. got: %d, last pruned at %v, want: %d, last"+
+			" pruned at %v\n", len(limiter.buckets), pruned, maxBuckets+2, now)
+	}
+
+	now = now.Add(pruneInterval / 2)
+	limiter.Allow("alice", "general", "", 1)
+	if limiter.pruned != pruned {
+		t.Errorf("Buckets were pruned again before pruneInterval was up\n")
+	}
+
+	now = now.Add(time.Hour)
+	limiter.Allow("alice", "general", "", 1)
+	// Only alice's bucket, which was just drained again, is left.
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Unexpected number of buckets after they refilled. got: %d, want: %d\n",
+			len(limiter.buckets), 1)
+	}
+}
+
+// BenchmarkLimiterAllowFlood measures Allow while the Limiter holds more than maxBuckets buckets,
+// none of which can be thrown out yet.
+func BenchmarkLimiterAllowFlood(b *testing.B) {
+	limiter := NewLimiter(LimiterConfig{User: BucketConfig{Capacity: 1, Period: time.Hour}})
+	for i := 0; i < maxBuckets*2; i++ {
+		limiter.Allow(strconv.Itoa(i), "general", "", 1)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		limiter.Allow(strconv.Itoa(i%(maxBuckets*2)), "general", "", 1)
+	}
+}
+
+// TestBotRateLimit makes sure that the bot posts a "slow down" message the first time that a user
+// is rate limited, and then ignores them.
+func TestBotRateLimit(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	bot.limiter = NewLimiter(LimiterConfig{User: BucketConfig{Capacity: 1, Period: time.Minute}})
+	p := newFakePlatform("botID")
+	m := &Message{ChannelID: "channel", Author: User{ID: "alice"}, Content: "!foo 5"}
+
+	bot.HandleMessage(p, m)
+	if !wasMessagePosted {
+		t.Error("No message was posted for the first invocation.")
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	bot.HandleMessage(p, m)
+	want := "Slow down! You can use me again in 1m0s"
+	if postedMsg != want {
+		t.Errorf("Unexpected response after being rate limited.\ngot: %q\nwant:%q\n", postedMsg,
+			want)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	bot.HandleMessage(p, m)
+	if wasMessagePosted {
+		t.Errorf("A message was posted after being rate limited twice: %q\n", postedMsg)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"unicode/utf8"
+)
+
+// contentKey is the key that message content is logged under. Unless the config says otherwise,
+// its values are redacted.
+const contentKey = "content"
+
+// newLogger returns a logger that writes to w in the format and at the level that the provided
+// config asks for.
+func newLogger(w io.Writer, config LogSection) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(config.Level)}
+	if !config.ShowContent {
+		opts.ReplaceAttr = redactContent
+	}
+	if config.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// parseLogLevel returns the level with the provided name, like "debug". Anything it doesn't
+// recognize, like an empty string, is info.
+func parseLogLevel(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// redactContent replaces the values of attributes named contentKey with how long they were, so
+// that what people say in chat doesn't end up in logs.
+func redactContent(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != contentKey {
+		return a
+	}
+	chars := utf8.RuneCountInString(a.Value.String())
+	return slog.String(contentKey, fmt.Sprintf("[redacted %d chars]", chars))
+}
+
+type requestContextKey struct{}
+
+// request is what's known about the handling of one message, for logging.
+type request struct {
+	id     string
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// Added along the way with annotate(), and logged once the message has been handled.
+	attrs []interface{}
+}
+
+// newRequestContext returns a context for handling the provided message, which was posted on the
+// provided chat service. Everything that's logged with it is tagged with a new request ID, and with
+// where the message came from and who posted it.
+func newRequestContext(platform string, m *Message) context.Context {
+	id := newRequestID()
+	logger := slog.Default().With(
+		"request_id", id,
+		"platform", platform,
+		"guild", m.GuildID,
+		"channel", m.ChannelID,
+		"user", m.Author.ID,
+	)
+	r := &request{id: id, logger: logger}
+	return context.WithValue(context.Background(), requestContextKey{}, r)
+}
+
+// newRequestID returns a short, random ID for telling requests apart in logs.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request that ctx belongs to, or an empty string if it doesn't
+// belong to one.
+func requestID(ctx context.Context) string {
+	if r, ok := ctx.Value(requestContextKey{}).(*request); ok {
+		return r.id
+	}
+	return ""
+}
+
+// loggerFrom returns the logger of the request that ctx belongs to, or the default logger if it
+// doesn't belong to one.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if r, ok := ctx.Value(requestContextKey{}).(*request); ok {
+		return r.logger
+	}
+	return slog.Default()
+}
+
+// annotate adds key/value pairs, like the seed that text was generated with, to what's logged once
+// the request that ctx belongs to has been handled. If ctx doesn't belong to a request, nothing
+// happens.
+func annotate(ctx context.Context, args ...interface{}) {
+	if r, ok := ctx.Value(requestContextKey{}).(*request); ok {
+		r.mu.Lock()
+		r.attrs = append(r.attrs, args...)
+		r.mu.Unlock()
+	}
+}
+
+// annotations returns the key/value pairs that were added to the request that ctx belongs to.
+func annotations(ctx context.Context) []interface{} {
+	if r, ok := ctx.Value(requestContextKey{}).(*request); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return append([]interface{}(nil), r.attrs...)
+	}
+	return nil
+}
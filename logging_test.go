@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// TestNewLogger makes sure that loggers write in the configured format, leave out anything below
+// the configured level, and redact message content unless they're told not to.
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  LogSection
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "text",
+			config:  LogSection{},
+			want:    []string{`level=INFO msg=shown`, `content="[redacted 11 chars]"`},
+			notWant: []string{"hidden", "hello world"},
+		},
+		{
+			name:    "json",
+			config:  LogSection{Format: "json", Level: "debug"},
+			want:    []string{`"msg":"hidden"`, `"msg":"shown"`, `"content":"[redacted 11 chars]"`},
+			notWant: []string{"hello world"},
+		},
+		{
+			name:    "show content",
+			config:  LogSection{Level: "WARN", ShowContent: true},
+			want:    []string{`msg=warned`, `content="hello world"`},
+			notWant: []string{"shown"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(&buf, tc.config)
+			logger.Debug("hidden")
+			logger.Info("shown", contentKey, "hello world")
+			logger.Warn("warned", contentKey, "hello world")
+
+			got := buf.String()
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("Expected %q in the logs.\ngot:\n%s\n", want, got)
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("Didn't expect %q in the logs.\ngot:\n%s\n", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+// TestRequestLogging makes sure that an invocation is logged once it's handled, tagged with where
+// it came from, and with what happened while it was handled.
+func TestRequestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&buf, LogSection{Format: "json"}))
+
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("logging", "!", hmm)
+	p := newFakePlatform("botID")
+	bot.HandleMessage(p, &Message{
+		GuildID:   "guild",
+		ChannelID: "channel",
+		Author:    User{ID: "someone"},
+		Content:   "!logging 3",
+	})
+	wasMessagePosted = false
+	postedMsg = ""
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected exactly one JSON log line: %v\ngot:\n%s\n", err, buf.String())
+	}
+	for key, want := range map[string]interface{}{
+		"msg":      "Handled invocation",
+		"platform": "fake",
+		"guild":    "guild",
+		"channel":  "channel",
+		"user":     "someone",
+		"command":  plainInvocation,
+		"persona":  "logging",
+		"outcome":  outcomeOK,
+		contentKey: "[redacted 10 chars]",
+	} {
+		if entry[key] != want {
+			t.Errorf("Unexpected %s. got: %v, want: %v\n", key, entry[key], want)
+		}
+	}
+	for _, key := range []string{"request_id", "seed", "latency", "generation_latency"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("Expected %s to be logged\n", key)
+		}
+	}
+}
+
+// TestAnnotate makes sure that annotations only stick to the request that they were added to.
+func TestAnnotate(t *testing.T) {
+	ctx := newRequestContext("fake", &Message{Author: User{ID: "someone"}})
+	annotate(ctx, "seed", 42)
+	annotate(context.Background(), "seed", 7)
+
+	got := annotations(ctx)
+	if len(got) != 2 || got[0] != "seed" || got[1] != 42 {
+		t.Errorf("Unexpected annotations: %v\n", got)
+	}
+	if got := annotations(context.Background()); got != nil {
+		t.Errorf("Expected no annotations outside of a request. got: %v\n", got)
+	}
+	if loggerFrom(context.Background()) != slog.Default() {
+		t.Errorf("Expected the default logger outside of a request\n")
+	}
+}
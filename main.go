@@ -1,47 +1,200 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
-	"path"
+	"os/signal"
+	"syscall"
 
 	_ "github.com/joho/godotenv/autoload"
+	"go.opentelemetry.io/otel"
 )
 
 const (
 	corporaDirName = "corpora"
-	maxRetries     = 20
+	// defaultMaxRetries is how many sentences' worth of retries a persona gets unless it's
+	// configured with some other number.
+	defaultMaxRetries = 20
+
+	// defaultSlackListenAddr is where the bot listens for requests from Slack unless
+	// SLACK_LISTEN_ADDR is set.
+	defaultSlackListenAddr = ":3000"
 )
 
 func main() {
-	botname := os.Getenv("BOT_NAME")
-	prefix := os.Getenv("BOT_PREFIX")
-	token := os.Getenv("BOT_TOKEN")
-	filename := os.Getenv("FILENAME")
+	args := os.Args[1:]
+	// serve returns instead of exiting itself, so that its deferred cleanup, like closing the
+	// store, runs first.
+	if len(args) == 0 {
+		os.Exit(serve(nil))
+	}
+	if args[0] == "serve" {
+		os.Exit(serve(args[1:]))
+	}
 
-	// Read the corpus file and "train" a hidden Markov model.
-	file, err := os.Open(path.Join(corporaDirName, filename))
-	if err != nil {
-		log.Fatalf("Failed to open corpus file: %v\n", err)
+	err := runCLI(args, os.Stdout, os.Stderr)
+	switch err {
+	case nil, flag.ErrHelp:
+	case errUsage:
+		os.Exit(2)
+	default:
+		fmt.Fprintf(os.Stderr, "hmm-discord-bot %s: %v\n", args[0], err)
+		os.Exit(1)
 	}
-	defer file.Close()
-	content, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Fatalf("Failed to read corpus file: %v\n", err)
+}
+
+// serve loads the config, and runs the bot, along with every chat service and anything else that's
+// configured, until the process is interrupted or terminated. Then it gives them
+// bot.shutdown_timeout to finish up what they're doing. It returns the process's exit code.
+func serve(args []string) int {
+	config, err := loadConfig(args, os.Getenv, os.Stderr)
+	switch err {
+	case nil:
+	case flag.ErrHelp:
+		return 0
+	case errUsage:
+		return 2
+	default:
+		return fatal("Failed to load config", err)
 	}
-	hmm, err := NewHMM(string(content), maxRetries)
-	if err != nil {
-		log.Fatalf("Failed to create a new HMM object: %v\n", err)
+	slog.SetDefault(newLogger(os.Stderr, config.Log))
+
+	// Read every persona's corpus file and "train" a hidden Markov model. The same goes for
+	// reloads, which happen whenever the config file or a corpus file changes, when the process
+	// gets a SIGHUP, or when an admin asks for one.
+	personas := NewPersonas()
+	reloader := NewReloader(personas, func() (Config, error) {
+		return loadConfig(args, os.Getenv, ioutil.Discard)
+	})
+	reloader.interval = config.reloadInterval()
+	if _, err := reloader.Apply(config); err != nil {
+		return fatal("Failed to load personas", err)
 	}
+	persona, _ := personas.Get("")
 
-	// Create a Discord bot and spin it up.
-	bot, err := NewBot(botname, prefix, token, hmm)
+	// Create a bot, and everything that it runs alongside. They're started in this order, and
+	// stopped in the reverse order, so chat services stop handing the bot messages before anything
+	// that handling a message relies on stops.
+	bot, err := NewBot(config.Bot.Name, config.Bot.Prefix, persona.HMM)
 	if err != nil {
-		log.Fatalf("Failed to create new Discord bot: %v\n", err)
+		return fatal("Failed to create new bot", err)
 	}
-	err = bot.Start()
-	if err != nil {
-		log.Fatalf("Failed to spin up Discord bot: %v\n", err)
+	bot.allowNSFW = config.Bot.AllowNSFW
+	bot.limiter = NewLimiter(config.limiterConfig())
+	bot.sampling = config.Sampling
+	bot.personas = personas
+	bot.reloader = reloader
+	health := NewHealth()
+	health.AddReadiness("models", personas.checkModels)
+	var services []Service
+	if config.Tracing.Endpoint != "" {
+		// Started first and stopped last, so that it exports every other service's spans.
+		t, err := NewTracer(config.Tracing.Endpoint)
+		if err != nil {
+			return fatal("Failed to set up tracing", err)
+		}
+		otel.SetTracerProvider(t.Provider())
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			slog.Warn("Tracing ran into a problem", "error", err)
+		}))
+		services = append(services, t)
+	}
+	if config.Persistence.Dir != "" {
+		store, err := OpenBoltStore(config.Persistence.Dir)
+		if err != nil {
+			return fatal("Failed to open the store", err)
+		}
+		defer store.Close()
+		bot.optOuts = NewOptOuts(store)
+		bot.settings = NewSettings(store, defaultSettings(config.Bot.Prefix))
+		// Started before the chat services and stopped after them, so that its last snapshot has
+		// everything that they handled.
+		snapshots := NewSnapshots(store, bot.channels, bot.feedback)
+		if err := snapshots.Load(); err != nil {
+			return fatal("Failed to load snapshots", err)
+		}
+		services = append(services, snapshots)
+	}
+	services = append(services, reloader)
+	if config.Metrics.Addr != "" {
+		services = append(services, &metricsService{addr: config.Metrics.Addr,
+			registry: metrics.registry})
 	}
+	if config.Health.Addr != "" {
+		services = append(services, &healthService{addr: config.Health.Addr, health: health})
+	}
+	if config.API.Addr != "" {
+		api, err := NewAPI(config.apiConfig(), personas)
+		if err != nil {
+			return fatal("Failed to create HTTP API", err)
+		}
+		services = append(services, api)
+	}
+	if config.IRC.Server != "" {
+		services = append(services, newIRCService(config.ircConfig(), bot))
+	}
+	if config.Slack.BotToken != "" {
+		slack, err := NewSlack(SlackConfig{
+			BotToken:      config.Slack.BotToken,
+			SigningSecret: config.Slack.SigningSecret,
+			ListenAddr:    config.Slack.ListenAddr,
+		}, bot)
+		if err != nil {
+			return fatal("Failed to create new Slack bot", err)
+		}
+		services = append(services, slack)
+	}
+	if config.Telegram.Token != "" {
+		telegram, err := NewTelegram(TelegramConfig{Token: config.Telegram.Token}, bot)
+		if err != nil {
+			return fatal("Failed to create new Telegram bot", err)
+		}
+		services = append(services, telegram)
+	}
+	if config.Matrix.Homeserver != "" {
+		matrix, err := NewMatrix(MatrixConfig{
+			Homeserver:  config.Matrix.Homeserver,
+			AccessToken: config.Matrix.AccessToken,
+		}, bot)
+		if err != nil {
+			return fatal("Failed to create new Matrix bot", err)
+		}
+		services = append(services, matrix)
+	}
+	if config.Discord.Token != "" {
+		discord, err := NewDiscord(config.Discord.Token, bot)
+		if err != nil {
+			return fatal("Failed to create new Discord bot", err)
+		}
+		stallTimeout := config.stallTimeout()
+		health.AddReadiness("discord", discord.checkSession)
+		health.AddLiveness("discord", func() error { return discord.checkHeartbeat(stallTimeout) })
+		services = append(services, discord)
+	}
+
+	// Run until Ctrl+C is pressed, or the process is interrupted or terminated.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sc := make(chan os.Signal, 1)
+		signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
+		<-sc
+		cancel()
+	}()
+	supervisor := NewSupervisor(defaultStartTimeout, config.shutdownTimeout(), services...)
+	health.AddReadiness("services", supervisor.checkReady)
+	if err := supervisor.Run(ctx); err != nil {
+		return fatal("Bot stopped", err)
+	}
+	return 0
+}
+
+// fatal logs that the bot can't keep going because of err, and returns the exit code for that.
+func fatal(msg string, err error) int {
+	slog.Error(msg, "error", err)
+	return 1
 }
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMatrixSyncTimeout is how long each sync waits for something to happen before the
+	// homeserver gives up and responds with nothing new.
+	defaultMatrixSyncTimeout = 30 * time.Second
+	// matrixRetryDelay is how long to wait before syncing again after a sync fails.
+	matrixRetryDelay = 5 * time.Second
+	// matrixClientPath is the prefix of every client-server API endpoint.
+	matrixClientPath = "/_matrix/client/v3"
+)
+
+// ErrMatrixNoHomeserver is returned when a Matrix is created without a homeserver or access token.
+var ErrMatrixNoHomeserver = errors.New("no Matrix homeserver or access token was configured")
+
+// MatrixConfig describes how to connect to a Matrix homeserver.
+type MatrixConfig struct {
+	// The homeserver's base URL, like "https://matrix.example.org".
+	Homeserver string
+	// An access token for the bot's account.
+	AccessToken string
+	// How long each sync may wait. Defaults to defaultMatrixSyncTimeout.
+	SyncTimeout time.Duration
+}
+
+// Matrix connects a Bot to a Matrix homeserver. It syncs with the homeserver to find out about new
+// messages in the rooms that the bot is in, hands them to its Bot, and is the Platform that the Bot
+// talks back through. It joins every room that it's invited to.
+type Matrix struct {
+	config MatrixConfig
+	bot    *Bot
+	client *http.Client
+
+	// Messages that are being handled.
+	handlers inFlight
+
+	mu     sync.Mutex
+	userID string
+	// Counts up to make every sent event's transaction ID unique.
+	txnCount int64
+
+	// Exists so that the passage of time can be faked in tests.
+	sleep func(time.Duration)
+}
+
+// NewMatrix returns a pointer to a new Matrix initialized with the provided config and the Bot to
+// hand messages to.
+func NewMatrix(config MatrixConfig, bot *Bot) (*Matrix, error) {
+	if config.Homeserver == "" || config.AccessToken == "" {
+		return nil, ErrMatrixNoHomeserver
+	}
+	config.Homeserver = strings.TrimRight(config.Homeserver, "/")
+	if config.SyncTimeout <= 0 {
+		config.SyncTimeout = defaultMatrixSyncTimeout
+	}
+
+	return &Matrix{
+		config: config,
+		bot:    bot,
+		// Leave room for a sync to run its course.
+		client: &http.Client{Timeout: config.SyncTimeout + 30*time.Second},
+		sleep:  time.Sleep,
+	}, nil
+}
+
+// Run looks up who the bot is, and then syncs with the homeserver until ctx is done. Then it lets
+// the messages that are being handled finish up. Messages that were sent before the bot started
+// aren't handed to the Bot, so that it doesn't answer old invocations.
+func (mx *Matrix) Run(ctx context.Context, ready func()) error {
+	defer mx.handlers.Close()
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := mx.call(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return err
+	}
+	mx.mu.Lock()
+	mx.userID = whoami.UserID
+	mx.mu.Unlock()
+	slog.Info("Connected to Matrix homeserver", "homeserver", mx.config.Homeserver,
+		"user", whoami.UserID)
+	ready()
+
+	since := ""
+	for {
+		params := url.Values{}
+		if since == "" {
+			params.Set("timeout", "0")
+		} else {
+			params.Set("since", since)
+			timeout := int64(mx.config.SyncTimeout / time.Millisecond)
+			params.Set("timeout", strconv.FormatInt(timeout, 10))
+		}
+		var resp matrixSyncResponse
+		err := mx.call(ctx, http.MethodGet, "/sync?"+params.Encode(), nil, &resp)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("Failed to sync with Matrix homeserver, retrying", "error", err,
+				"delay", matrixRetryDelay)
+			mx.sleep(matrixRetryDelay)
+			continue
+		}
+
+		for roomID := range resp.Rooms.Invite {
+			mx.join(ctx, roomID)
+		}
+		// Only pay attention to what's new since the first sync.
+		if since != "" {
+			for roomID, room := range resp.Rooms.Join {
+				for _, event := range room.Timeline.Events {
+					mx.handleEvent(roomID, event)
+				}
+			}
+		}
+		since = resp.NextBatch
+	}
+}
+
+// matrixSyncResponse is the part of a /sync response that a Matrix cares about.
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// matrixEvent is an event in a room, like a message being sent.
+type matrixEvent struct {
+	Type    string             `json:"type"`
+	EventID string             `json:"event_id"`
+	Sender  string             `json:"sender"`
+	Content matrixEventContent `json:"content"`
+}
+
+// matrixEventContent is the content of an m.room.message event.
+type matrixEventContent struct {
+	MsgType  string `json:"msgtype"`
+	Body     string `json:"body"`
+	Mentions *struct {
+		UserIDs []string `json:"user_ids"`
+	} `json:"m.mentions,omitempty"`
+}
+
+// isText reports whether an event is a plain text message.
+func (e matrixEvent) isText() bool {
+	return e.Type == "m.room.message" && e.Content.MsgType == "m.text"
+}
+
+// join joins the room with the provided ID.
+func (mx *Matrix) join(ctx context.Context, roomID string) {
+	err := mx.call(ctx, http.MethodPost, "/join/"+url.PathEscape(roomID), struct{}{}, nil)
+	if err != nil {
+		slog.Warn("Failed to join Matrix room", "room", roomID, "error", err)
+		return
+	}
+	slog.Info("Joined Matrix room", "room", roomID)
+}
+
+// handleEvent hands text messages to the Bot. Matrix user IDs look like "@alice:example.org", so
+// words that look like that are treated as mentions, along with any users in the message's
+// m.mentions.
+func (mx *Matrix) handleEvent(roomID string, event matrixEvent) {
+	if !event.isText() {
+		return
+	}
+
+	m := &Message{
+		ID:        event.EventID,
+		ChannelID: roomID,
+		Author:    User{ID: event.Sender, Name: event.Sender},
+		Content:   event.Content.Body,
+	}
+	mentioned := make(map[string]bool)
+	if event.Content.Mentions != nil {
+		for _, userID := range event.Content.Mentions.UserIDs {
+			mentioned[userID] = true
+			m.Mentions = append(m.Mentions, User{ID: userID, Name: userID})
+		}
+	}
+	for _, word := range strings.Fields(event.Content.Body) {
+		if strings.HasPrefix(word, "@") && strings.Contains(word, ":") && !mentioned[word] {
+			mentioned[word] = true
+			m.Mentions = append(m.Mentions, User{ID: word, Name: word})
+		}
+	}
+
+	// Generating speech can take a while, so don't hold up syncing while it happens.
+	mx.handlers.Go(func() { mx.bot.HandleMessage(mx, m) })
+}
+
+// Name returns "matrix".
+func (mx *Matrix) Name() string {
+	return "matrix"
+}
+
+// SelfID returns the bot's user ID, which is looked up when the Matrix starts.
+func (mx *Matrix) SelfID() string {
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+	return mx.userID
+}
+
+// Reply sends an m.text message to the provided room.
+func (mx *Matrix) Reply(ctx context.Context, channelID, msg string) {
+	content := matrixEventContent{MsgType: "m.text", Body: msg}
+	if err := mx.sendEvent(channelID, content); err != nil {
+		loggerFrom(ctx).Error("Failed to send message to Matrix room", "error", err)
+	}
+}
+
+// SendFile uploads a file to the homeserver's media repository, and then sends it to the provided
+// room as an m.file message.
+func (mx *Matrix) SendFile(channelID, name string, r io.Reader) error {
+	endpoint := fmt.Sprintf("%s/_matrix/media/v3/upload?filename=%s", mx.config.Homeserver,
+		url.QueryEscape(name))
+	req, err := http.NewRequest(http.MethodPost, endpoint, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var upload struct {
+		ContentURI string `json:"content_uri"`
+	}
+	if err := mx.do(req, &upload); err != nil {
+		return err
+	}
+
+	content := map[string]string{"msgtype": "m.file", "body": name, "url": upload.ContentURI}
+	return mx.sendEvent(channelID, content)
+}
+
+// FetchMessages pages backwards through a room's history with the /messages endpoint.
+func (mx *Matrix) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	var contents []string
+	from := ""
+
+	for page := 0; page < maxHistoryPages && len(contents) < limit; page++ {
+		params := url.Values{}
+		params.Set("dir", "b")
+		params.Set("limit", strconv.Itoa(maxMessagesPerPage))
+		if from != "" {
+			params.Set("from", from)
+		}
+		var resp struct {
+			Chunk []matrixEvent `json:"chunk"`
+			End   string        `json:"end"`
+		}
+		path := "/rooms/" + url.PathEscape(channelID) + "/messages?" + params.Encode()
+		if err := mx.call(context.Background(), http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, event := range resp.Chunk {
+			if len(contents) == limit {
+				break
+			}
+			if !event.isText() || !include(event.Sender) {
+				continue
+			}
+			if content := strings.TrimSpace(event.Content.Body); content != "" {
+				contents = append(contents, content)
+			}
+		}
+
+		// The homeserver leaves out the end token once there's nothing older.
+		if resp.End == "" || len(resp.Chunk) == 0 {
+			break
+		}
+		from = resp.End
+	}
+
+	return contents, nil
+}
+
+// IsNSFW always reports false, since Matrix rooms can't be marked as NSFW.
+func (mx *Matrix) IsNSFW(channelID string) (bool, error) {
+	return false, nil
+}
+
+// sendEvent sends an m.room.message event with the provided content to a room. Sends that fail
+// because the homeserver is rate limiting the bot, or having a bad day, are retried with backoff.
+func (mx *Matrix) sendEvent(roomID string, content interface{}) error {
+	// Reusing the transaction ID across retries keeps the homeserver from sending the message
+	// twice.
+	txnID := fmt.Sprintf("hmm%d.%d", time.Now().UnixNano(), atomic.AddInt64(&mx.txnCount, 1))
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), txnID)
+
+	for attempt := 1; ; attempt++ {
+		err := mx.call(context.Background(), http.MethodPut, path, content, nil)
+		if err == nil {
+			return nil
+		}
+		wait := defaultBaseBackoff << (attempt - 1)
+		if apiErr, ok := err.(*MatrixError); ok {
+			if apiErr.Status != http.StatusTooManyRequests && apiErr.Status < 500 {
+				return err
+			}
+			if apiErr.RetryAfter > 0 {
+				wait = apiErr.RetryAfter
+			}
+		}
+		if attempt >= defaultMaxAttempts {
+			return err
+		}
+		mx.sleep(wait)
+	}
+}
+
+// MatrixError is an error that a homeserver responded with.
+type MatrixError struct {
+	Status  int
+	ErrCode string
+	Message string
+	// How long the homeserver wants the bot to wait before trying again, if it's being rate
+	// limited.
+	RetryAfter time.Duration
+}
+
+func (e *MatrixError) Error() string {
+	return fmt.Sprintf("matrix API error %d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+// call calls a client-server API endpoint with the provided body encoded as JSON, if it isn't nil,
+// and decodes the response into out if it isn't nil. The call is abandoned if ctx is done first.
+func (mx *Matrix) call(ctx context.Context, method, path string, body interface{},
+	out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	endpoint := mx.config.Homeserver + matrixClientPath + path
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return mx.do(req, out)
+}
+
+// do sends a request to the homeserver with the bot's access token, and decodes the response into
+// out if it isn't nil.
+func (mx *Matrix) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+mx.config.AccessToken)
+	resp, err := mx.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			ErrCode      string `json:"errcode"`
+			Error        string `json:"error"`
+			RetryAfterMS int64  `json:"retry_after_ms"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return &MatrixError{
+			Status:     resp.StatusCode,
+			ErrCode:    apiErr.ErrCode,
+			Message:    apiErr.Error,
+			RetryAfter: time.Duration(apiErr.RetryAfterMS) * time.Millisecond,
+		}
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testMatrixToken = "syt_test_token"
+
+// fakeHomeserver is a local, in-process stand-in for a Matrix homeserver. It only implements the
+// endpoints that a Matrix uses.
+type fakeHomeserver struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Each room's messages, oldest first.
+	rooms map[string][]matrixEvent
+	// IDs of rooms that the bot has been invited to, but hasn't joined yet.
+	invites map[string]bool
+	// How many of each room's messages have been handed out by /sync.
+	synced   map[string]int
+	newEvent chan struct{}
+	// Messages sent with /send, in the order that they were sent.
+	sent chan matrixSent
+	// Transaction IDs that have been seen, so that retries aren't sent twice.
+	txnIDs map[string]bool
+	// Status codes to fail the next /send calls with.
+	sendFailures []int
+	// Names of the files uploaded to the media repository.
+	uploads []string
+}
+
+// matrixSent is a message sent with /send.
+type matrixSent struct {
+	RoomID  string
+	Content map[string]string
+}
+
+// newFakeHomeserver starts a fake homeserver that's shut down when the test finishes.
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	fake := &fakeHomeserver{
+		rooms:    make(map[string][]matrixEvent),
+		invites:  make(map[string]bool),
+		synced:   make(map[string]int),
+		newEvent: make(chan struct{}, 1),
+		sent:     make(chan matrixSent, 10),
+		txnIDs:   make(map[string]bool),
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+// addMessages posts m.text messages to a room, as if they had been sent by the user with the
+// provided ID. The last provided message is the newest one.
+func (f *fakeHomeserver) addMessages(roomID, userID string, bodies ...string) {
+	f.mu.Lock()
+	for _, body := range bodies {
+		f.rooms[roomID] = append(f.rooms[roomID], matrixEvent{
+			Type:    "m.room.message",
+			EventID: "$" + strconv.Itoa(len(f.rooms[roomID])),
+			Sender:  userID,
+			Content: matrixEventContent{MsgType: "m.text", Body: body},
+		})
+	}
+	f.mu.Unlock()
+	f.notify()
+}
+
+// invite invites the bot to a room.
+func (f *fakeHomeserver) invite(roomID string) {
+	f.mu.Lock()
+	f.invites[roomID] = true
+	f.mu.Unlock()
+	f.notify()
+}
+
+// notify wakes up a /sync that's waiting for something to happen.
+func (f *fakeHomeserver) notify() {
+	select {
+	case f.newEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakeHomeserver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testMatrixToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"errcode": "M_UNKNOWN_TOKEN", "error": "Invalid access token",
+		})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, matrixClientPath)
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case path == "/account/whoami":
+		json.NewEncoder(w).Encode(map[string]string{"user_id": "@foo:example.org"})
+	case path == "/sync":
+		f.serveSync(w, r)
+	case parts[0] == "join" && len(parts) == 2 && r.Method == http.MethodPost:
+		f.mu.Lock()
+		delete(f.invites, parts[1])
+		if _, ok := f.rooms[parts[1]]; !ok {
+			f.rooms[parts[1]] = nil
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"room_id": parts[1]})
+	case parts[0] == "rooms" && len(parts) == 3 && parts[2] == "messages":
+		f.serveMessages(w, r, parts[1])
+	case parts[0] == "rooms" && len(parts) == 5 && parts[2] == "send" && r.Method == http.MethodPut:
+		f.serveSend(w, r, parts[1], parts[4])
+	case r.URL.Path == "/_matrix/media/v3/upload" && r.Method == http.MethodPost:
+		f.mu.Lock()
+		f.uploads = append(f.uploads, r.URL.Query().Get("filename"))
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"content_uri": "mxc://example.org/abc123"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"errcode": "M_UNRECOGNIZED", "error": "Unrecognized request",
+		})
+	}
+}
+
+// serveSync hands out the invites and messages that the client hasn't seen yet. If there aren't
+// any, it waits for a little while for something to happen.
+func (f *fakeHomeserver) serveSync(w http.ResponseWriter, r *http.Request) {
+	for attempt := 0; attempt < 2; attempt++ {
+		var resp matrixSyncResponse
+		resp.Rooms.Invite = make(map[string]json.RawMessage)
+		resp.Rooms.Join = make(map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		})
+		news := false
+
+		f.mu.Lock()
+		for roomID := range f.invites {
+			resp.Rooms.Invite[roomID] = json.RawMessage(`{}`)
+			news = true
+		}
+		for roomID, events := range f.rooms {
+			if f.synced[roomID] == len(events) {
+				continue
+			}
+			room := resp.Rooms.Join[roomID]
+			room.Timeline.Events = events[f.synced[roomID]:]
+			resp.Rooms.Join[roomID] = room
+			f.synced[roomID] = len(events)
+			news = true
+		}
+		f.mu.Unlock()
+
+		resp.NextBatch = "s" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if news || attempt == 1 || r.URL.Query().Get("timeout") == "0" {
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		select {
+		case <-f.newEvent:
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveMessages pages backwards through a room's messages. Tokens are indexes into the room's
+// messages.
+func (f *fakeHomeserver) serveMessages(w http.ResponseWriter, r *http.Request, roomID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	events, ok := f.rooms[roomID]
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{
+			"errcode": "M_FORBIDDEN", "error": "You aren't a member of the room",
+		})
+		return
+	}
+
+	from := len(events)
+	if token := r.URL.Query().Get("from"); token != "" {
+		from, _ = strconv.Atoi(token)
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	to := from - limit
+	if to < 0 {
+		to = 0
+	}
+	var chunk []matrixEvent
+	for i := from - 1; i >= to; i-- {
+		chunk = append(chunk, events[i])
+	}
+	resp := map[string]interface{}{"chunk": chunk}
+	if to > 0 {
+		resp["end"] = strconv.Itoa(to)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveSend records a sent message, unless its transaction ID has been seen before.
+func (f *fakeHomeserver) serveSend(w http.ResponseWriter, r *http.Request, roomID, txnID string) {
+	f.mu.Lock()
+	if len(f.sendFailures) > 0 {
+		status := f.sendFailures[0]
+		f.sendFailures = f.sendFailures[1:]
+		f.mu.Unlock()
+		resp := map[string]interface{}{"errcode": "M_UNKNOWN", "error": http.StatusText(status)}
+		if status == http.StatusTooManyRequests {
+			resp["errcode"] = "M_LIMIT_EXCEEDED"
+			resp["retry_after_ms"] = 1500
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	seen := f.txnIDs[txnID]
+	f.txnIDs[txnID] = true
+	f.mu.Unlock()
+
+	if !seen {
+		var content map[string]string
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &content)
+		f.sent <- matrixSent{RoomID: roomID, Content: content}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"event_id": "$sent" + txnID})
+}
+
+// waitForSent returns the next message sent to the fake homeserver, or fails the test if nothing
+// is sent soon.
+func (f *fakeHomeserver) waitForSent(t *testing.T) matrixSent {
+	t.Helper()
+	select {
+	case sent := <-f.sent:
+		return sent
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a message to be sent to Matrix\n")
+		return matrixSent{}
+	}
+}
+
+// newTestMatrix returns a Matrix that talks to the provided fake homeserver, and whose bot is
+// named "foo" with a "!" prefix.
+func newTestMatrix(t *testing.T, fake *fakeHomeserver) *Matrix {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	mx, err := NewMatrix(MatrixConfig{
+		Homeserver:  fake.server.URL,
+		AccessToken: testMatrixToken,
+		SyncTimeout: time.Second,
+	}, bot)
+	if err != nil {
+		t.Fatalf("Failed to create new Matrix: %v\n", err)
+	}
+	mx.sleep = func(time.Duration) {}
+	return mx
+}
+
+// TestMatrix makes sure that a Matrix joins rooms that it's invited to, hands new messages to the
+// bot, sends its replies as m.text messages, and doesn't answer invocations from before it
+// started.
+func TestMatrix(t *testing.T) {
+	fake := newFakeHomeserver(t)
+	fake.addMessages("!old:example.org", "@bob:example.org", "!foo 3")
+	mx := newTestMatrix(t, fake)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- mx.Run(ctx, func() {}) }()
+	defer func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Errorf("Matrix stopped with an error: %v\n", err)
+		}
+	}()
+
+	fake.invite("!room:example.org")
+	// Wait for the bot to join.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fake.mu.Lock()
+		_, joined := fake.rooms["!room:example.org"]
+		fake.mu.Unlock()
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the bot to join a room it was invited to\n")
+		}
+	}
+
+	fake.addMessages("!room:example.org", "@bob:example.org", "!foo 3")
+	got := fake.waitForSent(t)
+	if got.RoomID != "!room:example.org" || got.Content["msgtype"] != "m.text" ||
+		len(strings.Fields(got.Content["body"])) != 3 {
+		t.Errorf("Unexpected reply to a bot invocation: %+v\n", got)
+	}
+
+	fake.addMessages("!room:example.org", "@alice:example.org", "hello there friend")
+	fake.addMessages("!room:example.org", "@bob:example.org", "!foo imitate @alice:example.org")
+	got = fake.waitForSent(t)
+	if got.Content["body"] == "" {
+		t.Errorf("Unexpected reply to an imitate invocation: %+v\n", got)
+	}
+	for _, word := range strings.Fields(got.Content["body"]) {
+		if !strings.Contains("hello there friend", word) {
+			t.Errorf("Imitation contains a word that alice never said: %q\n", word)
+		}
+	}
+
+	select {
+	case extra := <-fake.sent:
+		t.Errorf("Unexpected extra message sent: %+v\n", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestMatrixFetchMessages makes sure that a room's history is paged through, and that messages from
+// excluded users are skipped.
+func TestMatrixFetchMessages(t *testing.T) {
+	fake := newFakeHomeserver(t)
+	mx := newTestMatrix(t, fake)
+	for i := 0; i < 150; i++ {
+		fake.addMessages("!room:example.org", "@alice:example.org", "alice "+strconv.Itoa(i))
+		fake.addMessages("!room:example.org", "@bob:example.org", "bob "+strconv.Itoa(i))
+	}
+	include := func(authorID string) bool { return authorID == "@alice:example.org" }
+
+	got, err := mx.FetchMessages("!room:example.org", 3, include)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v\n", err)
+	}
+	want := []string{"alice 149", "alice 148", "alice 147"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected messages. got: %q, want: %q\n", got, want)
+	}
+
+	// Fetching every one of Alice's messages takes more than one page.
+	got, err = mx.FetchMessages("!room:example.org", 1000, include)
+	if err != nil {
+		t.Fatalf("FetchMessages failed: %v\n", err)
+	}
+	if len(got) != 150 {
+		t.Errorf("Unexpected number of messages. got: %d, want: %d\n", len(got), 150)
+	}
+
+	if _, err := mx.FetchMessages("!nope:example.org", 10, include); err == nil {
+		t.Errorf("Expected an error fetching a room that the bot isn't in\n")
+	}
+}
+
+// TestMatrixSendRetries makes sure that sends which fail because of rate limiting or server errors
+// are retried without sending the message twice, and that other failures are given up on.
+func TestMatrixSendRetries(t *testing.T) {
+	fake := newFakeHomeserver(t)
+	mx := newTestMatrix(t, fake)
+	var slept []time.Duration
+	mx.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	fake.mu.Lock()
+	fake.sendFailures = []int{http.StatusTooManyRequests, http.StatusBadGateway}
+	fake.mu.Unlock()
+	mx.Reply(context.Background(), "!room:example.org", "hello")
+	if got := fake.waitForSent(t); got.Content["body"] != "hello" {
+		t.Errorf("Unexpected message sent: %+v\n", got)
+	}
+	want := []time.Duration{1500 * time.Millisecond, 2 * defaultBaseBackoff}
+	if !reflect.DeepEqual(slept, want) {
+		t.Errorf("Unexpected waits between retries. got: %v, want: %v\n", slept, want)
+	}
+
+	fake.mu.Lock()
+	fake.sendFailures = []int{http.StatusForbidden}
+	fake.mu.Unlock()
+	if err := mx.sendEvent("!room:example.org", matrixEventContent{MsgType: "m.text"}); err == nil {
+		t.Errorf("Expected a send that failed permanently to return an error\n")
+	}
+
+	if err := mx.SendFile("!room:example.org", "model.txt", strings.NewReader("hi")); err != nil {
+		t.Fatalf("SendFile failed: %v\n", err)
+	}
+	got := fake.waitForSent(t)
+	if got.Content["msgtype"] != "m.file" || got.Content["url"] != "mxc://example.org/abc123" {
+		t.Errorf("Unexpected file message sent: %+v\n", got)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !reflect.DeepEqual(fake.uploads, []string{"model.txt"}) {
+		t.Errorf("Unexpected uploads. got: %q\n", fake.uploads)
+	}
+}
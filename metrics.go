@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes that invocations are counted under.
+const (
+	outcomeOK          = "ok"
+	outcomeInvalid     = "invalid"
+	outcomeRateLimited = "rate_limited"
+	outcomeDenied      = "denied"
+	outcomeFailed      = "failed"
+)
+
+// botMetrics is everything that the bot keeps count of.
+type botMetrics struct {
+	registry *prometheus.Registry
+
+	invocations       *prometheus.CounterVec
+	generationSeconds *prometheus.HistogramVec
+	generationWords   *prometheus.HistogramVec
+	discordSendErrors *prometheus.CounterVec
+	rateLimited       *prometheus.CounterVec
+	modelWords        *prometheus.GaugeVec
+	modelTransitions  *prometheus.GaugeVec
+	reloads           *prometheus.CounterVec
+	feedback          *prometheus.CounterVec
+}
+
+// newBotMetrics returns a pointer to a new botMetrics, with every metric registered in its own
+// registry.
+func newBotMetrics() *botMetrics {
+	m := &botMetrics{
+		registry: prometheus.NewRegistry(),
+		invocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hmm_invocations_total",
+			Help: "Bot invocations, by command, persona, and outcome.",
+		}, []string{"command", "persona", "outcome"}),
+		generationSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hmm_generation_duration_seconds",
+			Help:    "How long generating text took.",
+			Buckets: []float64{.0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"persona"}),
+		generationWords: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "hmm_generation_words",
+			Help:    "How many words were generated.",
+			Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"persona"}),
+		discordSendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hmm_discord_send_errors_total",
+			Help: "Failed attempts to send a message to Discord, by Discord's error code or HTTP " +
+				"status.",
+		}, []string{"code"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hmm_rate_limited_total",
+			Help: "Invocations and API requests that were turned away by rate limits.",
+		}, []string{"platform"}),
+		modelWords: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hmm_model_words",
+			Help: "Distinct words in each persona's model.",
+		}, []string{"persona"}),
+		modelTransitions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hmm_model_transitions",
+			Help: "Distinct word-to-word transitions in each persona's model.",
+		}, []string{"persona"}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hmm_reloads_total",
+			Help: "Reloads of the config and personas, by outcome.",
+		}, []string{"outcome"}),
+		feedback: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "hmm_feedback_total",
+			Help: "Reactions on generated messages that were taken as feedback, by persona and " +
+				"vote.",
+		}, []string{"persona", "vote"}),
+	}
+	m.registry.MustRegister(m.invocations, m.generationSeconds, m.generationWords,
+		m.discordSendErrors, m.rateLimited, m.modelWords, m.modelTransitions, m.reloads,
+		m.feedback)
+	return m
+}
+
+// metrics is where the whole bot keeps count. It's served on /metrics when metrics.addr is set.
+var metrics = newBotMetrics()
+
+// observeGeneration records how long it took to generate some text with the provided persona's
+// model, which started at start, and how many words came out.
+func (m *botMetrics) observeGeneration(persona string, start time.Time, text string) {
+	m.generationSeconds.WithLabelValues(persona).Observe(time.Since(start).Seconds())
+	m.generationWords.WithLabelValues(persona).Observe(float64(len(strings.Fields(text))))
+}
+
+// observeModel records the size of a persona's model.
+func (m *botMetrics) observeModel(persona string, hmm *HMM) {
+	stats := hmm.Stats()
+	m.modelWords.WithLabelValues(persona).Set(float64(stats.Words))
+	m.modelTransitions.WithLabelValues(persona).Set(float64(stats.Transitions))
+}
+
+// forgetModel stops reporting the size of a persona's model, once the persona is gone.
+func (m *botMetrics) forgetModel(persona string) {
+	m.modelWords.DeleteLabelValues(persona)
+	m.modelTransitions.DeleteLabelValues(persona)
+}
+
+// metricsService serves a Registry's metrics on /metrics.
+type metricsService struct {
+	addr     string
+	registry *prometheus.Registry
+}
+
+// Name returns "metrics".
+func (s *metricsService) Name() string {
+	return "metrics"
+}
+
+// Run serves metrics until ctx is done.
+func (s *metricsService) Run(ctx context.Context, ready func()) error {
+	slog.Info("Serving metrics", "addr", s.addr, "path", "/metrics")
+	return serveHTTP(ctx, s.addr, s.handler(), ready)
+}
+
+// handler returns a handler that serves the registry's metrics on /metrics.
+func (s *metricsService) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	return mux
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMetricsService makes sure that metrics are served for Prometheus to scrape, and that models'
+// sizes stop being reported once their personas are gone.
+func TestMetricsService(t *testing.T) {
+	m := newBotMetrics()
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	m.observeModel("foo", hmm)
+	m.observeModel("bar", hmm)
+	m.forgetModel("bar")
+	m.reloads.WithLabelValues("success").Inc()
+	m.reloads.WithLabelValues("success").Inc()
+
+	server := httptest.NewServer((&metricsService{registry: m.registry}).handler())
+	defer server.Close()
+	want := `# HELP hmm_model_words Distinct words in each persona's model.
+# TYPE hmm_model_words gauge
+hmm_model_words{persona="foo"} 8
+# HELP hmm_reloads_total Reloads of the config and personas, by outcome.
+# TYPE hmm_reloads_total counter
+hmm_reloads_total{outcome="success"} 2
+`
+	err := testutil.ScrapeAndCompare(server.URL+"/metrics", strings.NewReader(want),
+		"hmm_model_words", "hmm_reloads_total")
+	if err != nil {
+		t.Errorf("Unexpected metrics: %v\n", err)
+	}
+}
+
+// histogramCount returns how many values were added to a histogram.
+func histogramCount(t *testing.T, h prometheus.Observer) uint64 {
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("Failed to read a histogram: %v\n", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// TestBotMetrics makes sure that invocations are counted by command, persona, and outcome, and that
+// generations and rate limits are recorded.
+func TestBotMetrics(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("metrics", "!", hmm)
+	bot.limiter = NewLimiter(LimiterConfig{User: BucketConfig{Capacity: 1, Period: time.Hour}})
+	p := newFakePlatform("botID")
+
+	invocations := func(command, persona, outcome string) float64 {
+		return testutil.ToFloat64(metrics.invocations.WithLabelValues(command, persona, outcome))
+	}
+	okBefore := invocations(plainInvocation, "metrics", outcomeOK)
+	invalidBefore := invocations(plainInvocation, "metrics", outcomeInvalid)
+	limitedBefore := invocations(plainInvocation, "metrics", outcomeRateLimited)
+	optOutBefore := invocations(optOutCmd, "", outcomeOK)
+	rateLimitedBefore := testutil.ToFloat64(metrics.rateLimited.WithLabelValues("fake"))
+	generations := metrics.generationWords.WithLabelValues("metrics")
+	generationsBefore := histogramCount(t, generations)
+
+	for _, content := range []string{"!metrics 3", "!metrics 0", "!metrics 3", "!metrics optout"} {
+		bot.HandleMessage(p, &Message{Author: User{ID: "someone"}, Content: content})
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	for _, tc := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"ok invocations", invocations(plainInvocation, "metrics", outcomeOK), okBefore + 1},
+		{"invalid invocations", invocations(plainInvocation, "metrics", outcomeInvalid),
+			invalidBefore + 1},
+		{"rate limited invocations", invocations(plainInvocation, "metrics", outcomeRateLimited),
+			limitedBefore + 1},
+		{"opt outs", invocations(optOutCmd, "", outcomeOK), optOutBefore + 1},
+		{"rate limit rejections", testutil.ToFloat64(metrics.rateLimited.WithLabelValues("fake")),
+			rateLimitedBefore + 1},
+		{"generations", float64(histogramCount(t, generations)), float64(generationsBefore + 1)},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Unexpected number of %s. got: %v, want: %v\n", tc.name, tc.got, tc.want)
+		}
+	}
+}
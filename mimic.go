@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// imitateCmd is the argument that asks the bot to talk like another user.
+	imitateCmd = "imitate"
+	// channelCmd is the argument that asks the bot to talk like the channel it was invoked in.
+	channelCmd = "channel"
+
+	// defaultImitateMsgs is how many of a user's messages are fetched to imitate them when no
+	// number is provided in the bot invocation.
+	defaultImitateMsgs = 100
+	// defaultChannelMsgs is how many of a channel's messages are fetched to mimic it when no number
+	// is provided in the bot invocation.
+	defaultChannelMsgs = 200
+	// maxMimicMsgs is the most messages that may be fetched to build a throwaway HMM.
+	maxMimicMsgs = 1000
+	// modelCacheSize is how many throwaway HMMs are kept around at once.
+	modelCacheSize = 32
+	// modelCacheTTL is how long a throwaway HMM is reused for before it's built again from newer
+	// messages.
+	modelCacheTTL = 5 * time.Minute
+)
+
+// imitate responds to a bot invocation like "!botname imitate @user 50" by building an HMM from
+// the mentioned user's recent messages in the channel, and then generating speech with it.
+func (b *Bot) imitate(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s @someone <numMessages>`", b.invocation(p, m),
+		imitateCmd)
+	if len(m.Mentions) != 1 {
+		p.Reply(m.Context(), m.ChannelID, "Mention exactly one person to imitate. "+usage)
+		return outcomeInvalid
+	}
+	user := m.Mentions[0]
+	if b.optOuts.Has(platformID(p, user.ID)) {
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("%s has opted out of being imitated", user.Name))
+		return outcomeDenied
+	}
+
+	numMsgs, errMsg := parseNumMsgs(arguments, defaultImitateMsgs, usage)
+	if errMsg != "" {
+		p.Reply(m.Context(), m.ChannelID, errMsg)
+		return outcomeInvalid
+	}
+	if !b.allow(p, m, invocationCost(numMsgs)) {
+		return outcomeRateLimited
+	}
+
+	key := fmt.Sprintf("%s/%s/%d", platformID(p, user.ID), m.ChannelID, numMsgs)
+	isAuthor := func(authorID string) bool { return authorID == user.ID }
+	hmm, errMsg := b.modelFromHistory(p, m, key, numMsgs, isAuthor)
+	if errMsg != "" {
+		p.Reply(m.Context(), m.ChannelID, errMsg)
+		return outcomeFailed
+	}
+	if hmm == nil {
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("%s hasn't said anything here that I can imitate", user.Name))
+		return outcomeFailed
+	}
+
+	b.reply(p, m, hmm)
+	return outcomeOK
+}
+
+// mimicChannel responds to a bot invocation like "!botname channel 300" by building an HMM from
+// the channel's most recent messages, and then generating speech with it.
+//
+// Messages posted by the bot and by users who opted out are left out of the HMM. Channels that are
+// marked as NSFW are refused unless the bot was configured to allow them.
+func (b *Bot) mimicChannel(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s <numMessages>`", b.invocation(p, m), channelCmd)
+	numMsgs, errMsg := parseNumMsgs(arguments, defaultChannelMsgs, usage)
+	if errMsg != "" {
+		p.Reply(m.Context(), m.ChannelID, errMsg)
+		return outcomeInvalid
+	}
+	if !b.allow(p, m, invocationCost(numMsgs)) {
+		return outcomeRateLimited
+	}
+
+	if !b.allowNSFW {
+		nsfw, err := p.IsNSFW(m.ChannelID)
+		if err != nil {
+			p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("Couldn't look up this channel: %v", err))
+			return outcomeFailed
+		}
+		if nsfw {
+			p.Reply(m.Context(), m.ChannelID, "I'm not allowed to mimic NSFW channels")
+			return outcomeDenied
+		}
+	}
+
+	include := func(authorID string) bool {
+		return authorID != p.SelfID() && !b.optOuts.Has(platformID(p, authorID))
+	}
+	// Channels move on quickly, and mimicking one should go by what's being said now, so the model
+	// isn't cached.
+	hmm, errMsg := b.modelFromHistory(p, m, "", numMsgs, include)
+	if errMsg != "" {
+		p.Reply(m.Context(), m.ChannelID, errMsg)
+		return outcomeFailed
+	}
+	if hmm == nil {
+		p.Reply(m.Context(), m.ChannelID, "Nobody has said anything here that I can mimic")
+		return outcomeFailed
+	}
+
+	b.reply(p, m, hmm)
+	return outcomeOK
+}
+
+// reply generates speech with a throwaway HMM, and replies with it.
+func (b *Bot) reply(p Platform, m *Message, hmm *HMM) {
+	_, span := startSpan(m.Context(), "generate")
+	start := time.Now()
+	speech := hmm.GenerateSpeech()
+	span.End()
+	// Throwaway HMMs don't belong to any persona.
+	metrics.observeGeneration("", start, speech)
+	p.Reply(m.Context(), m.ChannelID, speech)
+}
+
+// modelFromHistory returns the HMM cached under the provided key. If there isn't one, a new HMM is
+// trained on up to numMsgs of the recent messages in m's channel whose authors are accepted by
+// include, and then cached. If key is empty, the HMM is always trained anew, and isn't cached.
+//
+// If there weren't any messages to train on, both return values are empty. If something went
+// wrong, the second return value is a message that describes the problem for chat users.
+func (b *Bot) modelFromHistory(p Platform, m *Message, key string, numMsgs int,
+	include func(authorID string) bool) (*HMM, string) {
+	_, span := startSpan(m.Context(), "lookup_model", attribute.Int("messages", numMsgs))
+	defer span.End()
+	if hmm, ok := b.models.Get(key); key != "" && ok {
+		span.SetAttributes(attribute.Bool("cached", true))
+		return hmm, ""
+	}
+	span.SetAttributes(attribute.Bool("cached", false))
+
+	msgs, err := p.FetchMessages(m.ChannelID, numMsgs, include)
+	if err != nil {
+		setSpanError(span, err)
+		return nil, fmt.Sprintf("Couldn't read this channel's history: %v", err)
+	}
+	corpus := buildCorpus(msgs, b.invocation(p, m))
+	if corpus == "" {
+		return nil, ""
+	}
+	hmm, err := NewHMM(corpus, b.model().maxRetries)
+	if err != nil {
+		return nil, fmt.Sprintf("Something went wrong: %v", err)
+	}
+	if key != "" {
+		b.models.Add(key, hmm)
+	}
+	return hmm, ""
+}
+
+// parseNumMsgs looks through a mimic command's arguments for the number of messages to fetch,
+// skipping over mentions. If no number is provided, defaultNumMsgs is returned. The number is
+// capped at maxMimicMsgs.
+//
+// If the arguments are invalid, the second return value is a message that explains why, followed
+// by the provided usage instructions.
+func parseNumMsgs(arguments []string, defaultNumMsgs int, usage string) (int, string) {
+	for _, arg := range arguments {
+		// Skip over mentions, which look like "<@1234>" on Discord and Slack, or "@nick" elsewhere.
+		if strings.HasPrefix(arg, "<@") || strings.HasPrefix(arg, "@") {
+			continue
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return 0, fmt.Sprintf("%q is not a number. %s", arg, usage)
+		}
+		if n < 1 {
+			return 0, "Can't build a model without reading any messages"
+		}
+		if n > maxMimicMsgs {
+			n = maxMimicMsgs
+		}
+		return n, ""
+	}
+	return defaultNumMsgs, ""
+}
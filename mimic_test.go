@@ -0,0 +1,201 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImitate makes sure that the bot responds to "imitate" invocations with speech built from the
+// mentioned user's messages, and that the model it builds is reused on later invocations.
+func TestImitate(t *testing.T) {
+	p := &countingPlatform{fakePlatform: newFakePlatform("botID")}
+	channelID := "channel"
+	p.addMessages(channelID, "alice", "hello there friend", "!foo imitate <@bob>")
+	p.addMessages(channelID, "bob", "roll up and roll out")
+
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	alice := User{ID: "alice", Name: "alice"}
+	newInvocation := func(content string, mentions ...User) *Message {
+		return &Message{
+			ChannelID: channelID,
+			Author:    User{ID: "bob"},
+			Content:   content,
+			Mentions:  mentions,
+		}
+	}
+
+	bot.HandleMessage(p, newInvocation("!foo imitate <@alice> 10", alice))
+	if !wasMessagePosted {
+		t.Fatal("No message was posted after asking the bot to imitate someone.")
+	}
+	vocab := map[string]bool{"hello": true, "there": true, "friend": true}
+	for _, word := range strings.Fields(postedMsg) {
+		if !vocab[word] {
+			t.Errorf("Imitation contained a word that %q never said: %q\n", alice.ID, word)
+		}
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	// A second invocation should hit the model cache instead of the platform.
+	now := time.Now()
+	bot.models.now = func() time.Time { return now }
+	fetches := p.fetches
+	bot.HandleMessage(p, newInvocation("!foo imitate <@alice> 10", alice))
+	if p.fetches != fetches {
+		t.Error("The channel's history was fetched again, even though a model for the same user," +
+			" channel, and number of messages was already cached.")
+	}
+	// Asking for a different number of messages builds a new model.
+	bot.HandleMessage(p, newInvocation("!foo imitate <@alice> 20", alice))
+	if p.fetches != fetches+1 {
+		t.Error("The cached model was used, even though it was built from a different number of" +
+			" messages.")
+	}
+
+	// Once the cached model is too old, what alice said since then shows up.
+	p.addMessages(channelID, "alice", "goodbye")
+	now = now.Add(modelCacheTTL)
+	bot.HandleMessage(p, newInvocation("!foo imitate <@alice> 10", alice))
+	model, _ := bot.models.Get("fake/alice/" + channelID + "/10")
+	if p.fetches != fetches+2 || model == nil || model.probMap["goodbye"] == nil {
+		t.Errorf("Expected an expired model to be built again from alice's new messages. fetches:"+
+			" %d, want: %d\n", p.fetches-fetches, 2)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	tests := []struct {
+		invocation *Message
+		want       string
+	}{
+		{
+			newInvocation("!foo imitate"),
+			"Mention exactly one person to imitate. Example usage: `!foo imitate @someone" +
+				" <numMessages>`",
+		},
+		{
+			newInvocation("!foo imitate <@alice> lots", alice),
+			"\"lots\" is not a number. Example usage: `!foo imitate @someone <numMessages>`",
+		},
+		{
+			newInvocation("!foo imitate <@alice> 0", alice),
+			"Can't build a model without reading any messages",
+		},
+		{
+			newInvocation("!foo imitate <@carol>", User{ID: "carol", Name: "carol"}),
+			"carol hasn't said anything here that I can imitate",
+		},
+	}
+	for _, c := range tests {
+		bot.HandleMessage(p, c.invocation)
+		if postedMsg != c.want {
+			t.Errorf("Unexpected response for %q.\ngot: %q\nwant:%q\n",
+				c.invocation.Content, postedMsg, c.want)
+		}
+		wasMessagePosted = false
+		postedMsg = ""
+	}
+}
+
+// TestMimicChannel makes sure that the bot responds to "channel" invocations with speech built from
+// the channel's messages, leaving out messages from the bot and from users who opted out, that new
+// messages show up right away, and that NSFW channels are refused.
+func TestMimicChannel(t *testing.T) {
+	p := newFakePlatform("botID")
+	channelID := "channel"
+	p.addMessages(channelID, "alice", "hello there friend")
+	p.addMessages(channelID, "bob", "roll up and roll out")
+	p.addMessages(channelID, "botID", "beep boop")
+	nsfwChannelID := "nsfw"
+	p.nsfw[nsfwChannelID] = true
+	p.addMessages(nsfwChannelID, "alice", "hello there friend")
+
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	newInvocation := func(channelID, authorID, content string) *Message {
+		return &Message{ChannelID: channelID, Author: User{ID: authorID}, Content: content}
+	}
+
+	// Bob opts out, so only alice's words should show up.
+	bot.HandleMessage(p, newInvocation(channelID, "bob", "!foo optout"))
+	wasMessagePosted = false
+	postedMsg = ""
+	bot.HandleMessage(p, newInvocation(channelID, "alice", "!foo channel 50"))
+	if !wasMessagePosted {
+		t.Fatal("No message was posted after asking the bot to mimic a channel.")
+	}
+	vocab := map[string]bool{"hello": true, "there": true, "friend": true}
+	for _, word := range strings.Fields(postedMsg) {
+		if !vocab[word] {
+			t.Errorf("Channel mimicry contained a word that shouldn't have been learned: %q\n", word)
+		}
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	// What's said after the channel was mimicked shows up the next time.
+	mimicLatest := func() map[string]bool {
+		postedMsg = ""
+		bot.HandleMessage(p, newInvocation(channelID, "alice", "!foo channel 1"))
+		words := make(map[string]bool)
+		for _, word := range strings.Fields(postedMsg) {
+			words[word] = true
+		}
+		return words
+	}
+	if got := mimicLatest(); !got["hello"] && !got["there"] && !got["friend"] {
+		t.Errorf("Expected alice's latest message to be mimicked. got: %q\n", postedMsg)
+	}
+	p.addMessages(channelID, "alice", "zebra crossing")
+	if got := mimicLatest(); len(got) == 0 || got["hello"] || got["there"] || got["friend"] {
+		t.Errorf("Expected only alice's new message to be mimicked. got: %q\n", postedMsg)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	// Opted out users can't be imitated either.
+	bob := User{ID: "bob", Name: "bob"}
+	m := newInvocation(channelID, "alice", "!foo imitate <@bob>")
+	m.Mentions = []User{bob}
+	bot.HandleMessage(p, m)
+	want := "bob has opted out of being imitated"
+	if postedMsg != want {
+		t.Errorf("Unexpected response for imitating an opted out user.\ngot: %q\nwant:%q\n",
+			postedMsg, want)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	bot.HandleMessage(p, newInvocation(nsfwChannelID, "alice", "!foo channel"))
+	want = "I'm not allowed to mimic NSFW channels"
+	if postedMsg != want {
+		t.Errorf("Unexpected response for mimicking an NSFW channel.\ngot: %q\nwant:%q\n",
+			postedMsg, want)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+
+	bot.allowNSFW = true
+	bot.HandleMessage(p, newInvocation(nsfwChannelID, "alice", "!foo channel"))
+	if !wasMessagePosted || postedMsg == want {
+		t.Errorf("An NSFW channel wasn't mimicked even though NSFW channels were allowed. got: %q\n",
+			postedMsg)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+}
+
+// countingPlatform is a fakePlatform that counts how many times a channel's history was fetched.
+type countingPlatform struct {
+	*fakePlatform
+	fetches int
+}
+
+func (p *countingPlatform) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	p.fetches++
+	return p.fakePlatform.FetchMessages(channelID, limit, include)
+}
@@ -0,0 +1,60 @@
+package main
+
+const (
+	// optOutCmd is the argument that keeps the invoking user's messages out of throwaway HMMs.
+	optOutCmd = "optout"
+	// optInCmd is the argument that undoes optOutCmd.
+	optInCmd = "optin"
+)
+
+// OptOuts is a set of the IDs of users who don't want their messages to be used to build HMMs. IDs
+// are prefixed with the name of the chat service that they came from. It's kept in a Store, so that
+// nobody has to opt out again after a restart. It's safe for concurrent use.
+type OptOuts struct {
+	store Store
+}
+
+// NewOptOuts returns a pointer to a new OptOuts which is kept in the provided Store.
+func NewOptOuts(store Store) *OptOuts {
+	return &OptOuts{store: store}
+}
+
+// Add marks the provided user as opted out.
+func (o *OptOuts) Add(userID string) error {
+	return o.store.Put(optOutsBucket, userID, nil)
+}
+
+// Remove marks the provided user as opted in.
+func (o *OptOuts) Remove(userID string) error {
+	return o.store.Delete(optOutsBucket, userID)
+}
+
+// Has reports whether the provided user has opted out.
+func (o *OptOuts) Has(userID string) bool {
+	_, ok := o.store.Get(optOutsBucket, userID)
+	return ok
+}
+
+// optOut responds to a bot invocation like "!botname optout". Every cached HMM is thrown out, since
+// any of them might have been trained on the invoking user's messages.
+func (b *Bot) optOut(p Platform, m *Message) string {
+	if err := b.optOuts.Add(platformID(p, m.Author.ID)); err != nil {
+		loggerFrom(m.Context()).Error("Failed to opt a user out", "error", err)
+		p.Reply(m.Context(), m.ChannelID, "Something went wrong. Try again in a bit")
+		return outcomeFailed
+	}
+	b.models.Clear()
+	p.Reply(m.Context(), m.ChannelID, "Got it. I won't learn from anything you say anymore")
+	return outcomeOK
+}
+
+// optIn responds to a bot invocation like "!botname optin".
+func (b *Bot) optIn(p Platform, m *Message) string {
+	if err := b.optOuts.Remove(platformID(p, m.Author.ID)); err != nil {
+		loggerFrom(m.Context()).Error("Failed to opt a user in", "error", err)
+		p.Reply(m.Context(), m.ChannelID, "Something went wrong. Try again in a bit")
+		return outcomeFailed
+	}
+	p.Reply(m.Context(), m.ChannelID, "Welcome back! I'll learn from what you say again")
+	return outcomeOK
+}
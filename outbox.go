@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// maxMsgLength is the most characters that Discord lets a message have.
+	maxMsgLength = 2000
+
+	// defaultMaxAttempts is how many times an Outbox tries to send a message before giving up.
+	defaultMaxAttempts = 5
+	// defaultBaseBackoff is how long an Outbox waits before its first retry. Every retry after that
+	// waits twice as long as the one before it.
+	defaultBaseBackoff = 500 * time.Millisecond
+)
+
+// msgTooLongNotice is posted in place of a generated message that Discord wouldn't accept.
+const msgTooLongNotice = "The generated message was too long. Discord doesn't let messages that are" +
+	" longer than 2000 characters go through."
+
+// Failure reasons that aren't Discord error codes.
+const (
+	failureTooLong = "too_long"
+	failureNetwork = "network"
+	failureOther   = "other"
+)
+
+// sendOptions are passed along with every request that an Outbox sends. Rate limits are handed
+// back to the Outbox instead of being waited out by discordgo, so that they're counted and
+// retried like every other failure.
+var sendOptions = []discordgo.RequestOption{discordgo.WithRetryOnRatelimit(false)}
+
+// Outbox delivers messages to Discord channels in the background. Messages to the same channel are
+// delivered one at a time in the order that they were posted, while different channels don't hold
+// each other up.
+//
+// Transient failures, like Discord having a bad day or a connection getting reset, are retried
+// with exponential backoff. Rate limits are retried once Discord says that they're up. Failures
+// that retrying won't fix, like missing permissions, are given up on right away. Either way, every
+// failure is counted in the Outbox's stats.
+//
+// discordgo already retries requests that Discord answered with a 502 before it hands back an
+// error. The Outbox leaves those to it, so that an endpoint that's already struggling doesn't get
+// even more requests.
+type Outbox struct {
+	mu     sync.Mutex
+	queues map[string][]outboundMsg
+	stats  DeliveryStats
+	// Tracks messages that haven't been delivered or given up on yet.
+	pending sync.WaitGroup
+
+	maxAttempts int
+	baseBackoff time.Duration
+
+	// Exist so that Discord and the passage of time can be faked in tests.
+	send  func(s *discordgo.Session, channelID, msg string, actions []Action) (string, error)
+	sleep func(time.Duration)
+}
+
+// outboundMsg is a message waiting in an Outbox's queue.
+type outboundMsg struct {
+	// Context of the request that the message answers.
+	ctx     context.Context
+	session *discordgo.Session
+	msg     string
+	// When the message was posted.
+	posted time.Time
+	// Buttons to put under the message.
+	actions []Action
+	// If sent isn't nil, it's called with the ID that Discord gave the message once it's delivered.
+	sent func(messageID string)
+}
+
+// DeliveryStats is a snapshot of how things have gone for an Outbox so far.
+type DeliveryStats struct {
+	// Number of messages that were delivered.
+	Sent int
+	// Number of times that sending a message had to be retried.
+	Retries int
+	// Number of messages that were given up on, keyed by the reason why. Reasons are either
+	// Discord's JSON error codes, HTTP status codes prefixed with "http_", "too_long", "network",
+	// or "other".
+	Failures map[string]int
+}
+
+// NewOutbox returns a pointer to a new, empty Outbox.
+func NewOutbox() *Outbox {
+	return &Outbox{
+		queues:      make(map[string][]outboundMsg),
+		stats:       DeliveryStats{Failures: make(map[string]int)},
+		maxAttempts: defaultMaxAttempts,
+		baseBackoff: defaultBaseBackoff,
+		send: func(s *discordgo.Session, channelID, msg string, actions []Action) (string, error) {
+			if len(actions) > 0 {
+				return sendWithButtons(s, channelID, msg, actions, sendOptions...)
+			}
+			m, err := s.ChannelMessageSend(channelID, msg, sendOptions...)
+			if err != nil {
+				return "", err
+			}
+			return m.ID, nil
+		},
+		sleep: time.Sleep,
+	}
+}
+
+// Post queues a message for delivery to the provided channel and returns right away. If nothing is
+// being delivered to that channel yet, a goroutine is started to work through its queue. ctx is
+// the context of the request that the message answers, and is used for logging.
+func (o *Outbox) Post(ctx context.Context, session *discordgo.Session, channelID, msg string) {
+	o.PostTracked(ctx, session, channelID, msg, nil, nil)
+}
+
+// PostTracked is like Post, but the message gets buttons for the provided actions, and sent is
+// called with the message's ID once it's delivered. sent isn't called if the message is given up
+// on, or if a notice had to be sent in its place.
+func (o *Outbox) PostTracked(ctx context.Context, session *discordgo.Session, channelID,
+	msg string, actions []Action, sent func(messageID string)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending.Add(1)
+	queue, busy := o.queues[channelID]
+	o.queues[channelID] = append(queue, outboundMsg{
+		ctx:     ctx,
+		session: session,
+		msg:     msg,
+		posted:  time.Now(),
+		actions: actions,
+		sent:    sent,
+	})
+	if !busy {
+		go o.drain(channelID)
+	}
+}
+
+// Wait blocks until every message that has been posted so far has either been delivered or given
+// up on.
+func (o *Outbox) Wait() {
+	o.pending.Wait()
+}
+
+// Stats returns a snapshot of the Outbox's delivery stats.
+func (o *Outbox) Stats() DeliveryStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := o.stats
+	stats.Failures = make(map[string]int, len(o.stats.Failures))
+	for reason, n := range o.stats.Failures {
+		stats.Failures[reason] = n
+	}
+	return stats
+}
+
+// drain delivers the provided channel's queued messages one at a time until the queue is empty.
+// Only one drain runs for a channel at any given time; a channel has a queue in o.queues for
+// exactly as long as its drain is running.
+func (o *Outbox) drain(channelID string) {
+	for {
+		o.mu.Lock()
+		queue := o.queues[channelID]
+		if len(queue) == 0 {
+			delete(o.queues, channelID)
+			o.mu.Unlock()
+			return
+		}
+		next := queue[0]
+		o.queues[channelID] = queue[1:]
+		o.mu.Unlock()
+
+		o.deliver(next, channelID)
+		o.pending.Done()
+	}
+}
+
+// deliver sends a message to the provided channel, retrying it as many times as it makes sense
+// to.
+func (o *Outbox) deliver(out outboundMsg, channelID string) {
+	logger := loggerFrom(out.ctx)
+	msg, actions, sent := out.msg, out.actions, out.sent
+	if utf8.RuneCountInString(msg) > maxMsgLength {
+		logger.Warn("Generated message is too long for Discord, so a notice is being sent instead",
+			"chars", utf8.RuneCountInString(msg))
+		o.recordFailure(failureTooLong)
+		// Let people know why the message they asked for never showed up.
+		msg, actions, sent = msgTooLongNotice, nil, nil
+	}
+
+	for attempt := 1; ; attempt++ {
+		_, span := startClientSpan(out.ctx, "discord.create_message",
+			attribute.String("channel", channelID), attribute.Int("attempt", attempt))
+		messageID, err := o.send(out.session, channelID, msg, actions)
+		setSpanError(span, err)
+		span.End()
+		if err == nil {
+			o.mu.Lock()
+			o.stats.Sent++
+			o.mu.Unlock()
+			logger.Debug("Delivered message", "attempts", attempt,
+				"delivery_latency", time.Since(out.posted))
+			if sent != nil {
+				sent(messageID)
+			}
+			return
+		}
+
+		reason, transient := classifyDeliveryErr(err)
+		metrics.discordSendErrors.WithLabelValues(reason).Inc()
+		if !transient || attempt == o.maxAttempts {
+			logger.Error("Failed to deliver message", "attempts", attempt, "reason", reason,
+				"error", err)
+			o.recordFailure(reason)
+			return
+		}
+
+		o.mu.Lock()
+		o.stats.Retries++
+		o.mu.Unlock()
+		backoff := o.baseBackoff << (attempt - 1)
+		var rateLimitErr *discordgo.RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			// Discord said how long to wait.
+			backoff = rateLimitErr.RetryAfter
+		}
+		o.sleep(backoff)
+	}
+}
+
+// recordFailure counts a message that was given up on for the provided reason.
+func (o *Outbox) recordFailure(reason string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stats.Failures[reason]++
+}
+
+// classifyDeliveryErr figures out why a message couldn't be sent. It returns a short reason that
+// failures are counted under, and whether trying again later might work.
+func classifyDeliveryErr(err error) (string, bool) {
+	var rateLimitErr *discordgo.RateLimitError
+	var restErr *discordgo.RESTError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &rateLimitErr):
+		return "http_" + strconv.Itoa(http.StatusTooManyRequests), true
+	case errors.As(err, &restErr) && restErr.Response != nil:
+		status := restErr.Response.StatusCode
+		reason := "http_" + strconv.Itoa(status)
+		if restErr.Message != nil && restErr.Message.Code != 0 {
+			reason = strconv.Itoa(restErr.Message.Code)
+		}
+		// Anything in the 4xx range means that the request itself was bad, so sending it again
+		// won't help.
+		return reason, status >= http.StatusInternalServerError
+	case errors.As(err, &netErr), errors.Is(err, discordgo.ErrJSONUnmarshal):
+		// The request never made it to Discord, or Discord's response was garbled.
+		return failureNetwork, true
+	default:
+		// discordgo gave up on the request itself, like after it ran out of retries for 502s.
+		return failureOther, false
+	}
+}
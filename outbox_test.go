@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestOutbox returns an Outbox which records how long it would have slept instead of sleeping,
+// along with a session to send messages with.
+func newTestOutbox() (*Outbox, *discordgo.Session, *[]time.Duration) {
+	var mu sync.Mutex
+	var sleeps []time.Duration
+	outbox := NewOutbox()
+	outbox.sleep = func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		sleeps = append(sleeps, d)
+	}
+	session, _ := discordgo.New("Bot token")
+	return outbox, session, &sleeps
+}
+
+// TestOutboxOrdering makes sure that messages to the same channel arrive in the order that they
+// were posted, even when some of them have to be retried.
+func TestOutboxOrdering(t *testing.T) {
+	fake := newFakeDiscord(t)
+	fake.sendFailures = []fakeFailure{
+		{http.StatusInternalServerError, "{}"},
+		{http.StatusServiceUnavailable, "{}"},
+	}
+	outbox, session, sleeps := newTestOutbox()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("message %d", i)
+		want = append(want, msg)
+		outbox.Post(context.Background(), session, "channel", msg)
+	}
+	outbox.Wait()
+	outbox.Post(context.Background(), session, "other", "hello")
+	outbox.Wait()
+
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages arrived out of order.\ngot: %q\nwant: %q\n", got, want)
+	}
+	if got := fake.sent["other"]; len(got) != 1 {
+		t.Errorf("Unexpected number of messages in a second channel. got: %d, want: %d\n",
+			len(got), 1)
+	}
+	stats := outbox.Stats()
+	if stats.Sent != 21 || stats.Retries != 2 || len(stats.Failures) != 0 {
+		t.Errorf("Unexpected delivery stats. got: %+v, want: 21 sent, 2 retries, no failures\n",
+			stats)
+	}
+	wantSleeps := []time.Duration{defaultBaseBackoff, 2 * defaultBaseBackoff}
+	if !reflect.DeepEqual(*sleeps, wantSleeps) {
+		t.Errorf("Unexpected backoff. got: %v, want: %v\n", *sleeps, wantSleeps)
+	}
+}
+
+// TestOutboxFailures makes sure that failures are given up on when they should be, and that they
+// show up in an Outbox's stats.
+func TestOutboxFailures(t *testing.T) {
+	fake := newFakeDiscord(t)
+	outbox, session, _ := newTestOutbox()
+	permissionErrs := metrics.discordSendErrors.WithLabelValues("50013")
+	serverErrs := metrics.discordSendErrors.WithLabelValues("http_500")
+	permissionErrsBefore, serverErrsBefore := testutil.ToFloat64(permissionErrs),
+		testutil.ToFloat64(serverErrs)
+
+	// Permanent failures aren't retried.
+	fake.sendFailures = []fakeFailure{
+		{http.StatusForbidden, `{"code": 50013, "message": "Missing Permissions"}`},
+	}
+	outbox.Post(context.Background(), session, "channel", "hello")
+	outbox.Wait()
+
+	// Transient failures are retried until the Outbox runs out of attempts.
+	for i := 0; i < defaultMaxAttempts; i++ {
+		fake.sendFailures = append(fake.sendFailures,
+			fakeFailure{http.StatusInternalServerError, "{}"})
+	}
+	outbox.Post(context.Background(), session, "channel", "hello")
+	outbox.Wait()
+
+	// Messages that are too long are replaced with a notice.
+	outbox.Post(context.Background(), session, "channel", strings.Repeat("a", maxMsgLength+1))
+	outbox.Wait()
+
+	stats := outbox.Stats()
+	wantFailures := map[string]int{"50013": 1, "http_500": 1, failureTooLong: 1}
+	if !reflect.DeepEqual(stats.Failures, wantFailures) {
+		t.Errorf("Unexpected failures. got: %v, want: %v\n", stats.Failures, wantFailures)
+	}
+	if stats.Retries != defaultMaxAttempts-1 {
+		t.Errorf("Unexpected number of retries. got: %d, want: %d\n", stats.Retries,
+			defaultMaxAttempts-1)
+	}
+	// Every failed attempt shows up in metrics, including the ones that were retried.
+	if got := testutil.ToFloat64(permissionErrs) - permissionErrsBefore; got != 1 {
+		t.Errorf("Unexpected number of 50013 send errors. got: %v, want: %v\n", got, 1)
+	}
+	if got := testutil.ToFloat64(serverErrs) - serverErrsBefore; got != defaultMaxAttempts {
+		t.Errorf("Unexpected number of http_500 send errors. got: %v, want: %v\n", got,
+			defaultMaxAttempts)
+	}
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, []string{msgTooLongNotice}) {
+		t.Errorf("Unexpected messages in the channel. got: %q, want: %q\n", got,
+			[]string{msgTooLongNotice})
+	}
+}
+
+// TestOutboxRateLimits makes sure that rate limits are retried once Discord says that they're up.
+func TestOutboxRateLimits(t *testing.T) {
+	fake := newFakeDiscord(t)
+	outbox, session, sleeps := newTestOutbox()
+	rateLimited := metrics.discordSendErrors.WithLabelValues("http_429")
+	before := testutil.ToFloat64(rateLimited)
+
+	fake.sendFailures = []fakeFailure{
+		{http.StatusTooManyRequests, `{"retry_after": 1.5}`},
+		{http.StatusTooManyRequests, `{"retry_after": 0.25}`},
+	}
+	outbox.Post(context.Background(), session, "channel", "hello")
+	outbox.Wait()
+
+	if got := fake.sent["channel"]; !reflect.DeepEqual(got, []string{"hello"}) {
+		t.Errorf("Unexpected messages in the channel. got: %q, want: %q\n", got,
+			[]string{"hello"})
+	}
+	wantSleeps := []time.Duration{1500 * time.Millisecond, 250 * time.Millisecond}
+	if !reflect.DeepEqual(*sleeps, wantSleeps) {
+		t.Errorf("Unexpected waits. got: %v, want: %v\n", *sleeps, wantSleeps)
+	}
+	if stats := outbox.Stats(); stats.Sent != 1 || stats.Retries != 2 {
+		t.Errorf("Unexpected delivery stats. got: %+v, want: 1 sent, 2 retries\n", stats)
+	}
+	if got := testutil.ToFloat64(rateLimited) - before; got != 2 {
+		t.Errorf("Unexpected number of http_429 send errors. got: %v, want: %v\n", got, 2)
+	}
+}
+
+// TestOutboxDiscordgoRetries makes sure that 502s, which discordgo retries on its own, aren't
+// retried by the Outbox on top of that.
+func TestOutboxDiscordgoRetries(t *testing.T) {
+	fake := newFakeDiscord(t)
+	outbox, session, sleeps := newTestOutbox()
+
+	// discordgo doesn't hand back a RESTError once it runs out of retries, so there's no status
+	// code to go by.
+	for i := 0; i <= session.MaxRestRetries; i++ {
+		fake.sendFailures = append(fake.sendFailures, fakeFailure{http.StatusBadGateway, "{}"})
+	}
+	_, err := session.ChannelMessageSend("channel", "hello", sendOptions...)
+	var restErr *discordgo.RESTError
+	if err == nil || errors.As(err, &restErr) {
+		t.Fatalf("Expected an error that isn't a RESTError after %d 502s. got: %#v\n",
+			session.MaxRestRetries+1, err)
+	}
+
+	for i := 0; i <= session.MaxRestRetries; i++ {
+		fake.sendFailures = append(fake.sendFailures, fakeFailure{http.StatusBadGateway, "{}"})
+	}
+	outbox.Post(context.Background(), session, "channel", "hi")
+	outbox.Wait()
+
+	if got := fake.sent["channel"]; len(got) != 0 {
+		t.Errorf("Unexpected messages in the channel. got: %q, want none\n", got)
+	}
+	stats := outbox.Stats()
+	wantFailures := map[string]int{failureOther: 1}
+	if stats.Retries != 0 || len(*sleeps) != 0 || !reflect.DeepEqual(stats.Failures,
+		wantFailures) {
+		t.Errorf("Unexpected delivery stats. got: %+v after %d sleeps, want: no retries and %v\n",
+			stats, len(*sleeps), wantFailures)
+	}
+}
+
+// TestOutboxTracked makes sure that tracked messages are handed the IDs that Discord gave them,
+// and that messages that never made it aren't.
+func TestOutboxTracked(t *testing.T) {
+	fake := newFakeDiscord(t)
+	outbox, session, _ := newTestOutbox()
+	var ids []string
+	sent := func(messageID string) { ids = append(ids, messageID) }
+
+	outbox.PostTracked(context.Background(), session, "channel", "hello", nil, sent)
+	outbox.Wait()
+	fake.sendFailures = []fakeFailure{
+		{http.StatusForbidden, `{"code": 50013, "message": "Missing Permissions"}`},
+	}
+	outbox.PostTracked(context.Background(), session, "channel", "forbidden", nil, sent)
+	outbox.PostTracked(context.Background(), session, "channel",
+		strings.Repeat("a", maxMsgLength+1), nil, sent)
+	outbox.PostTracked(context.Background(), session, "channel", "world", nil, sent)
+	outbox.Wait()
+
+	// The notice that replaced the message that was too long got an ID, too, but it isn't the
+	// message that was tracked.
+	if want := []string{"1", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("Unexpected message IDs. got: %q, want: %q\n", ids, want)
+	}
+}
+
+func TestClassifyDeliveryErr(t *testing.T) {
+	newRESTError := func(status int, header http.Header, body string) error {
+		restErr := &discordgo.RESTError{
+			Response:     &http.Response{StatusCode: status, Header: header},
+			ResponseBody: []byte(body),
+		}
+		if strings.Contains(body, "code") {
+			restErr.Message = &discordgo.APIErrorMessage{Code: 50013}
+		}
+		return restErr
+	}
+
+	tests := []struct {
+		err           error
+		reasonWant    string
+		transientWant bool
+	}{
+		{&url.Error{Op: "Post", Err: errors.New("connection reset")}, failureNetwork, true},
+		{fmt.Errorf("%w: unexpected end of JSON input", discordgo.ErrJSONUnmarshal),
+			failureNetwork, true},
+		{newRESTError(http.StatusServiceUnavailable, nil, ""), "http_503", true},
+		{&discordgo.RateLimitError{RateLimit: &discordgo.RateLimit{
+			TooManyRequests: &discordgo.TooManyRequests{RetryAfter: time.Second},
+		}}, "http_429", true},
+		{errors.New("something else"), failureOther, false},
+		{newRESTError(http.StatusForbidden, nil, `{"code": 50013}`), "50013", false},
+		{newRESTError(http.StatusNotFound, nil, ""), "http_404", false},
+	}
+	for _, c := range tests {
+		reason, transient := classifyDeliveryErr(c.err)
+		if reason != c.reasonWant || transient != c.transientWant {
+			t.Errorf("Unexpected classification for %v. got: %q, %t, want: %q, %t\n", c.err,
+				reason, transient, c.reasonWant, c.transientWant)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Subcommands are what permissions are granted for. Each one covers one or more commands.
+const (
+	subcommandGenerate = "generate"
+	subcommandImitate  = "imitate"
+	subcommandReload   = "reload"
+	subcommandConfig   = "config"
+	subcommandFeedback = "feedback"
+
+	// everyoneTarget and ownersTarget are what "!botname config permission" grants a subcommand to
+	// instead of roles or permissions: everyone, or only the bot's owners.
+	everyoneTarget = "everyone"
+	ownersTarget   = "owners"
+
+	// administratorPermission is the permission whose members may use every subcommand, whatever
+	// its Requirement says, so that a guild can't lock itself out.
+	administratorPermission = "administrator"
+	// manageServerPermission is the permission that changing a guild's settings takes, unless the
+	// guild says otherwise.
+	manageServerPermission = "manage_server"
+)
+
+// subcommands maps each command, and each button action, to the subcommand whose Requirement it
+// has to meet. Commands that aren't in here, like optout, are open to everyone.
+var subcommands = map[string]string{
+	plainInvocation: subcommandGenerate,
+	againCmd:        subcommandGenerate,
+	// Also the name of actionContinue.
+	continueCmd:              subcommandGenerate,
+	seedCmd:                  subcommandGenerate,
+	string(actionRegenerate): subcommandGenerate,
+	imitateCmd:               subcommandImitate,
+	channelCmd:               subcommandImitate,
+	reloadCmd:                subcommandReload,
+	configCmd:                subcommandConfig,
+	feedbackCmd:              subcommandFeedback,
+}
+
+// permissionNames are the names of the permissions that Requirements may ask for. Platforms that
+// implement MemberLookup report members' permissions with these names.
+var permissionNames = []string{
+	administratorPermission,
+	"ban_members",
+	"kick_members",
+	"manage_channels",
+	"manage_messages",
+	"manage_roles",
+	manageServerPermission,
+	"mention_everyone",
+}
+
+// Requirement is who may use a subcommand in a guild: everyone, if Everyone is set, or else
+// members who have any of Roles, or any of Permissions. The bot's owners always may, and so may
+// members with administratorPermission.
+type Requirement struct {
+	Everyone bool `json:"everyone,omitempty"`
+	// Role IDs, which aren't prefixed with the name of the chat service.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// defaultRequirements are the Requirements of subcommands that a guild didn't change.
+var defaultRequirements = map[string]Requirement{
+	subcommandGenerate: {Everyone: true},
+	subcommandImitate:  {Everyone: true},
+	subcommandReload:   {},
+	subcommandConfig:   {Permissions: []string{manageServerPermission}},
+	subcommandFeedback: {},
+}
+
+// requirement returns the Requirement of the provided subcommand in the guild.
+func (g GuildSettings) requirement(subcommand string) Requirement {
+	if requirement, ok := g.Permissions[subcommand]; ok {
+		return requirement
+	}
+	return defaultRequirements[subcommand]
+}
+
+// allows reports whether the provided member meets the requirement.
+func (r Requirement) allows(member Member) bool {
+	if r.Everyone || contains(member.Permissions, administratorPermission) {
+		return true
+	}
+	for _, role := range r.Roles {
+		if contains(member.Roles, role) {
+			return true
+		}
+	}
+	for _, permission := range r.Permissions {
+		if contains(member.Permissions, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// String describes who meets the requirement, like "people with <@&1234> or manage_server".
+func (r Requirement) String() string {
+	if r.Everyone {
+		return everyoneTarget
+	}
+	var who []string
+	for _, role := range r.Roles {
+		who = append(who, "<@&"+role+">")
+	}
+	who = append(who, r.Permissions...)
+	if len(who) == 0 {
+		return "my owners"
+	}
+	return "people with " + strings.Join(who, " or ")
+}
+
+// authorize reports whether the author of m may use the provided command, going by the settings
+// of the guild that it was posted in. If they may not, it also returns why not. This is the only
+// place that permissions are checked; commands themselves don't.
+func (b *Bot) authorize(p Platform, m *Message, settings GuildSettings,
+	command string) (bool, string) {
+	subcommand, ok := subcommands[command]
+	if !ok || b.limiter.IsAdmin(platformID(p, m.Author.ID)) {
+		return true, ""
+	}
+	requirement := settings.requirement(subcommand)
+	if requirement.Everyone {
+		return true, ""
+	}
+	denial := fmt.Sprintf("Sorry, only %s can use %s here", requirement, subcommand)
+	if m.GuildID == "" {
+		return false, denial
+	}
+	lookup, ok := p.(MemberLookup)
+	if !ok {
+		return false, denial
+	}
+	member, err := lookup.LookupMember(m)
+	if err != nil {
+		loggerFrom(m.Context()).Warn("Failed to look up a member's roles and permissions",
+			"error", err)
+		return false, "I couldn't check whether you can use that here. Try again in a bit"
+	}
+	if !requirement.allows(member) {
+		return false, denial
+	}
+	return true, ""
+}
+
+// replyPrivately answers m so that only its author sees the answer, if the Platform can, or else
+// like any other reply.
+func (b *Bot) replyPrivately(p Platform, m *Message, msg string) {
+	if private, ok := p.(PrivateReplier); ok {
+		private.ReplyPrivately(m.Context(), m, msg)
+		return
+	}
+	p.Reply(m.Context(), m.ChannelID, msg)
+}
+
+// describePermissions lists who may use each subcommand in the guild, one per line, each starting
+// with a line break.
+func (g GuildSettings) describePermissions() string {
+	var b strings.Builder
+	for _, subcommand := range sortedSubcommands() {
+		fmt.Fprintf(&b, "\n%s: %s", subcommand, g.requirement(subcommand))
+		if _, ok := g.Permissions[subcommand]; !ok {
+			b.WriteString(" (default)")
+		}
+	}
+	return b.String()
+}
+
+// permissionCommand responds to a bot invocation like
+// "!botname config permission imitate @regulars manage_messages", which changes who may use a
+// subcommand in the guild that it was posted in. Targets are role mentions, permission names,
+// everyoneTarget, ownersTarget, or defaultSetting.
+func (b *Bot) permissionCommand(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s permission <subcommand>"+
+		" <@role|permission|%s|%s|%s>...`. Subcommands are %s. Permissions are %s", b.invocation(p, m), configCmd,
+		everyoneTarget, ownersTarget, defaultSetting, strings.Join(sortedSubcommands(), ", "),
+		strings.Join(permissionNames, ", "))
+	if len(arguments) < 2 {
+		p.Reply(m.Context(), m.ChannelID, usage)
+		return outcomeInvalid
+	}
+	subcommand := strings.ToLower(arguments[0])
+	if _, ok := defaultRequirements[subcommand]; !ok {
+		p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("There's no subcommand named %q. %s",
+			subcommand, usage))
+		return outcomeInvalid
+	}
+
+	var requirement Requirement
+	reset := false
+	for _, arg := range arguments[1:] {
+		target := strings.ToLower(arg)
+		switch {
+		case target == everyoneTarget:
+			requirement.Everyone = true
+		case target == defaultSetting:
+			reset = true
+		case target == ownersTarget:
+		case strings.HasPrefix(arg, "<@&") && strings.HasSuffix(arg, ">"):
+			requirement.Roles = append(requirement.Roles,
+				strings.TrimSuffix(strings.TrimPrefix(arg, "<@&"), ">"))
+		case contains(permissionNames, target):
+			requirement.Permissions = append(requirement.Permissions, target)
+		default:
+			p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("%q isn't a role mention or a"+
+				" permission. %s", arg, usage))
+			return outcomeInvalid
+		}
+	}
+	if (reset || requirement.Everyone) && len(arguments) > 2 {
+		p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("%s and %s can't be combined with anything"+
+			" else", defaultSetting, everyoneTarget))
+		return outcomeInvalid
+	}
+
+	if outcome, ok := b.checkConfigurable(p, m); !ok {
+		return outcome
+	}
+	err := b.settings.Update(platformID(p, m.GuildID), func(s *GuildSettings) {
+		if reset {
+			delete(s.Permissions, subcommand)
+			return
+		}
+		if s.Permissions == nil {
+			s.Permissions = make(map[string]Requirement)
+		}
+		s.Permissions[subcommand] = requirement
+	})
+	if err != nil {
+		loggerFrom(m.Context()).Error("Failed to change a permission", "error", err)
+		p.Reply(m.Context(), m.ChannelID, "Something went wrong. Try again in a bit")
+		return outcomeFailed
+	}
+	if reset {
+		requirement = defaultRequirements[subcommand]
+	}
+	p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("From now on, %s can use %s here", requirement,
+		subcommand))
+	return outcomeOK
+}
+
+// sortedSubcommands returns the subcommands that permissions are granted for, in order.
+func sortedSubcommands() []string {
+	names := make([]string, 0, len(defaultRequirements))
+	for subcommand := range defaultRequirements {
+		names = append(names, subcommand)
+	}
+	sort.Strings(names)
+	return names
+}
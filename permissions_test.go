@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// privatePlatform is a managingPlatform that can answer messages privately.
+type privatePlatform struct {
+	*managingPlatform
+	// Private replies, in the order that they were sent.
+	private []string
+}
+
+func (p *privatePlatform) ReplyPrivately(ctx context.Context, m *Message, msg string) {
+	p.private = append(p.private, msg)
+}
+
+// TestRequirement makes sure that members meet requirements by having any of their roles or
+// permissions, and that administrators meet every requirement.
+func TestRequirement(t *testing.T) {
+	mods := Requirement{Roles: []string{"mods"}, Permissions: []string{"manage_messages"}}
+	tests := []struct {
+		name        string
+		requirement Requirement
+		member      Member
+		want        bool
+	}{
+		{"everyone", Requirement{Everyone: true}, Member{}, true},
+		{"owners", Requirement{}, Member{Roles: []string{"mods"}}, false},
+		{"role", mods, Member{Roles: []string{"regulars", "mods"}}, true},
+		{"permission", mods, Member{Permissions: []string{"manage_messages"}}, true},
+		{"neither", mods, Member{Roles: []string{"regulars"},
+			Permissions: []string{"kick_members"}}, false},
+		{"administrator", Requirement{}, Member{Permissions: []string{administratorPermission}},
+			true},
+	}
+	for _, tc := range tests {
+		if got := tc.requirement.allows(tc.member); got != tc.want {
+			t.Errorf("%s: unexpected answer. got: %t, want: %t\n", tc.name, got, tc.want)
+		}
+	}
+
+	if got, want := mods.String(), "people with <@&mods> or manage_messages"; got != want {
+		t.Errorf("Unexpected description. got: %q, want: %q\n", got, want)
+	}
+}
+
+// TestPermissionCommand makes sure that guilds can change who may use each subcommand, that
+// everyone else is told that they can't, privately, and that the bot's owners always can.
+func TestPermissionCommand(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("perms", "!", hmm)
+	bot.limiter = NewLimiter(LimiterConfig{Admins: []string{"fake/admin"}})
+	p := &privatePlatform{managingPlatform: newManagingPlatform("botID", "owner")}
+	p.members["mod"] = Member{Roles: []string{"mods"}}
+	p.members["boss"] = Member{Permissions: []string{administratorPermission}}
+	defer func() {
+		wasMessagePosted = false
+		postedMsg = ""
+	}()
+	invoke := func(guildID, authorID, content string) string {
+		postedMsg, p.private = "", nil
+		bot.HandleMessage(p, &Message{ChannelID: "channel", GuildID: guildID,
+			Author: User{ID: authorID}, Content: content})
+		return postedMsg + strings.Join(p.private, "")
+	}
+
+	usage := "Example usage: `!perms config permission <subcommand>" +
+		" <@role|permission|everyone|owners|default>...`. Subcommands are config, feedback," +
+		" generate, imitate, reload. Permissions are administrator, ban_members, kick_members," +
+		" manage_channels, manage_messages, manage_roles, manage_server, mention_everyone"
+	tests := []struct {
+		name    string
+		guildID string
+		author  string
+		content string
+		want    string
+	}{
+		{"owners only", "guild", "alice", "!perms reload",
+			"Sorry, only my owners can use reload here"},
+		{"owner", "guild", "admin", "!perms reload", "Reloading isn't turned on"},
+		{"direct message", "", "alice", "!perms feedback reset",
+			"Sorry, only my owners can use feedback here"},
+		{"not a manager", "guild", "mod", "!perms config permission generate everyone",
+			"Sorry, only people with manage_server can use config here"},
+		{"usage", "guild", "owner", "!perms config permission generate", usage},
+		{"unknown subcommand", "guild", "owner", "!perms config permission dance everyone",
+			`There's no subcommand named "dance". ` + usage},
+		{"unknown target", "guild", "owner", "!perms config permission generate <@&mods> kick",
+			`"kick" isn't a role mention or a permission. ` + usage},
+		{"combined", "guild", "owner", "!perms config permission generate default everyone",
+			"default and everyone can't be combined with anything else"},
+		{"restrict", "guild", "owner",
+			"!perms config permission generate <@&mods> manage_messages",
+			"From now on, people with <@&mods> or manage_messages can use generate here"},
+		{"restricted", "guild", "alice", "!perms quick 3",
+			"Sorry, only people with <@&mods> or manage_messages can use generate here"},
+		{"role", "guild", "mod", "!perms quick 3", "quick brown fox"},
+		{"administrator", "guild", "boss", "!perms quick 3", "quick brown fox"},
+		{"other guild", "other", "alice", "!perms quick 3", "quick brown fox"},
+		{"owners", "guild", "owner", "!perms config permission imitate owners",
+			"From now on, my owners can use imitate here"},
+		{"hand over config", "guild", "owner", "!perms config permission config <@&mods>",
+			"From now on, people with <@&mods> can use config here"},
+		{"reset", "guild", "mod", "!perms config permission generate default",
+			"From now on, everyone can use generate here"},
+		{"show", "guild", "mod", "!perms config show",
+			"Settings for this server:\nprefix: `!` (default)\npersona: perms (default)\n" +
+				"maxwords: 1000 (default)\nchannels: all\nconfig: people with <@&mods>" +
+				"\nfeedback: my owners (default)\ngenerate: everyone (default)" +
+				"\nimitate: my owners\nreload: my owners (default)"},
+		{"not restricted", "guild", "alice", "!perms quick 3", "quick brown fox"},
+	}
+	for _, tc := range tests {
+		if got := invoke(tc.guildID, tc.author, tc.content); got != tc.want {
+			t.Errorf("%s: unexpected reply.\ngot: %q\nwant: %q\n", tc.name, got, tc.want)
+		}
+	}
+
+	// Denials aren't posted for everyone to see.
+	invoke("guild", "alice", "!perms reload")
+	if postedMsg != "" || len(p.private) != 1 {
+		t.Errorf("Expected the denial to be sent privately. got: %q publicly and %q privately\n",
+			postedMsg, p.private)
+	}
+
+	// Buttons are checked too, before anything else.
+	invoke("guild", "mod", "!perms config permission generate owners")
+	press := &Message{ChannelID: "channel", GuildID: "guild", Author: User{ID: "alice"}}
+	if notice := bot.HandlePress(p, press, "posted", actionRegenerate); notice !=
+		"Sorry, only my owners can use generate here" {
+		t.Errorf("Unexpected notice for a denied button press: %q\n", notice)
+	}
+
+	p.err = errors.New("nope")
+	want := "I couldn't check whether you can use that here. Try again in a bit"
+	if got := invoke("guild", "alice", "!perms quick 3"); got != want {
+		t.Errorf("Unexpected reply when members can't be looked up.\ngot: %q\nwant: %q\n", got,
+			want)
+	}
+}
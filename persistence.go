@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// snapshotInterval is how often what the bot remembers is saved.
+const snapshotInterval = 30 * time.Second
+
+// Snapshots saves what the bot remembers, but changes too often to save every time it does, to a
+// Store every so often, and once more when it stops, so that it survives restarts. That's the last
+// few messages that were generated in each channel, and each persona's feedback weights.
+type Snapshots struct {
+	store    Store
+	channels *ChannelHistory
+	feedback *Feedback
+}
+
+// NewSnapshots returns a pointer to a new Snapshots which saves the provided ChannelHistory and
+// Feedback to the provided Store.
+func NewSnapshots(store Store, channels *ChannelHistory, feedback *Feedback) *Snapshots {
+	return &Snapshots{store: store, channels: channels, feedback: feedback}
+}
+
+// Load restores what was saved the last time. If nothing was saved yet, there's nothing to
+// restore.
+func (s *Snapshots) Load() error {
+	var channels []channelSnapshot
+	for _, id := range s.store.Keys(channelsBucket) {
+		channel := channelSnapshot{Channel: id}
+		if _, err := getJSON(s.store, channelsBucket, id, &channel.Entries); err != nil {
+			return err
+		}
+		if len(channel.Entries) > 0 {
+			channels = append(channels, channel)
+		}
+	}
+	// Channels that a message was generated in the longest time ago go first, so that they're the
+	// first to be forgotten again.
+	sort.SliceStable(channels, func(i, j int) bool {
+		a, b := channels[i].Entries, channels[j].Entries
+		return a[len(a)-1].Time.Before(b[len(b)-1].Time)
+	})
+	s.channels.Restore(channels)
+
+	for _, persona := range s.store.Keys(feedbackBucket) {
+		var weights []savedWeight
+		if _, err := getJSON(s.store, feedbackBucket, persona, &weights); err != nil {
+			return err
+		}
+		s.feedback.restore(persona, weights)
+	}
+	return nil
+}
+
+// Save saves what the bot remembers right now. Only what changed since the last time is written.
+func (s *Snapshots) Save() error {
+	channels := make(map[string]bool)
+	for _, channel := range s.channels.Snapshot() {
+		channels[channel.Channel] = true
+		if err := putJSON(s.store, channelsBucket, channel.Channel, channel.Entries); err != nil {
+			return err
+		}
+	}
+	if err := deleteOthers(s.store, channelsBucket, channels); err != nil {
+		return err
+	}
+
+	personas := make(map[string]bool)
+	for persona, weights := range s.feedback.snapshot() {
+		personas[persona] = true
+		if err := putJSON(s.store, feedbackBucket, persona, weights); err != nil {
+			return err
+		}
+	}
+	return deleteOthers(s.store, feedbackBucket, personas)
+}
+
+// deleteOthers deletes every key in the provided bucket that isn't in keep.
+func deleteOthers(s Store, bucket string, keep map[string]bool) error {
+	for _, key := range s.Keys(bucket) {
+		if keep[key] {
+			continue
+		}
+		if err := s.Delete(bucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns "snapshots".
+func (s *Snapshots) Name() string {
+	return "snapshots"
+}
+
+// Run saves what the bot remembers every snapshotInterval until ctx is done, and then saves it
+// once more. Since it's started before the chat services and stopped after them, that includes
+// everything that they handled while they stopped.
+func (s *Snapshots) Run(ctx context.Context, ready func()) error {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	ready()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return s.Save()
+		}
+		if err := s.Save(); err != nil {
+			slog.Warn("Failed to save a snapshot", "error", err)
+		}
+	}
+}
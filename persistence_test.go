@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshots makes sure that what's saved is what's loaded the next time, and that there's
+// nothing to load the first time.
+func TestSnapshots(t *testing.T) {
+	store := NewMemoryStore()
+	history, feedback := NewChannelHistory(), NewFeedback()
+	feedback.now = func() time.Time { return time.Date(2021, 1, 2, 3, 4, 7, 0, time.UTC) }
+	if err := NewSnapshots(store, history, feedback).Load(); err != nil {
+		t.Fatalf("Unexpected error loading before anything was saved: %v\n", err)
+	}
+
+	history.Record("fake/channel", generatedMsg{
+		Persona: "persona",
+		Start:   "the",
+		Words:   3,
+		Seed:    42,
+		Path:    []string{"the", "quick", "\n", "brown"},
+		Invoker: "fake/alice",
+		Time:    time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	history.Record("fake/other", generatedMsg{Persona: "persona", After: []string{"dog"},
+		Time: time.Date(2021, 1, 2, 3, 4, 6, 0, time.UTC)})
+	feedback.Track("fake/1", "persona", []string{"the", "quick", "brown"})
+	feedback.Vote("fake/1", "fake/alice", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// Run saves once more when it stops.
+	if err := NewSnapshots(store, history, feedback).Run(ctx, func() {}); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	restoredHistory, restoredFeedback := NewChannelHistory(), NewFeedback()
+	if err := NewSnapshots(store, restoredHistory, restoredFeedback).Load(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if got, want := restoredHistory.Snapshot(), history.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected history after loading.\ngot: %+v\nwant: %+v\n", got, want)
+	}
+	if got, want := restoredFeedback.snapshot(), feedback.snapshot(); !reflect.DeepEqual(got,
+		want) {
+		t.Errorf("Unexpected feedback after loading.\ngot: %+v\nwant: %+v\n", got, want)
+	}
+
+	// Feedback that was reset is forgotten the next time.
+	feedback.Reset("persona")
+	snapshots := NewSnapshots(store, history, feedback)
+	if err := snapshots.Save(); err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if keys := store.Keys(feedbackBucket); len(keys) != 0 {
+		t.Errorf("Expected reset feedback to be deleted. got: %v\n", keys)
+	}
+}
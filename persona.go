@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Persona is an HMM with a name, trained on one corpus file.
+type Persona struct {
+	Name string
+	// Name of the corpus file that the HMM was trained on.
+	Corpus string
+	HMM    *HMM
+}
+
+// Personas is a collection of Personas, looked up by name. The first Persona that's added is the
+// default one. It's safe for concurrent use.
+type Personas struct {
+	mu       sync.RWMutex
+	personas map[string]*Persona
+	fallback string
+}
+
+// NewPersonas returns a pointer to a new Personas with the provided Personas in it.
+func NewPersonas(personas ...*Persona) *Personas {
+	p := &Personas{personas: make(map[string]*Persona)}
+	for _, persona := range personas {
+		p.Add(persona)
+	}
+	return p
+}
+
+// Add adds a Persona, replacing any Persona that has the same name.
+func (p *Personas) Add(persona *Persona) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.personas) == 0 {
+		p.fallback = persona.Name
+	}
+	p.personas[persona.Name] = persona
+}
+
+// Get returns the Persona with the provided name, or the default Persona if name is empty.
+func (p *Personas) Get(name string) (*Persona, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if name == "" {
+		name = p.fallback
+	}
+	persona, ok := p.personas[name]
+	return persona, ok
+}
+
+// List returns every Persona, sorted by name.
+func (p *Personas) List() []*Persona {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]*Persona, 0, len(p.personas))
+	for _, persona := range p.personas {
+		list = append(list, persona)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// checkModels returns an error unless there's at least one Persona, and every Persona has a
+// model. It's a readiness check.
+func (p *Personas) checkModels() error {
+	list := p.List()
+	if len(list) == 0 {
+		return errors.New("no personas are loaded")
+	}
+	for _, persona := range list {
+		if persona.HMM == nil {
+			return fmt.Errorf("persona %q doesn't have a model", persona.Name)
+		}
+	}
+	return nil
+}
+
+// Replace swaps every Persona out for the provided ones all at once, so that nobody ever sees a
+// mix of old and new Personas. The first provided Persona becomes the default one.
+func (p *Personas) Replace(personas ...*Persona) {
+	replacements := make(map[string]*Persona, len(personas))
+	for _, persona := range personas {
+		replacements[persona.Name] = persona
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.personas = replacements
+	p.fallback = ""
+	if len(personas) > 0 {
+		p.fallback = personas[0].Name
+	}
+}
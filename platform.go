@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// Platform describes a chat service that the bot can be invoked from, like Discord. Each chat
+// service gets its own adapter that turns the service's events into Messages for Bot.HandleMessage()
+// and implements this interface so that the bot can talk back.
+type Platform interface {
+	// Name returns a short, unique name for the chat service, like "discord". It's used to keep
+	// IDs from different chat services apart.
+	Name() string
+	// SelfID returns the ID of the bot's own account on the chat service.
+	SelfID() string
+
+	// Reply posts a message in the provided channel. ctx is the context of the message that's
+	// being answered. If anything goes wrong, the Platform is responsible for handling that
+	// problem.
+	Reply(ctx context.Context, channelID, msg string)
+	// SendFile posts a file with the provided name and contents in the provided channel.
+	SendFile(channelID, name string, r io.Reader) error
+
+	// Platforms hand out their channels' history so that throwaway HMMs can be built from it.
+	HistoryFetcher
+	// IsNSFW reports whether the provided channel is marked as NSFW.
+	IsNSFW(channelID string) (bool, error)
+}
+
+// TrackedReplier is implemented by Platforms that can tell which message a reply became, so that
+// the bot can take feedback on it, and put buttons under it.
+type TrackedReplier interface {
+	// ReplyTracked is like Reply, but sent is called with the ID of the posted message once it's
+	// posted. If the message never gets posted, sent is never called. actions are the buttons to
+	// put under the message, which HandlePress() is called with when they're pressed.
+	ReplyTracked(ctx context.Context, channelID, msg string, actions []Action,
+		sent func(messageID string))
+}
+
+// MessageDeleter is implemented by Platforms that let the bot delete the messages that it posted.
+type MessageDeleter interface {
+	DeleteMessage(channelID, messageID string) error
+}
+
+// MemberLookup is implemented by Platforms that can tell which roles and permissions a user has
+// in a guild, which is what permission Requirements are checked against.
+type MemberLookup interface {
+	// LookupMember returns the roles and permissions of the author of m in the channel that it was
+	// posted in.
+	LookupMember(m *Message) (Member, error)
+}
+
+// PrivateReplier is implemented by Platforms that can answer a message so that only its author
+// sees the answer.
+type PrivateReplier interface {
+	ReplyPrivately(ctx context.Context, m *Message, msg string)
+}
+
+// Member is what a user may do in a guild.
+type Member struct {
+	// Role IDs, which aren't prefixed with the name of the chat service.
+	Roles []string
+	// Names of permissions, from permissionNames.
+	Permissions []string
+}
+
+// Message is a chat message that was posted on one of the chat services that the bot is connected
+// to.
+type Message struct {
+	ID        string
+	ChannelID string
+	// ID of the server, guild, or workspace that the message was posted in. Empty for direct
+	// messages, and for chat services that don't have such a thing.
+	GuildID  string
+	Author   User
+	Content  string
+	Mentions []User
+
+	// See Context().
+	ctx context.Context
+}
+
+// Context returns the context of the request to handle the message. It's never nil.
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// WithContext returns a shallow copy of the message with its context changed to ctx.
+func (m *Message) WithContext(ctx context.Context) *Message {
+	copied := *m
+	copied.ctx = ctx
+	return &copied
+}
+
+// User is an account on one of the chat services that the bot is connected to.
+type User struct {
+	ID   string
+	Name string
+	Bot  bool
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// fakePlatform is a Platform that keeps everything in memory. Its Reply() method sets the global
+// "wasMessagePosted" and "postedMsg" vars. A test is then responsible for checking the values of
+// those global vars and resetting them.
+type fakePlatform struct {
+	selfID string
+	// Each channel's messages, newest first.
+	history map[string][]Message
+	// IDs of channels that are marked as NSFW.
+	nsfw map[string]bool
+	// Contents of the files that were sent, keyed by file name.
+	files map[string]string
+}
+
+// newFakePlatform returns a pointer to a new fakePlatform where the bot has the provided ID.
+func newFakePlatform(selfID string) *fakePlatform {
+	return &fakePlatform{
+		selfID:  selfID,
+		history: make(map[string][]Message),
+		nsfw:    make(map[string]bool),
+		files:   make(map[string]string),
+	}
+}
+
+// addMessages adds messages to the beginning of a channel's history, as if they had just been
+// posted by the user with the provided ID. The last provided message is the newest one.
+func (p *fakePlatform) addMessages(channelID, userID string, contents ...string) {
+	for _, content := range contents {
+		msg := Message{ChannelID: channelID, Author: User{ID: userID}, Content: content}
+		p.history[channelID] = append([]Message{msg}, p.history[channelID]...)
+	}
+}
+
+func (p *fakePlatform) Name() string {
+	return "fake"
+}
+
+func (p *fakePlatform) SelfID() string {
+	return p.selfID
+}
+
+func (p *fakePlatform) Reply(ctx context.Context, channelID, msg string) {
+	wasMessagePosted = true
+	postedMsg = msg
+}
+
+func (p *fakePlatform) SendFile(channelID, name string, r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.files[name] = string(contents)
+	return nil
+}
+
+func (p *fakePlatform) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	var contents []string
+	for _, msg := range p.history[channelID] {
+		if len(contents) == limit {
+			break
+		}
+		if include(msg.Author.ID) {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents, nil
+}
+
+func (p *fakePlatform) IsNSFW(channelID string) (bool, error) {
+	return p.nsfw[channelID], nil
+}
+
+// trackingPlatform is a fakePlatform that can tell which message a reply became, and that can
+// delete messages. Every reply becomes a message with the ID "posted".
+type trackingPlatform struct {
+	*fakePlatform
+	// Actions that the last reply had buttons for.
+	actions []Action
+	// IDs of the messages that were deleted.
+	deleted []string
+}
+
+// newTrackingPlatform returns a pointer to a new trackingPlatform where the bot has the provided
+// ID.
+func newTrackingPlatform(selfID string) *trackingPlatform {
+	return &trackingPlatform{fakePlatform: newFakePlatform(selfID)}
+}
+
+func (p *trackingPlatform) ReplyTracked(ctx context.Context, channelID, msg string,
+	actions []Action, sent func(messageID string)) {
+	p.Reply(ctx, channelID, msg)
+	p.actions = actions
+	sent("posted")
+}
+
+func (p *trackingPlatform) DeleteMessage(channelID, messageID string) error {
+	p.deleted = append(p.deleted, messageID)
+	return nil
+}
+
+// managingPlatform is a fakePlatform that can tell which roles and permissions users have.
+type managingPlatform struct {
+	*fakePlatform
+	// Every guild's members, by user ID. Users who aren't in here have no roles or permissions.
+	members map[string]Member
+	// If set, LookupMember fails with it.
+	err error
+}
+
+// newManagingPlatform returns a pointer to a new managingPlatform where the bot has the provided
+// ID, and the provided users may manage every guild.
+func newManagingPlatform(selfID string, managers ...string) *managingPlatform {
+	p := &managingPlatform{fakePlatform: newFakePlatform(selfID), members: make(map[string]Member)}
+	for _, id := range managers {
+		p.members[id] = Member{Permissions: []string{manageServerPermission}}
+	}
+	return p
+}
+
+func (p *managingPlatform) LookupMember(m *Message) (Member, error) {
+	return p.members[m.Author.ID], p.err
+}
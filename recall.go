@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// againCmd, continueCmd, and seedCmd are the arguments for doing something with the last
+	// message that the bot generated in a channel. See ChannelHistory.
+	againCmd    = "again"
+	continueCmd = "continue"
+	seedCmd     = "seed"
+
+	// maxChannelEntries is how many generated messages are remembered for each channel.
+	maxChannelEntries = 10
+	// maxHistoryChannels is how many channels' generated messages are remembered. The channel
+	// that the bot generated a message in the longest time ago is forgotten first.
+	maxHistoryChannels = 1000
+)
+
+// ChannelHistory remembers the last few messages that the bot generated in each channel, so that
+// they can be generated again or continued without retyping the command. Channel IDs are prefixed
+// with the name of the chat service that they came from. It's safe for concurrent use.
+type ChannelHistory struct {
+	mu sync.Mutex
+	// Each channel's entries, oldest first.
+	channels map[string][]generatedMsg
+	// IDs of the channels in channels, from the one that a message was generated in the longest
+	// time ago to the most recent one.
+	order []string
+}
+
+// NewChannelHistory returns a pointer to a new, empty ChannelHistory.
+func NewChannelHistory() *ChannelHistory {
+	return &ChannelHistory{channels: make(map[string][]generatedMsg)}
+}
+
+// Record remembers a message that was generated in the provided channel. If the channel already
+// has maxChannelEntries entries, its oldest one is forgotten, and if there are too many channels,
+// the one that went the longest without a message is forgotten.
+func (h *ChannelHistory) Record(channelID string, entry generatedMsg) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries, ok := h.channels[channelID]
+	if ok {
+		h.forget(channelID)
+	} else if len(h.order) == maxHistoryChannels {
+		delete(h.channels, h.order[0])
+		h.order = h.order[1:]
+	}
+	if len(entries) == maxChannelEntries {
+		entries = entries[1:]
+	}
+	h.channels[channelID] = append(entries, entry)
+	h.order = append(h.order, channelID)
+}
+
+// forget takes the provided channel out of h.order. h.mu must be held.
+func (h *ChannelHistory) forget(channelID string) {
+	for i, id := range h.order {
+		if id == channelID {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// Last returns the last message that was generated in the provided channel, and whether there is
+// one.
+func (h *ChannelHistory) Last(channelID string) (generatedMsg, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.channels[channelID]
+	if len(entries) == 0 {
+		return generatedMsg{}, false
+	}
+	return entries[len(entries)-1], true
+}
+
+// channelSnapshot is a channel's entries in a snapshot of a ChannelHistory.
+type channelSnapshot struct {
+	Channel string         `json:"channel"`
+	Entries []generatedMsg `json:"entries"`
+}
+
+// Snapshot returns every channel's entries, from the channel that a message was generated in the
+// longest time ago to the most recent one.
+func (h *ChannelHistory) Snapshot() []channelSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := make([]channelSnapshot, 0, len(h.order))
+	for _, id := range h.order {
+		entries := append([]generatedMsg(nil), h.channels[id]...)
+		snapshot = append(snapshot, channelSnapshot{Channel: id, Entries: entries})
+	}
+	return snapshot
+}
+
+// Restore records the entries in a snapshot that Snapshot() returned.
+func (h *ChannelHistory) Restore(snapshot []channelSnapshot) {
+	for _, channel := range snapshot {
+		for _, entry := range channel.Entries {
+			h.Record(channel.Channel, entry)
+		}
+	}
+}
+
+// recall responds to a bot invocation like "!botname again", "!botname continue", or
+// "!botname seed", which do something with the last message that the bot generated in the
+// channel. It returns the name of the persona that generated a response, if one did, and the
+// invocation's outcome.
+func (b *Bot) recall(p Platform, m *Message, command string) (string, string) {
+	last, ok := b.channels.Last(platformID(p, m.ChannelID))
+	if !ok {
+		p.Reply(m.Context(), m.ChannelID, "I haven't said anything here yet")
+		return "", outcomeInvalid
+	}
+	if command == seedCmd {
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("My last message here was generated with seed %d", last.Seed))
+		return "", outcomeOK
+	}
+
+	persona, ok := b.personas.Get(last.Persona)
+	if !ok {
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("There's no persona named %q anymore", last.Persona))
+		return "", outcomeInvalid
+	}
+	opts := last.opts()
+	if command == continueCmd {
+		opts = last.continued()
+	}
+	if !b.allow(p, m, invocationCost(opts.Words)) {
+		return persona.Name, outcomeRateLimited
+	}
+	b.respond(p, m, persona, opts)
+	return persona.Name, outcomeOK
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// TestChannelHistory makes sure that only the last few messages in each channel, and only the
+// channels that the bot said something in most recently, are remembered.
+func TestChannelHistory(t *testing.T) {
+	h := NewChannelHistory()
+	for i := 1; i <= maxChannelEntries+1; i++ {
+		h.Record("busy", generatedMsg{Seed: int64(i)})
+	}
+	if last, ok := h.Last("busy"); !ok || last.Seed != maxChannelEntries+1 {
+		t.Errorf("Unexpected last message. got: %+v, %t\n", last, ok)
+	}
+	if _, ok := h.Last("quiet"); ok {
+		t.Errorf("Expected no last message in a channel that the bot didn't say anything in\n")
+	}
+	snapshot := h.Snapshot()
+	if len(snapshot) != 1 || len(snapshot[0].Entries) != maxChannelEntries ||
+		snapshot[0].Entries[0].Seed != 2 {
+		t.Errorf("Expected only the last %d messages in a channel to be remembered. got: %+v\n",
+			maxChannelEntries, snapshot)
+	}
+
+	// "busy" was used more recently than every channel but the last one, so only the first of
+	// these is forgotten to make room.
+	for i := 0; i < maxHistoryChannels-1; i++ {
+		h.Record(strconv.Itoa(i), generatedMsg{})
+	}
+	h.Record("busy", generatedMsg{})
+	h.Record("new", generatedMsg{})
+	if _, ok := h.Last("0"); ok {
+		t.Errorf("Expected the channel that went the longest without a message to be forgotten\n")
+	}
+	if _, ok := h.Last("busy"); !ok {
+		t.Errorf("Expected a recently used channel to be remembered\n")
+	}
+
+	restored := NewChannelHistory()
+	restored.Restore(h.Snapshot())
+	if !reflect.DeepEqual(restored.Snapshot(), h.Snapshot()) {
+		t.Errorf("Restoring a snapshot didn't bring back the same history\n")
+	}
+}
+
+// TestRecall makes sure that the last message in a channel can be generated again, continued, and
+// have its seed looked up.
+func TestRecall(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("recall", "!", hmm)
+	p := newFakePlatform("botID")
+	defer func() {
+		wasMessagePosted = false
+		postedMsg = ""
+	}()
+	invoke := func(content string) string {
+		postedMsg = ""
+		bot.HandleMessage(p, &Message{ChannelID: "channel", Author: User{ID: "alice"},
+			Content: content})
+		return postedMsg
+	}
+
+	if got := invoke("!recall again"); got != "I haven't said anything here yet" {
+		t.Errorf("Unexpected reply before anything was generated: %q\n", got)
+	}
+	if got := invoke("!recall quick 3"); got != "quick brown fox" {
+		t.Fatalf("Unexpected message. got: %q, want: %q\n", got, "quick brown fox")
+	}
+	last, _ := bot.channels.Last("fake/channel")
+	if got, want := invoke("!recall seed"), "My last message here was generated with seed "+
+		strconv.FormatInt(last.Seed, 10); got != want {
+		t.Errorf("Unexpected reply to seed. got: %q, want: %q\n", got, want)
+	}
+	if got := invoke("!recall again"); got != "quick brown fox" {
+		t.Errorf("Unexpected reply to again. got: %q, want: %q\n", got, "quick brown fox")
+	}
+	if got := invoke("!recall continue"); got != "jumps over the" {
+		t.Errorf("Unexpected reply to continue. got: %q, want: %q\n", got, "jumps over the")
+	}
+	// Messages in other channels don't count.
+	bot.HandleMessage(p, &Message{ChannelID: "other", Author: User{ID: "alice"},
+		Content: "!recall again"})
+	if postedMsg != "I haven't said anything here yet" {
+		t.Errorf("Unexpected reply in another channel: %q\n", postedMsg)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// reloadCmd is the argument that reloads the config and retrains personas' models. Only admins
+	// may use it.
+	reloadCmd = "reload"
+
+	// defaultReloadInterval is how often the config file and corpus files are checked for changes
+	// unless the config says otherwise.
+	defaultReloadInterval = 5 * time.Second
+)
+
+// fileStamp is what tells one version of a file apart from another without reading it.
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+// stampFile returns the provided file's fileStamp.
+func stampFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}, nil
+}
+
+// trainedPersona is a Persona, and everything that its HMM was trained with. If none of that
+// changes, the HMM doesn't need to be retrained.
+type trainedPersona struct {
+	section PersonaSection
+	path    string
+	stamp   fileStamp
+	persona *Persona
+}
+
+// Reloader trains the models of the personas that a Config describes, and puts them in service.
+// When it's told to reload, it reads the config again, retrains the models of personas whose
+// corpus files or settings changed, and swaps all of the personas in at once. Generations that are
+// already underway finish with the models that they started with. If anything goes wrong, the
+// personas that were already in service stay there. It's safe for concurrent use.
+//
+// Only personas are reloaded. Changes to anything else in the config take a restart.
+type Reloader struct {
+	personas *Personas
+	// Reads the config again.
+	load func() (Config, error)
+	// How often Run checks whether the config file or a corpus file changed. 0 means never.
+	interval time.Duration
+
+	// Held for the whole of a reload, so that only one happens at a time.
+	mu      sync.Mutex
+	config  Config
+	trained map[string]trainedPersona
+}
+
+// NewReloader returns a pointer to a new Reloader which puts personas in service in the provided
+// Personas, and calls load to read the config again when it's told to reload.
+func NewReloader(personas *Personas, load func() (Config, error)) *Reloader {
+	return &Reloader{personas: personas, load: load, trained: make(map[string]trainedPersona)}
+}
+
+// Apply trains the models of the personas in the provided config that haven't been trained on the
+// same corpus file with the same settings already, and then puts every persona in the config in
+// service. It returns the names of the personas whose models were trained.
+func (r *Reloader) Apply(config Config) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var personas []*Persona
+	var retrained []string
+	trained := make(map[string]trainedPersona, len(config.Personas))
+	for _, section := range config.Personas {
+		path := filepath.Join(config.Bot.CorporaDir, section.Corpus)
+		// Stamp the file before reading it, so that if it changes in the meantime, the change is
+		// picked up next time.
+		stamp, err := stampFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("persona %q: %v", section.Name, err)
+		}
+		persona, ok := r.trained[section.Name]
+		if !ok || persona.section != section || persona.path != path || persona.stamp != stamp {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("persona %q: %v", section.Name, err)
+			}
+			hmm, err := NewHMMOfOrder(string(content), section.MaxRetries, section.Order)
+			if err != nil {
+				return nil, fmt.Errorf("persona %q: %v", section.Name, err)
+			}
+			persona = trainedPersona{
+				section: section,
+				path:    path,
+				stamp:   stamp,
+				persona: &Persona{Name: section.Name, Corpus: section.Corpus, HMM: hmm},
+			}
+			retrained = append(retrained, section.Name)
+		}
+		trained[section.Name] = persona
+		personas = append(personas, persona.persona)
+	}
+
+	r.personas.Replace(personas...)
+	for _, name := range retrained {
+		metrics.observeModel(name, trained[name].persona.HMM)
+	}
+	for name := range r.trained {
+		if _, ok := trained[name]; !ok {
+			metrics.forgetModel(name)
+		}
+	}
+	if len(r.trained) > 0 && restartNeeded(r.config, config) {
+		slog.Warn("The config changed in ways that take a restart to pick up. Only personas" +
+			" were reloaded")
+	}
+	r.config = config
+	r.trained = trained
+	return retrained, nil
+}
+
+// restartNeeded reports whether two configs differ in anything other than their personas.
+func restartNeeded(old, new Config) bool {
+	old.Personas, new.Personas = nil, nil
+	return !reflect.DeepEqual(old, new)
+}
+
+// Reload reads the config again, and applies it. See Apply(). A panic while reading the config or
+// training models is turned into an error, so that a config file or a corpus file that trips
+// something up can't take the bot down with it.
+func (r *Reloader) Reload() (retrained []string, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			retrained, err = nil, fmt.Errorf("reloading panicked: %v", v)
+		}
+		if err != nil {
+			metrics.reloads.WithLabelValues("failure").Inc()
+		} else {
+			metrics.reloads.WithLabelValues("success").Inc()
+		}
+	}()
+
+	config, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r.Apply(config)
+}
+
+// reloadAndLog reloads, and logs what happened. reason explains why the reload happened.
+func (r *Reloader) reloadAndLog(reason string) {
+	retrained, err := r.Reload()
+	if err != nil {
+		slog.Error("Failed to reload, so the old personas are staying in service",
+			"reason", reason, "error", err)
+		return
+	}
+	slog.Info("Reloaded", "reason", reason, "retrained", describeRetrained(retrained))
+}
+
+// describeRetrained lists the personas whose models were retrained.
+func describeRetrained(retrained []string) string {
+	if len(retrained) == 0 {
+		return "nothing, since nothing changed"
+	}
+	return strings.Join(retrained, ", ")
+}
+
+// stamps returns the fileStamps of the config file and every persona's corpus file. Files that
+// can't be stamped, like ones that were deleted, get the zero fileStamp.
+func (r *Reloader) stamps() map[string]fileStamp {
+	r.mu.Lock()
+	paths := []string{r.config.path}
+	for _, persona := range r.trained {
+		paths = append(paths, persona.path)
+	}
+	r.mu.Unlock()
+
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			stamps[path], _ = stampFile(path)
+		}
+	}
+	return stamps
+}
+
+// changed reports whether the config file or any corpus file changed since the provided stamps
+// were taken, and returns the current stamps.
+func (r *Reloader) changed(seen map[string]fileStamp) (bool, map[string]fileStamp) {
+	current := r.stamps()
+	if len(current) != len(seen) {
+		return true, current
+	}
+	for path, stamp := range current {
+		if seen[path] != stamp {
+			return true, current
+		}
+	}
+	return false, current
+}
+
+// Name returns "reloader".
+func (r *Reloader) Name() string {
+	return "reloader"
+}
+
+// Run reloads whenever the process gets a SIGHUP, and, if the Reloader has an interval, whenever
+// the config file or a corpus file changed, which it checks for every interval. It's ready right
+// away, and stops once ctx is done. A reload that's underway by then finishes first.
+func (r *Reloader) Run(ctx context.Context, ready func()) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	seen := r.stamps()
+	ready()
+
+	for {
+		select {
+		case <-tick:
+			var changed bool
+			if changed, seen = r.changed(seen); changed {
+				r.reloadAndLog("a file changed")
+			}
+		case <-hup:
+			r.reloadAndLog("a SIGHUP")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// reload responds to a bot invocation like "!botname reload". By default, only admins may use it.
+func (b *Bot) reload(p Platform, m *Message) string {
+	if b.reloader == nil {
+		p.Reply(m.Context(), m.ChannelID, "Reloading isn't turned on")
+		return outcomeFailed
+	}
+	retrained, err := b.reloader.Reload()
+	if err != nil {
+		loggerFrom(m.Context()).Error("Failed to reload", "error", err)
+		p.Reply(m.Context(), m.ChannelID,
+			fmt.Sprintf("Reloading failed, so nothing changed: %v", err))
+		return outcomeFailed
+	}
+	p.Reply(m.Context(), m.ChannelID, "Reloaded. Retrained: "+describeRetrained(retrained))
+	return outcomeOK
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testReloadConfig = `
+[bot]
+name = "hmm"
+corpora_dir = "$CORPORA"
+
+[[personas]]
+name = "foo"
+corpus = "foo.txt"
+
+[[personas]]
+name = "bar"
+corpus = "bar.txt"
+
+[api]
+addr = ":8080"
+keys = ["k3y"]
+`
+
+// newTestReloader returns a Reloader that reloads a config file with two personas, "foo" and
+// "bar", along with the config file's path. The personas are already in service.
+func newTestReloader(t *testing.T) (*Reloader, *Personas, string) {
+	path := writeTestConfig(t, testReloadConfig, map[string]string{
+		"foo.txt": "roll up and roll out\n",
+		"bar.txt": "the cat sat on the mat\n",
+	})
+	env := testEnv(map[string]string{"CONFIG_FILE": path})
+	load := func() (Config, error) { return loadConfig(nil, env, ioutil.Discard) }
+	personas := NewPersonas()
+	reloader := NewReloader(personas, load)
+	retrained, err := reloader.Reload()
+	if err != nil {
+		t.Fatalf("Failed to load personas: %v\n", err)
+	}
+	if want := []string{"foo", "bar"}; !reflect.DeepEqual(retrained, want) {
+		t.Errorf("Unexpected retrained personas. got: %v, want: %v\n", retrained, want)
+	}
+	return reloader, personas, path
+}
+
+// writeTestFile overwrites one of the files in the config file's directory. Like writeTestConfig(),
+// it replaces $CORPORA with that directory.
+func writeTestFile(t *testing.T, configPath, name, content string) {
+	dir := filepath.Dir(configPath)
+	content = strings.ReplaceAll(content, "$CORPORA", filepath.ToSlash(dir))
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v\n", name, err)
+	}
+}
+
+// TestReloader makes sure that only the personas whose corpus files or settings changed are
+// retrained, and that a failed reload leaves the personas that were in service alone.
+func TestReloader(t *testing.T) {
+	reloader, personas, path := newTestReloader(t)
+	oldFoo, _ := personas.Get("foo")
+	oldBar, _ := personas.Get("bar")
+
+	reload := func(want ...string) {
+		t.Helper()
+		retrained, err := reloader.Reload()
+		if err != nil {
+			t.Fatalf("Failed to reload: %v\n", err)
+		}
+		if !reflect.DeepEqual(retrained, want) {
+			t.Errorf("Unexpected retrained personas. got: %v, want: %v\n", retrained, want)
+		}
+	}
+
+	// Nothing changed.
+	reload()
+	if foo, _ := personas.Get("foo"); foo != oldFoo {
+		t.Errorf("foo was replaced even though nothing changed\n")
+	}
+
+	// foo's corpus file changed.
+	writeTestFile(t, path, "foo.txt", "the quick brown fox jumps over the lazy dog\n")
+	reload("foo")
+	foo, _ := personas.Get("")
+	if foo == oldFoo || foo.Name != "foo" || foo.HMM.Stats().Words != 8 {
+		t.Errorf("foo wasn't retrained on its new corpus: %+v\n", foo)
+	}
+	if bar, _ := personas.Get("bar"); bar != oldBar {
+		t.Errorf("bar was retrained even though it didn't change\n")
+	}
+	if words := testutil.ToFloat64(metrics.modelWords.WithLabelValues("foo")); words != 8 {
+		t.Errorf("foo's model size wasn't updated in metrics. got: %v, want: %v\n", words, 8)
+	}
+	// Generations that started before the reload can finish with the old model.
+	if got := oldFoo.HMM.Generate(GenerateOptions{Start: "roll", Words: 2, TopK: 1}); got.Text !=
+		"roll out" {
+		t.Errorf("Unexpected speech from the old model. got: %q, want: %q\n", got.Text, "roll out")
+	}
+
+	// bar's settings changed.
+	writeTestFile(t, path, "config.toml", strings.Replace(testReloadConfig, `name = "bar"
+corpus = "bar.txt"`, `name = "bar"
+corpus = "bar.txt"
+order = 2`, 1))
+	reload("bar")
+	if bar, _ := personas.Get("bar"); bar.HMM.order != 2 {
+		t.Errorf("bar wasn't retrained with its new order\n")
+	}
+
+	// Failed reloads leave the personas alone.
+	before := personas.List()
+	failures := metrics.reloads.WithLabelValues("failure")
+	failuresBefore := testutil.ToFloat64(failures)
+	for _, tc := range []struct {
+		file, content string
+	}{
+		{"config.toml", "[bot\n"},
+		{"config.toml", strings.Replace(testReloadConfig, `"bar.txt"`, ",", 1)},
+		{"config.toml", strings.Replace(testReloadConfig, "bar.txt", "nope.txt", 1)},
+		{"bar.txt", ""},
+		{"bar.txt", "   "},
+		{"bar.txt", "   \n"},
+	} {
+		writeTestFile(t, path, tc.file, tc.content)
+		if _, err := reloader.Reload(); err == nil {
+			t.Errorf("Expected reloading with a bad %s to fail\n", tc.file)
+		}
+		if after := personas.List(); !reflect.DeepEqual(after, before) {
+			t.Errorf("A failed reload changed the personas\n")
+		}
+	}
+	if got := testutil.ToFloat64(failures) - failuresBefore; got != 6 {
+		t.Errorf("Unexpected number of failed reloads in metrics. got: %v, want: %v\n", got, 6)
+	}
+	// The personas that stayed in service can still generate.
+	for _, name := range []string{"foo", "bar"} {
+		persona, _ := personas.Get(name)
+		if gen := persona.HMM.Generate(GenerateOptions{Words: 5}); gen.Tokens != 5 {
+			t.Errorf("Unexpected generation from %s after failed reloads: %+v\n", name, gen)
+		}
+	}
+}
+
+// TestApplyNoWords makes sure that corpus files without any words in them are turned away when
+// they're applied, instead of being trained into models that can't generate anything.
+func TestApplyNoWords(t *testing.T) {
+	reloader, personas, path := newTestReloader(t)
+	for _, corpus := range []string{"   ", "   \n"} {
+		writeTestFile(t, path, "bar.txt", corpus)
+		config, err := reloader.load()
+		if err != nil {
+			t.Fatalf("Failed to load config: %v\n", err)
+		}
+		if _, err := reloader.Apply(config); err == nil ||
+			!strings.Contains(err.Error(), ErrNoWords.Error()) {
+			t.Errorf("Unexpected error applying a corpus of %q. got: %v, want: %v\n", corpus, err,
+				ErrNoWords)
+		}
+		bar, _ := personas.Get("bar")
+		if gen := bar.HMM.Generate(GenerateOptions{Words: 3}); gen.Tokens != 3 {
+			t.Errorf("bar can't generate after a bad corpus was applied: %+v\n", gen)
+		}
+	}
+}
+
+// TestReloaderPanic makes sure that a panic while reading the config fails the reload instead of
+// taking the bot down, and that the personas that were in service stay in service.
+func TestReloaderPanic(t *testing.T) {
+	reloader, personas, path := newTestReloader(t)
+	before := personas.List()
+	writeTestFile(t, path, "config.toml", "[bot]\nname = ,\n")
+	reloader.load = func() (Config, error) { panic("parser blew up") }
+
+	_, err := reloader.Reload()
+	if err == nil || !strings.Contains(err.Error(), "reloading panicked: parser blew up") {
+		t.Errorf("Unexpected error. got: %v\n", err)
+	}
+	if after := personas.List(); !reflect.DeepEqual(after, before) {
+		t.Errorf("A panicking reload changed the personas\n")
+	}
+	if foo, ok := personas.Get("foo"); !ok || foo.HMM.Generate(GenerateOptions{Start: "roll",
+		Words: 2, TopK: 1}).Text != "roll out" {
+		t.Errorf("The old personas aren't being served after a panicking reload\n")
+	}
+}
+
+// TestReloaderChanged makes sure that changes to the config file and corpus files are noticed.
+func TestReloaderChanged(t *testing.T) {
+	reloader, _, path := newTestReloader(t)
+	seen := reloader.stamps()
+	if len(seen) != 3 {
+		t.Errorf("Unexpected number of watched files. got: %d, want: %d\n", len(seen), 3)
+	}
+	changed, seen := reloader.changed(seen)
+	if changed {
+		t.Errorf("A change was noticed even though nothing changed\n")
+	}
+
+	writeTestFile(t, path, "bar.txt", "the cat sat on the mat and the hat\n")
+	if changed, seen = reloader.changed(seen); !changed {
+		t.Errorf("A changed corpus file wasn't noticed\n")
+	}
+	if changed, _ = reloader.changed(seen); changed {
+		t.Errorf("The same change was noticed twice\n")
+	}
+}
+
+// TestReloaderRun makes sure that a running Reloader reloads when a file changes, and when the
+// process gets a SIGHUP.
+func TestReloaderRun(t *testing.T) {
+	reloader, personas, path := newTestReloader(t)
+	reloader.interval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() { errs <- reloader.Run(ctx, func() { close(ready) }) }()
+	<-ready
+
+	waitForWords := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			if foo, _ := personas.Get("foo"); foo.HMM.Stats().Words == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for foo to be retrained on %d words\n", want)
+			}
+		}
+	}
+	writeTestFile(t, path, "foo.txt", "the quick brown fox jumps over the lazy dog\n")
+	waitForWords(8)
+
+	reloader.interval = 0
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("Unexpected error: %v\n", err)
+	}
+
+	// Without an interval, only SIGHUPs lead to reloads.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ready = make(chan struct{})
+	go func() { errs <- reloader.Run(ctx, func() { close(ready) }) }()
+	<-ready
+	writeTestFile(t, path, "foo.txt", "hmm\n")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitForWords(1)
+}
+
+// TestReloadCommand makes sure that only admins can reload the bot, and that the bot generates
+// text with the new model afterwards.
+func TestReloadCommand(t *testing.T) {
+	reloader, personas, path := newTestReloader(t)
+	foo, _ := personas.Get("")
+	bot, _ := NewBot("hmm", "!", foo.HMM)
+	bot.limiter = NewLimiter(LimiterConfig{Admins: []string{"fake/admin"}})
+	p := newFakePlatform("botID")
+
+	tests := []struct {
+		name     string
+		authorID string
+		setup    func()
+		want     string
+	}{
+		{"not an admin", "someone", nil, "Sorry, only my owners can use reload here"},
+		{"not turned on", "admin", nil, "Reloading isn't turned on"},
+		{"nothing changed", "admin", func() {
+			bot.personas = personas
+			bot.reloader = reloader
+		}, "Reloaded. Retrained: nothing, since nothing changed"},
+		{"changed", "admin", func() {
+			writeTestFile(t, path, "foo.txt", "hmm hmm hmm\n")
+		}, "Reloaded. Retrained: foo"},
+		{"failed", "admin", func() {
+			writeTestFile(t, path, "config.toml", "[bot\n")
+		}, "Reloading failed, so nothing changed: "},
+	}
+	for _, tc := range tests {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		bot.HandleMessage(p, &Message{Author: User{ID: tc.authorID}, Content: "!hmm reload"})
+		if !strings.HasPrefix(postedMsg, tc.want) {
+			t.Errorf("%s: unexpected response. got: %q, want: %q\n", tc.name, postedMsg, tc.want)
+		}
+		wasMessagePosted = false
+		postedMsg = ""
+	}
+
+	bot.HandleMessage(p, &Message{Author: User{ID: "someone"}, Content: "!hmm 3"})
+	if postedMsg != "hmm hmm hmm" {
+		t.Errorf("The bot didn't generate text with the reloaded model. got: %q\n", postedMsg)
+	}
+	wasMessagePosted = false
+	postedMsg = ""
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// hereChannel stands for the channel that a command was posted in, wherever a channel is expected.
+const hereChannel = "here"
+
+// ChannelRules are where in a guild the bot answers, and which persona it answers as. Channel IDs
+// aren't prefixed with the name of the chat service, since the guild's already are.
+type ChannelRules struct {
+	// If there are any, the bot only answers in these channels.
+	Allowed []string `json:"allowed,omitempty"`
+	// The bot never answers in these channels.
+	Denied []string `json:"denied,omitempty"`
+	// The personas that plain invocations generate text with in some channels, instead of the
+	// guild's, by channel ID.
+	ChannelPersonas map[string]string `json:"channel_personas,omitempty"`
+}
+
+// Answers reports whether the bot answers in the provided channel.
+func (r ChannelRules) Answers(channelID string) bool {
+	if contains(r.Denied, channelID) {
+		return false
+	}
+	return len(r.Allowed) == 0 || contains(r.Allowed, channelID)
+}
+
+// inChannel returns the settings that apply in the provided channel of the guild.
+func (g GuildSettings) inChannel(channelID string) GuildSettings {
+	if persona, ok := g.ChannelPersonas[channelID]; ok {
+		g.Persona = persona
+	}
+	return g
+}
+
+// allow lets the bot answer in the provided channel.
+func (r *ChannelRules) allow(channelID string) {
+	r.Denied = remove(r.Denied, channelID)
+	if !contains(r.Allowed, channelID) {
+		r.Allowed = append(r.Allowed, channelID)
+	}
+}
+
+// deny keeps the bot from answering in the provided channel.
+func (r *ChannelRules) deny(channelID string) {
+	r.Allowed = remove(r.Allowed, channelID)
+	if !contains(r.Denied, channelID) {
+		r.Denied = append(r.Denied, channelID)
+	}
+}
+
+// reset forgets every rule about the provided channel.
+func (r *ChannelRules) reset(channelID string) {
+	r.Allowed = remove(r.Allowed, channelID)
+	r.Denied = remove(r.Denied, channelID)
+	delete(r.ChannelPersonas, channelID)
+}
+
+// bind makes plain invocations in the provided channel generate text with the provided persona,
+// or with the guild's persona again if persona is empty.
+func (r *ChannelRules) bind(channelID, persona string) {
+	if persona == "" {
+		delete(r.ChannelPersonas, channelID)
+		return
+	}
+	if r.ChannelPersonas == nil {
+		r.ChannelPersonas = make(map[string]string)
+	}
+	r.ChannelPersonas[channelID] = persona
+}
+
+// normalized returns the rules with empty lists and maps left out, so that rules without anything
+// in them are the zero value.
+func (r ChannelRules) normalized() ChannelRules {
+	if len(r.Allowed) == 0 {
+		r.Allowed = nil
+	}
+	if len(r.Denied) == 0 {
+		r.Denied = nil
+	}
+	if len(r.ChannelPersonas) == 0 {
+		r.ChannelPersonas = nil
+	}
+	return r
+}
+
+// describe lists the rules, one per line, each starting with a line break.
+func (r ChannelRules) describe() string {
+	var b strings.Builder
+	if len(r.Allowed) == 0 {
+		b.WriteString("\nchannels: all")
+	} else {
+		b.WriteString("\nchannels: only " + mentionChannels(r.Allowed))
+	}
+	if len(r.Denied) > 0 {
+		b.WriteString("\nnever in: " + mentionChannels(r.Denied))
+	}
+	channels := make([]string, 0, len(r.ChannelPersonas))
+	for channelID := range r.ChannelPersonas {
+		channels = append(channels, channelID)
+	}
+	sort.Strings(channels)
+	for _, channelID := range channels {
+		fmt.Fprintf(&b, "\npersona in %s: %s", mentionChannel(channelID),
+			r.ChannelPersonas[channelID])
+	}
+	return b.String()
+}
+
+// mentionChannel returns a mention of the provided channel, like "<#1234>".
+func mentionChannel(channelID string) string {
+	return "<#" + channelID + ">"
+}
+
+// mentionChannels returns a comma-separated list of mentions of the provided channels.
+func mentionChannels(channelIDs []string) string {
+	mentions := make([]string, len(channelIDs))
+	for i, channelID := range channelIDs {
+		mentions[i] = mentionChannel(channelID)
+	}
+	return strings.Join(mentions, ", ")
+}
+
+// parseChannel returns the ID of the channel that arg names, which is either a mention like
+// "<#1234>" or "<#C1234|general>", hereChannel for the channel that m was posted in, or an ID.
+func parseChannel(m *Message, arg string) string {
+	if strings.ToLower(arg) == hereChannel {
+		return m.ChannelID
+	}
+	if strings.HasPrefix(arg, "<#") && strings.HasSuffix(arg, ">") {
+		arg = strings.TrimSuffix(strings.TrimPrefix(arg, "<#"), ">")
+		if i := strings.Index(arg, "|"); i != -1 {
+			arg = arg[:i]
+		}
+	}
+	return arg
+}
+
+// channelCommand responds to a bot invocation like "!botname config channel deny #general" or
+// "!botname config channel persona #theatre shakespeare", which change where in the guild that it
+// was posted in the bot answers, and which persona it answers as.
+func (b *Bot) channelCommand(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s channel <allow|deny|reset> <#channel|%s>` or"+
+		" `%s %s channel persona <#channel|%s> <persona|%s>`", b.invocation(p, m), configCmd,
+		hereChannel, b.invocation(p, m), configCmd, hereChannel, defaultSetting)
+	if len(arguments) < 2 {
+		p.Reply(m.Context(), m.ChannelID, usage)
+		return outcomeInvalid
+	}
+	action, channelID := strings.ToLower(arguments[0]), parseChannel(m, arguments[1])
+	var change func(*ChannelRules)
+	var msg string
+	switch {
+	case action == "allow" && len(arguments) == 2:
+		change = func(r *ChannelRules) { r.allow(channelID) }
+		msg = fmt.Sprintf("I'll answer in %s", mentionChannel(channelID))
+	case action == "deny" && len(arguments) == 2:
+		change = func(r *ChannelRules) { r.deny(channelID) }
+		msg = fmt.Sprintf("I won't answer in %s anymore", mentionChannel(channelID))
+	case action == "reset" && len(arguments) == 2:
+		change = func(r *ChannelRules) { r.reset(channelID) }
+		msg = fmt.Sprintf("Forgot the rules for %s", mentionChannel(channelID))
+	case action == "persona" && len(arguments) == 3:
+		persona := arguments[2]
+		if strings.ToLower(persona) == defaultSetting {
+			persona = ""
+			msg = fmt.Sprintf("I'll answer as this server's persona in %s",
+				mentionChannel(channelID))
+		} else if _, ok := b.personas.Get(persona); !ok {
+			p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("There's no persona named %q", persona))
+			return outcomeInvalid
+		} else {
+			msg = fmt.Sprintf("I'll answer as %s in %s", persona, mentionChannel(channelID))
+		}
+		change = func(r *ChannelRules) { r.bind(channelID, persona) }
+	default:
+		p.Reply(m.Context(), m.ChannelID, usage)
+		return outcomeInvalid
+	}
+
+	if outcome, ok := b.checkConfigurable(p, m); !ok {
+		return outcome
+	}
+	err := b.settings.Update(platformID(p, m.GuildID), func(s *GuildSettings) {
+		change(&s.ChannelRules)
+	})
+	if err != nil {
+		loggerFrom(m.Context()).Error("Failed to change a channel's rules", "error", err)
+		p.Reply(m.Context(), m.ChannelID, "Something went wrong. Try again in a bit")
+		return outcomeFailed
+	}
+	p.Reply(m.Context(), m.ChannelID, msg)
+	return outcomeOK
+}
+
+// contains reports whether s has the provided string in it.
+func contains(s []string, str string) bool {
+	for _, item := range s {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
+
+// remove returns s without the provided string in it.
+func remove(s []string, str string) []string {
+	kept := s[:0]
+	for _, item := range s {
+		if item != str {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
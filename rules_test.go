@@ -0,0 +1,127 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestChannelRules makes sure that allowing, denying, and resetting channels changes where the
+// bot answers, and that rules without anything in them are forgotten.
+func TestChannelRules(t *testing.T) {
+	var r ChannelRules
+	if !r.Answers("general") {
+		t.Errorf("Expected the bot to answer everywhere without any rules\n")
+	}
+	r.deny("general")
+	if r.Answers("general") || !r.Answers("random") {
+		t.Errorf("Expected the bot to answer everywhere but in a denied channel\n")
+	}
+	r.allow("bots")
+	r.allow("bots")
+	if !r.Answers("bots") || r.Answers("random") {
+		t.Errorf("Expected the bot to only answer in allowed channels\n")
+	}
+	r.allow("general")
+	if !reflect.DeepEqual(r.Allowed, []string{"bots", "general"}) || len(r.Denied) != 0 {
+		t.Errorf("Expected allowing a denied channel to undo denying it. got: %+v\n", r)
+	}
+
+	r.bind("theatre", "shakespeare")
+	settings := GuildSettings{Persona: "obama", ChannelRules: r}
+	if got := settings.inChannel("theatre").Persona; got != "shakespeare" {
+		t.Errorf("Unexpected persona in a bound channel. got: %q\n", got)
+	}
+	if got := settings.inChannel("general").Persona; got != "obama" {
+		t.Errorf("Unexpected persona in an unbound channel. got: %q\n", got)
+	}
+
+	for _, channelID := range []string{"bots", "general", "theatre"} {
+		r.reset(channelID)
+	}
+	if got := r.normalized(); !reflect.DeepEqual(got, ChannelRules{}) {
+		t.Errorf("Expected rules without anything in them to be the zero value. got: %+v\n", got)
+	}
+}
+
+// TestParseChannel makes sure that channels can be named by mention, by ID, or as "here".
+func TestParseChannel(t *testing.T) {
+	m := &Message{ChannelID: "current"}
+	for arg, want := range map[string]string{
+		"<#1234>":          "1234",
+		"<#C1234|general>": "C1234",
+		"here":             "current",
+		"#general":         "#general",
+	} {
+		if got := parseChannel(m, arg); got != want {
+			t.Errorf("Unexpected channel for %q. got: %q, want: %q\n", arg, got, want)
+		}
+	}
+}
+
+// TestChannelCommand makes sure that people who can manage a guild can restrict the bot to some
+// of its channels, and bind personas to channels, and that the bot silently ignores invocations
+// in channels that it doesn't answer in.
+func TestChannelCommand(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("rules", "!", hmm)
+	other, _ := NewHMM("out damned spot\n", 5)
+	bot.personas.Add(&Persona{Name: "shakespeare", HMM: other})
+	p := newManagingPlatform("botID", "owner")
+	defer func() {
+		wasMessagePosted = false
+		postedMsg = ""
+	}()
+	invoke := func(channelID, authorID, content string) string {
+		postedMsg = ""
+		bot.HandleMessage(p, &Message{ChannelID: channelID, GuildID: "guild",
+			Author: User{ID: authorID}, Content: content})
+		return postedMsg
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		author  string
+		content string
+		want    string
+	}{
+		{"not a manager", "general", "alice", "!rules config channel deny here",
+			"Sorry, only people with manage_server can use config here"},
+		{"usage", "general", "owner", "!rules config channel deny",
+			"Example usage: `!rules config channel <allow|deny|reset> <#channel|here>` or" +
+				" `!rules config channel persona <#channel|here> <persona|default>`"},
+		{"unknown persona", "general", "owner", "!rules config channel persona here obama",
+			`There's no persona named "obama"`},
+		{"deny", "general", "owner", "!rules config channel deny <#politics>",
+			"I won't answer in <#politics> anymore"},
+		{"denied", "politics", "alice", "!rules quick 3", ""},
+		{"not denied", "general", "alice", "!rules quick 3", "quick brown fox"},
+		{"allow", "general", "owner", "!rules config channel allow <#bots>",
+			"I'll answer in <#bots>"},
+		{"not allowed", "general", "alice", "!rules quick 3", ""},
+		{"allowed", "bots", "alice", "!rules quick 3", "quick brown fox"},
+		{"config where not allowed", "general", "owner",
+			"!rules config channel persona <#theatre> shakespeare",
+			"I'll answer as shakespeare in <#theatre>"},
+		{"allow bound", "general", "owner", "!rules config channel allow <#theatre>",
+			"I'll answer in <#theatre>"},
+		{"bound", "theatre", "alice", "!rules out 2", "out damned"},
+		{"show", "bots", "owner", "!rules config show",
+			"Settings for this server:\nprefix: `!` (default)\npersona: rules (default)\n" +
+				"maxwords: 1000 (default)\nchannels: only <#bots>, <#theatre>\n" +
+				"never in: <#politics>\npersona in <#theatre>: shakespeare\n" +
+				"config: people with manage_server (default)\nfeedback: my owners (default)\n" +
+				"generate: everyone (default)\nimitate: everyone (default)\n" +
+				"reload: my owners (default)"},
+		{"unbind", "theatre", "owner", "!rules config channel persona here default",
+			"I'll answer as this server's persona in <#theatre>"},
+		{"unbound", "theatre", "alice", "!rules quick 3", "quick brown fox"},
+		{"reset", "general", "owner", "!rules config channel reset <#politics>",
+			"Forgot the rules for <#politics>"},
+	}
+	for _, tc := range tests {
+		if got := invoke(tc.channel, tc.author, tc.content); got != tc.want {
+			t.Errorf("%s: unexpected reply.\ngot: %q\nwant: %q\n", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// configCmd is the argument for looking at and changing a guild's settings. By default, only
+	// people who can manage the guild, and admins, may use it.
+	configCmd = "config"
+
+	// settingsBucket holds each guild's GuildSettings, by the guild's platform ID.
+	settingsBucket = "settings"
+	// maxPrefixLength is the longest prefix that a guild may pick.
+	maxPrefixLength = 5
+	// defaultSetting is the value that puts a setting back to its default.
+	defaultSetting = "default"
+)
+
+// GuildSettings are what a guild's admins may change about how the bot behaves there. Zero values
+// mean that the global default applies.
+type GuildSettings struct {
+	// What invocations start with, before the bot's name.
+	Prefix string `json:"prefix,omitempty"`
+	// The persona that plain invocations generate text with.
+	Persona string `json:"persona,omitempty"`
+	// The most words that may be asked for in a plain invocation.
+	MaxWords int `json:"max_words,omitempty"`
+
+	// See ChannelRules. They don't have global defaults.
+	ChannelRules
+	// Who may use each subcommand, by subcommand, for the ones that the guild changed. See
+	// defaultRequirements for the rest.
+	Permissions map[string]Requirement `json:"permissions,omitempty"`
+}
+
+// Settings keeps each guild's GuildSettings in a Store. It's safe for concurrent use.
+type Settings struct {
+	// Serializes changes, since each one reads a guild's settings, and then writes them back.
+	mu       sync.Mutex
+	store    Store
+	defaults GuildSettings
+}
+
+// NewSettings returns a pointer to a new Settings which is kept in the provided Store. Guilds
+// that didn't change a setting get its value in defaults.
+func NewSettings(store Store, defaults GuildSettings) *Settings {
+	return &Settings{store: store, defaults: defaults}
+}
+
+// defaultSettings returns the global defaults for a bot with the provided prefix.
+func defaultSettings(prefix string) GuildSettings {
+	return GuildSettings{Prefix: prefix, MaxWords: maxNumWords}
+}
+
+// overrides returns only the settings that the provided guild changed.
+func (s *Settings) overrides(guildID string) (GuildSettings, error) {
+	var settings GuildSettings
+	_, err := getJSON(s.store, settingsBucket, guildID, &settings)
+	return settings, err
+}
+
+// Get returns the provided guild's settings, with defaults filled in for the ones that it didn't
+// change. guildID should be prefixed with the name of the chat service that it came from, and an
+// empty one gets the defaults.
+func (s *Settings) Get(guildID string) GuildSettings {
+	settings := s.defaults
+	if guildID == "" {
+		return settings
+	}
+	overrides, err := s.overrides(guildID)
+	if err != nil {
+		// A corrupted entry shouldn't keep the bot from answering at all.
+		return settings
+	}
+	if overrides.Prefix != "" {
+		settings.Prefix = overrides.Prefix
+	}
+	if overrides.Persona != "" {
+		settings.Persona = overrides.Persona
+	}
+	if overrides.MaxWords != 0 {
+		settings.MaxWords = overrides.MaxWords
+	}
+	settings.ChannelRules = overrides.ChannelRules
+	settings.Permissions = overrides.Permissions
+	return settings
+}
+
+// Update changes the provided guild's settings with change, which is passed only the settings
+// that the guild changed so far, and saves them.
+func (s *Settings) Update(guildID string, change func(*GuildSettings)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	settings, err := s.overrides(guildID)
+	if err != nil {
+		return err
+	}
+	change(&settings)
+	settings.ChannelRules = settings.ChannelRules.normalized()
+	if len(settings.Permissions) == 0 {
+		settings.Permissions = nil
+	}
+	if reflect.DeepEqual(settings, GuildSettings{}) {
+		return s.store.Delete(settingsBucket, guildID)
+	}
+	return putJSON(s.store, settingsBucket, guildID, settings)
+}
+
+// settingsFor returns the settings of the guild that m was posted in.
+func (b *Bot) settingsFor(p Platform, m *Message) GuildSettings {
+	return b.settings.Get(platformID(p, m.GuildID))
+}
+
+// invocation returns what invocations start with in the guild that m was posted in, like
+// "!botname".
+func (b *Bot) invocation(p Platform, m *Message) string {
+	return b.settingsFor(p, m).Prefix + b.name
+}
+
+// configCommand responds to a bot invocation like "!botname config show" or
+// "!botname config set prefix ?", which look at or change the settings of the guild that it was
+// posted in.
+func (b *Bot) configCommand(p Platform, m *Message, arguments []string) string {
+	usage := fmt.Sprintf("Example usage: `%s %s show`, `%s %s set <prefix|persona|maxwords>"+
+		" <value|%s>`, `%s %s channel`, or `%s %s permission`", b.invocation(p, m), configCmd,
+		b.invocation(p, m), configCmd, defaultSetting, b.invocation(p, m), configCmd,
+		b.invocation(p, m), configCmd)
+	if len(arguments) == 0 {
+		p.Reply(m.Context(), m.ChannelID, usage)
+		return outcomeInvalid
+	}
+	switch strings.ToLower(arguments[0]) {
+	case "show":
+		p.Reply(m.Context(), m.ChannelID, b.describeSettings(p, m))
+		return outcomeOK
+	case "set":
+		if len(arguments) != 3 {
+			break
+		}
+		return b.setSetting(p, m, strings.ToLower(arguments[1]), arguments[2])
+	case "channel":
+		return b.channelCommand(p, m, arguments[1:])
+	case "permission":
+		return b.permissionCommand(p, m, arguments[1:])
+	}
+	p.Reply(m.Context(), m.ChannelID, usage)
+	return outcomeInvalid
+}
+
+// describeSettings lists the settings of the guild that m was posted in, and which of them are
+// defaults.
+func (b *Bot) describeSettings(p Platform, m *Message) string {
+	settings := b.settingsFor(p, m)
+	overrides, _ := b.settings.overrides(platformID(p, m.GuildID))
+	persona := settings.Persona
+	if persona == "" {
+		defaultPersona, _ := b.personas.Get("")
+		persona = defaultPersona.Name
+	}
+	describe := func(name, value string, changed bool) string {
+		if !changed {
+			value += " (default)"
+		}
+		return fmt.Sprintf("\n%s: %s", name, value)
+	}
+	return "Settings for this server:" +
+		describe("prefix", "`"+settings.Prefix+"`", overrides.Prefix != "") +
+		describe("persona", persona, overrides.Persona != "") +
+		describe("maxwords", strconv.Itoa(settings.MaxWords), overrides.MaxWords != 0) +
+		settings.ChannelRules.describe() + settings.describePermissions()
+}
+
+// setSetting changes one of the settings of the guild that m was posted in, or puts it back to
+// its default if value is defaultSetting.
+func (b *Bot) setSetting(p Platform, m *Message, name, value string) string {
+	if outcome, ok := b.checkConfigurable(p, m); !ok {
+		return outcome
+	}
+
+	reset := strings.ToLower(value) == defaultSetting
+	var change func(*GuildSettings)
+	switch name {
+	case "prefix":
+		if !reset && utf8.RuneCountInString(value) > maxPrefixLength {
+			p.Reply(m.Context(), m.ChannelID,
+				fmt.Sprintf("Prefixes can't be longer than %d characters", maxPrefixLength))
+			return outcomeInvalid
+		}
+		change = func(s *GuildSettings) { s.Prefix = value }
+	case "persona":
+		if _, ok := b.personas.Get(value); !reset && !ok {
+			p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("There's no persona named %q", value))
+			return outcomeInvalid
+		}
+		change = func(s *GuildSettings) { s.Persona = value }
+	case "maxwords":
+		maxWords, err := strconv.Atoi(value)
+		if !reset && (err != nil || maxWords < 1 || maxWords > maxNumWords) {
+			p.Reply(m.Context(), m.ChannelID,
+				fmt.Sprintf("maxwords should be a number from 1 to %d", maxNumWords))
+			return outcomeInvalid
+		}
+		change = func(s *GuildSettings) { s.MaxWords = maxWords }
+	default:
+		p.Reply(m.Context(), m.ChannelID, fmt.Sprintf("There's no setting named %q. Settings are"+
+			" prefix, persona, and maxwords", name))
+		return outcomeInvalid
+	}
+	if reset {
+		// The zero value of every setting means that the default applies. change reads value when
+		// it's called, so it picks this up.
+		value = ""
+	}
+
+	if err := b.settings.Update(platformID(p, m.GuildID), change); err != nil {
+		loggerFrom(m.Context()).Error("Failed to change a setting", "setting", name, "error", err)
+		p.Reply(m.Context(), m.ChannelID, "Something went wrong. Try again in a bit")
+		return outcomeFailed
+	}
+	msg := fmt.Sprintf("Set %s to %s", name, value)
+	if reset {
+		msg = fmt.Sprintf("Set %s back to its default", name)
+	}
+	if name == "prefix" {
+		msg += fmt.Sprintf(". Invoke me with `%s` from now on", b.invocation(p, m))
+	}
+	p.Reply(m.Context(), m.ChannelID, msg)
+	return outcomeOK
+}
+
+// checkConfigurable reports whether the settings of the guild that m was posted in can be
+// changed. If they can't, the author is told why, and the invocation's outcome is returned. Who
+// may change them was already checked by authorize.
+func (b *Bot) checkConfigurable(p Platform, m *Message) (string, bool) {
+	if m.GuildID == "" {
+		p.Reply(m.Context(), m.ChannelID, "Settings can only be changed in a server")
+		return outcomeInvalid, false
+	}
+	return "", true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSettings makes sure that guilds get the defaults for the settings that they didn't change,
+// and that changing every setting back to its default forgets the guild.
+func TestSettings(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewSettings(store, defaultSettings("!"))
+	if got, want := s.Get("fake/guild"), defaultSettings("!"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settings. got: %+v, want: %+v\n", got, want)
+	}
+	s.Update("fake/guild", func(g *GuildSettings) { g.Prefix = "?" })
+	s.Update("fake/guild", func(g *GuildSettings) { g.MaxWords = 20 })
+	want := GuildSettings{Prefix: "?", MaxWords: 20}
+	if got := s.Get("fake/guild"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settings. got: %+v, want: %+v\n", got, want)
+	}
+	if got := s.Get("fake/other"); !reflect.DeepEqual(got, defaultSettings("!")) {
+		t.Errorf("Expected another guild to get the defaults. got: %+v\n", got)
+	}
+	got := NewSettings(store, defaultSettings("!")).Get("fake/guild")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected settings to be kept in the store. got: %+v, want: %+v\n", got, want)
+	}
+
+	s.Update("fake/guild", func(g *GuildSettings) { *g = GuildSettings{} })
+	if keys := store.Keys(settingsBucket); len(keys) != 0 {
+		t.Errorf("Expected a guild without any changed settings to be forgotten. got: %v\n", keys)
+	}
+}
+
+// TestConfigCommand makes sure that people who can manage a guild can change its settings, and
+// that the bot goes by them there.
+func TestConfigCommand(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("settings", "!", hmm)
+	other, _ := NewHMM("out damned spot\n", 5)
+	bot.personas.Add(&Persona{Name: "shakespeare", HMM: other})
+	p := newManagingPlatform("botID", "owner")
+	defer func() {
+		wasMessagePosted = false
+		postedMsg = ""
+	}()
+	invoke := func(guildID, authorID, content string) string {
+		postedMsg = ""
+		bot.HandleMessage(p, &Message{ChannelID: "channel", GuildID: guildID,
+			Author: User{ID: authorID}, Content: content})
+		return postedMsg
+	}
+
+	tests := []struct {
+		name    string
+		guildID string
+		author  string
+		content string
+		want    string
+	}{
+		{"not a manager", "guild", "alice", "!settings config set prefix ?",
+			"Sorry, only people with manage_server can use config here"},
+		{"direct message", "", "owner", "!settings config set prefix ?",
+			"Sorry, only people with manage_server can use config here"},
+		{"unknown setting", "guild", "owner", "!settings config set color blue",
+			`There's no setting named "color". Settings are prefix, persona, and maxwords`},
+		{"long prefix", "guild", "owner", "!settings config set prefix ??????",
+			"Prefixes can't be longer than 5 characters"},
+		{"unknown persona", "guild", "owner", "!settings config set persona obama",
+			`There's no persona named "obama"`},
+		{"bad maxwords", "guild", "owner", "!settings config set maxwords 0",
+			"maxwords should be a number from 1 to 1000"},
+		{"usage", "guild", "owner", "!settings config",
+			"Example usage: `!settings config show`, `!settings config set" +
+				" <prefix|persona|maxwords> <value|default>`, `!settings config channel`, or" +
+				" `!settings config permission`"},
+		{"set prefix", "guild", "owner", "!settings config set prefix ?",
+			"Set prefix to ?. Invoke me with `?settings` from now on"},
+		{"old prefix", "guild", "alice", "!settings 3", ""},
+		{"other guild", "other", "alice", "!settings quick 3", "quick brown fox"},
+		{"new prefix", "guild", "alice", "?settings quick 3", "quick brown fox"},
+		{"set maxwords", "guild", "owner", "?settings config set maxwords 2", "Set maxwords to 2"},
+		{"too many words", "guild", "alice", "?settings 3", "Can't post more than 2 words"},
+		{"set persona", "guild", "owner", "?settings config set persona shakespeare",
+			"Set persona to shakespeare"},
+		{"persona", "guild", "alice", "?settings out 2", "out damned"},
+		{"show", "guild", "owner", "?settings config show",
+			"Settings for this server:\nprefix: `?`\npersona: shakespeare\nmaxwords: 2\n" +
+				"channels: all\n" +
+				"config: people with manage_server (default)\nfeedback: my owners (default)\n" +
+				"generate: everyone (default)\nimitate: everyone (default)\n" +
+				"reload: my owners (default)"},
+		{"reset", "guild", "owner", "?settings config set maxwords default",
+			"Set maxwords back to its default"},
+		{"show defaults", "other", "owner", "!settings config show",
+			"Settings for this server:\nprefix: `!` (default)\npersona: settings (default)\n" +
+				"maxwords: 1000 (default)\nchannels: all\n" +
+				"config: people with manage_server (default)\nfeedback: my owners (default)\n" +
+				"generate: everyone (default)\nimitate: everyone (default)\n" +
+				"reload: my owners (default)"},
+	}
+	for _, tc := range tests {
+		if got := invoke(tc.guildID, tc.author, tc.content); got != tc.want {
+			t.Errorf("%s: unexpected reply.\ngot: %q\nwant: %q\n", tc.name, got, tc.want)
+		}
+	}
+}
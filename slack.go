@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSlackAPIURL is where Slack's Web API lives.
+	defaultSlackAPIURL = "https://slack.com/api/"
+	// slackMaxTimestampSkew is how old a request from Slack may be before it's rejected. This keeps
+	// old requests from being replayed.
+	slackMaxTimestampSkew = 5 * time.Minute
+	// slackSlashCommand is the slash command that maps onto the bot's usual invocation.
+	slackSlashCommand = "/hmm"
+	// slackEventMemory is how long the IDs of events are remembered for, so that Slack's retries
+	// of them aren't handled twice. Slack gives up on an event after retrying it 5 minutes later.
+	slackEventMemory = 10 * time.Minute
+)
+
+// Errors that Slack requests may fail with.
+var (
+	ErrSlackNoToken      = errors.New("no Slack bot token was configured")
+	ErrSlackBadSignature = errors.New("request signature doesn't match")
+	ErrSlackOldTimestamp = errors.New("request timestamp is too old")
+	ErrSlackNoSigningKey = errors.New("no Slack signing secret was configured")
+	slackMentionRegexp   = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+	slackTextUnescaper   = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+	slackTextEscaper     = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+)
+
+// SlackConfig describes how to connect to a Slack workspace.
+type SlackConfig struct {
+	// The bot user OAuth token, which starts with "xoxb-".
+	BotToken string
+	// Used to verify that requests really came from Slack.
+	SigningSecret string
+	// Address to listen for Events API callbacks and slash commands on, like ":3000".
+	ListenAddr string
+	// Where Slack's Web API lives. Defaults to defaultSlackAPIURL.
+	APIURL string
+}
+
+// Slack connects a Bot to a Slack workspace. Slack sends it messages through the Events API, and
+// slash commands, over HTTP. It hands them to its Bot, and is the Platform that the Bot talks back
+// through, using Slack's Web API.
+//
+// Slack serves these paths:
+//   - POST /slack/events for Events API callbacks
+//   - POST /slack/commands for the /hmm slash command
+type Slack struct {
+	config SlackConfig
+	bot    *Bot
+	client *http.Client
+	selfID string
+	// Messages that are being handled.
+	handlers inFlight
+
+	mu sync.Mutex
+	// When each event that was handled arrived, by event ID.
+	seen map[string]time.Time
+	// When seen was last pruned of events that are too old to be retried.
+	pruned time.Time
+
+	// Exists so that the passage of time can be faked in tests.
+	now func() time.Time
+}
+
+// NewSlack returns a pointer to a new Slack initialized with the provided config and the Bot to
+// hand messages to.
+func NewSlack(config SlackConfig, bot *Bot) (*Slack, error) {
+	if config.BotToken == "" {
+		return nil, ErrSlackNoToken
+	}
+	if config.SigningSecret == "" {
+		return nil, ErrSlackNoSigningKey
+	}
+	if config.APIURL == "" {
+		config.APIURL = defaultSlackAPIURL
+	}
+
+	return &Slack{
+		config: config,
+		bot:    bot,
+		client: &http.Client{Timeout: 30 * time.Second},
+		seen:   make(map[string]time.Time),
+		now:    time.Now,
+	}, nil
+}
+
+// Run looks up the bot's own user ID, and then listens for requests from Slack until ctx is done.
+// Then it lets the requests that are being served, and the messages that are being handled, finish
+// up.
+func (s *Slack) Run(ctx context.Context, ready func()) error {
+	if err := s.authTest(); err != nil {
+		return err
+	}
+	slog.Info("Listening for Slack events", "addr", s.config.ListenAddr)
+	err := serveHTTP(ctx, s.config.ListenAddr, s, ready)
+	s.handlers.Close()
+	return err
+}
+
+// ServeHTTP verifies that a request came from Slack, and then routes it to the right handler.
+func (s *Slack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if err := s.verify(r.Header, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/slack/events":
+		s.handleEvent(w, body)
+	case "/slack/commands":
+		s.handleCommand(w, body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks a request's signature, which Slack computes with the app's signing secret. See:
+// https://api.slack.com/authentication/verifying-requests-from-slack
+func (s *Slack) verify(header http.Header, body []byte) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrSlackBadSignature
+	}
+	if math.Abs(s.now().Sub(time.Unix(secs, 0)).Seconds()) > slackMaxTimestampSkew.Seconds() {
+		return ErrSlackOldTimestamp
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.config.SigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(header.Get("X-Slack-Signature")), []byte(want)) {
+		return ErrSlackBadSignature
+	}
+	return nil
+}
+
+// slackEventEnvelope is the body of an Events API callback.
+type slackEventEnvelope struct {
+	Type      string     `json:"type"`
+	Challenge string     `json:"challenge"`
+	TeamID    string     `json:"team_id"`
+	EventID   string     `json:"event_id"`
+	Event     slackEvent `json:"event"`
+}
+
+// slackEvent is the event inside of an Events API callback, or a message in a channel's history.
+type slackEvent struct {
+	Type    string `json:"type"`
+	Subtype string `json:"subtype"`
+	User    string `json:"user"`
+	BotID   string `json:"bot_id"`
+	Text    string `json:"text"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// handleEvent responds to an Events API callback. Slack wants a response within 3 seconds, so
+// messages are handed to the Bot in the background. Slack retries events that it didn't get a
+// response to in time, so events that were already handled are skipped.
+func (s *Slack) handleEvent(w http.ResponseWriter, body []byte) {
+	var envelope slackEventEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, "malformed event", http.StatusBadRequest)
+		return
+	}
+
+	switch envelope.Type {
+	case "url_verification":
+		// Slack sends this once, when the app's request URL is configured.
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, envelope.Challenge)
+		return
+	case "event_callback":
+		if s.handled(envelope.EventID) {
+			slog.Debug("Skipping a retried Slack event", "event_id", envelope.EventID)
+			break
+		}
+		event := envelope.Event
+		// Skip edits, joins, and other bots' messages, including our own.
+		if event.Type == "message" && event.Subtype == "" && event.BotID == "" {
+			message := s.newMessage(envelope.TeamID, event)
+			s.handlers.Go(func() { s.bot.HandleMessage(s, message) })
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handled reports whether an event with the provided ID was already handled, and remembers it if
+// it wasn't.
+func (s *Slack) handled(eventID string) bool {
+	if eventID == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.pruned) >= slackEventMemory {
+		for id, at := range s.seen {
+			if now.Sub(at) >= slackEventMemory {
+				delete(s.seen, id)
+			}
+		}
+		s.pruned = now
+	}
+	if _, ok := s.seen[eventID]; ok {
+		return true
+	}
+	s.seen[eventID] = now
+	return false
+}
+
+// handleCommand responds to the /hmm slash command. "/hmm america 40" is handled just like
+// "!botname america 40".
+func (s *Slack) handleCommand(w http.ResponseWriter, body []byte) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil || form.Get("command") != slackSlashCommand {
+		http.Error(w, "unknown command", http.StatusBadRequest)
+		return
+	}
+
+	event := slackEvent{
+		User:    form.Get("user_id"),
+		Channel: form.Get("channel_id"),
+		Text:    form.Get("text"),
+	}
+	message := s.newMessage(form.Get("team_id"), event)
+	message.Content = strings.TrimSpace(s.bot.invocation(s, message) + " " + message.Content)
+	s.handlers.Go(func() { s.bot.HandleMessage(s, message) })
+	// An empty response keeps Slack from echoing the command back into the channel.
+	w.WriteHeader(http.StatusOK)
+}
+
+// newMessage converts a Slack message into a platform-neutral Message. Slack escapes a few
+// characters in message text, and writes mentions like "<@U1234>".
+func (s *Slack) newMessage(teamID string, event slackEvent) *Message {
+	m := &Message{
+		ID:        event.TS,
+		ChannelID: event.Channel,
+		GuildID:   teamID,
+		Author:    User{ID: event.User, Name: event.User},
+		Content:   slackTextUnescaper.Replace(event.Text),
+	}
+	for _, match := range slackMentionRegexp.FindAllStringSubmatch(event.Text, -1) {
+		m.Mentions = append(m.Mentions, User{ID: match[1], Name: "<@" + match[1] + ">"})
+	}
+	return m
+}
+
+// Name returns "slack".
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+// SelfID returns the bot's user ID, which is looked up when the Slack starts.
+func (s *Slack) SelfID() string {
+	return s.selfID
+}
+
+// Reply posts a message in the provided channel with chat.postMessage.
+func (s *Slack) Reply(ctx context.Context, channelID, msg string) {
+	params := map[string]string{"channel": channelID, "text": slackTextEscaper.Replace(msg)}
+	if err := s.call("chat.postMessage", params, nil); err != nil {
+		loggerFrom(ctx).Error("Failed to post message in Slack channel", "error", err)
+	}
+}
+
+// ReplyPrivately posts a message in the channel that m was posted in with chat.postEphemeral, so
+// that only its author sees it.
+func (s *Slack) ReplyPrivately(ctx context.Context, m *Message, msg string) {
+	params := map[string]string{"channel": m.ChannelID, "user": m.Author.ID,
+		"text": slackTextEscaper.Replace(msg)}
+	if err := s.call("chat.postEphemeral", params, nil); err != nil {
+		loggerFrom(ctx).Error("Failed to post ephemeral message in Slack channel", "error", err)
+	}
+}
+
+// SendFile uploads a file to the provided channel with files.upload.
+func (s *Slack) SendFile(channelID, name string, r io.Reader) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("channels", channelID)
+	form.WriteField("filename", name)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.APIURL+"files.upload", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return s.do(req, nil)
+}
+
+// FetchMessages pages through a channel's history with conversations.history.
+func (s *Slack) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	var contents []string
+	cursor := ""
+
+	for page := 0; page < maxHistoryPages && len(contents) < limit; page++ {
+		var resp struct {
+			Messages []slackEvent `json:"messages"`
+			Metadata struct {
+				NextCursor string `json:"next_cursor"`
+			} `json:"response_metadata"`
+		}
+		params := map[string]string{
+			"channel": channelID,
+			"limit":   strconv.Itoa(maxMessagesPerPage),
+			"cursor":  cursor,
+		}
+		if err := s.callForm("conversations.history", params, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, msg := range resp.Messages {
+			if len(contents) == limit {
+				break
+			}
+			if msg.Subtype != "" || msg.BotID != "" || !include(msg.User) {
+				continue
+			}
+			if content := strings.TrimSpace(slackTextUnescaper.Replace(msg.Text)); content != "" {
+				contents = append(contents, content)
+			}
+		}
+
+		cursor = resp.Metadata.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	return contents, nil
+}
+
+// IsNSFW always reports false, since Slack channels can't be marked as NSFW.
+func (s *Slack) IsNSFW(channelID string) (bool, error) {
+	return false, nil
+}
+
+// authTest looks up the bot's own user ID with auth.test, which also makes sure that the bot token
+// works.
+func (s *Slack) authTest() error {
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	if err := s.callForm("auth.test", nil, &resp); err != nil {
+		return err
+	}
+	s.selfID = resp.UserID
+	return nil
+}
+
+// call calls a Slack Web API method with the provided params encoded as JSON, and decodes the
+// response into out if it isn't nil. Only methods that write, like chat.postMessage, take JSON.
+func (s *Slack) call(method string, params map[string]string, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.config.APIURL+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	return s.do(req, out)
+}
+
+// callForm is like call, but the params are form encoded. Methods that read, like
+// conversations.history, only take form encoded params. Empty params are left out.
+func (s *Slack) callForm(method string, params map[string]string, out interface{}) error {
+	form := url.Values{}
+	for key, value := range params {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, s.config.APIURL+method,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.do(req, out)
+}
+
+// do sends a request to Slack's Web API with the bot's token. Slack responds with a 200 even when
+// a call fails, and says whether it worked in the response's "ok" field.
+func (s *Slack) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Authorization", "Bearer "+s.config.BotToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack responded with HTTP %s", resp.Status)
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return fmt.Errorf("slack API error: %s", status.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(body, out)
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// storeFileName is the name of the file in the persistence directory that a BoltStore is kept
+	// in.
+	storeFileName = "hmm.db"
+	// storeLockTimeout is how long opening a store waits for another process to let go of it.
+	storeLockTimeout = time.Second
+
+	// metaBucket holds a Store's own bookkeeping, like its version under versionKey.
+	metaBucket = "meta"
+	versionKey = "version"
+	// optOutsBucket, feedbackBucket, and channelsBucket hold OptOuts, each persona's feedback
+	// weights, and each channel's ChannelHistory entries.
+	optOutsBucket  = "optouts"
+	feedbackBucket = "feedback"
+	channelsBucket = "channels"
+)
+
+// Store is where the bot keeps what it knows, so that it survives restarts. Values are grouped into
+// buckets, and looked up by key. Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value of the provided key, and whether it's set.
+	Get(bucket, key string) ([]byte, bool)
+	// Put sets the provided key's value.
+	Put(bucket, key string, value []byte) error
+	// Delete unsets the provided key. Deleting a key that isn't set isn't an error.
+	Delete(bucket, key string) error
+	// Keys returns the bucket's keys, in order.
+	Keys(bucket string) []string
+}
+
+// getJSON decodes the provided key's value into v, and reports whether it's set.
+func getJSON(s Store, bucket, key string, v interface{}) (bool, error) {
+	data, ok := s.Get(bucket, key)
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return true, fmt.Errorf("%s/%s is corrupted: %v", bucket, key, err)
+	}
+	return true, nil
+}
+
+// putJSON sets the provided key's value to v, encoded as JSON. Nothing is written if the value
+// didn't change.
+func putJSON(s Store, bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if old, ok := s.Get(bucket, key); ok && bytes.Equal(old, data) {
+		return nil
+	}
+	return s.Put(bucket, key, data)
+}
+
+// MemoryStore is a Store that only lives as long as the process does. It's what the bot uses when
+// there's no persistence directory.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore returns a pointer to a new, empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+// Get returns the value of the provided key, and whether it's set.
+func (m *MemoryStore) Get(bucket, key string) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.buckets[bucket][key]
+	return value, ok
+}
+
+// Put sets the provided key's value.
+func (m *MemoryStore) Put(bucket, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string][]byte)
+	}
+	m.buckets[bucket][key] = append([]byte{}, value...)
+	return nil
+}
+
+// Delete unsets the provided key.
+func (m *MemoryStore) Delete(bucket, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets[bucket], key)
+	if len(m.buckets[bucket]) == 0 {
+		delete(m.buckets, bucket)
+	}
+	return nil
+}
+
+// Keys returns the bucket's keys, in order.
+func (m *MemoryStore) Keys(bucket string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.buckets[bucket]))
+	for key := range m.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BoltStore is a Store that's kept in a bbolt database in a directory. Every change is its own
+// transaction, so it's on disk by the time Put or Delete returns.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the BoltStore in the provided directory, and creates it if there isn't one
+// yet. It's migrated to the latest version before it's returned. Only one process can have a
+// store open at a time, so it fails if another one already does.
+func OpenBoltStore(dir string) (*BoltStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := openBolt(filepath.Join(dir, storeFileName), false)
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{db: db}
+	if err := migrate(s, dir); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openBolt opens the bbolt database at path, and gives up if another process doesn't let go of it
+// within storeLockTimeout.
+func openBolt(path string, readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: storeLockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process, like a running bot", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return db, nil
+}
+
+// Get returns the value of the provided key, and whether it's set.
+func (s *BoltStore) Get(bucket, key string) ([]byte, bool) {
+	var value []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			// Values are only good until the transaction ends.
+			if v := b.Get([]byte(key)); v != nil {
+				value = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+	return value, value != nil
+}
+
+// Put sets the provided key's value.
+func (s *BoltStore) Put(bucket, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Delete unsets the provided key.
+func (s *BoltStore) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Keys returns the bucket's keys, in order.
+func (s *BoltStore) Keys(bucket string) []string {
+	var keys []string
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys
+}
+
+// Close closes the database. The store can't be used after that.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// countKeys returns how many keys are set in the provided database, in every bucket.
+func countKeys(db *bolt.DB) (int, error) {
+	n := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			n += b.Stats().KeyN
+			return nil
+		})
+	})
+	return n, err
+}
+
+// migrations upgrade a Store from one version to the next: migrations[0] upgrades a brand new
+// store to version 1, migrations[1] upgrades it from version 1 to version 2, and so on. They're
+// passed the directory that the store is in. Add to the end whenever what's kept in a store
+// changes in a way that older versions of the bot can't read, and never change the ones that are
+// already here.
+var migrations = []func(s Store, dir string) error{
+	importChannelsFile,
+}
+
+// storeVersion returns the version of the provided store, which is 0 for a brand new one.
+func storeVersion(s Store) (int, error) {
+	data, ok := s.Get(metaBucket, versionKey)
+	if !ok {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("%s/%s is corrupted: %v", metaBucket, versionKey, err)
+	}
+	return version, nil
+}
+
+// migrate runs every migration that the provided store hasn't had yet, in order.
+func migrate(s Store, dir string) error {
+	version, err := storeVersion(s)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("the store is version %d, but only versions up to %d can be read",
+			version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		if err := migrations[version](s, dir); err != nil {
+			return fmt.Errorf("failed to migrate the store to version %d: %v", version+1, err)
+		}
+		if err := s.Put(metaBucket, versionKey, []byte(strconv.Itoa(version+1))); err != nil {
+			return err
+		}
+		slog.Info("Migrated the store", "version", version+1)
+	}
+	return nil
+}
+
+// importChannelsFile moves what's in channels.json, where channel histories were saved before
+// there was a store, into the store.
+func importChannelsFile(s Store, dir string) error {
+	path := filepath.Join(dir, "channels.json")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Version  int               `json:"version"`
+		Channels []channelSnapshot `json:"channels"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s is corrupted: %v", path, err)
+	}
+	for _, channel := range file.Channels {
+		if err := putJSON(s, channelsBucket, channel.Channel, channel.Entries); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// backupStore writes a copy of the store in the provided directory to w, and returns how many
+// keys it has. The copy is a bbolt database, just like the store. Since only one process can have
+// the store open at a time, the bot has to be stopped first.
+func backupStore(dir string, w io.Writer) (int, error) {
+	path := filepath.Join(dir, storeFileName)
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	db, err := openBolt(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	n, err := countKeys(db)
+	if err != nil {
+		return 0, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// restoreStore replaces the store in the provided directory with the backup in r, and returns how
+// many keys it has. A backup from a newer version of the bot can't be restored. The bot has to be
+// stopped first.
+func restoreStore(dir string, r io.Reader) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(dir, storeFileName)
+	// The backup is written next to where it belongs, and then moved into place once it checks
+	// out, so that a bad backup never replaces a good store.
+	tmp, err := ioutil.TempFile(dir, storeFileName+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := checkBackup(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	// Make sure that the bot isn't using the store that's about to be replaced.
+	if _, err := os.Stat(path); err == nil {
+		db, err := openBolt(path, false)
+		if err != nil {
+			return 0, err
+		}
+		db.Close()
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// checkBackup makes sure that the backup at path is a store that this version of the bot can
+// read, and returns how many keys it has.
+func checkBackup(path string) (int, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("the backup is corrupted: %v", err)
+	}
+	defer db.Close()
+	version, err := storeVersion(&BoltStore{db: db})
+	if err != nil {
+		return 0, err
+	}
+	if version > len(migrations) {
+		return 0, fmt.Errorf("the backup is version %d, but only versions up to %d can be read",
+			version, len(migrations))
+	}
+	return countKeys(db)
+}
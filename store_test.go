@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBoltStore makes sure that what's put in a BoltStore is still there after it's opened again,
+// and that only one process can have it open at a time.
+func TestBoltStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	s, err := OpenBoltStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	s.Put(optOutsBucket, "fake/alice", nil)
+	s.Put(optOutsBucket, "fake/bob", nil)
+	s.Put(feedbackBucket, "persona", []byte(`[]`))
+	s.Put(feedbackBucket, "persona", []byte(`[{}]`))
+	s.Delete(optOutsBucket, "fake/bob")
+	s.Delete("nope", "fake/bob")
+	if _, err := OpenBoltStore(dir); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected an error opening a store that's already open. got: %v\n", err)
+	}
+	s.Close()
+	if err := s.Put(optOutsBucket, "fake/carol", nil); err == nil {
+		t.Errorf("Expected an error putting into a closed store\n")
+	}
+
+	s, err = OpenBoltStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	defer s.Close()
+	if got, want := s.Keys(optOutsBucket), []string{"fake/alice"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys. got: %v, want: %v\n", got, want)
+	}
+	if value, ok := s.Get(optOutsBucket, "fake/alice"); !ok || len(value) != 0 {
+		t.Errorf("Unexpected value. got: %q, %t, want an empty value that's set\n", value, ok)
+	}
+	if value, _ := s.Get(feedbackBucket, "persona"); string(value) != `[{}]` {
+		t.Errorf("Unexpected value. got: %q, want: %q\n", value, `[{}]`)
+	}
+	if _, ok := s.Get("nope", "persona"); ok {
+		t.Errorf("Expected a key in a bucket that doesn't exist not to be set\n")
+	}
+	if version, _ := storeVersion(s); version != len(migrations) {
+		t.Errorf("Expected the store to be migrated to version %d. got: %d\n", len(migrations),
+			version)
+	}
+}
+
+// TestMigrations makes sure that channel histories that were saved before there was a store are
+// moved into it, and that stores from newer versions of the bot aren't opened.
+func TestMigrations(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"version": 1, "channels": [{"channel": "fake/channel", "entries": [{"seed": 7}]}]}`
+	ioutil.WriteFile(filepath.Join(dir, "channels.json"), []byte(legacy), 0644)
+	s, err := OpenBoltStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	var entries []generatedMsg
+	if ok, err := getJSON(s, channelsBucket, "fake/channel", &entries); !ok || err != nil ||
+		len(entries) != 1 || entries[0].Seed != 7 {
+		t.Errorf("Unexpected imported entries: %+v, %t, %v\n", entries, ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "channels.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected channels.json to be removed once it was imported\n")
+	}
+
+	s.Put(metaBucket, versionKey, []byte("99"))
+	s.Close()
+	if _, err := OpenBoltStore(dir); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Expected an error about the version. got: %v\n", err)
+	}
+}
+
+// TestBackupRestore makes sure that restoring a backup brings back what was in the store when it
+// was backed up, and that neither happens while the store is in use.
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := OpenBoltStore(dir)
+	s.Put(optOutsBucket, "fake/alice", nil)
+	var backup bytes.Buffer
+	if _, err := backupStore(dir, &backup); err == nil {
+		t.Errorf("Expected an error backing up a store that's in use\n")
+	}
+	s.Close()
+
+	backup.Reset()
+	if _, err := backupStore(dir, &backup); err != nil {
+		t.Fatalf("Unexpected error backing up: %v\n", err)
+	}
+	restoreDir := filepath.Join(t.TempDir(), "restored")
+	n, err := restoreStore(restoreDir, bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatalf("Unexpected error restoring: %v\n", err)
+	}
+	// The opt-out, and the store's version.
+	if n != 2 {
+		t.Errorf("Unexpected number of restored keys. got: %d, want: %d\n", n, 2)
+	}
+	restored, err := OpenBoltStore(restoreDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !NewOptOuts(restored).Has("fake/alice") {
+		t.Errorf("Expected the opt-out to be restored\n")
+	}
+	if _, err := restoreStore(restoreDir, bytes.NewReader(backup.Bytes())); err == nil {
+		t.Errorf("Expected an error restoring over a store that's in use\n")
+	}
+
+	// A backup from a newer version of the bot.
+	restored.Put(metaBucket, versionKey, []byte("99"))
+	restored.Close()
+	var newer bytes.Buffer
+	backupStore(restoreDir, &newer)
+	if _, err := restoreStore(dir, &newer); err == nil ||
+		!strings.Contains(err.Error(), "version 99") {
+		t.Errorf("Expected an error restoring a backup from a newer version. got: %v\n", err)
+	}
+	if _, err := restoreStore(dir, strings.NewReader("nope\n")); err == nil {
+		t.Errorf("Expected an error restoring a corrupted backup\n")
+	}
+	// Backups that can't be restored leave the store alone.
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected nothing but %s to be left behind. got %d files\n", storeFileName,
+			len(files))
+	}
+	s, err = OpenBoltStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	defer s.Close()
+	if version, _ := storeVersion(s); version != len(migrations) {
+		t.Errorf("Unexpected version after failed restores. got: %d, want: %d\n", version,
+			len(migrations))
+	}
+}
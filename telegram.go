@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTelegramAPIURL is where Telegram's Bot API lives.
+	defaultTelegramAPIURL = "https://api.telegram.org"
+	// defaultTelegramPollTimeout is how long each long poll for updates waits for something to
+	// happen before Telegram gives up and responds with nothing.
+	defaultTelegramPollTimeout = 30 * time.Second
+	// telegramRetryDelay is how long to wait before polling again after a poll fails.
+	telegramRetryDelay = 5 * time.Second
+	// maxTelegramTextLength is the most characters that Telegram lets a message have.
+	maxTelegramTextLength = 4096
+	// telegramGenerateCmd is the bot command that maps onto the bot's usual invocation.
+	telegramGenerateCmd = "/generate"
+)
+
+// ErrTelegramNoToken is returned when a Telegram is created without a bot token.
+var ErrTelegramNoToken = errors.New("no Telegram bot token was configured")
+
+// TelegramConfig describes how to connect to Telegram.
+type TelegramConfig struct {
+	// The token that @BotFather handed out, like "123456:ABC-DEF1234ghIkl".
+	Token string
+	// Where Telegram's Bot API lives. Defaults to defaultTelegramAPIURL.
+	APIURL string
+	// How long each long poll for updates may wait. Defaults to defaultTelegramPollTimeout.
+	PollTimeout time.Duration
+}
+
+// Telegram connects a Bot to Telegram. It long polls the Bot API for new messages in the chats
+// that the bot is in, hands them to its Bot, and is the Platform that the Bot talks back through.
+// The bot's replies are threaded under the messages that they answer.
+//
+// Telegram's Bot API doesn't let bots read a chat's history, so a Telegram remembers the most
+// recent messages in each chat itself. When the bot's group privacy mode is on, which it is unless
+// it's turned off with @BotFather, Telegram only sends the bot commands and replies to its own
+// messages in groups. In that case, imitate and channel only learn from those.
+type Telegram struct {
+	config TelegramConfig
+	bot    *Bot
+	client *http.Client
+
+	// Messages that are being handled.
+	handlers inFlight
+
+	mu      sync.Mutex
+	self    telegramUser
+	history map[string][]Message // Newest first.
+	userIDs map[string]string    // Lowercase usernames to user IDs.
+
+	// Exists so that the passage of time can be faked in tests.
+	sleep func(time.Duration)
+}
+
+// NewTelegram returns a pointer to a new Telegram initialized with the provided config and the Bot
+// to hand messages to.
+func NewTelegram(config TelegramConfig, bot *Bot) (*Telegram, error) {
+	if config.Token == "" {
+		return nil, ErrTelegramNoToken
+	}
+	if config.APIURL == "" {
+		config.APIURL = defaultTelegramAPIURL
+	}
+	if config.PollTimeout <= 0 {
+		config.PollTimeout = defaultTelegramPollTimeout
+	}
+
+	return &Telegram{
+		config: config,
+		bot:    bot,
+		// Leave room for a long poll to run its course.
+		client:  &http.Client{Timeout: config.PollTimeout + 30*time.Second},
+		history: make(map[string][]Message),
+		userIDs: make(map[string]string),
+		sleep:   time.Sleep,
+	}, nil
+}
+
+// Run looks up who the bot is, and then polls for new messages until ctx is done. Then it lets the
+// messages that are being handled finish up.
+func (t *Telegram) Run(ctx context.Context, ready func()) error {
+	defer t.handlers.Close()
+	var self telegramUser
+	if err := t.call(ctx, "getMe", nil, &self); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.self = self
+	t.mu.Unlock()
+	slog.Info("Connected to Telegram", "username", self.Username)
+	if !self.CanReadAllGroupMessages {
+		slog.Warn("Telegram privacy mode is on, so the bot only sees commands and replies in" +
+			" groups")
+	}
+	ready()
+
+	offset := 0
+	for {
+		var updates []telegramUpdate
+		params := map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(t.config.PollTimeout / time.Second),
+			"allowed_updates": []string{"message"},
+		}
+		err := t.call(ctx, "getUpdates", params, &updates)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("Failed to poll Telegram for updates, retrying", "error", err,
+				"delay", telegramRetryDelay)
+			t.sleep(telegramRetryDelay)
+			continue
+		}
+
+		for _, update := range updates {
+			// Acknowledge every update, even ones that aren't handled, so they aren't sent again.
+			offset = update.UpdateID + 1
+			if update.Message != nil {
+				t.handleMessage(update.Message)
+			}
+		}
+	}
+}
+
+// telegramUpdate is one thing that happened, as reported by getUpdates.
+type telegramUpdate struct {
+	UpdateID int              `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+// telegramMessage is a message in a Telegram chat.
+type telegramMessage struct {
+	MessageID      int64            `json:"message_id"`
+	From           *telegramUser    `json:"from"`
+	Chat           telegramChat     `json:"chat"`
+	Text           string           `json:"text"`
+	ReplyToMessage *telegramMessage `json:"reply_to_message"`
+	Entities       []telegramEntity `json:"entities"`
+}
+
+// telegramUser is a Telegram user or bot.
+type telegramUser struct {
+	ID                      int64  `json:"id"`
+	IsBot                   bool   `json:"is_bot"`
+	FirstName               string `json:"first_name"`
+	Username                string `json:"username"`
+	CanReadAllGroupMessages bool   `json:"can_read_all_group_messages"`
+}
+
+// telegramChat is a private chat, group, supergroup, or channel.
+type telegramChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// telegramEntity is a special part of a message's text, like a mention or a command.
+type telegramEntity struct {
+	Type string        `json:"type"`
+	User *telegramUser `json:"user"`
+}
+
+// handleMessage records a message in its chat's history, and then hands it to the Bot along with
+// a Platform that threads replies under it.
+func (t *Telegram) handleMessage(tm *telegramMessage) {
+	if tm.From == nil || tm.Text == "" {
+		return
+	}
+	content, ok := t.parseCommand(tm.Text)
+	if !ok {
+		return
+	}
+
+	m := Message{
+		ID:        strconv.FormatInt(tm.MessageID, 10),
+		ChannelID: strconv.FormatInt(tm.Chat.ID, 10),
+		Author:    newTelegramUser(tm.From),
+		Content:   content,
+	}
+
+	t.mu.Lock()
+	if tm.From.Username != "" {
+		t.userIDs[strings.ToLower(tm.From.Username)] = m.Author.ID
+	}
+	for _, entity := range tm.Entities {
+		// Users without usernames can only be mentioned by a link to their account.
+		if entity.Type == "text_mention" && entity.User != nil {
+			m.Mentions = append(m.Mentions, newTelegramUser(entity.User))
+		}
+	}
+	for _, word := range strings.Fields(content) {
+		if len(word) > 1 && strings.HasPrefix(word, "@") {
+			username := strings.TrimPrefix(word, "@")
+			id, ok := t.userIDs[strings.ToLower(username)]
+			if !ok {
+				// They haven't said anything that the bot has seen.
+				id = username
+			}
+			m.Mentions = append(m.Mentions, User{ID: id, Name: username})
+		}
+	}
+	history := append([]Message{m}, t.history[m.ChannelID]...)
+	if len(history) > maxMimicMsgs {
+		history = history[:maxMimicMsgs]
+	}
+	t.history[m.ChannelID] = history
+	t.mu.Unlock()
+
+	// Replying to someone's message with "/generate imitate" imitates whoever wrote it.
+	fields := strings.Fields(content)
+	if len(m.Mentions) == 0 && len(fields) > 1 && fields[1] == imitateCmd &&
+		tm.ReplyToMessage != nil && tm.ReplyToMessage.From != nil {
+		m.Mentions = []User{newTelegramUser(tm.ReplyToMessage.From)}
+	}
+
+	// Generating speech can take a while, so don't hold up polling while it happens.
+	reply := telegramReply{Telegram: t, replyTo: tm.MessageID}
+	t.handlers.Go(func() { t.bot.HandleMessage(reply, &m) })
+}
+
+// parseCommand turns "/generate" commands into the bot's usual invocation, so "/generate 40" is
+// handled just like "!botname 40". In groups with more than one bot, commands may be addressed to
+// a specific bot, like "/generate@somebot 40". Commands that are addressed to other bots are
+// reported as not ok.
+func (t *Telegram) parseCommand(text string) (string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return text, true
+	}
+
+	cmd := fields[0]
+	if i := strings.Index(cmd, "@"); i != -1 {
+		t.mu.Lock()
+		username := t.self.Username
+		t.mu.Unlock()
+		if !strings.EqualFold(cmd[i+1:], username) {
+			return "", false
+		}
+		cmd = cmd[:i]
+	}
+	if cmd != telegramGenerateCmd {
+		return text, true
+	}
+	args := strings.Join(fields[1:], " ")
+	// Telegram doesn't have guilds, so the default prefix always applies.
+	return strings.TrimSpace(t.bot.settings.Get("").Prefix + t.bot.name + " " + args), true
+}
+
+// newTelegramUser converts a Telegram user into a platform-neutral User.
+func newTelegramUser(u *telegramUser) User {
+	name := u.Username
+	if name == "" {
+		name = u.FirstName
+	}
+	return User{ID: strconv.FormatInt(u.ID, 10), Name: name, Bot: u.IsBot}
+}
+
+// telegramReply is the Platform that a Telegram hands to its Bot along with each message, so that
+// the Bot's replies are threaded under that message.
+type telegramReply struct {
+	*Telegram
+	replyTo int64
+}
+
+// Reply sends a message to the provided chat as a reply to the message being handled.
+func (r telegramReply) Reply(ctx context.Context, channelID, msg string) {
+	r.sendMessage(ctx, channelID, msg, r.replyTo)
+}
+
+// Name returns "telegram".
+func (t *Telegram) Name() string {
+	return "telegram"
+}
+
+// SelfID returns the bot's user ID, which is looked up when the Telegram starts.
+func (t *Telegram) SelfID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.self.ID == 0 {
+		return ""
+	}
+	return strconv.FormatInt(t.self.ID, 10)
+}
+
+// Reply sends a message to the provided chat.
+func (t *Telegram) Reply(ctx context.Context, channelID, msg string) {
+	t.sendMessage(ctx, channelID, msg, 0)
+}
+
+// SendFile uploads a file to the provided chat with sendDocument.
+func (t *Telegram) SendFile(channelID, name string, r io.Reader) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("chat_id", channelID)
+	part, err := form.CreateFormFile("document", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	return t.do(context.Background(), "sendDocument", form.FormDataContentType(), &body, nil)
+}
+
+// FetchMessages returns the contents of messages that the bot has seen in the provided chat since
+// it started, newest first.
+func (t *Telegram) FetchMessages(channelID string, limit int,
+	include func(authorID string) bool) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var contents []string
+	for _, msg := range t.history[channelID] {
+		if len(contents) == limit {
+			break
+		}
+		if include(msg.Author.ID) {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents, nil
+}
+
+// IsNSFW always reports false, since Telegram chats can't be marked as NSFW.
+func (t *Telegram) IsNSFW(channelID string) (bool, error) {
+	return false, nil
+}
+
+// sendMessage sends a message to the provided chat, split up into as many messages as it takes.
+// If replyTo isn't 0, the first message is a reply to the message with that ID. Sends that fail
+// because Telegram is rate limiting the bot, or having a bad day, are retried with backoff. ctx is
+// the context of the request that the message answers, and is used for logging.
+func (t *Telegram) sendMessage(ctx context.Context, chatID, msg string, replyTo int64) {
+	for _, chunk := range splitIRCText(msg, maxTelegramTextLength) {
+		params := map[string]interface{}{"chat_id": chatID, "text": chunk}
+		if replyTo != 0 {
+			params["reply_to_message_id"] = replyTo
+			// Send the reply anyway if the message being replied to was deleted.
+			params["allow_sending_without_reply"] = true
+		}
+
+		for attempt := 1; ; attempt++ {
+			err := t.call(context.Background(), "sendMessage", params, nil)
+			if err == nil {
+				break
+			}
+			wait := defaultBaseBackoff << (attempt - 1)
+			if apiErr, ok := err.(*TelegramError); ok {
+				if apiErr.Code != http.StatusTooManyRequests && apiErr.Code < 500 {
+					attempt = defaultMaxAttempts
+				} else if apiErr.RetryAfter > 0 {
+					wait = apiErr.RetryAfter
+				}
+			}
+			if attempt >= defaultMaxAttempts {
+				loggerFrom(ctx).Error("Failed to send message to Telegram chat", "error", err)
+				return
+			}
+			t.sleep(wait)
+		}
+		replyTo = 0
+	}
+}
+
+// TelegramError is an error that the Bot API responded with.
+type TelegramError struct {
+	Code        int
+	Description string
+	// How long Telegram wants the bot to wait before trying again, if it's being rate limited.
+	RetryAfter time.Duration
+}
+
+func (e *TelegramError) Error() string {
+	return fmt.Sprintf("telegram API error %d: %s", e.Code, e.Description)
+}
+
+// call calls a Bot API method with the provided params encoded as JSON, and decodes the result
+// into out if it isn't nil. The call is abandoned if ctx is done first.
+func (t *Telegram) call(ctx context.Context, method string, params interface{},
+	out interface{}) error {
+	if params == nil {
+		params = struct{}{}
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return t.do(ctx, method, "application/json", bytes.NewReader(body), out)
+}
+
+// do sends a request to the Bot API, and decodes the result into out if it isn't nil.
+func (t *Telegram) do(ctx context.Context, method, contentType string, body io.Reader,
+	out interface{}) error {
+	url := fmt.Sprintf("%s/bot%s/%s", t.config.APIURL, t.config.Token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("telegram responded with HTTP %s: %v", resp.Status, err)
+	}
+	if !result.OK {
+		return &TelegramError{
+			Code:        result.ErrorCode,
+			Description: result.Description,
+			RetryAfter:  time.Duration(result.Parameters.RetryAfter) * time.Second,
+		}
+	}
+	if out != nil {
+		return json.Unmarshal(result.Result, out)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTelegramToken = "123456:test-token"
+
+// fakeTelegram is a local, in-process stand-in for Telegram's Bot API.
+type fakeTelegram struct {
+	server *httptest.Server
+
+	mu sync.Mutex
+	// Updates that haven't been acknowledged yet.
+	updates  []telegramUpdate
+	nextID   int
+	newBatch chan struct{}
+	// Messages sent with sendMessage, in the order that they were sent.
+	sent chan telegramSent
+	// Status codes to fail the next sendMessage calls with.
+	sendFailures []int
+	// Names of the files sent with sendDocument.
+	files []string
+}
+
+// telegramSent is a message sent with sendMessage.
+type telegramSent struct {
+	ChatID  string `json:"chat_id"`
+	Text    string `json:"text"`
+	ReplyTo int64  `json:"reply_to_message_id"`
+}
+
+// newFakeTelegram starts a fake Bot API server that's shut down when the test finishes.
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	fake := &fakeTelegram{
+		newBatch: make(chan struct{}, 1),
+		sent:     make(chan telegramSent, 10),
+	}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+// addMessage queues up a message to be handed out by getUpdates.
+func (f *fakeTelegram) addMessage(m telegramMessage) {
+	f.mu.Lock()
+	f.nextID++
+	f.updates = append(f.updates, telegramUpdate{UpdateID: f.nextID, Message: &m})
+	f.mu.Unlock()
+	select {
+	case f.newBatch <- struct{}{}:
+	default:
+	}
+}
+
+func (f *fakeTelegram) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+	}
+	prefix := "/bot" + testTelegramToken + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok": false, "error_code": 401, "description": "Unauthorized",
+		})
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, prefix) {
+	case "getMe":
+		reply(telegramUser{ID: 1000, IsBot: true, FirstName: "Foo", Username: "foo_bot"})
+	case "getUpdates":
+		var params struct {
+			Offset int `json:"offset"`
+		}
+		json.NewDecoder(r.Body).Decode(&params)
+		// Long poll for a little while if there's nothing new.
+		for attempt := 0; attempt < 2; attempt++ {
+			f.mu.Lock()
+			var pending []telegramUpdate
+			for _, update := range f.updates {
+				if update.UpdateID >= params.Offset {
+					pending = append(pending, update)
+				}
+			}
+			f.updates = pending
+			f.mu.Unlock()
+			if len(pending) > 0 || attempt == 1 {
+				reply(pending)
+				return
+			}
+			select {
+			case <-f.newBatch:
+			case <-time.After(100 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	case "sendMessage":
+		f.mu.Lock()
+		if len(f.sendFailures) > 0 {
+			status := f.sendFailures[0]
+			f.sendFailures = f.sendFailures[1:]
+			f.mu.Unlock()
+			resp := map[string]interface{}{
+				"ok":          false,
+				"error_code":  status,
+				"description": http.StatusText(status),
+			}
+			if status == http.StatusTooManyRequests {
+				resp["parameters"] = map[string]int{"retry_after": 3}
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+		f.mu.Unlock()
+		var sent telegramSent
+		json.NewDecoder(r.Body).Decode(&sent)
+		f.sent <- sent
+		reply(map[string]interface{}{"message_id": 1})
+	case "sendDocument":
+		r.ParseMultipartForm(1 << 20)
+		_, header, err := r.FormFile("document")
+		if err == nil {
+			f.mu.Lock()
+			f.files = append(f.files, header.Filename)
+			f.mu.Unlock()
+		}
+		reply(map[string]interface{}{"message_id": 2})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok": false, "error_code": 404, "description": "Not Found",
+		})
+	}
+}
+
+// waitForSent returns the next message sent to the fake Telegram, or fails the test if nothing is
+// sent soon.
+func (f *fakeTelegram) waitForSent(t *testing.T) telegramSent {
+	t.Helper()
+	select {
+	case sent := <-f.sent:
+		return sent
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a message to be sent to Telegram\n")
+		return telegramSent{}
+	}
+}
+
+// newTestTelegram returns a Telegram that talks to the provided fake Telegram, and whose bot is
+// named "foo" with a "!" prefix.
+func newTestTelegram(t *testing.T, fake *fakeTelegram) *Telegram {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	tg, err := NewTelegram(TelegramConfig{
+		Token:       testTelegramToken,
+		APIURL:      fake.server.URL,
+		PollTimeout: time.Second,
+	}, bot)
+	if err != nil {
+		t.Fatalf("Failed to create new Telegram: %v\n", err)
+	}
+	tg.sleep = func(time.Duration) {}
+	return tg
+}
+
+// startTestTelegram starts polling the provided fake Telegram with a new Telegram. It's stopped
+// when the test finishes.
+func startTestTelegram(t *testing.T, fake *fakeTelegram) *Telegram {
+	tg := newTestTelegram(t, fake)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- tg.Run(ctx, func() {}) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errs; err != nil {
+			t.Errorf("Telegram stopped with an error: %v\n", err)
+		}
+	})
+	return tg
+}
+
+// TestTelegram makes sure that /generate commands are handed to the bot, that its replies are
+// threaded under the messages that they answer, and that commands addressed to other bots are
+// ignored.
+func TestTelegram(t *testing.T) {
+	fake := newFakeTelegram(t)
+	startTestTelegram(t, fake)
+	alice := &telegramUser{ID: 1, FirstName: "Alice", Username: "alice"}
+	bob := &telegramUser{ID: 2, FirstName: "Bob"}
+	group := telegramChat{ID: -100, Type: "supergroup"}
+
+	fake.addMessage(telegramMessage{MessageID: 10, From: alice, Chat: group,
+		Text: "/generate@other_bot 3"})
+	fake.addMessage(telegramMessage{MessageID: 11, From: alice, Chat: group,
+		Text: "/generate@Foo_Bot 3"})
+	got := fake.waitForSent(t)
+	if got.ChatID != "-100" || got.ReplyTo != 11 || len(strings.Fields(got.Text)) != 3 {
+		t.Errorf("Unexpected reply to /generate 3: %+v\n", got)
+	}
+
+	fake.addMessage(telegramMessage{MessageID: 12, From: alice, Chat: group,
+		Text: "hello there friend"})
+	fake.addMessage(telegramMessage{MessageID: 13, From: bob, Chat: group,
+		Text: "/generate imitate @alice"})
+	got = fake.waitForSent(t)
+	if got.ReplyTo != 13 || got.Text == "" {
+		t.Errorf("Unexpected reply to an imitate invocation: %+v\n", got)
+	}
+	for _, word := range strings.Fields(got.Text) {
+		if !strings.Contains("hello there friend", word) {
+			t.Errorf("Imitation contains a word that alice never said: %q\n", word)
+		}
+	}
+
+	// Replying to someone's message imitates them, even if they don't have a username.
+	fake.addMessage(telegramMessage{MessageID: 14, From: bob, Chat: group,
+		Text: "how are you doing"})
+	fake.addMessage(telegramMessage{
+		MessageID:      15,
+		From:           alice,
+		Chat:           group,
+		Text:           "/generate imitate",
+		ReplyToMessage: &telegramMessage{MessageID: 14, From: bob, Chat: group},
+	})
+	got = fake.waitForSent(t)
+	if got.ReplyTo != 15 {
+		t.Errorf("Unexpected reply to an imitate invocation: %+v\n", got)
+	}
+	for _, word := range strings.Fields(got.Text) {
+		if !strings.Contains("how are you doing", word) {
+			t.Errorf("Imitation contains a word that Bob never said: %q\n", word)
+		}
+	}
+
+	select {
+	case extra := <-fake.sent:
+		t.Errorf("Unexpected extra message sent: %+v\n", extra)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestTelegramSendRetries makes sure that sends which fail because of rate limiting or server
+// errors are retried, and that other failures are given up on.
+func TestTelegramSendRetries(t *testing.T) {
+	fake := newFakeTelegram(t)
+	tg := newTestTelegram(t, fake)
+	var slept []time.Duration
+	tg.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	fake.mu.Lock()
+	fake.sendFailures = []int{http.StatusTooManyRequests, http.StatusBadGateway}
+	fake.mu.Unlock()
+	tg.Reply(context.Background(), "42", "hello")
+	if got := fake.waitForSent(t); got.Text != "hello" || got.ReplyTo != 0 {
+		t.Errorf("Unexpected message sent: %+v\n", got)
+	}
+	want := []time.Duration{3 * time.Second, 2 * defaultBaseBackoff}
+	if !reflect.DeepEqual(slept, want) {
+		t.Errorf("Unexpected waits between retries. got: %v, want: %v\n", slept, want)
+	}
+
+	fake.mu.Lock()
+	fake.sendFailures = []int{http.StatusForbidden}
+	fake.mu.Unlock()
+	tg.Reply(context.Background(), "42", "nope")
+	select {
+	case sent := <-fake.sent:
+		t.Errorf("A send that failed permanently was retried: %+v\n", sent)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := tg.SendFile("42", "model.txt", strings.NewReader("hello")); err != nil {
+		t.Fatalf("SendFile failed: %v\n", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !reflect.DeepEqual(fake.files, []string{"model.txt"}) {
+		t.Errorf("Unexpected sent files. got: %q\n", fake.files)
+	}
+}
+
+// TestTelegramParseCommand makes sure that /generate commands are turned into the bot's usual
+// invocation.
+func TestTelegramParseCommand(t *testing.T) {
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("foo", "!", hmm)
+	tg, _ := NewTelegram(TelegramConfig{Token: testTelegramToken}, bot)
+	tg.self = telegramUser{Username: "foo_bot"}
+
+	tests := []struct {
+		text   string
+		want   string
+		wantOK bool
+	}{
+		{"/generate", "!foo", true},
+		{"/generate 40", "!foo 40", true},
+		{"/generate@foo_bot imitate @alice 50", "!foo imitate @alice 50", true},
+		{"/generate@other_bot 40", "", false},
+		{"/start", "/start", true},
+		{"just chatting", "just chatting", true},
+	}
+	for _, tc := range tests {
+		got, ok := tg.parseCommand(tc.text)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("parseCommand(%q) = %q, %v. want: %q, %v\n", tc.text, got, ok, tc.want,
+				tc.wantOK)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracingServiceName is what the bot's spans are attributed to.
+	tracingServiceName = "hmm-discord-bot"
+	// tracingFlushInterval is how often finished spans are exported.
+	tracingFlushInterval = 5 * time.Second
+	// maxQueuedSpans is the most finished spans that wait to be exported at once. If the exporter
+	// can't keep up, spans past this are dropped instead of piling up in memory.
+	maxQueuedSpans = 2048
+	// tracingExportTimeout is how long an export gets before it's given up on.
+	tracingExportTimeout = 10 * time.Second
+)
+
+// startSpan starts a span with the provided name as a child of the span in ctx, if there is one,
+// and returns a context with the new span in it. Spans come from OpenTelemetry's global tracer
+// provider, so until main installs a Tracer's, they don't record anything, and callers never need
+// to check whether tracing is on.
+func startSpan(ctx context.Context, name string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracingServiceName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startClientSpan is like startSpan, but for requests to other services.
+func startClientSpan(ctx context.Context, name string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracingServiceName).Start(ctx, name, trace.WithAttributes(attrs...),
+		trace.WithSpanKind(trace.SpanKindClient))
+}
+
+// setSpanError marks a span's work as failed because of err. Nil errors are ignored.
+func setSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Tracer exports finished spans to an OpenTelemetry collector in batches.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+}
+
+// NewTracer returns a pointer to a new Tracer which exports spans to the collector at the
+// provided endpoint, like "http://localhost:4318", with OTLP over HTTP.
+func NewTracer(endpoint string) (*Tracer, error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"),
+		otlptracehttp.WithTimeout(tracingExportTimeout))
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{provider: sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(tracingFlushInterval),
+			sdktrace.WithMaxQueueSize(maxQueuedSpans),
+			sdktrace.WithExportTimeout(tracingExportTimeout)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", tracingServiceName))),
+	)}, nil
+}
+
+// Provider returns the tracer provider that hands out the spans which the Tracer exports.
+func (t *Tracer) Provider() trace.TracerProvider {
+	return t.provider
+}
+
+// Name returns "tracer".
+func (t *Tracer) Name() string {
+	return "tracer"
+}
+
+// Run exports finished spans every tracingFlushInterval until ctx is done, and then exports the
+// ones that are left. Since it's started first and stopped last, that includes the spans of every
+// invocation that the chat services finished up while they stopped.
+func (t *Tracer) Run(ctx context.Context, ready func()) error {
+	ready()
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), tracingExportTimeout)
+	defer cancel()
+	return t.provider.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// byName returns the exported spans with the provided name, in the order that they ended.
+func byName(exporter *tracetest.InMemoryExporter, name string) []tracetest.SpanStub {
+	var spans []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// attr returns the value of the span's attribute with the provided key, or an empty value if it
+// doesn't have one.
+func attr(span tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// useMemoryExporter turns tracing on for the rest of the test, with spans going to the returned
+// exporter as soon as they end.
+func useMemoryExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+// TestTracingOff makes sure that nothing is recorded unless tracing was turned on, and that spans
+// that are handed out while it's off can be used anyway.
+func TestTracingOff(t *testing.T) {
+	_, span := startSpan(context.Background(), "nothing")
+	if span.IsRecording() || span.SpanContext().IsValid() {
+		t.Errorf("Expected a span that doesn't record anything while tracing is off\n")
+	}
+	span.SetAttributes(attribute.String("key", "value"))
+	setSpanError(span, errors.New("nope"))
+	span.End()
+}
+
+// TestInvocationTracing makes sure that an invocation's parsing, model lookup, and generation are
+// traced as children of one span for the whole invocation.
+func TestInvocationTracing(t *testing.T) {
+	exporter := useMemoryExporter(t)
+	hmm, _ := NewHMM("the quick brown fox jumps over the lazy dog\n", 5)
+	bot, _ := NewBot("tracing", "!", hmm)
+	bot.HandleMessage(newFakePlatform("botID"), &Message{Author: User{ID: "someone"},
+		Content: "!tracing 3"})
+	wasMessagePosted = false
+	postedMsg = ""
+
+	roots := byName(exporter, "invocation")
+	if len(roots) != 1 {
+		t.Fatalf("Unexpected number of invocation spans. got: %d, want: 1\n", len(roots))
+	}
+	root := roots[0]
+	if root.Parent.IsValid() {
+		t.Errorf("The invocation span has a parent\n")
+	}
+	for key, want := range map[string]string{
+		"platform": "fake",
+		"command":  plainInvocation,
+		"persona":  "tracing",
+		"outcome":  outcomeOK,
+	} {
+		if got := attr(root, key); got != attribute.StringValue(want) {
+			t.Errorf("Unexpected %s on the invocation span. got: %v, want: %v\n", key,
+				got.Emit(), want)
+		}
+	}
+	if id := attr(root, "request_id"); id.AsString() == "" {
+		t.Errorf("The invocation span doesn't have a request ID\n")
+	}
+
+	for _, name := range []string{"parse_invocation", "lookup_model", "generate"} {
+		spans := byName(exporter, name)
+		if len(spans) != 1 {
+			t.Errorf("Unexpected number of %s spans. got: %d, want: 1\n", name, len(spans))
+			continue
+		}
+		if spans[0].SpanContext.TraceID() != root.SpanContext.TraceID() ||
+			spans[0].Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("The %s span isn't a child of the invocation span\n", name)
+		}
+		if spans[0].EndTime.Before(spans[0].StartTime) {
+			t.Errorf("The %s span ended before it started\n", name)
+		}
+	}
+	if generate := byName(exporter, "generate"); len(generate) == 1 {
+		if attr(generate[0], "seed").Type() != attribute.INT64 ||
+			attr(generate[0], "words") != attribute.IntValue(3) {
+			t.Errorf("Unexpected attributes on the generate span: %v\n", generate[0].Attributes)
+		}
+	}
+}
+
+// TestDeliveryTracing makes sure that each attempt to send a message to Discord gets its own span
+// in the trace of the invocation that the message answers.
+func TestDeliveryTracing(t *testing.T) {
+	exporter := useMemoryExporter(t)
+	fake := newFakeDiscord(t)
+	fake.sendFailures = []fakeFailure{{http.StatusInternalServerError, "{}"}}
+	outbox, session, _ := newTestOutbox()
+
+	ctx, root := startSpan(context.Background(), "invocation")
+	outbox.Post(ctx, session, "channel", "hello")
+	outbox.Wait()
+	root.End()
+
+	sends := byName(exporter, "discord.create_message")
+	if len(sends) != 2 {
+		t.Fatalf("Unexpected number of send spans. got: %d, want: 2\n", len(sends))
+	}
+	for i, span := range sends {
+		if span.SpanContext.TraceID() != root.SpanContext().TraceID() ||
+			span.Parent.SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Send span %d isn't a child of the invocation span\n", i)
+		}
+		if span.SpanKind != trace.SpanKindClient ||
+			attr(span, "attempt") != attribute.IntValue(i+1) {
+			t.Errorf("Unexpected send span %d: kind %v, attributes %v\n", i, span.SpanKind,
+				span.Attributes)
+		}
+	}
+	if sends[0].Status.Code != codes.Error || sends[1].Status.Code != codes.Unset {
+		t.Errorf("Expected only the first attempt to fail. got: %v, %v\n", sends[0].Status,
+			sends[1].Status)
+	}
+}
+
+// TestTracerExport makes sure that a Tracer sends the spans that are left to a collector with
+// OTLP over HTTP once it stops.
+func TestTracerExport(t *testing.T) {
+	var mu sync.Mutex
+	var gotPath, gotType string
+	var got coltracepb.ExportTraceServiceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		gotPath, gotType = r.URL.Path, r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &got); err != nil {
+			t.Errorf("Failed to decode the spans: %v\n", err)
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := NewTracer(collector.URL + "/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tr.Run(runCtx, func() {}) }()
+
+	ctx, parent := tr.Provider().Tracer("test").Start(context.Background(), "parent")
+	_, child := tr.Provider().Tracer("test").Start(ctx, "child")
+	child.End()
+	parent.End()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if gotPath != "/v1/traces" || gotType != "application/x-protobuf" {
+		t.Errorf("Unexpected request. path: %q, content type: %q\n", gotPath, gotType)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected request: %v\n", &got)
+	}
+	var service string
+	for _, kv := range got.ResourceSpans[0].Resource.GetAttributes() {
+		if kv.Key == "service.name" {
+			service = kv.Value.GetStringValue()
+		}
+	}
+	if service != tracingServiceName {
+		t.Errorf("Unexpected service name. got: %q, want: %q\n", service, tracingServiceName)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("Unexpected spans: %v\n", spans)
+	}
+}